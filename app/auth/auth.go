@@ -0,0 +1,127 @@
+package auth
+
+// auth.go
+// Who is making a call (the Principal) and what they may do. Callers prove
+// who they are with a JWT bearer token (see JWT) or an mTLS client
+// certificate (see Certificates) and their roles decide which calls they may
+// make (see Authorize).
+
+import (
+	"context"
+	"errors"
+)
+
+// Role is what a principal is allowed to do
+type Role string
+
+// Roles (admins may make every call)
+const (
+	// RoleAgent an agent, calls only for its own agent ID
+	RoleAgent Role = "agent"
+	// RoleDispatcher routes tasks to agents (e.g. the call centre's telephony)
+	RoleDispatcher Role = "dispatcher"
+	// RoleAdmin manages the agents
+	RoleAdmin Role = "admin"
+)
+
+// Roles are the known roles
+var Roles = []Role{RoleAgent, RoleDispatcher, RoleAdmin}
+
+// ValidRole returns whether name is a known role
+func ValidRole(name string) bool {
+	for _, role := range Roles {
+		if string(role) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Principal is the caller of a call
+type Principal struct {
+	// Subject identifies the caller (token subject or certificate common name)
+	Subject string
+	Roles   []Role
+	// AgentID is the agent the caller is (agents only)
+	AgentID int32
+	// Tenant the caller belongs to ("" may call for any tenant)
+	Tenant string
+}
+
+// HasRole returns whether p has role
+func (p Principal) HasRole(role Role) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx for a call by p
+func NewContext(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, contextKey{}, p)
+}
+
+// FromContext returns the principal set by NewContext
+func FromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(contextKey{}).(Principal)
+	return p, ok
+}
+
+// ErrNoCredentials is returned by an Authenticator for a call without its
+// kind of credentials (so the next one can be tried)
+var ErrNoCredentials = errors.New("no credentials")
+
+// Authenticator finds out who is making a call
+type Authenticator interface {
+	// Authenticate returns the principal making the call with ctx,
+	// ErrNoCredentials or ErrUnauthenticated if the credentials are not valid
+	Authenticate(ctx context.Context) (Principal, error)
+}
+
+// Authenticators authenticates a call with the first of its Authenticators
+// the call has credentials for
+type Authenticators []Authenticator
+
+// Authenticate implements Authenticator
+func (a Authenticators) Authenticate(ctx context.Context) (Principal, error) {
+	for _, authn := range a {
+		p, err := authn.Authenticate(ctx)
+		if err == ErrNoCredentials {
+			continue
+		}
+		return p, err
+	}
+	return Principal{}, ErrNoCredentials
+}
+
+// WithRoles returns an Authenticator whose principals also have the roles of
+// their subject in roles (e.g. {"telephony": ["dispatcher"]})
+func WithRoles(authn Authenticator, roles map[string][]Role) Authenticator {
+	if len(roles) == 0 {
+		return authn
+	}
+	return roleAuthenticator{authn, roles}
+}
+
+type roleAuthenticator struct {
+	next  Authenticator
+	roles map[string][]Role
+}
+
+func (a roleAuthenticator) Authenticate(ctx context.Context) (Principal, error) {
+	p, err := a.next.Authenticate(ctx)
+	if err != nil {
+		return p, err
+	}
+
+	for _, role := range a.roles[p.Subject] {
+		if !p.HasRole(role) {
+			p.Roles = append(p.Roles, role)
+		}
+	}
+	return p, nil
+}
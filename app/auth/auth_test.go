@@ -0,0 +1,166 @@
+package auth_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"testing"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+
+	"github.com/newtonsystems/agent-mgmt/app/auth"
+	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+	tu "github.com/newtonsystems/agent-mgmt/app/testutil"
+)
+
+func TestAuthorize(t *testing.T) {
+	var (
+		agent      = auth.Principal{Subject: "agent-1", Roles: []auth.Role{auth.RoleAgent}, AgentID: 1}
+		dispatcher = auth.Principal{Subject: "telephony", Roles: []auth.Role{auth.RoleDispatcher}}
+		admin      = auth.Principal{Subject: "ops", Roles: []auth.Role{auth.RoleAdmin}}
+		nobody     = auth.Principal{Subject: "nobody"}
+		// An agent without an agent ID is no agent in particular
+		noAgentID = auth.Principal{Subject: "agent-0", Roles: []auth.Role{auth.RoleAgent}}
+	)
+
+	testCases := []struct {
+		description string
+		p           auth.Principal
+		method      string
+		agentID     int32
+		allowed     bool
+	}{
+		{"agent_heartbeat_self", agent, "HeartBeat", 1, true},
+		{"agent_heartbeat_other", agent, "HeartBeat", 2, false},
+		{"agent_accept_call_self", agent, "AcceptCall", 1, true},
+		{"agent_accept_call_other", agent, "AcceptCall", 2, false},
+		{"agent_list_all_tasks", agent, "ListTasks", 0, false},
+		{"agent_add_task", agent, "AddTask", 0, false},
+		{"agent_sum", agent, "Sum", 0, true},
+		{"agent_without_id", noAgentID, "HeartBeat", 0, false},
+		{"dispatcher_add_task", dispatcher, "AddTask", 0, true},
+		{"dispatcher_accept_call", dispatcher, "AcceptCall", 2, true},
+		{"dispatcher_heartbeat", dispatcher, "HeartBeat", 2, false},
+		{"dispatcher_register_agent", dispatcher, "RegisterAgent", 0, false},
+		{"admin_register_agent", admin, "RegisterAgent", 0, true},
+		{"admin_heartbeat", admin, "HeartBeat", 2, true},
+		{"no_roles", nobody, "Sum", 0, false},
+		{"unknown_method", dispatcher, "DropDatabase", 0, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			err := auth.Authorize(tc.p, tc.method, tc.agentID)
+			if tc.allowed {
+				tu.Ok(t, err)
+			} else {
+				tu.IsAmError(t, amerrors.ErrPermissionDenied, err)
+			}
+		})
+	}
+}
+
+// principal authenticates every call as its Principal (or fails with err)
+type principal struct {
+	p   auth.Principal
+	err error
+}
+
+func (a principal) Authenticate(ctx context.Context) (auth.Principal, error) {
+	return a.p, a.err
+}
+
+func TestAuthenticators(t *testing.T) {
+	ctx := context.Background()
+	telephony := auth.Principal{Subject: "telephony"}
+
+	p, err := auth.Authenticators{principal{err: auth.ErrNoCredentials}, principal{p: telephony}}.Authenticate(ctx)
+	tu.Ok(t, err)
+	tu.Equals(t, telephony, p)
+
+	// Invalid credentials are not passed over
+	_, err = auth.Authenticators{principal{err: amerrors.ErrUnauthenticatedError("expired")}, principal{p: telephony}}.Authenticate(ctx)
+	tu.IsAmError(t, amerrors.ErrUnauthenticated, err)
+
+	_, err = auth.Authenticators{principal{err: auth.ErrNoCredentials}}.Authenticate(ctx)
+	tu.Equals(t, auth.ErrNoCredentials, err)
+}
+
+func TestWithRoles(t *testing.T) {
+	roles := map[string][]auth.Role{"telephony": {auth.RoleDispatcher, auth.RoleAdmin}}
+	authn := auth.WithRoles(principal{p: auth.Principal{Subject: "telephony", Roles: []auth.Role{auth.RoleAdmin}}}, roles)
+
+	p, err := authn.Authenticate(context.Background())
+	tu.Ok(t, err)
+	tu.Equals(t, []auth.Role{auth.RoleAdmin, auth.RoleDispatcher}, p.Roles)
+
+	p, err = auth.WithRoles(principal{p: auth.Principal{Subject: "agent-1"}}, roles).Authenticate(context.Background())
+	tu.Ok(t, err)
+	tu.Equals(t, 0, len(p.Roles))
+}
+
+func TestCertificates(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "telephony", OrganizationalUnit: []string{"dispatcher", "engineering"}}}
+	withPeer := func(state tls.ConnectionState) context.Context {
+		return peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{State: state}})
+	}
+
+	p, err := auth.Certificates{}.Authenticate(withPeer(tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert}},
+	}))
+	tu.Ok(t, err)
+	tu.Equals(t, auth.Principal{Subject: "telephony", Roles: []auth.Role{auth.RoleDispatcher}}, p)
+
+	_, err = auth.Certificates{}.Authenticate(withPeer(tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}))
+	tu.IsAmError(t, amerrors.ErrUnauthenticated, err)
+
+	for _, ctx := range []context.Context{context.Background(), withPeer(tls.ConnectionState{})} {
+		_, err = auth.Certificates{}.Authenticate(ctx)
+		tu.Equals(t, auth.ErrNoCredentials, err)
+	}
+
+	// The agent-mgmt uri names the tenant and agent
+	withURIs := func(uris ...string) context.Context {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: "agent-3", OrganizationalUnit: []string{"agent"}}}
+		for _, uri := range uris {
+			u, err := url.Parse(uri)
+			tu.Ok(t, err)
+			cert.URIs = append(cert.URIs, u)
+		}
+		return withPeer(tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}})
+	}
+
+	testCases := []struct {
+		description string
+		uris        []string
+		want        auth.Principal
+	}{
+		{"agent", []string{"spiffe://example.com/agent-3", "agent-mgmt://acme/agents/3"}, auth.Principal{Subject: "agent-3", Roles: []auth.Role{auth.RoleAgent}, AgentID: 3, Tenant: "acme"}},
+		{"tenant", []string{"agent-mgmt://acme"}, auth.Principal{Subject: "agent-3", Roles: []auth.Role{auth.RoleAgent}, Tenant: "acme"}},
+		{"no_tenant_agent", []string{"agent-mgmt:///agents/3"}, auth.Principal{Subject: "agent-3", Roles: []auth.Role{auth.RoleAgent}, AgentID: 3}},
+		{"no_uri", nil, auth.Principal{Subject: "agent-3", Roles: []auth.Role{auth.RoleAgent}}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			p, err := auth.Certificates{}.Authenticate(withURIs(tc.uris...))
+			tu.Ok(t, err)
+			tu.Equals(t, tc.want, p)
+		})
+	}
+
+	for _, uris := range [][]string{
+		{"agent-mgmt://acme/agents/0"},
+		{"agent-mgmt://acme/agents/three"},
+		{"agent-mgmt://acme/tasks/3"},
+		{"agent-mgmt:acme"},
+		{"agent-mgmt://acme/agents/3", "agent-mgmt://globex/agents/3"},
+	} {
+		_, err = auth.Certificates{}.Authenticate(withURIs(uris...))
+		tu.IsAmError(t, amerrors.ErrUnauthenticated, err)
+	}
+}
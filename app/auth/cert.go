@@ -0,0 +1,92 @@
+package auth
+
+// cert.go
+// Callers authenticated by their mTLS client certificate (verified by the
+// gRPC server's TLS config against the client CA). The certificate's common
+// name is the subject and its organisational units are its roles. Its
+// agent-mgmt URI SAN (see URIScheme) names its tenant and agent.
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+
+	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+)
+
+// URIScheme is the scheme of the URI SAN naming a certificate's tenant and
+// agent, agent-mgmt://<tenant>/agents/<agent id> (e.g. agent-mgmt://acme for a
+// dispatcher of acme or agent-mgmt://acme/agents/3 for its agent 3)
+const URIScheme = "agent-mgmt"
+
+// Certificates authenticates callers by their client certificate
+type Certificates struct{}
+
+// Authenticate implements Authenticator
+func (Certificates) Authenticate(ctx context.Context) (Principal, error) {
+	pr, ok := peer.FromContext(ctx)
+	if !ok {
+		return Principal{}, ErrNoCredentials
+	}
+	info, ok := pr.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.PeerCertificates) == 0 {
+		return Principal{}, ErrNoCredentials
+	}
+	// Only verified chains are to be trusted (the certificate may have been
+	// given without a client CA to verify it against)
+	if len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return Principal{}, amerrors.ErrUnauthenticatedError("client certificate not verified")
+	}
+
+	cert := info.State.VerifiedChains[0][0]
+	p := Principal{Subject: cert.Subject.CommonName}
+	for _, unit := range cert.Subject.OrganizationalUnit {
+		if ValidRole(unit) {
+			p.Roles = append(p.Roles, Role(unit))
+		}
+	}
+
+	var found bool
+	for _, uri := range cert.URIs {
+		if uri.Scheme != URIScheme {
+			continue
+		}
+		if found {
+			return Principal{}, amerrors.ErrUnauthenticatedError("client certificate has more than one " + URIScheme + " uri")
+		}
+		found = true
+
+		tenantID, agentID, err := parseCertURI(uri)
+		if err != nil {
+			return Principal{}, err
+		}
+		p.Tenant, p.AgentID = tenantID, agentID
+	}
+	return p, nil
+}
+
+// parseCertURI returns the tenant and agent ID (0 if none) of an agent-mgmt
+// URI SAN
+func parseCertURI(uri *url.URL) (string, int32, error) {
+	invalid := amerrors.ErrUnauthenticatedError("invalid client certificate uri: " + uri.String())
+	if uri.Opaque != "" || uri.User != nil || uri.Port() != "" || uri.RawQuery != "" || uri.Fragment != "" {
+		return "", 0, invalid
+	}
+
+	path := strings.TrimSuffix(uri.Path, "/")
+	if path == "" {
+		return uri.Hostname(), 0, nil
+	}
+	if !strings.HasPrefix(path, "/agents/") {
+		return "", 0, invalid
+	}
+	agentID, err := strconv.ParseInt(strings.TrimPrefix(path, "/agents/"), 10, 32)
+	if err != nil || agentID <= 0 {
+		return "", 0, invalid
+	}
+	return uri.Hostname(), int32(agentID), nil
+}
@@ -0,0 +1,151 @@
+package auth
+
+// jwks.go
+// The public keys tokens are signed with, from a JSON Web Key Set file
+// (RFC 7517, e.g. an identity provider's jwks_uri saved to disk)
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+
+	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+)
+
+// JWKS are the signing keys of a JSON Web Key Set by key ID
+type JWKS struct {
+	keys map[string]interface{}
+}
+
+// jwk is a JSON Web Key (RSA or EC public key)
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// LoadJWKS returns the keys of the JWKS file at path
+func LoadJWKS(path string) (*JWKS, error) {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := ParseJWKS(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS file %s: %v", path, err)
+	}
+	return keys, nil
+}
+
+// ParseJWKS returns the signing keys of a JWKS (encryption keys are skipped)
+func ParseJWKS(src []byte) (*JWKS, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(src, &set); err != nil {
+		return nil, err
+	}
+
+	keys := &JWKS{keys: make(map[string]interface{})}
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %d (kid %q): %v", i, k.Kid, err)
+		}
+		if _, ok := keys.keys[k.Kid]; ok {
+			return nil, fmt.Errorf("key %d: kid %q is used twice", i, k.Kid)
+		}
+		keys.keys[k.Kid] = key
+	}
+
+	if len(keys.keys) == 0 {
+		return nil, fmt.Errorf("no signing keys")
+	}
+	return keys, nil
+}
+
+// Key returns the key with key ID kid (any key if there is only one and the
+// token does not say which)
+func (k *JWKS) Key(kid string) (interface{}, error) {
+	if key, ok := k.keys[kid]; ok {
+		return key, nil
+	}
+	if kid == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, nil
+		}
+	}
+	return nil, amerrors.ErrUnauthenticatedError("unknown signing key %q", kid)
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("n: %v", err)
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("e: %v", err)
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("e is too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("x: %v", err)
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("y: %v", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// decodeInt decodes a base64url big-endian integer
+func decodeInt(value string) (*big.Int, error) {
+	if value == "" {
+		return nil, fmt.Errorf("missing")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
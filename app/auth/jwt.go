@@ -0,0 +1,125 @@
+package auth
+
+// jwt.go
+// Callers authenticated by the JWT bearer token in their gRPC metadata
+// ("authorization: Bearer <token>"). Tokens are signed with a shared HMAC
+// secret or one of the keys of a JWKS file (RSA or ECDSA) and must expire.
+
+import (
+	"context"
+	"strings"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+
+	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+)
+
+// MetadataKey is the gRPC metadata key of the bearer token
+const MetadataKey = "authorization"
+
+const bearerPrefix = "Bearer "
+
+// Claims are the claims of a token (roles, agent_id and tenant_id are ours)
+type Claims struct {
+	jwt.StandardClaims
+	Roles   []string `json:"roles,omitempty"`
+	AgentID int32    `json:"agent_id,omitempty"`
+	Tenant  string   `json:"tenant_id,omitempty"`
+}
+
+// JWT authenticates callers by their bearer token
+type JWT struct {
+	secret   []byte
+	keys     *JWKS
+	issuer   string
+	audience string
+}
+
+// NewJWT returns a JWT that accepts tokens signed with secret (HS256/384/512)
+// or one of keys (RS*, PS* and ES*). Either may be nil. Tokens must have been
+// issued by issuer for audience unless they are "".
+func NewJWT(secret []byte, keys *JWKS, issuer string, audience string) *JWT {
+	return &JWT{secret: secret, keys: keys, issuer: issuer, audience: audience}
+}
+
+// Authenticate implements Authenticator
+func (j *JWT) Authenticate(ctx context.Context) (Principal, error) {
+	raw, ok := bearerToken(ctx)
+	if !ok {
+		return Principal{}, ErrNoCredentials
+	}
+
+	var claims Claims
+	if _, err := jwt.ParseWithClaims(raw, &claims, j.key); err != nil {
+		return Principal{}, amerrors.ErrUnauthenticatedError("invalid token: %v", err)
+	}
+
+	if claims.ExpiresAt == 0 {
+		return Principal{}, amerrors.ErrUnauthenticatedError("invalid token: no expiry (exp)")
+	}
+	if j.issuer != "" && !claims.VerifyIssuer(j.issuer, true) {
+		return Principal{}, amerrors.ErrUnauthenticatedError("invalid token: not issued by %s", j.issuer)
+	}
+	if j.audience != "" && !claims.VerifyAudience(j.audience, true) {
+		return Principal{}, amerrors.ErrUnauthenticatedError("invalid token: not for %s", j.audience)
+	}
+
+	p := Principal{Subject: claims.Subject, AgentID: claims.AgentID, Tenant: claims.Tenant}
+	for _, role := range claims.Roles {
+		if ValidRole(role) {
+			p.Roles = append(p.Roles, Role(role))
+		}
+	}
+	return p, nil
+}
+
+// key returns the key token was signed with
+func (j *JWT) key(token *jwt.Token) (interface{}, error) {
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if j.secret == nil {
+			return nil, amerrors.ErrUnauthenticatedError("HMAC signed tokens are not accepted")
+		}
+		return j.secret, nil
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA:
+		if j.keys == nil {
+			return nil, amerrors.ErrUnauthenticatedError("%s signed tokens are not accepted", token.Method.Alg())
+		}
+		kid, _ := token.Header["kid"].(string)
+		return j.keys.Key(kid)
+	}
+	return nil, amerrors.ErrUnauthenticatedError("%s signed tokens are not accepted", token.Method.Alg())
+}
+
+// bearerToken returns the bearer token in the incoming metadata of ctx
+func bearerToken(ctx context.Context) (string, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", false
+	}
+	for _, value := range md[MetadataKey] {
+		if strings.HasPrefix(value, bearerPrefix) {
+			return strings.TrimPrefix(value, bearerPrefix), true
+		}
+	}
+	return "", false
+}
+
+// BearerToken returns the credentials sending token with every call (see
+// grpc.WithPerRPCCredentials). The token is sent over connections without
+// TLS too (e.g. to the linkerd sidecar).
+func BearerToken(token string) credentials.PerRPCCredentials {
+	return bearer(token)
+}
+
+type bearer string
+
+func (b bearer) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{MetadataKey: bearerPrefix + string(b)}, nil
+}
+
+func (b bearer) RequireTransportSecurity() bool {
+	return false
+}
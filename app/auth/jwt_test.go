@@ -0,0 +1,145 @@
+package auth_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/newtonsystems/agent-mgmt/app/auth"
+	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+	tu "github.com/newtonsystems/agent-mgmt/app/testutil"
+)
+
+var secret = []byte("s3cret")
+
+// withToken returns the incoming context of a call with bearer token
+func withToken(token string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(auth.MetadataKey, "Bearer "+token))
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims auth.Claims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	tu.Ok(t, err)
+	return signed
+}
+
+func b64(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+func TestJWT(t *testing.T) {
+	expires := time.Now().Add(time.Hour).Unix()
+	valid := auth.Claims{
+		StandardClaims: jwt.StandardClaims{Subject: "agent-1", ExpiresAt: expires, Issuer: "https://id.example.com", Audience: "agent-mgmt"},
+		Roles:          []string{"agent", "superuser"},
+		AgentID:        1,
+		Tenant:         "acme",
+	}
+	authn := auth.NewJWT(secret, nil, "https://id.example.com", "agent-mgmt")
+
+	p, err := authn.Authenticate(withToken(sign(t, jwt.SigningMethodHS256, secret, "", valid)))
+	tu.Ok(t, err)
+	tu.Equals(t, auth.Principal{Subject: "agent-1", Roles: []auth.Role{auth.RoleAgent}, AgentID: 1, Tenant: "acme"}, p)
+
+	_, err = authn.Authenticate(context.Background())
+	tu.Equals(t, auth.ErrNoCredentials, err)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	tu.Ok(t, err)
+
+	expired, noExpiry, wrongIssuer, wrongAudience := valid, valid, valid, valid
+	expired.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	noExpiry.ExpiresAt = 0
+	wrongIssuer.Issuer = "https://evil.example.com"
+	wrongAudience.Audience = "billing"
+
+	testCases := []struct {
+		description string
+		token       string
+	}{
+		{"expired", sign(t, jwt.SigningMethodHS256, secret, "", expired)},
+		{"no_expiry", sign(t, jwt.SigningMethodHS256, secret, "", noExpiry)},
+		{"wrong_issuer", sign(t, jwt.SigningMethodHS256, secret, "", wrongIssuer)},
+		{"wrong_audience", sign(t, jwt.SigningMethodHS256, secret, "", wrongAudience)},
+		{"wrong_secret", sign(t, jwt.SigningMethodHS256, []byte("guess"), "", valid)},
+		{"rsa_without_jwks", sign(t, jwt.SigningMethodRS256, rsaKey, "", valid)},
+		{"unsigned", sign(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "", valid)},
+		{"garbage", "not.a.token"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			_, err := authn.Authenticate(withToken(tc.token))
+			tu.IsAmError(t, amerrors.ErrUnauthenticated, err)
+		})
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	tu.Ok(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tu.Ok(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	tu.Ok(t, err)
+
+	keys, err := auth.ParseJWKS([]byte(fmt.Sprintf(`{"keys": [
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": %q, "e": %q},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": %q, "y": %q},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": %q, "e": %q}
+	]}`, b64(rsaKey.N), b64(big.NewInt(int64(rsaKey.E))), b64(ecKey.X), b64(ecKey.Y), b64(otherKey.N), b64(big.NewInt(int64(otherKey.E))))))
+	tu.Ok(t, err)
+
+	claims := auth.Claims{
+		StandardClaims: jwt.StandardClaims{Subject: "telephony", ExpiresAt: time.Now().Add(time.Hour).Unix()},
+		Roles:          []string{"dispatcher"},
+	}
+	authn := auth.NewJWT(nil, keys, "", "")
+
+	for _, token := range []string{
+		sign(t, jwt.SigningMethodRS256, rsaKey, "rsa", claims),
+		sign(t, jwt.SigningMethodPS256, rsaKey, "rsa", claims),
+		sign(t, jwt.SigningMethodES256, ecKey, "ec", claims),
+	} {
+		p, err := authn.Authenticate(withToken(token))
+		tu.Ok(t, err)
+		tu.Equals(t, auth.Principal{Subject: "telephony", Roles: []auth.Role{auth.RoleDispatcher}}, p)
+	}
+
+	for _, token := range []string{
+		// Signed with the wrong key, an encryption key or an unknown key
+		sign(t, jwt.SigningMethodRS256, otherKey, "rsa", claims),
+		sign(t, jwt.SigningMethodRS256, otherKey, "enc", claims),
+		sign(t, jwt.SigningMethodRS256, rsaKey, "", claims),
+		// HMAC tokens are not accepted without a secret
+		sign(t, jwt.SigningMethodHS256, secret, "", claims),
+	} {
+		_, err = authn.Authenticate(withToken(token))
+		tu.IsAmError(t, amerrors.ErrUnauthenticated, err)
+	}
+
+	for _, src := range []string{
+		`{"keys": []}`,
+		`{"keys": [{"kty": "oct", "kid": "hmac", "k": "c2VjcmV0"}]}`,
+		`{"keys": [{"kty": "EC", "kid": "ec", "crv": "P-256", "x": "AQ", "y": "AQ"}]}`,
+		fmt.Sprintf(`{"keys": [{"kty": "EC", "kid": "ec", "crv": "P-256", "x": %q, "y": %q}, {"kty": "EC", "kid": "ec", "crv": "P-256", "x": %q, "y": %q}]}`, b64(ecKey.X), b64(ecKey.Y), b64(ecKey.X), b64(ecKey.Y)),
+		`not json`,
+	} {
+		_, err = auth.ParseJWKS([]byte(src))
+		tu.Assert(t, err != nil, "expected an error parsing JWKS %s", src)
+	}
+}
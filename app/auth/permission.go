@@ -0,0 +1,61 @@
+package auth
+
+// permission.go
+// Who may make each call of the service (by service method name)
+
+import (
+	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+)
+
+// Permission is who may make a call
+type Permission struct {
+	// Roles that may make the call for any agent (admins always may)
+	Roles []Role
+	// Self lets an agent make the call for its own agent ID
+	Self bool
+}
+
+// Permissions of the service methods. Methods not listed are for admins only.
+var Permissions = map[string]Permission{
+	"Sum":                {Roles: Roles},
+	"Concat":             {Roles: Roles},
+	"GetAvailableAgents": {Roles: []Role{RoleDispatcher}},
+	"GetAgentIDFromRef":  {Roles: []Role{RoleDispatcher}},
+	"HeartBeat":          {Self: true},
+	"AddTask":            {Roles: []Role{RoleDispatcher}},
+	"OfferTask":          {Roles: []Role{RoleDispatcher}},
+	"AcceptCall":         {Roles: []Role{RoleDispatcher}, Self: true},
+	"StartTask":          {Roles: []Role{RoleDispatcher}, Self: true},
+	"CompleteTask":       {Roles: []Role{RoleDispatcher}, Self: true},
+	"GetTask":            {Roles: []Role{RoleDispatcher}},
+	"ListTasks":          {Roles: []Role{RoleDispatcher}, Self: true},
+	"CancelTask":         {Roles: []Role{RoleDispatcher}},
+	"SetAgentState":      {Self: true},
+	"WatchAgents":        {Roles: []Role{RoleDispatcher}},
+	"ConnectAgent":       {Self: true},
+	"KeepAlive":          {Self: true},
+	// SetAgentSkills, RegisterAgent and DeregisterAgent are for admins
+}
+
+// Authorize returns ErrPermissionDenied unless p may call method for agentID
+// (0 if the call is not for an agent, which an agent may never make)
+func Authorize(p Principal, method string, agentID int32) error {
+	if p.HasRole(RoleAdmin) {
+		return nil
+	}
+
+	permission := Permissions[method]
+	for _, role := range permission.Roles {
+		if p.HasRole(role) {
+			return nil
+		}
+	}
+	if permission.Self && p.HasRole(RoleAgent) && p.AgentID != 0 && p.AgentID == agentID {
+		return nil
+	}
+
+	if p.HasRole(RoleAgent) && permission.Self {
+		return amerrors.ErrPermissionDeniedError("%s may not call %s for Agent(AgentID=%d)", p.Subject, method, agentID)
+	}
+	return amerrors.ErrPermissionDeniedError("%s may not call %s", p.Subject, method)
+}
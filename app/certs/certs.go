@@ -0,0 +1,271 @@
+package certs
+
+// certs.go
+// TLS certificates loaded from files and reloaded when the files change (e.g.
+// a renewed kubernetes secret) so the servers and the linkerd connection pick
+// up new certificates without a restart
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"google.golang.org/grpc/credentials"
+)
+
+// Reloader holds a certificate (and key) and a CA pool loaded from files,
+// reloading them when the files change
+type Reloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	interval time.Duration
+	logger   log.Logger
+
+	mu     sync.RWMutex
+	cert   *tls.Certificate
+	leaf   *x509.Certificate
+	pool   *x509.CertPool
+	stamps map[string]stamp
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// stamp is when a file was last changed (and its size, as some file systems
+// only keep mod times to the second)
+type stamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// New returns a Reloader of the certificate in certFile (with its key in
+// keyFile) and the CA certificates in caFile, reloaded every interval if they
+// have changed (see Run). The certificate or the CA file may be "".
+func New(certFile string, keyFile string, caFile string, interval time.Duration, logger log.Logger) (*Reloader, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("certificate and key files must be given together")
+	}
+	if certFile == "" && caFile == "" {
+		return nil, errors.New("no certificate or CA file")
+	}
+
+	r := &Reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		interval: interval,
+		logger:   logger,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Reloader) files() []string {
+	var files []string
+	for _, file := range []string{r.certFile, r.keyFile, r.caFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// Reload loads the files again if any of them has changed and returns whether
+// they had. The certificates in use are kept if loading fails.
+func (r *Reloader) Reload() (bool, error) {
+	stamps := make(map[string]stamp)
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+		stamps[file] = stamp{info.ModTime(), info.Size()}
+	}
+
+	r.mu.RLock()
+	changed := len(r.stamps) == 0
+	for file, s := range stamps {
+		changed = changed || r.stamps[file] != s
+	}
+	r.mu.RUnlock()
+	if !changed {
+		return false, nil
+	}
+
+	var (
+		cert *tls.Certificate
+		leaf *x509.Certificate
+		pool *x509.CertPool
+	)
+	if r.certFile != "" {
+		pair, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			return false, err
+		}
+		if leaf, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+			return false, fmt.Errorf("failed to parse certificate %s: %v", r.certFile, err)
+		}
+		pair.Leaf = leaf
+		cert = &pair
+	}
+	if r.caFile != "" {
+		pem, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return false, err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return false, fmt.Errorf("no certificates in CA file %s", r.caFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert, r.leaf, r.pool, r.stamps = cert, leaf, pool, stamps
+	r.mu.Unlock()
+	return true, nil
+}
+
+// Run reloads the files every interval (if they have changed) until Stop is
+// called (returns immediately if the interval is 0)
+func (r *Reloader) Run() {
+	defer close(r.done)
+
+	if r.interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			reloaded, err := r.Reload()
+			if err != nil {
+				r.logger.Log("level", "error", "msg", "Failed to reload certificates (still using the old ones)", "files", fmt.Sprint(r.files()), "err", err)
+				continue
+			}
+			if reloaded {
+				r.logger.Log("level", "info", "msg", "Certificates reloaded", "files", fmt.Sprint(r.files()), "expires", r.NotAfter())
+			}
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Stop stops Run
+func (r *Reloader) Stop() {
+	r.stopOnce.Do(func() { close(r.stop) })
+	<-r.done
+}
+
+// NotAfter returns when the certificate expires (zero without a certificate)
+func (r *Reloader) NotAfter() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.leaf == nil {
+		return time.Time{}
+	}
+	return r.leaf.NotAfter
+}
+
+// ServerConfig returns the TLS config of a server with the certificate.
+// Client certificates are verified against the CA pool (if there is one) as
+// clientAuth says. Every connection uses the certificates loaded last.
+func (r *Reloader) ServerConfig(clientAuth tls.ClientAuthType, nextProtos ...string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+
+			if r.cert == nil {
+				return nil, errors.New("no server certificate")
+			}
+			config := &tls.Config{
+				Certificates: []tls.Certificate{*r.cert},
+				MinVersion:   tls.VersionTLS12,
+				NextProtos:   nextProtos,
+			}
+			if r.pool != nil {
+				config.ClientCAs = r.pool
+				config.ClientAuth = clientAuth
+			}
+			return config, nil
+		},
+	}
+}
+
+// clientConfig returns the TLS config of a client verifying servers against
+// the CA pool (the system's if there is none) with the certificate as its
+// client certificate (if there is one)
+func (r *Reloader) clientConfig(serverName string) *tls.Config {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	config := &tls.Config{
+		RootCAs:    r.pool,
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if r.cert != nil {
+		config.Certificates = []tls.Certificate{*r.cert}
+	}
+	return config
+}
+
+// ClientCredentials returns the gRPC transport credentials of a client (see
+// grpc.WithTransportCredentials). Every connection uses the certificates
+// loaded last. serverName overrides the name the server is verified as if
+// it is not "".
+func (r *Reloader) ClientCredentials(serverName string) credentials.TransportCredentials {
+	return &clientCredentials{r, serverName}
+}
+
+// clientCredentials make each handshake with a TLS config of the current
+// certificates (grpc's TLS credentials keep the config they were made with)
+type clientCredentials struct {
+	r          *Reloader
+	serverName string
+}
+
+func (c *clientCredentials) creds() credentials.TransportCredentials {
+	return credentials.NewTLS(c.r.clientConfig(c.serverName))
+}
+
+func (c *clientCredentials) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return c.creds().ClientHandshake(ctx, authority, conn)
+}
+
+func (c *clientCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, errors.New("client credentials cannot be used by a server")
+}
+
+func (c *clientCredentials) Info() credentials.ProtocolInfo {
+	return c.creds().Info()
+}
+
+func (c *clientCredentials) Clone() credentials.TransportCredentials {
+	return &clientCredentials{c.r, c.serverName}
+}
+
+func (c *clientCredentials) OverrideServerName(serverName string) error {
+	c.serverName = serverName
+	return nil
+}
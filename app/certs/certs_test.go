@@ -0,0 +1,207 @@
+package certs_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/newtonsystems/agent-mgmt/app/certs"
+	tu "github.com/newtonsystems/agent-mgmt/app/testutil"
+)
+
+// issuer is a certificate and its key
+type issuer struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// issue returns a certificate for name signed by parent (self signed if nil)
+// that expires at notAfter
+func issue(t *testing.T, parent *issuer, name string, notAfter time.Time) *issuer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tu.Ok(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tu.Ok(t, err)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	tu.Ok(t, err)
+	cert, err := x509.ParseCertificate(der)
+	tu.Ok(t, err)
+	return &issuer{cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// writes counts the certificates written
+var writes int
+
+// write writes the certificate and key of c to dir/name.crt and dir/name.key
+func (c *issuer) write(t *testing.T, dir string, name string) (string, string) {
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	tu.Ok(t, err)
+
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	tu.Ok(t, ioutil.WriteFile(certFile, c.pem, 0600))
+	tu.Ok(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+
+	// Rewritten files must look changed (mod times may only be to the second)
+	writes++
+	later := time.Now().Add(time.Duration(writes) * time.Second)
+	tu.Ok(t, os.Chtimes(certFile, later, later))
+	return certFile, keyFile
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent-mgmt-certs")
+	tu.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := issue(t, nil, "ca", time.Now().Add(24*time.Hour))
+	caFile, _ := ca.write(t, dir, "ca")
+
+	notAfter := time.Now().Add(time.Hour).Truncate(time.Second)
+	certFile, keyFile := issue(t, ca, "localhost", notAfter).write(t, dir, "server")
+
+	r, err := certs.New(certFile, keyFile, caFile, time.Minute, log.NewNopLogger())
+	tu.Ok(t, err)
+	tu.TimeEquals(t, notAfter, r.NotAfter())
+
+	reloaded, err := r.Reload()
+	tu.Ok(t, err)
+	tu.Equals(t, false, reloaded)
+
+	// A renewed certificate is loaded
+	renewed := notAfter.Add(time.Hour)
+	issue(t, ca, "localhost", renewed).write(t, dir, "server")
+	reloaded, err = r.Reload()
+	tu.Ok(t, err)
+	tu.Equals(t, true, reloaded)
+	tu.TimeEquals(t, renewed, r.NotAfter())
+
+	// A broken certificate is not (the renewed one is still used)
+	tu.Ok(t, ioutil.WriteFile(certFile, []byte("not a certificate"), 0600))
+	_, err = r.Reload()
+	tu.Assert(t, err != nil, "expected an error reloading a broken certificate")
+	tu.TimeEquals(t, renewed, r.NotAfter())
+
+	for _, files := range [][3]string{
+		{certFile, "", ""},
+		{"", "", ""},
+		{filepath.Join(dir, "missing.crt"), keyFile, ""},
+		{"", "", keyFile},
+	} {
+		_, err = certs.New(files[0], files[1], files[2], time.Minute, log.NewNopLogger())
+		tu.Assert(t, err != nil, "expected an error loading %v", files)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent-mgmt-certs")
+	tu.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := issue(t, nil, "ca", time.Now().Add(24*time.Hour))
+	caFile, _ := ca.write(t, dir, "ca")
+	serverCertFile, serverKeyFile := issue(t, ca, "localhost", time.Now().Add(time.Hour)).write(t, dir, "server")
+	clientCertFile, clientKeyFile := issue(t, ca, "telephony", time.Now().Add(time.Hour)).write(t, dir, "client")
+
+	server, err := certs.New(serverCertFile, serverKeyFile, caFile, time.Minute, log.NewNopLogger())
+	tu.Ok(t, err)
+	client, err := certs.New(clientCertFile, clientKeyFile, caFile, time.Minute, log.NewNopLogger())
+	tu.Ok(t, err)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", server.ServerConfig(tls.RequireAndVerifyClientCert))
+	tu.Ok(t, err)
+	defer ln.Close()
+
+	// handshake returns the certificates the client and the server were given
+	handshake := func(t *testing.T, creds credentials.TransportCredentials) (*x509.Certificate, *x509.Certificate) {
+		clientCert := make(chan *x509.Certificate, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				clientCert <- nil
+				return
+			}
+			defer conn.Close()
+
+			tlsConn := conn.(*tls.Conn)
+			if tlsConn.Handshake() != nil || len(tlsConn.ConnectionState().PeerCertificates) == 0 {
+				clientCert <- nil
+				return
+			}
+			clientCert <- tlsConn.ConnectionState().PeerCertificates[0]
+		}()
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		tu.Ok(t, err)
+		defer conn.Close()
+
+		tlsConn, info, err := creds.ClientHandshake(context.Background(), "localhost", conn)
+		tu.Ok(t, err)
+		defer tlsConn.Close()
+
+		return info.(credentials.TLSInfo).State.PeerCertificates[0], <-clientCert
+	}
+
+	serverCert, clientCert := handshake(t, client.ClientCredentials(""))
+	tu.Equals(t, "localhost", serverCert.Subject.CommonName)
+	tu.Equals(t, "telephony", clientCert.Subject.CommonName)
+
+	// Renewed certificates are used by the next connections
+	renewed := time.Now().Add(2 * time.Hour).Truncate(time.Second)
+	issue(t, ca, "localhost", renewed).write(t, dir, "server")
+	issue(t, ca, "telephony", renewed).write(t, dir, "client")
+	for _, r := range []*certs.Reloader{server, client} {
+		_, err = r.Reload()
+		tu.Ok(t, err)
+	}
+
+	serverCert, clientCert = handshake(t, client.ClientCredentials(""))
+	tu.TimeEquals(t, renewed, serverCert.NotAfter)
+	tu.TimeEquals(t, renewed, clientCert.NotAfter)
+
+	// The server is verified for the server name if it is given
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	tu.Ok(t, err)
+	defer conn.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	_, _, err = client.ClientCredentials("linkerd").ClientHandshake(context.Background(), "localhost", conn)
+	tu.Assert(t, err != nil, "expected the server not to be verified as linkerd")
+}
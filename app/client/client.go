@@ -0,0 +1,428 @@
+package client
+
+// client.go
+// A Go client of the agent mgmt service. Client implements service.Service
+// over gRPC: every call has a deadline, idempotent calls are retried with
+// backoff and calls are balanced (round robin) across the service instances.
+// Errors are returned as *amerrors.AgentMgmtError where the service sent one.
+// Calls are made for the tenant of their context (see tenant.NewContext).
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	kitendpoint "github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+	"github.com/go-kit/kit/sd/lb"
+	"google.golang.org/grpc"
+
+	amendpoint "github.com/newtonsystems/agent-mgmt/app/endpoint"
+	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+	"github.com/newtonsystems/agent-mgmt/app/heartbeat"
+	"github.com/newtonsystems/agent-mgmt/app/models"
+	"github.com/newtonsystems/agent-mgmt/app/service"
+	"github.com/newtonsystems/agent-mgmt/app/tenant"
+	"github.com/newtonsystems/agent-mgmt/app/transport"
+	"github.com/newtonsystems/agent-mgmt/app/watch"
+	"github.com/newtonsystems/grpc_types/go/grpc_types"
+)
+
+const (
+	// DefaultTimeout is the deadline of a call (including its retries)
+	DefaultTimeout = 5 * time.Second
+	// DefaultRetries is how many times a failed idempotent call is retried
+	DefaultRetries = 3
+	// DefaultBackoff is the wait before the first retry (doubled every retry)
+	DefaultBackoff = 100 * time.Millisecond
+	// DefaultMaxBackoff is the longest wait between retries
+	DefaultMaxBackoff = 2 * time.Second
+)
+
+// ErrNotSupported is returned by the Service methods that are not RPCs of the agent mgmt service
+var ErrNotSupported = errors.New("not supported by the agent mgmt client")
+
+// Options of a Client
+type Options struct {
+	// Timeout is the deadline of a call unless the method is in Timeouts
+	Timeout time.Duration
+	// Timeouts are the deadlines of the methods by name (e.g. "GetAvailableAgents")
+	Timeouts map[string]time.Duration
+	// Retries is how many times a failed idempotent call is retried
+	Retries    int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// DialOptions are added to the options used to dial every instance
+	// (grpc.WithInsecure if there are none)
+	DialOptions []grpc.DialOption
+}
+
+// DefaultOptions returns the default options
+func DefaultOptions() Options {
+	return Options{
+		Timeout:    DefaultTimeout,
+		Retries:    DefaultRetries,
+		Backoff:    DefaultBackoff,
+		MaxBackoff: DefaultMaxBackoff,
+	}
+}
+
+// timeout returns the deadline of method
+func (o Options) timeout(method string) time.Duration {
+	if timeout, ok := o.Timeouts[method]; ok {
+		return timeout
+	}
+	return o.Timeout
+}
+
+// Client is a service.Service of the agent mgmt service instances
+type Client struct {
+	opts   Options
+	logger log.Logger
+	conns  []*grpc.ClientConn
+	sets   []amendpoint.Set
+	agents *heartbeat.Registry // connections of the agents (on any instance)
+
+	getAvailableAgents kitendpoint.Endpoint
+	getAgentIDFromRef  kitendpoint.Endpoint
+	heartBeat          kitendpoint.Endpoint
+	addTask            kitendpoint.Endpoint
+	offerTask          kitendpoint.Endpoint
+	acceptCall         kitendpoint.Endpoint
+	startTask          kitendpoint.Endpoint
+	completeTask       kitendpoint.Endpoint
+	setAgentState      kitendpoint.Endpoint
+	setAgentSkills     kitendpoint.Endpoint
+	getTask            kitendpoint.Endpoint
+	listTasks          kitendpoint.Endpoint
+	cancelTask         kitendpoint.Endpoint
+	registerAgent      kitendpoint.Endpoint
+	deregisterAgent    kitendpoint.Endpoint
+
+	mu      sync.Mutex
+	next    int                           // instance of the next stream
+	streams map[streamKey]heartBeatStream // open heartbeat streams by tenant's agent
+}
+
+// streamKey is a tenant's agent with a heartbeat stream
+type streamKey struct {
+	tenant  string
+	agentID int32
+}
+
+// heartBeatStream is the instance and connection of an agent's heartbeat stream
+type heartBeatStream struct {
+	instance int
+	conn     *heartbeat.Conn
+}
+
+var _ service.Service = (*Client)(nil)
+
+// New returns a Client of the service instances (host:port)
+func New(instances []string, opts Options, logger log.Logger) (*Client, error) {
+	if len(instances) == 0 {
+		return nil, errors.New("no agent mgmt service instances")
+	}
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+
+	dialOptions := opts.DialOptions
+	if len(dialOptions) == 0 {
+		dialOptions = []grpc.DialOption{grpc.WithInsecure()}
+	}
+	dialOptions = append(dialOptions, grpc.WithUnaryInterceptor(transport.ClientErrorInterceptor))
+
+	c := &Client{
+		opts:    opts,
+		logger:  logger,
+		agents:  heartbeat.NewRegistry(heartbeat.DefaultBuffer),
+		streams: make(map[streamKey]heartBeatStream),
+	}
+
+	for _, instance := range instances {
+		conn, err := grpc.Dial(instance, dialOptions...)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.conns = append(c.conns, conn)
+		c.sets = append(c.sets, transport.NewGRPCClient(conn, c.agents, log.With(logger, "instance", instance)))
+	}
+
+	c.getAvailableAgents = c.endpoint("GetAvailableAgents", true, func(s amendpoint.Set) kitendpoint.Endpoint { return s.GetAvailableAgentsEndpoint })
+	c.getAgentIDFromRef = c.endpoint("GetAgentIDFromRef", true, func(s amendpoint.Set) kitendpoint.Endpoint { return s.GetAgentIDFromRefEndpoint })
+	c.heartBeat = c.endpoint("HeartBeat", true, func(s amendpoint.Set) kitendpoint.Endpoint { return s.HeartBeatEndpoint })
+	c.addTask = c.endpoint("AddTask", false, func(s amendpoint.Set) kitendpoint.Endpoint { return s.AddTaskEndpoint })
+	c.offerTask = c.endpoint("OfferTask", false, func(s amendpoint.Set) kitendpoint.Endpoint { return s.OfferTaskEndpoint })
+	c.acceptCall = c.endpoint("AcceptCall", false, func(s amendpoint.Set) kitendpoint.Endpoint { return s.AcceptCallEndpoint })
+	c.startTask = c.endpoint("StartTask", false, func(s amendpoint.Set) kitendpoint.Endpoint { return s.StartTaskEndpoint })
+	c.completeTask = c.endpoint("CompleteTask", false, func(s amendpoint.Set) kitendpoint.Endpoint { return s.CompleteTaskEndpoint })
+	c.setAgentState = c.endpoint("SetAgentState", false, func(s amendpoint.Set) kitendpoint.Endpoint { return s.SetAgentStateEndpoint })
+	c.setAgentSkills = c.endpoint("SetAgentSkills", true, func(s amendpoint.Set) kitendpoint.Endpoint { return s.SetAgentSkillsEndpoint })
+	c.getTask = c.endpoint("GetTask", true, func(s amendpoint.Set) kitendpoint.Endpoint { return s.GetTaskEndpoint })
+	c.listTasks = c.endpoint("ListTasks", true, func(s amendpoint.Set) kitendpoint.Endpoint { return s.ListTasksEndpoint })
+	c.cancelTask = c.endpoint("CancelTask", false, func(s amendpoint.Set) kitendpoint.Endpoint { return s.CancelTaskEndpoint })
+	c.registerAgent = c.endpoint("RegisterAgent", false, func(s amendpoint.Set) kitendpoint.Endpoint { return s.RegisterAgentEndpoint })
+	c.deregisterAgent = c.endpoint("DeregisterAgent", false, func(s amendpoint.Set) kitendpoint.Endpoint { return s.DeregisterAgentEndpoint })
+
+	return c, nil
+}
+
+// endpoint returns method balanced across the instances. Idempotent methods
+// are retried.
+func (c *Client) endpoint(method string, idempotent bool, get func(amendpoint.Set) kitendpoint.Endpoint) kitendpoint.Endpoint {
+	endpoints := make(sd.FixedEndpointer, 0, len(c.sets))
+	for _, set := range c.sets {
+		endpoints = append(endpoints, get(set))
+	}
+
+	attempts := 1
+	if idempotent {
+		attempts += c.opts.Retries
+	}
+
+	var e kitendpoint.Endpoint
+	{
+		e = Retry(attempts, c.opts.Backoff, c.opts.MaxBackoff, lb.NewRoundRobin(endpoints))
+		e = Deadline(c.opts.timeout(method))(e)
+		e = amendpoint.LoggingMiddleware(log.With(c.logger, "method", method))(e)
+	}
+	return e
+}
+
+// Close ends the agents' connections and closes the connections to the instances
+func (c *Client) Close() error {
+	c.agents.Close()
+
+	var err error
+	for _, conn := range c.conns {
+		if cerr := conn.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Sum is not an RPC of the agent mgmt service
+func (c *Client) Sum(ctx context.Context, a, b int) (int, error) {
+	return 0, ErrNotSupported
+}
+
+// Concat is not an RPC of the agent mgmt service
+func (c *Client) Concat(ctx context.Context, a, b string) (string, error) {
+	return "", ErrNotSupported
+}
+
+// GetAvailableAgents calls GetAvailableAgents()
+func (c *Client) GetAvailableAgents(ctx context.Context, limit int32, strategy string, skills []models.SkillRequirement) ([]string, error) {
+	resp, err := c.getAvailableAgents(ctx, amendpoint.GetAvailableAgentsRequest{Limit: limit, Strategy: strategy, Skills: skills})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(amendpoint.GetAvailableAgentsResponse).AgentIds, nil
+}
+
+// GetAgentIDFromRef calls GetAgentIDFromRef()
+func (c *Client) GetAgentIDFromRef(ctx context.Context, refID string) (int32, error) {
+	resp, err := c.getAgentIDFromRef(ctx, amendpoint.GetAgentIDFromRefRequest{RefId: refID})
+	if err != nil {
+		return 0, err
+	}
+	return resp.(amendpoint.GetAgentIDFromRefResponse).AgentId, nil
+}
+
+// HeartBeat calls HeartBeat()
+func (c *Client) HeartBeat(ctx context.Context, agentID int32) (grpc_types.HeartBeatResponse_HeartBeatStatus, time.Duration, error) {
+	resp, err := c.heartBeat(ctx, amendpoint.HeartBeatRequest{AgentId: agentID})
+	if err != nil {
+		return grpc_types.HeartBeatResponse_HEARTBEAT_FAILED, 0, err
+	}
+	response := resp.(amendpoint.HeartBeatResponse)
+	return response.Status, response.NextHeartBeat, nil
+}
+
+// AddTask calls AddTask()
+func (c *Client) AddTask(ctx context.Context, custID int32, agentIDs []int32, skills []models.SkillRequirement) (int32, error) {
+	resp, err := c.addTask(ctx, amendpoint.AddTaskRequest{CustId: custID, AgentIds: agentIDs, RequiredSkills: skills})
+	if err != nil {
+		return 0, err
+	}
+	return resp.(amendpoint.AddTaskResponse).TaskId, nil
+}
+
+// OfferTask calls OfferTask() (only the task ID, agent IDs and status of the task are set)
+func (c *Client) OfferTask(ctx context.Context, taskID int32, agentIDs []int32) (models.Task, error) {
+	resp, err := c.offerTask(ctx, amendpoint.OfferTaskRequest{TaskId: taskID, AgentIds: agentIDs})
+	if err != nil {
+		return models.Task{}, err
+	}
+	response := resp.(amendpoint.OfferTaskResponse)
+	return models.Task{TaskID: response.TaskId, AgentIDs: agentIDs, Status: models.TaskStatus(response.Status)}, nil
+}
+
+// AcceptCall calls AcceptCall() (only the task and customer IDs of the task are set)
+func (c *Client) AcceptCall(ctx context.Context, agentID int32, taskID int32) (models.Task, error) {
+	resp, err := c.acceptCall(ctx, amendpoint.AcceptCallRequest{AgentId: agentID, TaskId: taskID})
+	if err != nil {
+		return models.Task{}, err
+	}
+	response := resp.(amendpoint.AcceptCallResponse)
+	return models.Task{TaskID: response.TaskId, CustID: response.CustId}, nil
+}
+
+// StartTask calls StartTask() (only the task ID and status of the task are set)
+func (c *Client) StartTask(ctx context.Context, agentID int32, taskID int32) (models.Task, error) {
+	resp, err := c.startTask(ctx, amendpoint.StartTaskRequest{AgentId: agentID, TaskId: taskID})
+	if err != nil {
+		return models.Task{}, err
+	}
+	response := resp.(amendpoint.StartTaskResponse)
+	return models.Task{TaskID: response.TaskId, Status: models.TaskStatus(response.Status)}, nil
+}
+
+// CompleteTask calls CompleteTask() (only the task ID of the task is set)
+func (c *Client) CompleteTask(ctx context.Context, agentID int32, taskID int32) (models.Task, error) {
+	resp, err := c.completeTask(ctx, amendpoint.CompleteTaskRequest{AgentId: agentID, TaskId: taskID})
+	if err != nil {
+		return models.Task{}, err
+	}
+	return models.Task{TaskID: resp.(amendpoint.CompleteTaskResponse).TaskId}, nil
+}
+
+// GetTask calls GetTask()
+func (c *Client) GetTask(ctx context.Context, taskID int32) (models.Task, error) {
+	resp, err := c.getTask(ctx, amendpoint.GetTaskRequest{TaskId: taskID})
+	if err != nil {
+		return models.Task{}, err
+	}
+	return resp.(amendpoint.GetTaskResponse).Task, nil
+}
+
+// ListTasks calls ListTasks()
+func (c *Client) ListTasks(ctx context.Context, custID int32, agentID int32, status string, limit int32) ([]models.Task, error) {
+	resp, err := c.listTasks(ctx, amendpoint.ListTasksRequest{CustId: custID, AgentId: agentID, Status: status, Limit: limit})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(amendpoint.ListTasksResponse).Tasks, nil
+}
+
+// CancelTask calls CancelTask() (only the task ID and status of the task are set)
+func (c *Client) CancelTask(ctx context.Context, taskID int32, abandoned bool) (models.Task, error) {
+	resp, err := c.cancelTask(ctx, amendpoint.CancelTaskRequest{TaskId: taskID, Abandoned: abandoned})
+	if err != nil {
+		return models.Task{}, err
+	}
+	response := resp.(amendpoint.CancelTaskResponse)
+	return models.Task{TaskID: response.TaskId, Status: models.TaskStatus(response.Status)}, nil
+}
+
+// SetAgentState calls SetAgentState()
+func (c *Client) SetAgentState(ctx context.Context, agentID int32, state string) error {
+	_, err := c.setAgentState(ctx, amendpoint.SetAgentStateRequest{AgentId: agentID, State: state})
+	return err
+}
+
+// SetAgentSkills calls SetAgentSkills() (only the agent ID and skills of the agent are set)
+func (c *Client) SetAgentSkills(ctx context.Context, agentID int32, skills []models.Skill) (models.Agent, error) {
+	resp, err := c.setAgentSkills(ctx, amendpoint.SetAgentSkillsRequest{AgentId: agentID, Skills: skills})
+	if err != nil {
+		return models.Agent{}, err
+	}
+	response := resp.(amendpoint.SetAgentSkillsResponse)
+	return models.Agent{AgentID: response.AgentId, Skills: response.Skills}, nil
+}
+
+// RegisterAgent calls RegisterAgent()
+func (c *Client) RegisterAgent(ctx context.Context) (int32, error) {
+	resp, err := c.registerAgent(ctx, amendpoint.RegisterAgentRequest{})
+	if err != nil {
+		return 0, err
+	}
+	return resp.(amendpoint.RegisterAgentResponse).AgentId, nil
+}
+
+// DeregisterAgent calls DeregisterAgent()
+func (c *Client) DeregisterAgent(ctx context.Context, agentID int32) error {
+	_, err := c.deregisterAgent(ctx, amendpoint.DeregisterAgentRequest{AgentId: agentID})
+	return err
+}
+
+// WatchAgents opens a WatchAgents() stream to the next instance. Only the
+// agent IDs of the available agents are set. The watcher is closed when the
+// stream ends (the caller should watch again). Only changes made through that
+// instance are streamed, so with several instances the snapshot of a new
+// stream is needed to catch up with the others (or use GetAvailableAgents).
+func (c *Client) WatchAgents(ctx context.Context) ([]models.Agent, *watch.Watcher, error) {
+	return c.sets[c.instance()].WatchAgents(ctx)
+}
+
+// ConnectAgent opens a HeartBeatStream() for agent id to the next instance.
+// The commands pushed by the service are sent to the returned connection.
+func (c *Client) ConnectAgent(ctx context.Context, agentID int32) (*heartbeat.Conn, time.Duration, error) {
+	instance := c.instance()
+
+	ctx, cancel := context.WithTimeout(ctx, c.opts.timeout("HeartBeatStream"))
+	defer cancel()
+
+	conn, next, err := c.sets[instance].HeartBeatStream.Connect(ctx, agentID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	key := streamKey{conn.Tenant, agentID}
+	c.mu.Lock()
+	old, ok := c.streams[key]
+	c.streams[key] = heartBeatStream{instance: instance, conn: conn}
+	c.mu.Unlock()
+
+	// An agent has one stream: its old connection was replaced but the old
+	// stream may be to another instance
+	if ok && old.instance != instance {
+		c.sets[old.instance].HeartBeatStream.Disconnect(ctx, old.conn)
+	}
+
+	return conn, next, nil
+}
+
+// KeepAlive sends a heartbeat down agent id's stream
+func (c *Client) KeepAlive(ctx context.Context, agentID int32, sinceLastBeat time.Duration) error {
+	c.mu.Lock()
+	s, ok := c.streams[streamKey{tenant.FromContext(ctx), agentID}]
+	c.mu.Unlock()
+
+	if !ok {
+		return amerrors.ErrStreamClosedError("Agent(AgentID=%d) has no heartbeat stream", agentID)
+	}
+	return c.sets[s.instance].HeartBeatStream.KeepAlive(ctx, agentID, sinceLastBeat)
+}
+
+// DisconnectAgent closes conn's heartbeat stream
+func (c *Client) DisconnectAgent(ctx context.Context, conn *heartbeat.Conn) error {
+	c.mu.Lock()
+	key := streamKey{conn.Tenant, conn.AgentID}
+	s, ok := c.streams[key]
+	if ok && s.conn == conn {
+		delete(c.streams, key)
+	}
+	c.mu.Unlock()
+
+	if !ok || s.conn != conn {
+		conn.Close()
+		return nil
+	}
+	return c.sets[s.instance].HeartBeatStream.Disconnect(ctx, conn)
+}
+
+// instance returns the instance of the next stream (round robin)
+func (c *Client) instance() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	instance := c.next
+	c.next = (c.next + 1) % len(c.sets)
+	return instance
+}
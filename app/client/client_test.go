@@ -0,0 +1,249 @@
+package client_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/newtonsystems/agent-mgmt/app/client"
+	"github.com/newtonsystems/agent-mgmt/app/config"
+	amendpoint "github.com/newtonsystems/agent-mgmt/app/endpoint"
+	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+	"github.com/newtonsystems/agent-mgmt/app/heartbeat"
+	"github.com/newtonsystems/agent-mgmt/app/models"
+	"github.com/newtonsystems/agent-mgmt/app/service"
+	tu "github.com/newtonsystems/agent-mgmt/app/testutil"
+	"github.com/newtonsystems/agent-mgmt/app/transport"
+	"github.com/newtonsystems/agent-mgmt/app/watch"
+	"github.com/newtonsystems/grpc_types/go/grpc_types"
+)
+
+var now = time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)
+
+// server starts an agent mgmt service on a free port of an in-memory
+// database with agents 1 (available, ref001a) and 2 (offline, ref002a)
+func server(t *testing.T) (string, models.Session, *heartbeat.Registry, func()) {
+	service.NowFunc = func() time.Time { return now }
+
+	session, db := tu.NewTestMemoryConnection()
+	tu.InsertCollectionToDB(t, db, "agents", []tu.TestModelInsert{
+		&models.Agent{AgentID: 1, State: models.AgentAvailable, LastHeartBeat: now},
+		&models.Agent{AgentID: 2, State: models.AgentOffline, LastHeartBeat: now.Add(-time.Hour)},
+	})
+	tu.InsertCollectionToDB(t, db, "phonesessions", []tu.TestModelInsert{
+		&models.PhoneSession{SessID: 1, AgentID: 1, RefID: "ref001a"},
+		&models.PhoneSession{SessID: 2, AgentID: 2, RefID: "ref002a"},
+	})
+
+	var (
+		events    = watch.NewHub(watch.DefaultBuffer)
+		agents    = heartbeat.NewRegistry(heartbeat.DefaultBuffer)
+		svc       = service.NewService(config.Default(), models.NewRepositories(session, tu.MongoDBName), nil, nil, events, agents, nil)
+		endpoints = amendpoint.NewEndpoint(svc, nil, nil, nil)
+	)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	tu.Ok(t, err)
+
+	s := grpc.NewServer()
+	grpc_types.RegisterAgentMgmtServer(s, transport.GRPCServer(endpoints, nil, nil))
+	go s.Serve(ln)
+
+	return ln.Addr().String(), session, agents, func() {
+		agents.Close()
+		events.Close()
+		s.Stop()
+		session.Close()
+	}
+}
+
+// deadInstance returns the address of a closed port
+func deadInstance(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	tu.Ok(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestClient(t *testing.T) {
+	addr, session, _, stop := server(t)
+	defer stop()
+
+	c, err := client.New([]string{addr}, client.DefaultOptions(), nil)
+	tu.Ok(t, err)
+	defer c.Close()
+
+	agentIDs, err := c.GetAvailableAgents(context.Background(), 0, "", nil)
+	tu.Ok(t, err)
+	tu.Equals(t, []string{"1"}, agentIDs)
+
+	agentID, err := c.GetAgentIDFromRef(context.Background(), "ref002a")
+	tu.Ok(t, err)
+	tu.Equals(t, int32(2), agentID)
+
+	status, next, err := c.HeartBeat(context.Background(), 2)
+	tu.Ok(t, err)
+	tu.Equals(t, grpc_types.HeartBeatResponse_HEARTBEAT_SUCCESSFUL, status)
+	tu.Equals(t, 30*time.Second, next)
+
+	taskID, err := c.AddTask(context.Background(), 5, []int32{1}, nil)
+	tu.Ok(t, err)
+
+	task, err := c.AcceptCall(context.Background(), 1, taskID)
+	tu.Ok(t, err)
+	tu.Equals(t, models.Task{TaskID: taskID, CustID: 5}, task)
+
+	task, err = c.GetTask(context.Background(), taskID)
+	tu.Ok(t, err)
+	tu.Equals(t, models.TaskAccepted, task.Status)
+	tu.Equals(t, int32(1), task.AcceptedBy)
+
+	tasks, err := c.ListTasks(context.Background(), 5, 0, "", 0)
+	tu.Ok(t, err)
+	tu.Equals(t, 1, len(tasks))
+
+	task, err = c.CompleteTask(context.Background(), 1, taskID)
+	tu.Ok(t, err)
+	tu.Equals(t, taskID, task.TaskID)
+
+	agent, err := c.SetAgentSkills(context.Background(), 1, []models.Skill{{Name: "french", Level: 3}})
+	tu.Ok(t, err)
+	tu.Equals(t, []models.Skill{{Name: "french", Level: 3}}, agent.Skills)
+
+	tu.Ok(t, c.SetAgentState(context.Background(), 1, string(models.AgentAway)))
+
+	agentID, err = c.RegisterAgent(context.Background())
+	tu.Ok(t, err)
+	tu.Ok(t, c.DeregisterAgent(context.Background(), agentID))
+
+	stored, err := session.DB(tu.MongoDBName).GetAgent(context.Background(), 1)
+	tu.Ok(t, err)
+	tu.Equals(t, models.AgentAway, stored.State)
+}
+
+func TestClientErrors(t *testing.T) {
+	addr, _, _, stop := server(t)
+	defer stop()
+
+	c, err := client.New([]string{addr}, client.DefaultOptions(), nil)
+	tu.Ok(t, err)
+	defer c.Close()
+
+	// The service's errors come back typed
+	_, err = c.GetAgentIDFromRef(context.Background(), "ref999a")
+	tu.IsAmError(t, amerrors.ErrAgentIDNotFound, err)
+
+	_, err = c.GetTask(context.Background(), 99)
+	tu.IsAmError(t, amerrors.ErrTaskNotFound, err)
+
+	_, err = c.AddTask(context.Background(), 0, nil, nil)
+	tu.IsAmError(t, amerrors.ErrCustIDInvalid, err)
+	tu.Equals(t, "cust_id", err.(*amerrors.AgentMgmtError).Field)
+
+	_, err = c.Sum(context.Background(), 1, 2)
+	tu.Equals(t, client.ErrNotSupported, err)
+
+	_, err = client.New(nil, client.DefaultOptions(), nil)
+	tu.Assert(t, err != nil, "expected an error without instances")
+}
+
+func TestClientRetry(t *testing.T) {
+	addr, _, _, stop := server(t)
+	defer stop()
+
+	// Round robin starts with the dead instance
+	opts := client.DefaultOptions()
+	opts.Backoff = time.Millisecond
+	c, err := client.New([]string{deadInstance(t), addr}, opts, nil)
+	tu.Ok(t, err)
+	defer c.Close()
+
+	// Idempotent calls are retried on the next instance
+	agentID, err := c.GetAgentIDFromRef(context.Background(), "ref001a")
+	tu.Ok(t, err)
+	tu.Equals(t, int32(1), agentID)
+
+	// The others are not
+	_, err = c.GetAgentIDFromRef(context.Background(), "ref001a")
+	tu.Ok(t, err)
+	_, err = c.RegisterAgent(context.Background())
+	tu.Equals(t, codes.Unavailable, status.Code(err))
+
+	// Nor are errors from the service
+	_, err = c.GetTask(context.Background(), 99)
+	tu.IsAmError(t, amerrors.ErrTaskNotFound, err)
+}
+
+func TestClientDeadline(t *testing.T) {
+	addr, _, _, stop := server(t)
+	defer stop()
+
+	opts := client.DefaultOptions()
+	opts.Timeouts = map[string]time.Duration{"GetTask": time.Nanosecond}
+	c, err := client.New([]string{addr}, opts, nil)
+	tu.Ok(t, err)
+	defer c.Close()
+
+	_, err = c.GetTask(context.Background(), 1)
+	tu.Equals(t, codes.DeadlineExceeded, status.Code(err))
+
+	// Other methods have the default timeout
+	_, err = c.GetAgentIDFromRef(context.Background(), "ref001a")
+	tu.Ok(t, err)
+}
+
+func TestClientStreams(t *testing.T) {
+	addr, _, agents, stop := server(t)
+	defer stop()
+
+	c, err := client.New([]string{addr}, client.DefaultOptions(), nil)
+	tu.Ok(t, err)
+	defer c.Close()
+
+	available, watcher, err := c.WatchAgents(context.Background())
+	tu.Ok(t, err)
+	defer watcher.Close()
+	tu.Equals(t, []models.Agent{{AgentID: 1}}, available)
+
+	// The agent is told how often to heartbeat
+	conn, next, err := c.ConnectAgent(context.Background(), 2)
+	tu.Ok(t, err)
+	tu.Equals(t, 30*time.Second, next)
+
+	select {
+	case event := <-watcher.C:
+		tu.Equals(t, watch.EventAvailable, event.Type)
+		tu.Equals(t, int32(2), event.AgentID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the agent to become available")
+	}
+
+	tu.Ok(t, c.KeepAlive(context.Background(), 2, time.Second))
+
+	// and offered tasks as they are added
+	taskID, err := c.AddTask(context.Background(), 5, []int32{2}, nil)
+	tu.Ok(t, err)
+
+	select {
+	case cmd := <-conn.C:
+		tu.Equals(t, heartbeat.Command{Type: heartbeat.CommandOfferTask, TaskID: taskID, CustID: 5}, cmd)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the task offer")
+	}
+
+	// Hanging up closes the stream on the server
+	tu.Ok(t, c.DisconnectAgent(context.Background(), conn))
+	for i := 0; len(agents.AgentIDs("")) > 0; i++ {
+		tu.Assert(t, i < 500, "expected the server to close the stream, got %v", agents.AgentIDs(""))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err = c.KeepAlive(context.Background(), 2, time.Second)
+	tu.IsAmError(t, amerrors.ErrStreamClosed, err)
+}
@@ -0,0 +1,65 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	kitendpoint "github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/sd/lb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Retry returns an endpoint that calls an endpoint of balancer up to attempts
+// times until one succeeds, waiting backoff between attempts (doubled every
+// attempt up to maxBackoff). Only errors a later attempt can succeed after
+// (see Retryable) are retried and the wait ends with the request's context.
+func Retry(attempts int, backoff, maxBackoff time.Duration, balancer lb.Balancer) kitendpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		wait := backoff
+		for attempt := 1; ; attempt++ {
+			e, err := balancer.Endpoint()
+			if err != nil {
+				return nil, err
+			}
+
+			response, err := e(ctx, request)
+			if err == nil || attempt >= attempts || !Retryable(err) {
+				return response, err
+			}
+
+			select {
+			case <-ctx.Done():
+				return nil, err
+			case <-time.After(wait):
+			}
+
+			wait *= 2
+			if wait > maxBackoff {
+				wait = maxBackoff
+			}
+		}
+	}
+}
+
+// Retryable returns true if the call failed before reaching the service
+// (e.g. the instance is down) so it is safe to try again
+func Retryable(err error) bool {
+	return status.Code(err) == codes.Unavailable
+}
+
+// Deadline returns an endpoint middleware that gives up on a call after
+// timeout (no deadline if timeout is 0)
+func Deadline(timeout time.Duration) kitendpoint.Middleware {
+	return func(next kitendpoint.Endpoint) kitendpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			if timeout <= 0 {
+				return next(ctx, request)
+			}
+
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			return next(ctx, request)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"path/filepath"
@@ -12,13 +13,18 @@ import (
 	"testing"
 	"time"
 
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/newtonsystems/agent-mgmt/app/auth"
+	"github.com/newtonsystems/agent-mgmt/app/config"
 	amendpoint "github.com/newtonsystems/agent-mgmt/app/endpoint"
 	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+	"github.com/newtonsystems/agent-mgmt/app/heartbeat"
 	"github.com/newtonsystems/agent-mgmt/app/models"
 	"github.com/newtonsystems/agent-mgmt/app/service"
 	tu "github.com/newtonsystems/agent-mgmt/app/testutil"
 	"github.com/newtonsystems/agent-mgmt/app/transport"
 	"github.com/newtonsystems/agent-mgmt/app/utils"
+	"github.com/newtonsystems/agent-mgmt/app/watch"
 	"github.com/newtonsystems/grpc_types/go/grpc_types"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -119,11 +125,11 @@ var data = []entry{
 	{
 		"getagentidfromref",
 		&grpc_types.GetAgentIDFromRefRequest{RefId: ""},
-		amerrors.ErrAgentIDNotFound,
+		amerrors.ErrInvalidArgument,
 		"getagentidfromref_empty.input",
 		"response agent ID",
 		"getagentidfromref_empty.golden",
-		"A test to check that we get an ErrAgentIDNotFound error when refID is empty returned by service's GetAgentIDFromRef()",
+		"A test to check that an empty refID is rejected (ErrInvalidArgument) before service's GetAgentIDFromRef() is called",
 	},
 	{
 		"getagentidfromref",
@@ -139,25 +145,25 @@ var data = []entry{
 		&grpc_types.HeartBeatRequest{AgentId: 3},
 		0,
 		"heartbeat.input",
-		"response heartbeat status",
+		"response heartbeat status and next heartbeat",
 		"heartbeat.golden",
 		"A basic test of service's HeartBeat()",
 	},
 	{
 		"heartbeat",
 		&grpc_types.HeartBeatRequest{AgentId: 32},
-		amerrors.ErrAgentIDNotFound,
+		amerrors.ErrAgentNotFound,
 		"heartbeat.input",
-		"response heartbeat status",
+		"response heartbeat status and next heartbeat",
 		"heartbeat_wrongagentid.golden",
 		"A test to check correct error if the agent does not exist given agent id provided to service's HeartBeat()",
 	},
 	{
 		"heartbeat",
 		&grpc_types.HeartBeatRequest{},
-		amerrors.ErrAgentIDNotFound,
+		amerrors.ErrInvalidArgument,
 		"heartbeat.input",
-		"response heartbeat status",
+		"response heartbeat status and next heartbeat",
 		"heartbeat_noagentidinrequest.golden",
 		"A test to check correct error if no agent id is provided to service's HeartBeat()",
 	},
@@ -188,6 +194,195 @@ var data = []entry{
 		"addtask_custid0.golden",
 		"A test to check of invalid custid of 0 for service's AddTask()",
 	},
+	{
+		"acceptcall",
+		[]*grpc_types.AcceptCallRequest{{AgentId: 2, TaskId: 2}},
+		0,
+		"acceptcall.input",
+		"accepted task",
+		"acceptcall.golden",
+		"A basic test of service's AcceptCall()",
+	},
+	{
+		"acceptcall",
+		[]*grpc_types.AcceptCallRequest{{AgentId: 2, TaskId: 2}, {AgentId: 3, TaskId: 2}},
+		amerrors.ErrTaskAlreadyAccepted,
+		"acceptcall.input",
+		"accepted task",
+		"acceptcall_twice.golden",
+		"A test to check a second accept of the same task returns ErrTaskAlreadyAccepted for service's AcceptCall()",
+	},
+	{
+		"acceptcall",
+		[]*grpc_types.AcceptCallRequest{{AgentId: 5, TaskId: 2}},
+		amerrors.ErrTaskNotOffered,
+		"acceptcall.input",
+		"accepted task",
+		"acceptcall_notoffered.golden",
+		"A test to check an agent can not accept a task not offered to them for service's AcceptCall()",
+	},
+	{
+		"acceptcall",
+		[]*grpc_types.AcceptCallRequest{{AgentId: 2, TaskId: 20}},
+		amerrors.ErrTaskNotFound,
+		"acceptcall.input",
+		"accepted task",
+		"acceptcall_wrongtaskid.golden",
+		"A test to check we get an ErrTaskNotFound error when the task does not exist for service's AcceptCall()",
+	},
+	{
+		"acceptcall",
+		[]*grpc_types.AcceptCallRequest{{AgentId: 4, TaskId: 2}},
+		amerrors.ErrAgentStateTransition,
+		"acceptcall.input",
+		"accepted task",
+		"acceptcall_oncall.golden",
+		"A test to check an agent already on a call can not accept another for service's AcceptCall()",
+	},
+	{
+		"getavailableagents",
+		&grpc_types.GetAvailableAgentsRequest{},
+		0,
+		"getavailableagents_states.input",
+		"response agent IDs",
+		"getavailableagents_states.golden",
+		"A test to ensure only agents in the available state are returned by service's GetAvailableAgents()",
+	},
+	{
+		"completetask",
+		&grpc_types.CompleteTaskRequest{AgentId: 2, TaskId: 2},
+		0,
+		"agentstates.input",
+		"completed task",
+		"completetask.golden",
+		"A basic test of service's CompleteTask()",
+	},
+	{
+		"completetask",
+		&grpc_types.CompleteTaskRequest{AgentId: 1, TaskId: 2},
+		amerrors.ErrTaskNotAccepted,
+		"agentstates.input",
+		"completed task",
+		"completetask_notaccepted.golden",
+		"A test to check an agent can not complete a task they did not accept for service's CompleteTask()",
+	},
+	{
+		"gettask",
+		&grpc_types.GetTaskRequest{TaskId: 3},
+		0,
+		"tasks.input",
+		"task",
+		"gettask.golden",
+		"A basic test of service's GetTask()",
+	},
+	{
+		"gettask",
+		&grpc_types.GetTaskRequest{TaskId: 20},
+		amerrors.ErrTaskNotFound,
+		"tasks.input",
+		"task",
+		"gettask_wrongtaskid.golden",
+		"A test to check we get an ErrTaskNotFound error when the task does not exist for service's GetTask()",
+	},
+	{
+		"listtasks",
+		&grpc_types.ListTasksRequest{CustId: 2},
+		0,
+		"tasks.input",
+		"task IDs",
+		"listtasks.golden",
+		"A basic test of service's ListTasks()",
+	},
+	{
+		"listtasks",
+		&grpc_types.ListTasksRequest{Status: "lost"},
+		amerrors.ErrTaskStatusInvalid,
+		"tasks.input",
+		"task IDs",
+		"listtasks_invalidstatus.golden",
+		"A test to check we get an ErrTaskStatusInvalid error for an unknown status for service's ListTasks()",
+	},
+	{
+		"canceltask",
+		&grpc_types.CancelTaskRequest{TaskId: 1},
+		0,
+		"tasks.input",
+		"cancelled task",
+		"canceltask.golden",
+		"A basic test of service's CancelTask()",
+	},
+	{
+		"canceltask",
+		&grpc_types.CancelTaskRequest{TaskId: 3, Abandoned: true},
+		amerrors.ErrTaskStatusTransition,
+		"tasks.input",
+		"cancelled task",
+		"canceltask_completed.golden",
+		"A test to check a completed task can not be abandoned for service's CancelTask()",
+	},
+	{
+		"setagentskills",
+		&grpc_types.SetAgentSkillsRequest{AgentId: 1, Skills: []*grpc_types.Skill{{Name: "language:fr", Level: 3}}},
+		0,
+		"agentstates.input",
+		"agent skills",
+		"setagentskills.golden",
+		"A basic test of service's SetAgentSkills()",
+	},
+	{
+		"setagentskills",
+		&grpc_types.SetAgentSkillsRequest{AgentId: 1, Skills: []*grpc_types.Skill{{Name: "", Level: 3}}},
+		amerrors.ErrSkillInvalid,
+		"agentstates.input",
+		"agent skills",
+		"setagentskills_noname.golden",
+		"A test to check we get an ErrSkillInvalid error for a skill without a name for service's SetAgentSkills()",
+	},
+	{
+		"setagentstate",
+		&grpc_types.SetAgentStateRequest{AgentId: 1, State: "away"},
+		0,
+		"agentstates.input",
+		"empty response",
+		"setagentstate.golden",
+		"A basic test of service's SetAgentState()",
+	},
+	{
+		"setagentstate",
+		&grpc_types.SetAgentStateRequest{AgentId: 1, State: "lunch"},
+		amerrors.ErrAgentStateInvalid,
+		"agentstates.input",
+		"empty response",
+		"setagentstate_invalid.golden",
+		"A test to check we get an ErrAgentStateInvalid error for an unknown state for service's SetAgentState()",
+	},
+	{
+		"registeragent",
+		&grpc_types.RegisterAgentRequest{},
+		0,
+		"registeragent.input",
+		"response agentid",
+		"registeragent.golden",
+		"A basic test of service's RegisterAgent() (skips agent IDs that are already taken)",
+	},
+	{
+		"deregisteragent",
+		&grpc_types.DeregisterAgentRequest{AgentId: 3},
+		0,
+		"deregisteragent.input",
+		"available agent IDs after deregistering",
+		"deregisteragent.golden",
+		"A test to check a deregistered agent is no longer returned by service's GetAvailableAgents()",
+	},
+	{
+		"deregisteragent",
+		&grpc_types.DeregisterAgentRequest{AgentId: 20},
+		amerrors.ErrAgentNotFound,
+		"deregisteragent.input",
+		"available agent IDs after deregistering",
+		"deregisteragent_wrongagentid.golden",
+		"A test to check we get an ErrAgentNotFound error when the agent does not exist for service's DeregisterAgent()",
+	},
 }
 
 type entryQueryError struct {
@@ -204,14 +399,64 @@ var dataMockErrors = []entryQueryError{
 	},
 	{
 		"getagentidfromref",
-		&grpc_types.GetAgentIDFromRefRequest{},
+		&grpc_types.GetAgentIDFromRefRequest{RefId: "ref001a"},
 		"A basic QueryError test of service's GetAgentIDFromRef()",
 	},
+	{
+		"heartbeat",
+		&grpc_types.HeartBeatRequest{AgentId: 1},
+		"A basic QueryError test of service's HeartBeat()",
+	},
 	{
 		"addtask",
-		&grpc_types.AddTaskRequest{},
+		&grpc_types.AddTaskRequest{CustId: 1},
 		"A basic QueryError test of service's AddTask()",
 	},
+	{
+		"acceptcall",
+		[]*grpc_types.AcceptCallRequest{{AgentId: 1, TaskId: 1}},
+		"A basic QueryError test of service's AcceptCall()",
+	},
+	{
+		"completetask",
+		&grpc_types.CompleteTaskRequest{AgentId: 1, TaskId: 1},
+		"A basic QueryError test of service's CompleteTask()",
+	},
+	{
+		"setagentstate",
+		&grpc_types.SetAgentStateRequest{AgentId: 1, State: "busy"},
+		"A basic QueryError test of service's SetAgentState()",
+	},
+	{
+		"gettask",
+		&grpc_types.GetTaskRequest{TaskId: 1},
+		"A basic QueryError test of service's GetTask()",
+	},
+	{
+		"listtasks",
+		&grpc_types.ListTasksRequest{},
+		"A basic QueryError test of service's ListTasks()",
+	},
+	{
+		"canceltask",
+		&grpc_types.CancelTaskRequest{TaskId: 1},
+		"A basic QueryError test of service's CancelTask()",
+	},
+	{
+		"setagentskills",
+		&grpc_types.SetAgentSkillsRequest{AgentId: 1},
+		"A basic QueryError test of service's SetAgentSkills()",
+	},
+	{
+		"registeragent",
+		&grpc_types.RegisterAgentRequest{},
+		"A basic QueryError test of service's RegisterAgent()",
+	},
+	{
+		"deregisteragent",
+		&grpc_types.DeregisterAgentRequest{AgentId: 1},
+		"A basic QueryError test of service's DeregisterAgent()",
+	},
 }
 
 // runSrvTest runs a specifc test based off testName we convert to bytes for possible writing
@@ -271,7 +516,7 @@ func runSrvTest(t *testing.T, client grpc_types.AgentMgmtClient, header, trailer
 		)
 		// Style: this doesnt feel go like
 		if err == nil {
-			res = []byte(strconv.Itoa(int(resp.Status)))
+			res = []byte(fmt.Sprintf("%d next=%dms", resp.Status, resp.NextHeartbeatMs))
 		}
 		resErr = err
 
@@ -291,6 +536,165 @@ func runSrvTest(t *testing.T, client grpc_types.AgentMgmtClient, header, trailer
 			res = []byte(strconv.Itoa(int(resp.TaskId)))
 		}
 		resErr = err
+
+	case "acceptcall":
+		// Requests are sent in order (stops at the first error)
+		requests, ok := testReq.([]*grpc_types.AcceptCallRequest)
+		if !ok {
+			tu.FailNowAt(t, "Failed to convert/decode request. This shouldnt happen ...")
+		}
+		var lines []string
+		for _, request := range requests {
+			resp, err := client.AcceptCall(
+				ctx,
+				request,
+				grpc.Header(header),
+				grpc.Trailer(trailer),
+			)
+			if err != nil {
+				resErr = err
+				break
+			}
+			lines = append(lines, fmt.Sprintf("taskid=%d custid=%d", resp.TaskId, resp.CustId))
+		}
+		res = []byte(strings.Join(lines, "\n"))
+
+	case "completetask":
+		request, ok := testReq.(*grpc_types.CompleteTaskRequest)
+		if !ok {
+			tu.FailNowAt(t, "Failed to convert/decode request. This shouldnt happen ...")
+		}
+		resp, err := client.CompleteTask(
+			ctx,
+			request,
+			grpc.Header(header),
+			grpc.Trailer(trailer),
+		)
+		if err == nil {
+			res = []byte(strconv.Itoa(int(resp.TaskId)))
+		}
+		resErr = err
+
+	case "setagentstate":
+		request, ok := testReq.(*grpc_types.SetAgentStateRequest)
+		if !ok {
+			tu.FailNowAt(t, "Failed to convert/decode request. This shouldnt happen ...")
+		}
+		_, err := client.SetAgentState(
+			ctx,
+			request,
+			grpc.Header(header),
+			grpc.Trailer(trailer),
+		)
+		resErr = err
+
+	case "gettask":
+		request, ok := testReq.(*grpc_types.GetTaskRequest)
+		if !ok {
+			tu.FailNowAt(t, "Failed to convert/decode request. This shouldnt happen ...")
+		}
+		resp, err := client.GetTask(
+			ctx,
+			request,
+			grpc.Header(header),
+			grpc.Trailer(trailer),
+		)
+		if err == nil {
+			task := resp.Task
+			res = []byte(fmt.Sprintf("taskid=%d custid=%d status=%s acceptedby=%d wait=%dms handle=%dms", task.TaskId, task.CustId, task.Status, task.AcceptedBy, task.WaitTimeMs, task.HandleTimeMs))
+		}
+		resErr = err
+
+	case "listtasks":
+		request, ok := testReq.(*grpc_types.ListTasksRequest)
+		if !ok {
+			tu.FailNowAt(t, "Failed to convert/decode request. This shouldnt happen ...")
+		}
+		resp, err := client.ListTasks(
+			ctx,
+			request,
+			grpc.Header(header),
+			grpc.Trailer(trailer),
+		)
+		if err == nil {
+			var taskIDs []string
+			for _, task := range resp.Tasks {
+				taskIDs = append(taskIDs, strconv.Itoa(int(task.TaskId)))
+			}
+			res = []byte(strings.Join(taskIDs, ", "))
+		}
+		resErr = err
+
+	case "canceltask":
+		request, ok := testReq.(*grpc_types.CancelTaskRequest)
+		if !ok {
+			tu.FailNowAt(t, "Failed to convert/decode request. This shouldnt happen ...")
+		}
+		resp, err := client.CancelTask(
+			ctx,
+			request,
+			grpc.Header(header),
+			grpc.Trailer(trailer),
+		)
+		if err == nil {
+			res = []byte(fmt.Sprintf("%d %s", resp.TaskId, resp.Status))
+		}
+		resErr = err
+
+	case "setagentskills":
+		request, ok := testReq.(*grpc_types.SetAgentSkillsRequest)
+		if !ok {
+			tu.FailNowAt(t, "Failed to convert/decode request. This shouldnt happen ...")
+		}
+		resp, err := client.SetAgentSkills(
+			ctx,
+			request,
+			grpc.Header(header),
+			grpc.Trailer(trailer),
+		)
+		if err == nil {
+			var names []string
+			for _, skill := range resp.Skills {
+				names = append(names, fmt.Sprintf("%s/%d", skill.Name, skill.Level))
+			}
+			res = []byte(fmt.Sprintf("%d %s", resp.AgentId, strings.Join(names, ", ")))
+		}
+		resErr = err
+
+	case "registeragent":
+		request, ok := testReq.(*grpc_types.RegisterAgentRequest)
+		if !ok {
+			tu.FailNowAt(t, "Failed to convert/decode request. This shouldnt happen ...")
+		}
+		resp, err := client.RegisterAgent(
+			ctx,
+			request,
+			grpc.Header(header),
+			grpc.Trailer(trailer),
+		)
+		if err == nil {
+			res = []byte(strconv.Itoa(int(resp.AgentId)))
+		}
+		resErr = err
+
+	case "deregisteragent":
+		request, ok := testReq.(*grpc_types.DeregisterAgentRequest)
+		if !ok {
+			tu.FailNowAt(t, "Failed to convert/decode request. This shouldnt happen ...")
+		}
+		_, err := client.DeregisterAgent(
+			ctx,
+			request,
+			grpc.Header(header),
+			grpc.Trailer(trailer),
+		)
+		// Compare who is still available
+		if err == nil {
+			resp, errAvailable := client.GetAvailableAgents(ctx, &grpc_types.GetAvailableAgentsRequest{})
+			tu.Ok(t, errAvailable)
+			res = []byte(strings.Join(resp.AgentIds, ", "))
+		}
+		resErr = err
 	}
 
 	return res, resErr
@@ -323,6 +727,10 @@ func checkAPICall(t *testing.T, client grpc_types.AgentMgmtClient, session model
 			t.Error(err)
 			tu.FailNowAt(t, "Expected error type:"+amerrors.StrName(testHasErr)+" however got: "+fmt.Sprintf("%#v", service.UnWrapError(err, trailer)))
 		}
+		// The status code must match the error type (as well as the trailer)
+		if testHasErr != 0 && status.Code(err) != service.ErrorCode(testHasErr) {
+			tu.FailNowAt(t, "Expected status code:"+service.ErrorCode(testHasErr).String()+" however got: "+status.Code(err).String())
+		}
 		// If not expecting an error , fail
 		if testHasErr == 0 {
 			t.Error(err)
@@ -369,8 +777,8 @@ func TestGRPCServerClient(t *testing.T) {
 
 	// Create Service &  Endpoints (no logger, tracer, metrics etc)
 	var (
-		service   = service.NewService(nil, nil)
-		endpoints = amendpoint.NewEndpoint(service, nil, nil, nil, session, "test")
+		service   = service.NewService(config.Default(), models.NewRepositories(session, "test"), nil, nil, nil, nil, nil)
+		endpoints = amendpoint.NewEndpoint(service, nil, nil, nil)
 	)
 
 	// gRPC server
@@ -412,12 +820,156 @@ func TestGRPCServerClient(t *testing.T) {
 	}
 }
 
-// TestGRPCQueryError tests the server against query errors
-func TestGRPCQueryError(t *testing.T) {
+// TestGRPCWatchAgents tests the WatchAgents stream from snapshot to server shutdown
+func TestGRPCWatchAgents(t *testing.T) {
+	now := time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)
+	service.NowFunc = func() time.Time { return now }
+
 	// Initialise mongo connection
 	session, _ := tu.NewTestMongoConnection(*tu.Debug, *tu.OutsideConn)
 	defer tu.CleanUpTestMongoConnection(t, session)
+	defer tu.CleanAllCollectionsTestMongo(session)
 
+	tu.Ok(t, session.DB("test").C("agents").Insert(
+		&models.Agent{AgentID: 1, State: models.AgentAvailable, LastHeartBeat: now},
+		&models.Agent{AgentID: 2, State: models.AgentAvailable, LastHeartBeat: now},
+	))
+
+	var (
+		events    = watch.NewHub(watch.DefaultBuffer)
+		service   = service.NewService(config.Default(), models.NewRepositories(session, "test"), nil, nil, events, nil, nil)
+		endpoints = amendpoint.NewEndpoint(service, nil, nil, nil)
+	)
+
+	// gRPC server
+	ln, err := net.Listen("tcp", hostPort)
+	tu.Ok(t, err)
+
+	s := grpc.NewServer()
+	grpc_types.RegisterAgentMgmtServer(s, transport.GRPCServer(endpoints, nil, nil))
+	go s.Serve(ln)
+
+	conn, err := grpc.Dial(hostPort, grpc.WithInsecure())
+	tu.Ok(t, err)
+	defer conn.Close()
+	client := grpc_types.NewAgentMgmtClient(conn)
+
+	stream, err := client.WatchAgents(context.Background(), &grpc_types.WatchAgentsRequest{})
+	tu.Ok(t, err)
+
+	event, err := stream.Recv()
+	tu.Ok(t, err)
+	tu.Equals(t, grpc_types.AgentEvent_SNAPSHOT, event.Type)
+	tu.Equals(t, []int32{1, 2}, event.AgentIds)
+
+	_, err = client.DeregisterAgent(context.Background(), &grpc_types.DeregisterAgentRequest{AgentId: 2})
+	tu.Ok(t, err)
+
+	event, err = stream.Recv()
+	tu.Ok(t, err)
+	tu.Equals(t, &grpc_types.AgentEvent{Type: grpc_types.AgentEvent_DEREGISTERED, AgentId: 2, AtMs: now.UnixNano() / int64(time.Millisecond)}, event)
+
+	// A cancelled client stream is let go by the server
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled, err := client.WatchAgents(ctx, &grpc_types.WatchAgentsRequest{})
+	tu.Ok(t, err)
+	_, err = cancelled.Recv()
+	tu.Ok(t, err)
+	cancel()
+	_, err = cancelled.Recv()
+	tu.Equals(t, codes.Canceled, status.Code(err))
+
+	// Shutting down ends the stream cleanly and the server can stop gracefully
+	events.Close()
+	_, err = stream.Recv()
+	tu.Equals(t, io.EOF, err)
+	s.GracefulStop()
+}
+
+// TestGRPCHeartBeatStream tests an agent's heartbeat stream from connecting to hanging up
+func TestGRPCHeartBeatStream(t *testing.T) {
+	now := time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)
+	service.NowFunc = func() time.Time { return now }
+
+	// Initialise mongo connection
+	session, _ := tu.NewTestMongoConnection(*tu.Debug, *tu.OutsideConn)
+	defer tu.CleanUpTestMongoConnection(t, session)
+	defer tu.CleanAllCollectionsTestMongo(session)
+
+	tu.Ok(t, session.DB("test").C("agents").Insert(
+		&models.Agent{AgentID: 1, State: models.AgentOffline, LastHeartBeat: now.Add(-time.Hour)},
+		&models.Agent{AgentID: 2, State: models.AgentOffline, LastHeartBeat: now.Add(-time.Hour)},
+	))
+
+	var (
+		agents    = heartbeat.NewRegistry(heartbeat.DefaultBuffer)
+		service   = service.NewService(config.Default(), models.NewRepositories(session, "test"), nil, nil, nil, agents, nil)
+		endpoints = amendpoint.NewEndpoint(service, nil, nil, nil)
+	)
+
+	// gRPC server
+	ln, err := net.Listen("tcp", hostPort)
+	tu.Ok(t, err)
+
+	s := grpc.NewServer()
+	grpc_types.RegisterAgentMgmtServer(s, transport.GRPCServer(endpoints, nil, nil))
+	go s.Serve(ln)
+
+	conn, err := grpc.Dial(hostPort, grpc.WithInsecure())
+	tu.Ok(t, err)
+	defer conn.Close()
+	client := grpc_types.NewAgentMgmtClient(conn)
+
+	// The agent is told how often to heartbeat
+	stream, err := client.HeartBeatStream(context.Background())
+	tu.Ok(t, err)
+	tu.Ok(t, stream.Send(&grpc_types.HeartBeatStreamRequest{AgentId: 1}))
+	cmd, err := stream.Recv()
+	tu.Ok(t, err)
+	tu.Equals(t, &grpc_types.HeartBeatCommand{Type: grpc_types.HeartBeatCommand_CHANGE_INTERVAL, NextHeartBeatMs: 30000}, cmd)
+
+	// and offered tasks as they are added
+	resp, err := client.AddTask(context.Background(), &grpc_types.AddTaskRequest{CustId: 5, CallIds: []int32{1}})
+	tu.Ok(t, err)
+	cmd, err = stream.Recv()
+	tu.Ok(t, err)
+	tu.Equals(t, &grpc_types.HeartBeatCommand{Type: grpc_types.HeartBeatCommand_OFFER_TASK, TaskId: resp.TaskId, CustId: 5}, cmd)
+
+	// An unknown agent is turned away
+	unknown, err := client.HeartBeatStream(context.Background())
+	tu.Ok(t, err)
+	tu.Ok(t, unknown.Send(&grpc_types.HeartBeatStreamRequest{AgentId: 3}))
+	_, err = unknown.Recv()
+	tu.Assert(t, err != nil, "expected the unknown agent's stream to fail")
+
+	// Hanging up marks the agent offline straight away
+	tu.Ok(t, stream.CloseSend())
+	_, err = stream.Recv()
+	tu.Equals(t, io.EOF, err)
+	agent, err := session.DB("test").GetAgent(context.Background(), 1)
+	tu.Ok(t, err)
+	tu.Equals(t, models.AgentOffline, agent.State)
+
+	// Shutting down tells the agent to go away (it stays available for another server)
+	other, err := client.HeartBeatStream(context.Background())
+	tu.Ok(t, err)
+	tu.Ok(t, other.Send(&grpc_types.HeartBeatStreamRequest{AgentId: 2}))
+	_, err = other.Recv()
+	tu.Ok(t, err)
+	agents.Close()
+	cmd, err = other.Recv()
+	tu.Ok(t, err)
+	tu.Equals(t, grpc_types.HeartBeatCommand_GO_AWAY, cmd.Type)
+	_, err = other.Recv()
+	tu.Equals(t, io.EOF, err)
+	agent, err = session.DB("test").GetAgent(context.Background(), 2)
+	tu.Ok(t, err)
+	tu.Equals(t, models.AgentAvailable, agent.State)
+	s.GracefulStop()
+}
+
+// TestGRPCQueryError tests the server against query errors
+func TestGRPCQueryError(t *testing.T) {
 	// Create Service &  Endpoints (no logger, tracer, metrics etc)
 	// https://husobee.github.io/golang/testing/unit-test/2015/06/08/golang-unit-testing.html
 	var (
@@ -429,14 +981,41 @@ func TestGRPCQueryError(t *testing.T) {
 			MockGetAgentIDFromRef: func() (int32, error) {
 				return 0, &mgo.QueryError{Code: 1}
 			},
-			MockHeartBeat: func() (grpc_types.HeartBeatResponse_HeartBeatStatus, error) {
-				return grpc_types.HeartBeatResponse_HEARTBEAT_FAILED, &mgo.QueryError{Code: 1}
+			MockHeartBeat: func() (grpc_types.HeartBeatResponse_HeartBeatStatus, time.Duration, error) {
+				return grpc_types.HeartBeatResponse_HEARTBEAT_FAILED, 0, &mgo.QueryError{Code: 1}
 			},
 			MockAddTask: func() (int32, error) {
 				return 0, &mgo.QueryError{Code: 1}
 			},
+			MockAcceptCall: func() (models.Task, error) {
+				return models.Task{}, &mgo.QueryError{Code: 1}
+			},
+			MockCompleteTask: func() (models.Task, error) {
+				return models.Task{}, &mgo.QueryError{Code: 1}
+			},
+			MockSetAgentState: func() error {
+				return &mgo.QueryError{Code: 1}
+			},
+			MockGetTask: func() (models.Task, error) {
+				return models.Task{}, &mgo.QueryError{Code: 1}
+			},
+			MockListTasks: func() ([]models.Task, error) {
+				return nil, &mgo.QueryError{Code: 1}
+			},
+			MockCancelTask: func() (models.Task, error) {
+				return models.Task{}, &mgo.QueryError{Code: 1}
+			},
+			MockSetAgentSkills: func() (models.Agent, error) {
+				return models.Agent{}, &mgo.QueryError{Code: 1}
+			},
+			MockRegisterAgent: func() (int32, error) {
+				return 0, &mgo.QueryError{Code: 1}
+			},
+			MockDeregisterAgent: func() error {
+				return &mgo.QueryError{Code: 1}
+			},
 		}
-		endpoints = amendpoint.NewEndpoint(svc, nil, nil, nil, session, "test")
+		endpoints = amendpoint.NewEndpoint(svc, nil, nil, nil)
 	)
 
 	// gRPC server
@@ -474,7 +1053,7 @@ func TestGRPCQueryError(t *testing.T) {
 
 			// is an error is expected? If so, we check it is the correct one{
 			s, _ := status.FromError(err)
-			if s.Code() != codes.Unknown {
+			if s.Code() != codes.Internal {
 				t.Error(err)
 				t.FailNow()
 			}
@@ -482,3 +1061,68 @@ func TestGRPCQueryError(t *testing.T) {
 		})
 	}
 }
+
+// TestGRPCHeartBeatErrorCodes tests the status codes of refused heartbeats
+// reach the client (and not a HEARTBEAT_FAILED response)
+func TestGRPCHeartBeatErrorCodes(t *testing.T) {
+	var (
+		secret = []byte("s3cret")
+		svc    = tu.MockService{
+			MockHeartBeat: func() (grpc_types.HeartBeatResponse_HeartBeatStatus, time.Duration, error) {
+				return grpc_types.HeartBeatResponse_HEARTBEAT_SUCCESSFUL, config.DefaultHeartBeatInterval, nil
+			},
+		}
+		endpoints = amendpoint.NewEndpoint(service.AuthMiddleware(auth.NewJWT(secret, nil, "", ""), nil, logger)(svc), nil, nil, nil)
+	)
+
+	// gRPC server
+	ln, err := net.Listen("tcp", hostPort)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	srv := transport.GRPCServer(endpoints, nil, nil)
+	s := grpc.NewServer()
+	grpc_types.RegisterAgentMgmtServer(s, srv)
+	go s.Serve(ln)
+	defer s.GracefulStop()
+
+	// Connection to grpc server and create a client
+	conn, err := grpc.Dial(hostPort, grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("unable to Dial: %+v", err)
+	}
+	defer conn.Close()
+
+	client := grpc_types.NewAgentMgmtClient(conn)
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, auth.Claims{
+		StandardClaims: jwt.StandardClaims{Subject: "agent-1", ExpiresAt: time.Now().Add(time.Hour).Unix()},
+		Roles:          []string{"agent"},
+		AgentID:        1,
+	}).SignedString(secret)
+	tu.Ok(t, err)
+	agent := metadata.NewOutgoingContext(context.Background(), metadata.Pairs(auth.MetadataKey, "Bearer "+token))
+
+	testCases := []struct {
+		description string
+		ctx         context.Context
+		agentID     int32
+		code        codes.Code
+	}{
+		{"own_heartbeat", agent, 1, codes.OK},
+		{"other_agent", agent, 2, codes.PermissionDenied},
+		{"no_token", context.Background(), 1, codes.Unauthenticated},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			resp, err := client.HeartBeat(tc.ctx, &grpc_types.HeartBeatRequest{AgentId: tc.agentID})
+			tu.Equals(t, tc.code, status.Code(err))
+			if err == nil {
+				tu.Equals(t, grpc_types.HeartBeatResponse_HEARTBEAT_SUCCESSFUL, resp.Status)
+			}
+		})
+	}
+}
@@ -0,0 +1,692 @@
+package config
+
+// config.go
+// Typed service configuration loaded from defaults, a config file,
+// environment variables and flags (in that order, later wins)
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/newtonsystems/agent-mgmt/app/auth"
+	"github.com/newtonsystems/agent-mgmt/app/tenant"
+)
+
+const (
+	// DefaultStalenessWindow agents whose last heartbeat is older than this are not available
+	DefaultStalenessWindow = time.Minute
+	// DefaultGracePeriod extra time allowed for late heartbeats (network delays etc.)
+	DefaultGracePeriod = 0 * time.Second
+	// DefaultHeartBeatInterval how often clients are expected to send a heartbeat
+	DefaultHeartBeatInterval = 30 * time.Second
+	// DefaultHeartBeatFlushInterval how often buffered heartbeats are written to the database
+	DefaultHeartBeatFlushInterval = 5 * time.Second
+	// DefaultReaperInterval how often the reaper cleans up the database
+	DefaultReaperInterval = time.Minute
+	// DefaultPhoneSessionTTL phone sessions older than this are deleted by the reaper
+	DefaultPhoneSessionTTL = 24 * time.Hour
+	// DefaultTaskArchiveAfter completed tasks older than this are archived by the reaper
+	DefaultTaskArchiveAfter = 24 * time.Hour
+	// DefaultTLSReloadInterval how often certificate files are checked for changes
+	DefaultTLSReloadInterval = time.Minute
+	// DefaultDBStartupTimeout how long startup waits for the database to be reachable
+	DefaultDBStartupTimeout = 5 * time.Minute
+	// DefaultRoutingStrategy how available agents are ordered when no strategy is requested
+	DefaultRoutingStrategy = RoutingLongestIdle
+)
+
+// Routing strategies (see service.Router)
+const (
+	RoutingLongestIdle     = "longest-idle"
+	RoutingRoundRobin      = "round-robin"
+	RoutingLeastTasksToday = "least-tasks-today"
+	RoutingRandom          = "random"
+)
+
+// RoutingStrategies are the known routing strategies
+var RoutingStrategies = []string{RoutingLongestIdle, RoutingRoundRobin, RoutingLeastTasksToday, RoutingRandom}
+
+// ValidRoutingStrategy returns whether name is a known routing strategy
+func ValidRoutingStrategy(name string) bool {
+	for _, strategy := range RoutingStrategies {
+		if strategy == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Environment variables
+const (
+	EnvConfigFile        = "CONFIG_FILE"
+	EnvStalenessWindow   = "AGENT_STALENESS_WINDOW"
+	EnvGracePeriod       = "AGENT_GRACE_PERIOD"
+	EnvHeartBeatInterval = "HEARTBEAT_INTERVAL"
+	EnvHeartBeatFlush    = "HEARTBEAT_FLUSH_INTERVAL"
+	EnvReaperInterval    = "REAPER_INTERVAL"
+	EnvPhoneSessionTTL   = "PHONESESSION_TTL"
+	EnvTaskArchiveAfter  = "TASK_ARCHIVE_AFTER"
+	EnvReaperDryRun      = "REAPER_DRY_RUN"
+	EnvRoutingStrategy   = "ROUTING_STRATEGY"
+	EnvRoutingSeed       = "ROUTING_SEED"
+	EnvTenants           = "TENANTS"
+	EnvAuthHMACSecret    = "AUTH_HMAC_SECRET"
+	EnvAuthJWKSFile      = "AUTH_JWKS_FILE"
+	EnvAuthIssuer        = "AUTH_ISSUER"
+	EnvAuthAudience      = "AUTH_AUDIENCE"
+	EnvTLSCertFile       = "TLS_CERT_FILE"
+	EnvTLSKeyFile        = "TLS_KEY_FILE"
+	EnvTLSClientCAFile   = "TLS_CLIENT_CA_FILE"
+	EnvTLSReloadInterval = "TLS_RELOAD_INTERVAL"
+	EnvDebugTLSCertFile  = "DEBUG_TLS_CERT_FILE"
+	EnvDebugTLSKeyFile   = "DEBUG_TLS_KEY_FILE"
+	EnvDebugTLSClientCA  = "DEBUG_TLS_CLIENT_CA_FILE"
+	EnvLinkerdTLSCAFile  = "LINKERD_TLS_CA_FILE"
+	EnvLinkerdTLSCert    = "LINKERD_TLS_CERT_FILE"
+	EnvLinkerdTLSKey     = "LINKERD_TLS_KEY_FILE"
+	EnvLinkerdTLSServer  = "LINKERD_TLS_SERVER_NAME"
+	EnvMigrateOnStart    = "MIGRATE_ON_START"
+	EnvMongoURI          = "MONGO_URI"
+	EnvMongoPassword     = "MONGO_PASSWORD"
+	EnvDBStartup         = "DB_STARTUP_TIMEOUT"
+	EnvPostgresURI       = "POSTGRES_URI"
+
+	// EnvFileSuffix a secret's env name with this suffix names the file it is
+	// read from instead (e.g. MONGO_PASSWORD_FILE for a mounted Kubernetes secret)
+	EnvFileSuffix = "_FILE"
+)
+
+// Config is the agent availability configuration for the service
+type Config struct {
+	// StalenessWindow agents whose last heartbeat is older than this are not available
+	StalenessWindow time.Duration
+	// GracePeriod is added to the staleness window to allow for late heartbeats
+	GracePeriod time.Duration
+	// HeartBeatInterval how often clients are expected to send a heartbeat
+	// (returned to the client in the HeartBeat response)
+	HeartBeatInterval time.Duration
+	// HeartBeatFlushInterval heartbeats are buffered in memory and written to
+	// the database in bulk this often (0 writes every heartbeat straight away)
+	HeartBeatFlushInterval time.Duration
+	// ReaperInterval how often the reaper runs (0 disables the reaper)
+	ReaperInterval time.Duration
+	// PhoneSessionTTL phone sessions older than this are deleted
+	PhoneSessionTTL time.Duration
+	// TaskArchiveAfter completed tasks older than this are archived
+	TaskArchiveAfter time.Duration
+	// ReaperDryRun the reaper only logs/counts what it would change
+	ReaperDryRun bool
+	// RoutingStrategy the default routing strategy (see RoutingStrategies)
+	RoutingStrategy string
+	// TenantRoutingStrategies routing strategy per tenant ID (overrides RoutingStrategy)
+	TenantRoutingStrategies map[string]string
+	// RoutingSeed seeds the random routing strategy (0 seeds from the clock)
+	RoutingSeed int64
+	// Tenants the organisations served, each in its own database. Every call
+	// must be for one of them. None serves a single organisation (any tenant
+	// ID is then only used to pick its routing strategy).
+	Tenants []string
+	// AuthHMACSecret verifies HMAC signed bearer tokens (only from the
+	// environment or a secret file)
+	AuthHMACSecret string
+	// AuthJWKSFile JSON Web Key Set file that verifies RSA/ECDSA signed bearer tokens
+	AuthJWKSFile string
+	// AuthIssuer and AuthAudience bearer tokens must have (not checked if "")
+	AuthIssuer   string
+	AuthAudience string
+	// AuthRoles extra roles by subject (token sub or certificate common name)
+	AuthRoles map[string][]string
+	// TLSCertFile and TLSKeyFile the server certificate (none serves plaintext)
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSClientCAFile verifies client certificates, which then authenticate callers
+	TLSClientCAFile string
+	// TLSReloadInterval how often certificate files are reloaded if they have
+	// changed (0 only loads them at startup)
+	TLSReloadInterval time.Duration
+	// DebugTLSCertFile and DebugTLSKeyFile the debug/metrics HTTP server
+	// certificate (none serves plaintext)
+	DebugTLSCertFile string
+	DebugTLSKeyFile  string
+	// DebugTLSClientCAFile requires /debug/pprof clients to have a certificate
+	// it verifies (probes and metrics scrapes need none)
+	DebugTLSClientCAFile string
+	// LinkerdTLSCAFile verifies linkerd's certificate (the system CAs if "" and
+	// a client certificate is set). Either dials linkerd with TLS.
+	LinkerdTLSCAFile string
+	// LinkerdTLSCertFile and LinkerdTLSKeyFile the client certificate given to linkerd
+	LinkerdTLSCertFile string
+	LinkerdTLSKeyFile  string
+	// LinkerdTLSServerName the name linkerd's certificate is verified for (its host if "")
+	LinkerdTLSServerName string
+	// MigrateOnStart applies pending migrations at startup (otherwise they
+	// are only applied by the migrate command)
+	MigrateOnStart bool
+	// MongoURI the mongodb:// URI of the database servers with the
+	// credentials, auth source and mechanism, replica set name, tls and read
+	// preference (see models.ParseMongoURI). "" connects to the in cluster
+	// replica set.
+	MongoURI string
+	// MongoPassword overrides the password in MongoURI (only from the
+	// environment or a secret file)
+	MongoPassword string
+	// DBStartupTimeout how long startup retries connecting to the database
+	// (mongo or postgres) before giving up (0 retries forever). The service is
+	// not ready until then.
+	DBStartupTimeout time.Duration
+	// PostgresURI the postgres:// URI of the database with the credentials
+	// and sslmode (see models.ParsePostgresURI), used by the postgres storage
+	// backend
+	PostgresURI string
+}
+
+// Default returns the Config used when nothing is configured
+// (heartbeats every 30 secs and agents available for one minute after a heartbeat)
+func Default() Config {
+	return Config{
+		StalenessWindow:        DefaultStalenessWindow,
+		GracePeriod:            DefaultGracePeriod,
+		HeartBeatInterval:      DefaultHeartBeatInterval,
+		HeartBeatFlushInterval: DefaultHeartBeatFlushInterval,
+		ReaperInterval:         DefaultReaperInterval,
+		PhoneSessionTTL:        DefaultPhoneSessionTTL,
+		TaskArchiveAfter:       DefaultTaskArchiveAfter,
+		RoutingStrategy:        DefaultRoutingStrategy,
+		TLSReloadInterval:      DefaultTLSReloadInterval,
+		MigrateOnStart:         true,
+		DBStartupTimeout:       DefaultDBStartupTimeout,
+	}
+}
+
+// AvailableSince returns the oldest heartbeat an available agent can have at time now
+func (c Config) AvailableSince(now time.Time) time.Time {
+	return now.Add(-(c.StalenessWindow + c.GracePeriod))
+}
+
+// Validate checks the durations make sense together
+func (c Config) Validate() error {
+	if c.StalenessWindow <= 0 {
+		return errors.New("staleness window must be positive")
+	}
+	if c.GracePeriod < 0 {
+		return errors.New("grace period must not be negative")
+	}
+	if c.HeartBeatInterval <= 0 {
+		return errors.New("heartbeat interval must be positive")
+	}
+	// Otherwise agents that heartbeat on time would flap between available and not
+	if c.HeartBeatInterval >= c.StalenessWindow {
+		return fmt.Errorf("heartbeat interval (%v) must be shorter than the staleness window (%v)", c.HeartBeatInterval, c.StalenessWindow)
+	}
+	if c.HeartBeatFlushInterval < 0 {
+		return errors.New("heartbeat flush interval must not be negative")
+	}
+	// Otherwise the reaper would expire agents whose heartbeats are still buffered
+	if c.HeartBeatInterval+c.HeartBeatFlushInterval >= c.StalenessWindow+c.GracePeriod {
+		return fmt.Errorf("heartbeat interval (%v) plus flush interval (%v) must be shorter than the staleness window (%v)", c.HeartBeatInterval, c.HeartBeatFlushInterval, c.StalenessWindow+c.GracePeriod)
+	}
+	if c.ReaperInterval < 0 {
+		return errors.New("reaper interval must not be negative")
+	}
+	if c.PhoneSessionTTL <= 0 {
+		return errors.New("phone session ttl must be positive")
+	}
+	if c.TaskArchiveAfter <= 0 {
+		return errors.New("task archive after must be positive")
+	}
+	if !ValidRoutingStrategy(c.RoutingStrategy) {
+		return fmt.Errorf("unknown routing strategy %q (expected one of %v)", c.RoutingStrategy, RoutingStrategies)
+	}
+	for tenant, strategy := range c.TenantRoutingStrategies {
+		if !ValidRoutingStrategy(strategy) {
+			return fmt.Errorf("unknown routing strategy %q for tenant %s (expected one of %v)", strategy, tenant, RoutingStrategies)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, id := range c.Tenants {
+		if !tenant.Valid(id) {
+			return fmt.Errorf("invalid tenant ID %q (lower case letters, digits, '-' and '_', at most 32 characters)", id)
+		}
+		if seen[id] {
+			return fmt.Errorf("tenant %s is listed twice", id)
+		}
+		seen[id] = true
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return errors.New("tls cert file and tls key file must be set together")
+	}
+	if c.TLSClientCAFile != "" && c.TLSCertFile == "" {
+		return errors.New("tls client ca file needs a tls cert file and key file")
+	}
+	if c.TLSReloadInterval < 0 {
+		return errors.New("tls reload interval must not be negative")
+	}
+	if c.DBStartupTimeout < 0 {
+		return errors.New("db startup timeout must not be negative")
+	}
+	if (c.DebugTLSCertFile == "") != (c.DebugTLSKeyFile == "") {
+		return errors.New("debug tls cert file and debug tls key file must be set together")
+	}
+	if c.DebugTLSClientCAFile != "" && c.DebugTLSCertFile == "" {
+		return errors.New("debug tls client ca file needs a debug tls cert file and key file")
+	}
+	if (c.LinkerdTLSCertFile == "") != (c.LinkerdTLSKeyFile == "") {
+		return errors.New("linkerd tls cert file and linkerd tls key file must be set together")
+	}
+	for subject, roles := range c.AuthRoles {
+		for _, role := range roles {
+			if !auth.ValidRole(role) {
+				return fmt.Errorf("unknown role %q for %s (expected one of %v)", role, subject, auth.Roles)
+			}
+		}
+	}
+	return nil
+}
+
+// AuthEnabled returns whether callers must authenticate (with a bearer token
+// or a client certificate)
+func (c Config) AuthEnabled() bool {
+	return c.AuthHMACSecret != "" || c.AuthJWKSFile != "" || c.TLSClientCAFile != ""
+}
+
+// LinkerdTLS returns whether linkerd is dialled with TLS
+func (c Config) LinkerdTLS() bool {
+	return c.LinkerdTLSCAFile != "" || c.LinkerdTLSCertFile != ""
+}
+
+// HasTenant returns whether the service serves tenant id
+func (c Config) HasTenant(id string) bool {
+	for _, t := range c.Tenants {
+		if t == id {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits a comma separated list (ignoring spaces and empty items)
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// fileConfig is the config file format (durations as strings e.g. "1m30s")
+type fileConfig struct {
+	StalenessWindow   string `json:"staleness_window"`
+	GracePeriod       string `json:"grace_period"`
+	HeartBeatInterval string `json:"heartbeat_interval"`
+	HeartBeatFlush    string `json:"heartbeat_flush_interval"`
+	ReaperInterval    string `json:"reaper_interval"`
+	PhoneSessionTTL   string `json:"phonesession_ttl"`
+	TaskArchiveAfter  string `json:"task_archive_after"`
+	ReaperDryRun      *bool  `json:"reaper_dry_run"`
+	RoutingStrategy   string `json:"routing_strategy"`
+	RoutingSeed       *int64 `json:"routing_seed"`
+	// TenantRoutingStrategies e.g. {"acme": "round-robin"}
+	TenantRoutingStrategies map[string]string `json:"tenant_routing_strategies"`
+	Tenants                 []string          `json:"tenants"`
+	AuthJWKSFile            string            `json:"auth_jwks_file"`
+	AuthIssuer              string            `json:"auth_issuer"`
+	AuthAudience            string            `json:"auth_audience"`
+	// AuthRoles e.g. {"dispatch-svc": ["dispatcher"]}
+	AuthRoles            map[string][]string `json:"auth_roles"`
+	TLSCertFile          string              `json:"tls_cert_file"`
+	TLSKeyFile           string              `json:"tls_key_file"`
+	TLSClientCAFile      string              `json:"tls_client_ca_file"`
+	TLSReloadInterval    string              `json:"tls_reload_interval"`
+	DebugTLSCertFile     string              `json:"debug_tls_cert_file"`
+	DebugTLSKeyFile      string              `json:"debug_tls_key_file"`
+	DebugTLSClientCAFile string              `json:"debug_tls_client_ca_file"`
+	LinkerdTLSCAFile     string              `json:"linkerd_tls_ca_file"`
+	LinkerdTLSCertFile   string              `json:"linkerd_tls_cert_file"`
+	LinkerdTLSKeyFile    string              `json:"linkerd_tls_key_file"`
+	LinkerdTLSServerName string              `json:"linkerd_tls_server_name"`
+	MigrateOnStart       *bool               `json:"migrate_on_start"`
+	MongoURI             string              `json:"mongo_uri"`
+	DBStartupTimeout     string              `json:"db_startup_timeout"`
+	PostgresURI          string              `json:"postgres_uri"`
+}
+
+// stringSetting is a Config string with its config file value and env name
+type stringSetting struct {
+	field *string
+	file  string
+	env   string
+}
+
+func (c *Config) stringSettings(file fileConfig) []stringSetting {
+	return []stringSetting{
+		{&c.AuthJWKSFile, file.AuthJWKSFile, EnvAuthJWKSFile},
+		{&c.AuthIssuer, file.AuthIssuer, EnvAuthIssuer},
+		{&c.AuthAudience, file.AuthAudience, EnvAuthAudience},
+		{&c.TLSCertFile, file.TLSCertFile, EnvTLSCertFile},
+		{&c.TLSKeyFile, file.TLSKeyFile, EnvTLSKeyFile},
+		{&c.TLSClientCAFile, file.TLSClientCAFile, EnvTLSClientCAFile},
+		{&c.DebugTLSCertFile, file.DebugTLSCertFile, EnvDebugTLSCertFile},
+		{&c.DebugTLSKeyFile, file.DebugTLSKeyFile, EnvDebugTLSKeyFile},
+		{&c.DebugTLSClientCAFile, file.DebugTLSClientCAFile, EnvDebugTLSClientCA},
+		{&c.LinkerdTLSCAFile, file.LinkerdTLSCAFile, EnvLinkerdTLSCAFile},
+		{&c.LinkerdTLSCertFile, file.LinkerdTLSCertFile, EnvLinkerdTLSCert},
+		{&c.LinkerdTLSKeyFile, file.LinkerdTLSKeyFile, EnvLinkerdTLSKey},
+		{&c.LinkerdTLSServerName, file.LinkerdTLSServerName, EnvLinkerdTLSServer},
+	}
+}
+
+// secretSetting is a Config secret with its env name. It is read from the file
+// named by env+EnvFileSuffix if that is set instead.
+type secretSetting struct {
+	field *string
+	env   string
+}
+
+func (c *Config) secretSettings() []secretSetting {
+	return []secretSetting{
+		{&c.AuthHMACSecret, EnvAuthHMACSecret},
+		{&c.MongoURI, EnvMongoURI},
+		{&c.MongoPassword, EnvMongoPassword},
+		{&c.PostgresURI, EnvPostgresURI},
+	}
+}
+
+// durationSetting is a Config duration with its config file value and env name
+type durationSetting struct {
+	field *time.Duration
+	file  string
+	env   string
+}
+
+func (c *Config) settings(file fileConfig) []durationSetting {
+	return []durationSetting{
+		{&c.StalenessWindow, file.StalenessWindow, EnvStalenessWindow},
+		{&c.GracePeriod, file.GracePeriod, EnvGracePeriod},
+		{&c.HeartBeatInterval, file.HeartBeatInterval, EnvHeartBeatInterval},
+		{&c.HeartBeatFlushInterval, file.HeartBeatFlush, EnvHeartBeatFlush},
+		{&c.ReaperInterval, file.ReaperInterval, EnvReaperInterval},
+		{&c.PhoneSessionTTL, file.PhoneSessionTTL, EnvPhoneSessionTTL},
+		{&c.TaskArchiveAfter, file.TaskArchiveAfter, EnvTaskArchiveAfter},
+		{&c.TLSReloadInterval, file.TLSReloadInterval, EnvTLSReloadInterval},
+		{&c.DBStartupTimeout, file.DBStartupTimeout, EnvDBStartup},
+	}
+}
+
+// LoadFile overrides c with the durations set in the JSON config file at path
+func (c *Config) LoadFile(path string) error {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var file fileConfig
+	if err = json.Unmarshal(src, &file); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+
+	for _, s := range c.settings(file) {
+		if s.file == "" {
+			continue
+		}
+		if *s.field, err = time.ParseDuration(s.file); err != nil {
+			return fmt.Errorf("failed to parse config file %s: %v", path, err)
+		}
+	}
+	if file.ReaperDryRun != nil {
+		c.ReaperDryRun = *file.ReaperDryRun
+	}
+	if file.RoutingStrategy != "" {
+		c.RoutingStrategy = file.RoutingStrategy
+	}
+	if file.RoutingSeed != nil {
+		c.RoutingSeed = *file.RoutingSeed
+	}
+	if file.TenantRoutingStrategies != nil {
+		c.TenantRoutingStrategies = file.TenantRoutingStrategies
+	}
+	if file.Tenants != nil {
+		c.Tenants = file.Tenants
+	}
+	for _, s := range c.stringSettings(file) {
+		if s.file != "" {
+			*s.field = s.file
+		}
+	}
+	if file.AuthRoles != nil {
+		c.AuthRoles = file.AuthRoles
+	}
+	if file.MigrateOnStart != nil {
+		c.MigrateOnStart = *file.MigrateOnStart
+	}
+	if file.MongoURI != "" {
+		c.MongoURI = file.MongoURI
+	}
+	if file.PostgresURI != "" {
+		c.PostgresURI = file.PostgresURI
+	}
+	return nil
+}
+
+// LoadEnv overrides c with the settings in the environment (getenv is usually os.Getenv)
+func (c *Config) LoadEnv(getenv func(string) string) error {
+	var err error
+	for _, s := range c.settings(fileConfig{}) {
+		value := getenv(s.env)
+		if value == "" {
+			continue
+		}
+		if *s.field, err = time.ParseDuration(value); err != nil {
+			return fmt.Errorf("failed to parse %s: %v", s.env, err)
+		}
+	}
+	if value := getenv(EnvReaperDryRun); value != "" {
+		if c.ReaperDryRun, err = strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("failed to parse %s: %v", EnvReaperDryRun, err)
+		}
+	}
+	if value := getenv(EnvRoutingStrategy); value != "" {
+		c.RoutingStrategy = value
+	}
+	if value := getenv(EnvRoutingSeed); value != "" {
+		if c.RoutingSeed, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return fmt.Errorf("failed to parse %s: %v", EnvRoutingSeed, err)
+		}
+	}
+	if value := getenv(EnvTenants); value != "" {
+		c.Tenants = splitList(value)
+	}
+	for _, s := range c.stringSettings(fileConfig{}) {
+		if value := getenv(s.env); value != "" {
+			*s.field = value
+		}
+	}
+	for _, s := range c.secretSettings() {
+		value, path := getenv(s.env), getenv(s.env+EnvFileSuffix)
+		if value != "" && path != "" {
+			return fmt.Errorf("only one of %s and %s may be set", s.env, s.env+EnvFileSuffix)
+		}
+		if path != "" {
+			src, err := ioutil.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %v", s.env+EnvFileSuffix, err)
+			}
+			// Secret files usually end with a newline
+			value = strings.TrimRight(string(src), "\r\n")
+		}
+		if value != "" {
+			*s.field = value
+		}
+	}
+	if value := getenv(EnvMigrateOnStart); value != "" {
+		if c.MigrateOnStart, err = strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("failed to parse %s: %v", EnvMigrateOnStart, err)
+		}
+	}
+	return nil
+}
+
+// Flags are the command line flags that override the Config
+type Flags struct {
+	fs                *flag.FlagSet
+	File              *string
+	stalenessWindow   *time.Duration
+	gracePeriod       *time.Duration
+	heartBeatInterval *time.Duration
+	heartBeatFlush    *time.Duration
+	reaperInterval    *time.Duration
+	phoneSessionTTL   *time.Duration
+	taskArchiveAfter  *time.Duration
+	reaperDryRun      *bool
+	routingStrategy   *string
+	routingSeed       *int64
+	tenants           *string
+	authJWKSFile      *string
+	authIssuer        *string
+	authAudience      *string
+	tlsCertFile       *string
+	tlsKeyFile        *string
+	tlsClientCAFile   *string
+	tlsReloadInterval *time.Duration
+	debugTLSCertFile  *string
+	debugTLSKeyFile   *string
+	debugTLSClientCA  *string
+	linkerdTLSCAFile  *string
+	linkerdTLSCert    *string
+	linkerdTLSKey     *string
+	linkerdTLSServer  *string
+	migrateOnStart    *bool
+	mongoURI          *string
+	dbStartup         *time.Duration
+	postgresURI       *string
+}
+
+// RegisterFlags registers the config flags on fs (call Load after fs is parsed)
+func RegisterFlags(fs *flag.FlagSet) *Flags {
+	return &Flags{
+		fs:                fs,
+		File:              fs.String("config", "", "JSON config file (env: "+EnvConfigFile+")"),
+		stalenessWindow:   fs.Duration("agent.staleness-window", DefaultStalenessWindow, "Agents whose last heartbeat is older than this are not available (env: "+EnvStalenessWindow+")"),
+		gracePeriod:       fs.Duration("agent.grace-period", DefaultGracePeriod, "Extra time allowed for late heartbeats (env: "+EnvGracePeriod+")"),
+		heartBeatInterval: fs.Duration("heartbeat.interval", DefaultHeartBeatInterval, "How often clients should send a heartbeat (env: "+EnvHeartBeatInterval+")"),
+		heartBeatFlush:    fs.Duration("heartbeat.flush-interval", DefaultHeartBeatFlushInterval, "How often buffered heartbeats are written to the database, 0 writes them straight away (env: "+EnvHeartBeatFlush+")"),
+		reaperInterval:    fs.Duration("reaper.interval", DefaultReaperInterval, "How often the reaper cleans up the database, 0 disables it (env: "+EnvReaperInterval+")"),
+		phoneSessionTTL:   fs.Duration("reaper.phonesession-ttl", DefaultPhoneSessionTTL, "Phone sessions older than this are deleted (env: "+EnvPhoneSessionTTL+")"),
+		taskArchiveAfter:  fs.Duration("reaper.task-archive-after", DefaultTaskArchiveAfter, "Completed tasks older than this are archived (env: "+EnvTaskArchiveAfter+")"),
+		reaperDryRun:      fs.Bool("reaper.dry-run", false, "Only count what the reaper would change (env: "+EnvReaperDryRun+")"),
+		routingStrategy:   fs.String("routing.strategy", DefaultRoutingStrategy, "Default routing strategy for available agents (env: "+EnvRoutingStrategy+")"),
+		routingSeed:       fs.Int64("routing.seed", 0, "Seed for the random routing strategy, 0 seeds from the clock (env: "+EnvRoutingSeed+")"),
+		tenants:           fs.String("tenants", "", "Comma separated tenant IDs, each with its own database, empty serves a single tenant (env: "+EnvTenants+")"),
+		authJWKSFile:      fs.String("auth.jwks-file", "", "JSON Web Key Set file verifying RSA/ECDSA signed bearer tokens (env: "+EnvAuthJWKSFile+")"),
+		authIssuer:        fs.String("auth.issuer", "", "Issuer (iss) bearer tokens must have (env: "+EnvAuthIssuer+")"),
+		authAudience:      fs.String("auth.audience", "", "Audience (aud) bearer tokens must have (env: "+EnvAuthAudience+")"),
+		tlsCertFile:       fs.String("tls.cert-file", "", "Server certificate file, empty serves plaintext (env: "+EnvTLSCertFile+")"),
+		tlsKeyFile:        fs.String("tls.key-file", "", "Server private key file (env: "+EnvTLSKeyFile+")"),
+		tlsClientCAFile:   fs.String("tls.client-ca-file", "", "CA file verifying client certificates, which then authenticate callers (env: "+EnvTLSClientCAFile+")"),
+		tlsReloadInterval: fs.Duration("tls.reload-interval", DefaultTLSReloadInterval, "How often changed certificate files are reloaded, 0 only loads them at startup (env: "+EnvTLSReloadInterval+")"),
+		debugTLSCertFile:  fs.String("debug.tls.cert-file", "", "Debug/metrics HTTP server certificate file, empty serves plaintext (env: "+EnvDebugTLSCertFile+")"),
+		debugTLSKeyFile:   fs.String("debug.tls.key-file", "", "Debug/metrics HTTP server private key file (env: "+EnvDebugTLSKeyFile+")"),
+		debugTLSClientCA:  fs.String("debug.tls.client-ca-file", "", "CA file verifying the certificates /debug/pprof clients must have (env: "+EnvDebugTLSClientCA+")"),
+		linkerdTLSCAFile:  fs.String("linkerd.tls.ca-file", "", "CA file verifying linkerd's certificate, dials linkerd with TLS (env: "+EnvLinkerdTLSCAFile+")"),
+		linkerdTLSCert:    fs.String("linkerd.tls.cert-file", "", "Client certificate file given to linkerd, dials linkerd with TLS (env: "+EnvLinkerdTLSCert+")"),
+		linkerdTLSKey:     fs.String("linkerd.tls.key-file", "", "Client private key file given to linkerd (env: "+EnvLinkerdTLSKey+")"),
+		linkerdTLSServer:  fs.String("linkerd.tls.server-name", "", "Name linkerd's certificate is verified for, empty uses its host (env: "+EnvLinkerdTLSServer+")"),
+		migrateOnStart:    fs.Bool("migrate.on-start", true, "Apply pending database migrations at startup (env: "+EnvMigrateOnStart+")"),
+		dbStartup:         fs.Duration("db.startup-timeout", DefaultDBStartupTimeout, "How long startup retries connecting to the database, 0 retries forever (env: "+EnvDBStartup+")"),
+		mongoURI:          fs.String("mongo.uri", "", "mongodb:// URI of the database servers, empty connects to the in cluster replica set (env: "+EnvMongoURI+" or "+EnvMongoURI+EnvFileSuffix+")"),
+		postgresURI:       fs.String("postgres.uri", "", "postgres:// URI of the database of the postgres storage backend (env: "+EnvPostgresURI+" or "+EnvPostgresURI+EnvFileSuffix+")"),
+	}
+}
+
+// Load returns the validated Config from defaults, the config file, the
+// environment and then any flags set on the command line
+func (f *Flags) Load(getenv func(string) string) (Config, error) {
+	cfg := Default()
+
+	path := *f.File
+	if path == "" {
+		path = getenv(EnvConfigFile)
+	}
+	if path != "" {
+		if err := cfg.LoadFile(path); err != nil {
+			return cfg, err
+		}
+	}
+
+	if err := cfg.LoadEnv(getenv); err != nil {
+		return cfg, err
+	}
+
+	// Only flags explicitly set override (defaults would clobber the file/env)
+	f.fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "agent.staleness-window":
+			cfg.StalenessWindow = *f.stalenessWindow
+		case "agent.grace-period":
+			cfg.GracePeriod = *f.gracePeriod
+		case "heartbeat.interval":
+			cfg.HeartBeatInterval = *f.heartBeatInterval
+		case "heartbeat.flush-interval":
+			cfg.HeartBeatFlushInterval = *f.heartBeatFlush
+		case "reaper.interval":
+			cfg.ReaperInterval = *f.reaperInterval
+		case "reaper.phonesession-ttl":
+			cfg.PhoneSessionTTL = *f.phoneSessionTTL
+		case "reaper.task-archive-after":
+			cfg.TaskArchiveAfter = *f.taskArchiveAfter
+		case "reaper.dry-run":
+			cfg.ReaperDryRun = *f.reaperDryRun
+		case "routing.strategy":
+			cfg.RoutingStrategy = *f.routingStrategy
+		case "routing.seed":
+			cfg.RoutingSeed = *f.routingSeed
+		case "tenants":
+			cfg.Tenants = splitList(*f.tenants)
+		case "auth.jwks-file":
+			cfg.AuthJWKSFile = *f.authJWKSFile
+		case "auth.issuer":
+			cfg.AuthIssuer = *f.authIssuer
+		case "auth.audience":
+			cfg.AuthAudience = *f.authAudience
+		case "tls.cert-file":
+			cfg.TLSCertFile = *f.tlsCertFile
+		case "tls.key-file":
+			cfg.TLSKeyFile = *f.tlsKeyFile
+		case "tls.client-ca-file":
+			cfg.TLSClientCAFile = *f.tlsClientCAFile
+		case "tls.reload-interval":
+			cfg.TLSReloadInterval = *f.tlsReloadInterval
+		case "debug.tls.cert-file":
+			cfg.DebugTLSCertFile = *f.debugTLSCertFile
+		case "debug.tls.key-file":
+			cfg.DebugTLSKeyFile = *f.debugTLSKeyFile
+		case "debug.tls.client-ca-file":
+			cfg.DebugTLSClientCAFile = *f.debugTLSClientCA
+		case "linkerd.tls.ca-file":
+			cfg.LinkerdTLSCAFile = *f.linkerdTLSCAFile
+		case "linkerd.tls.cert-file":
+			cfg.LinkerdTLSCertFile = *f.linkerdTLSCert
+		case "linkerd.tls.key-file":
+			cfg.LinkerdTLSKeyFile = *f.linkerdTLSKey
+		case "linkerd.tls.server-name":
+			cfg.LinkerdTLSServerName = *f.linkerdTLSServer
+		case "migrate.on-start":
+			cfg.MigrateOnStart = *f.migrateOnStart
+		case "mongo.uri":
+			cfg.MongoURI = *f.mongoURI
+		case "db.startup-timeout":
+			cfg.DBStartupTimeout = *f.dbStartup
+		case "postgres.uri":
+			cfg.PostgresURI = *f.postgresURI
+		}
+	})
+
+	return cfg, cfg.Validate()
+}
@@ -8,6 +8,8 @@ import (
 	"github.com/go-kit/kit/endpoint"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/metrics"
+
+	"github.com/newtonsystems/agent-mgmt/app/service"
 )
 
 // InstrumentingMiddleware returns an endpoint middleware that records
@@ -34,23 +36,10 @@ func LoggingMiddleware(logger log.Logger) endpoint.Middleware {
 		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 
 			defer func(begin time.Time) {
-				logger.Log("transport_error", err, "took", time.Since(begin))
+				service.ContextLogger(ctx, logger).Log("transport_error", err, "took", time.Since(begin))
 			}(time.Now())
 			return next(ctx, request)
 
 		}
 	}
 }
-
-// func authMiddleware(logger log.Logger) endpoint.Middleware {
-// 	return func(next endpoint.Endpoint) endpoint.Endpoint {
-// 		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
-//
-// 			defer func(begin time.Time) {
-// 				logger.Log("transport_error", err, "took", time.Since(begin))
-// 			}(time.Now())
-// 			return next(ctx, request)
-//
-// 		}
-// 	}
-// }
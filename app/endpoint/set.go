@@ -2,6 +2,7 @@ package endpoint
 
 import (
 	"context"
+	"time"
 
 	stdopentracing "github.com/opentracing/opentracing-go"
 
@@ -9,8 +10,10 @@ import (
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/metrics"
 
+	"github.com/newtonsystems/agent-mgmt/app/heartbeat"
 	"github.com/newtonsystems/agent-mgmt/app/models"
 	"github.com/newtonsystems/agent-mgmt/app/service"
+	"github.com/newtonsystems/agent-mgmt/app/watch"
 	"github.com/newtonsystems/grpc_types/go/grpc_types"
 )
 
@@ -26,11 +29,26 @@ type Set struct {
 	GetAgentIDFromRefEndpoint  endpoint.Endpoint
 	HeartBeatEndpoint          endpoint.Endpoint
 	AddTaskEndpoint            endpoint.Endpoint
+	OfferTaskEndpoint          endpoint.Endpoint
+	AcceptCallEndpoint         endpoint.Endpoint
+	StartTaskEndpoint          endpoint.Endpoint
+	CompleteTaskEndpoint       endpoint.Endpoint
+	SetAgentStateEndpoint      endpoint.Endpoint
+	SetAgentSkillsEndpoint     endpoint.Endpoint
+	GetTaskEndpoint            endpoint.Endpoint
+	ListTasksEndpoint          endpoint.Endpoint
+	CancelTaskEndpoint         endpoint.Endpoint
+	RegisterAgentEndpoint      endpoint.Endpoint
+	DeregisterAgentEndpoint    endpoint.Endpoint
+	// WatchAgents is server-streaming so it is not a go-kit endpoint
+	WatchAgents WatchAgentsFunc
+	// HeartBeatStream is bidirectional streaming so it is not a go-kit endpoint
+	HeartBeatStream HeartBeatStreamFuncs
 }
 
 // New returns a Set that wraps the provided server, and wires in all of the
 // expected endpoint middlewares via the various parameters.
-func NewEndpoint(svc service.Service, logger log.Logger, duration metrics.Histogram, trace stdopentracing.Tracer, session models.Session, db string) Set {
+func NewEndpoint(svc service.Service, logger log.Logger, duration metrics.Histogram, trace stdopentracing.Tracer) Set {
 	// var sumEndpoint endpoint.Endpoint
 	// {
 	// 	sumEndpoint = MakeSumEndpoint(svc)
@@ -51,7 +69,7 @@ func NewEndpoint(svc service.Service, logger log.Logger, duration metrics.Histog
 	// }
 	var getAvailableAgentsEndpoint endpoint.Endpoint
 	{
-		getAvailableAgentsEndpoint = MakeGetAvailableAgentsEndpoint(svc, session, db)
+		getAvailableAgentsEndpoint = MakeGetAvailableAgentsEndpoint(svc)
 		//getAvailableAgentsEndpoint = ratelimit.NewTokenBucketLimiter(rl.NewBucketWithRate(100, 100))(getAvailableAgentsEndpoint)
 		//getAvailableAgentsEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{}))(getAvailableAgentsEndpoint)
 		//getAvailableAgentsEndpoint = opentracing.TraceServer(trace, "GetAvailableAgents")(getAvailableAgentsEndpoint)
@@ -62,7 +80,7 @@ func NewEndpoint(svc service.Service, logger log.Logger, duration metrics.Histog
 	}
 	var getAgentIDFromRefEndpoint endpoint.Endpoint
 	{
-		getAgentIDFromRefEndpoint = MakeGetAgentIDFromRefEndpoint(svc, session, db)
+		getAgentIDFromRefEndpoint = MakeGetAgentIDFromRefEndpoint(svc)
 		//getAgentIDFromRefEndpoint = ratelimit.NewTokenBucketLimiter(rl.NewBucketWithRate(100, 100))(getAgentIDFromRefEndpoint)
 		//getAgentIDFromRefEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{}))(getAgentIDFromRefEndpoint)
 		//getAgentIDFromRefEndpoint = opentracing.TraceServer(trace, "GetAgentIDFromRef")(getAgentIDFromRefEndpoint)
@@ -73,7 +91,7 @@ func NewEndpoint(svc service.Service, logger log.Logger, duration metrics.Histog
 	}
 	var heartBeatEndpoint endpoint.Endpoint
 	{
-		heartBeatEndpoint = MakeHeartBeatEndpoint(svc, session, db)
+		heartBeatEndpoint = MakeHeartBeatEndpoint(svc)
 		//heartBeatEndpoint = ratelimit.NewTokenBucketLimiter(rl.NewBucketWithRate(100, 100))(heartBeatEndpoint)
 		//heartBeatEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{}))(heartBeatEndpoint)
 		//heartBeatEndpoint = opentracing.TraceServer(trace, "GetAgentIDFromRef")(heartBeatEndpoint)
@@ -84,7 +102,7 @@ func NewEndpoint(svc service.Service, logger log.Logger, duration metrics.Histog
 	}
 	var addTaskEndpoint endpoint.Endpoint
 	{
-		addTaskEndpoint = MakeAddTaskEndpoint(svc, session, db)
+		addTaskEndpoint = MakeAddTaskEndpoint(svc)
 		//addTaskEndpoint = ratelimit.NewTokenBucketLimiter(rl.NewBucketWithRate(100, 100))(addTaskEndpoint)
 		//addTaskEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{}))(addTaskEndpoint)
 		//addTaskEndpoint = opentracing.TraceServer(trace, "GetAgentIDFromRef")(addTaskEndpoint)
@@ -93,6 +111,83 @@ func NewEndpoint(svc service.Service, logger log.Logger, duration metrics.Histog
 		}
 		//getAgentIDFromRefEndpoint = InstrumentingMiddleware(duration.With("method", "GetAgentIDFromRef"))(getAgentIDFromRefEndpoint)
 	}
+	var offerTaskEndpoint endpoint.Endpoint
+	{
+		offerTaskEndpoint = MakeOfferTaskEndpoint(svc)
+		if logger != nil {
+			offerTaskEndpoint = LoggingMiddleware(log.With(logger, "method", "OfferTask"))(offerTaskEndpoint)
+		}
+	}
+	var acceptCallEndpoint endpoint.Endpoint
+	{
+		acceptCallEndpoint = MakeAcceptCallEndpoint(svc)
+		if logger != nil {
+			acceptCallEndpoint = LoggingMiddleware(log.With(logger, "method", "AcceptCall"))(acceptCallEndpoint)
+		}
+	}
+	var startTaskEndpoint endpoint.Endpoint
+	{
+		startTaskEndpoint = MakeStartTaskEndpoint(svc)
+		if logger != nil {
+			startTaskEndpoint = LoggingMiddleware(log.With(logger, "method", "StartTask"))(startTaskEndpoint)
+		}
+	}
+	var completeTaskEndpoint endpoint.Endpoint
+	{
+		completeTaskEndpoint = MakeCompleteTaskEndpoint(svc)
+		if logger != nil {
+			completeTaskEndpoint = LoggingMiddleware(log.With(logger, "method", "CompleteTask"))(completeTaskEndpoint)
+		}
+	}
+	var setAgentStateEndpoint endpoint.Endpoint
+	{
+		setAgentStateEndpoint = MakeSetAgentStateEndpoint(svc)
+		if logger != nil {
+			setAgentStateEndpoint = LoggingMiddleware(log.With(logger, "method", "SetAgentState"))(setAgentStateEndpoint)
+		}
+	}
+	var setAgentSkillsEndpoint endpoint.Endpoint
+	{
+		setAgentSkillsEndpoint = MakeSetAgentSkillsEndpoint(svc)
+		if logger != nil {
+			setAgentSkillsEndpoint = LoggingMiddleware(log.With(logger, "method", "SetAgentSkills"))(setAgentSkillsEndpoint)
+		}
+	}
+	var getTaskEndpoint endpoint.Endpoint
+	{
+		getTaskEndpoint = MakeGetTaskEndpoint(svc)
+		if logger != nil {
+			getTaskEndpoint = LoggingMiddleware(log.With(logger, "method", "GetTask"))(getTaskEndpoint)
+		}
+	}
+	var listTasksEndpoint endpoint.Endpoint
+	{
+		listTasksEndpoint = MakeListTasksEndpoint(svc)
+		if logger != nil {
+			listTasksEndpoint = LoggingMiddleware(log.With(logger, "method", "ListTasks"))(listTasksEndpoint)
+		}
+	}
+	var cancelTaskEndpoint endpoint.Endpoint
+	{
+		cancelTaskEndpoint = MakeCancelTaskEndpoint(svc)
+		if logger != nil {
+			cancelTaskEndpoint = LoggingMiddleware(log.With(logger, "method", "CancelTask"))(cancelTaskEndpoint)
+		}
+	}
+	var registerAgentEndpoint endpoint.Endpoint
+	{
+		registerAgentEndpoint = MakeRegisterAgentEndpoint(svc)
+		if logger != nil {
+			registerAgentEndpoint = LoggingMiddleware(log.With(logger, "method", "RegisterAgent"))(registerAgentEndpoint)
+		}
+	}
+	var deregisterAgentEndpoint endpoint.Endpoint
+	{
+		deregisterAgentEndpoint = MakeDeregisterAgentEndpoint(svc)
+		if logger != nil {
+			deregisterAgentEndpoint = LoggingMiddleware(log.With(logger, "method", "DeregisterAgent"))(deregisterAgentEndpoint)
+		}
+	}
 	return Set{
 		//SumEndpoint:                sumEndpoint,
 		//ConcatEndpoint:             concatEndpoint,
@@ -100,6 +195,19 @@ func NewEndpoint(svc service.Service, logger log.Logger, duration metrics.Histog
 		GetAgentIDFromRefEndpoint:  getAgentIDFromRefEndpoint,
 		HeartBeatEndpoint:          heartBeatEndpoint,
 		AddTaskEndpoint:            addTaskEndpoint,
+		OfferTaskEndpoint:          offerTaskEndpoint,
+		AcceptCallEndpoint:         acceptCallEndpoint,
+		StartTaskEndpoint:          startTaskEndpoint,
+		CompleteTaskEndpoint:       completeTaskEndpoint,
+		SetAgentStateEndpoint:      setAgentStateEndpoint,
+		SetAgentSkillsEndpoint:     setAgentSkillsEndpoint,
+		GetTaskEndpoint:            getTaskEndpoint,
+		ListTasksEndpoint:          listTasksEndpoint,
+		CancelTaskEndpoint:         cancelTaskEndpoint,
+		RegisterAgentEndpoint:      registerAgentEndpoint,
+		DeregisterAgentEndpoint:    deregisterAgentEndpoint,
+		WatchAgents:                MakeWatchAgentsFunc(svc),
+		HeartBeatStream:            MakeHeartBeatStreamFuncs(svc),
 	}
 }
 
@@ -146,41 +254,176 @@ func MakeConcatEndpoint(s service.Service) endpoint.Endpoint {
 }
 
 // MakeGetAvailableAgentsEndpoint constructs a GetAvailableAgents endpoint wrapping the service.
-func MakeGetAvailableAgentsEndpoint(s service.Service, session models.Session, db string) endpoint.Endpoint {
+func MakeGetAvailableAgentsEndpoint(s service.Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 		req := request.(GetAvailableAgentsRequest)
-		v, err := s.GetAvailableAgents(ctx, session, db, req.Limit)
+		v, err := s.GetAvailableAgents(ctx, req.Limit, req.Strategy, req.Skills)
 		return GetAvailableAgentsResponse{AgentIds: v, Err: err}, service.WrapError(ctx, err)
 	}
 }
 
 // MakeGetAgentIDFromRefEndpoint constructs a GetAgentIDFromRef endpoint wrapping the service.
-func MakeGetAgentIDFromRefEndpoint(s service.Service, session models.Session, db string) endpoint.Endpoint {
+func MakeGetAgentIDFromRefEndpoint(s service.Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 		req := request.(GetAgentIDFromRefRequest)
-		v, err := s.GetAgentIDFromRef(session, db, req.RefId)
+		v, err := s.GetAgentIDFromRef(ctx, req.RefId)
 		return GetAgentIDFromRefResponse{AgentId: v, Err: err}, service.WrapError(ctx, err)
 	}
 }
 
-// MakeHeartBeatEndpoint constructs a GetAgentIDFromRef endpoint wrapping the service.
-func MakeHeartBeatEndpoint(s service.Service, session models.Session, db string) endpoint.Endpoint {
+// MakeHeartBeatEndpoint constructs a HeartBeat endpoint wrapping the service.
+func MakeHeartBeatEndpoint(s service.Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 		req := request.(HeartBeatRequest)
-		v, err := s.HeartBeat(session, db, req.AgentId)
-		return HeartBeatResponse{Status: v, Message: err}, nil
+		v, next, err := s.HeartBeat(ctx, req.AgentId)
+		return HeartBeatResponse{Status: v, NextHeartBeat: next, Message: err}, service.WrapError(ctx, err)
 	}
 }
 
 // MakeAddTaskEndpoint constructs a GetAgentIDFromRef endpoint wrapping the service.
-func MakeAddTaskEndpoint(s service.Service, session models.Session, db string) endpoint.Endpoint {
+func MakeAddTaskEndpoint(s service.Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 		req := request.(AddTaskRequest)
-		v, err := s.AddTask(session, db, req.CustId, req.AgentIds)
+		v, err := s.AddTask(ctx, req.CustId, req.AgentIds, req.RequiredSkills)
 		return AddTaskResponse{TaskId: v}, service.WrapError(ctx, err)
 	}
 }
 
+// MakeAcceptCallEndpoint constructs a AcceptCall endpoint wrapping the service.
+func MakeAcceptCallEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(AcceptCallRequest)
+		v, err := s.AcceptCall(ctx, req.AgentId, req.TaskId)
+		return AcceptCallResponse{TaskId: v.TaskID, CustId: v.CustID, Err: err}, service.WrapError(ctx, err)
+	}
+}
+
+// MakeOfferTaskEndpoint constructs a OfferTask endpoint wrapping the service.
+func MakeOfferTaskEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(OfferTaskRequest)
+		v, err := s.OfferTask(ctx, req.TaskId, req.AgentIds)
+		return OfferTaskResponse{TaskId: v.TaskID, Status: string(v.Status), Err: err}, service.WrapError(ctx, err)
+	}
+}
+
+// MakeStartTaskEndpoint constructs a StartTask endpoint wrapping the service.
+func MakeStartTaskEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(StartTaskRequest)
+		v, err := s.StartTask(ctx, req.AgentId, req.TaskId)
+		return StartTaskResponse{TaskId: v.TaskID, Status: string(v.Status), Err: err}, service.WrapError(ctx, err)
+	}
+}
+
+// MakeCompleteTaskEndpoint constructs a CompleteTask endpoint wrapping the service.
+func MakeCompleteTaskEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(CompleteTaskRequest)
+		v, err := s.CompleteTask(ctx, req.AgentId, req.TaskId)
+		return CompleteTaskResponse{TaskId: v.TaskID, Err: err}, service.WrapError(ctx, err)
+	}
+}
+
+// MakeSetAgentStateEndpoint constructs a SetAgentState endpoint wrapping the service.
+func MakeSetAgentStateEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(SetAgentStateRequest)
+		err = s.SetAgentState(ctx, req.AgentId, req.State)
+		return SetAgentStateResponse{Err: err}, service.WrapError(ctx, err)
+	}
+}
+
+// MakeSetAgentSkillsEndpoint constructs a SetAgentSkills endpoint wrapping the service.
+func MakeSetAgentSkillsEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(SetAgentSkillsRequest)
+		v, err := s.SetAgentSkills(ctx, req.AgentId, req.Skills)
+		return SetAgentSkillsResponse{AgentId: v.AgentID, Skills: v.Skills, Err: err}, service.WrapError(ctx, err)
+	}
+}
+
+// WatchAgentsFunc returns the available agents and a watcher of their changes
+// (the caller must Close the watcher)
+type WatchAgentsFunc func(ctx context.Context) ([]models.Agent, *watch.Watcher, error)
+
+// MakeWatchAgentsFunc constructs a WatchAgents func wrapping the service.
+func MakeWatchAgentsFunc(s service.Service) WatchAgentsFunc {
+	return func(ctx context.Context) ([]models.Agent, *watch.Watcher, error) {
+		agents, watcher, err := s.WatchAgents(ctx)
+		return agents, watcher, service.WrapError(ctx, err)
+	}
+}
+
+// HeartBeatStreamFuncs are the service calls of a heartbeat stream: Connect
+// when it opens, KeepAlive every heartbeat interval and Disconnect when it ends
+type HeartBeatStreamFuncs struct {
+	Connect    func(ctx context.Context, agentID int32) (*heartbeat.Conn, time.Duration, error)
+	KeepAlive  func(ctx context.Context, agentID int32, sinceLastBeat time.Duration) error
+	Disconnect func(ctx context.Context, conn *heartbeat.Conn) error
+}
+
+// MakeHeartBeatStreamFuncs constructs the HeartBeatStream funcs wrapping the service.
+func MakeHeartBeatStreamFuncs(s service.Service) HeartBeatStreamFuncs {
+	return HeartBeatStreamFuncs{
+		Connect: func(ctx context.Context, agentID int32) (*heartbeat.Conn, time.Duration, error) {
+			conn, next, err := s.ConnectAgent(ctx, agentID)
+			return conn, next, service.WrapError(ctx, err)
+		},
+		KeepAlive: func(ctx context.Context, agentID int32, sinceLastBeat time.Duration) error {
+			return service.WrapError(ctx, s.KeepAlive(ctx, agentID, sinceLastBeat))
+		},
+		Disconnect: func(ctx context.Context, conn *heartbeat.Conn) error {
+			return service.WrapError(ctx, s.DisconnectAgent(ctx, conn))
+		},
+	}
+}
+
+// MakeGetTaskEndpoint constructs a GetTask endpoint wrapping the service.
+func MakeGetTaskEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(GetTaskRequest)
+		v, err := s.GetTask(ctx, req.TaskId)
+		return GetTaskResponse{Task: v, Err: err}, service.WrapError(ctx, err)
+	}
+}
+
+// MakeListTasksEndpoint constructs a ListTasks endpoint wrapping the service.
+func MakeListTasksEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(ListTasksRequest)
+		v, err := s.ListTasks(ctx, req.CustId, req.AgentId, req.Status, req.Limit)
+		return ListTasksResponse{Tasks: v, Err: err}, service.WrapError(ctx, err)
+	}
+}
+
+// MakeCancelTaskEndpoint constructs a CancelTask endpoint wrapping the service.
+func MakeCancelTaskEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(CancelTaskRequest)
+		v, err := s.CancelTask(ctx, req.TaskId, req.Abandoned)
+		return CancelTaskResponse{TaskId: v.TaskID, Status: string(v.Status), Err: err}, service.WrapError(ctx, err)
+	}
+}
+
+// MakeRegisterAgentEndpoint constructs a RegisterAgent endpoint wrapping the service.
+func MakeRegisterAgentEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		_ = request.(RegisterAgentRequest)
+		v, err := s.RegisterAgent(ctx)
+		return RegisterAgentResponse{AgentId: v, Err: err}, service.WrapError(ctx, err)
+	}
+}
+
+// MakeDeregisterAgentEndpoint constructs a DeregisterAgent endpoint wrapping the service.
+func MakeDeregisterAgentEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(DeregisterAgentRequest)
+		err = s.DeregisterAgent(ctx, req.AgentId)
+		return DeregisterAgentResponse{Err: err}, service.WrapError(ctx, err)
+	}
+}
+
 // Failer is an interface that should be implemented by response types.
 // Response encoders can check if responses are Failer, and if so if they've
 // failed, and if so encode them using a separate write path based on the error.
@@ -235,7 +478,9 @@ type SayWorldResponse struct {
 
 // GetAvailableAgents()
 type GetAvailableAgentsRequest struct {
-	Limit int32
+	Limit    int32
+	Strategy string
+	Skills   []models.SkillRequirement
 }
 
 type GetAvailableAgentsResponse struct {
@@ -262,19 +507,175 @@ type HeartBeatRequest struct {
 
 // HeartBeatResponse is an internal representation of the response for HeartBeat()
 type HeartBeatResponse struct {
-	Message error
-	Status  grpc_types.HeartBeatResponse_HeartBeatStatus
+	Message       error
+	Status        grpc_types.HeartBeatResponse_HeartBeatStatus
+	NextHeartBeat time.Duration
 }
 
 // AddTask()
 
 // AddTaskRequest is an internal representation of the request for AddTask()
 type AddTaskRequest struct {
-	CustId   int32
-	AgentIds []int32
+	CustId         int32
+	AgentIds       []int32
+	RequiredSkills []models.SkillRequirement
 }
 
 // AddTaskResponse is an internal representation of the response for AddTask()
 type AddTaskResponse struct {
 	TaskId int32
 }
+
+// OfferTask()
+
+// OfferTaskRequest is an internal representation of the request for OfferTask()
+type OfferTaskRequest struct {
+	TaskId   int32
+	AgentIds []int32
+}
+
+// OfferTaskResponse is an internal representation of the response for OfferTask()
+type OfferTaskResponse struct {
+	TaskId int32
+	Status string
+	Err    error
+}
+
+// AcceptCall()
+
+// AcceptCallRequest is an internal representation of the request for AcceptCall()
+type AcceptCallRequest struct {
+	AgentId int32
+	TaskId  int32
+}
+
+// AcceptCallResponse is an internal representation of the response for AcceptCall()
+type AcceptCallResponse struct {
+	TaskId int32
+	CustId int32
+	Err    error
+}
+
+// StartTask()
+
+// StartTaskRequest is an internal representation of the request for StartTask()
+type StartTaskRequest struct {
+	AgentId int32
+	TaskId  int32
+}
+
+// StartTaskResponse is an internal representation of the response for StartTask()
+type StartTaskResponse struct {
+	TaskId int32
+	Status string
+	Err    error
+}
+
+// CompleteTask()
+
+// CompleteTaskRequest is an internal representation of the request for CompleteTask()
+type CompleteTaskRequest struct {
+	AgentId int32
+	TaskId  int32
+}
+
+// CompleteTaskResponse is an internal representation of the response for CompleteTask()
+type CompleteTaskResponse struct {
+	TaskId int32
+	Err    error
+}
+
+// SetAgentState()
+
+// SetAgentStateRequest is an internal representation of the request for SetAgentState()
+type SetAgentStateRequest struct {
+	AgentId int32
+	State   string
+}
+
+// SetAgentStateResponse is an internal representation of the response for SetAgentState()
+type SetAgentStateResponse struct {
+	Err error
+}
+
+// SetAgentSkills()
+
+// SetAgentSkillsRequest is an internal representation of the request for SetAgentSkills()
+type SetAgentSkillsRequest struct {
+	AgentId int32
+	Skills  []models.Skill
+}
+
+// SetAgentSkillsResponse is an internal representation of the response for SetAgentSkills()
+type SetAgentSkillsResponse struct {
+	AgentId int32
+	Skills  []models.Skill
+	Err     error
+}
+
+// GetTask()
+
+// GetTaskRequest is an internal representation of the request for GetTask()
+type GetTaskRequest struct {
+	TaskId int32
+}
+
+// GetTaskResponse is an internal representation of the response for GetTask()
+type GetTaskResponse struct {
+	Task models.Task
+	Err  error
+}
+
+// ListTasks()
+
+// ListTasksRequest is an internal representation of the request for ListTasks()
+type ListTasksRequest struct {
+	CustId  int32
+	AgentId int32
+	Status  string
+	Limit   int32
+}
+
+// ListTasksResponse is an internal representation of the response for ListTasks()
+type ListTasksResponse struct {
+	Tasks []models.Task
+	Err   error
+}
+
+// CancelTask()
+
+// CancelTaskRequest is an internal representation of the request for CancelTask()
+type CancelTaskRequest struct {
+	TaskId    int32
+	Abandoned bool
+}
+
+// CancelTaskResponse is an internal representation of the response for CancelTask()
+type CancelTaskResponse struct {
+	TaskId int32
+	Status string
+	Err    error
+}
+
+// RegisterAgent()
+
+// RegisterAgentRequest is an internal representation of the request for RegisterAgent()
+type RegisterAgentRequest struct{}
+
+// RegisterAgentResponse is an internal representation of the response for RegisterAgent()
+type RegisterAgentResponse struct {
+	AgentId int32
+	Err     error
+}
+
+// DeregisterAgent()
+
+// DeregisterAgentRequest is an internal representation of the request for DeregisterAgent()
+type DeregisterAgentRequest struct {
+	AgentId int32
+}
+
+// DeregisterAgentResponse is an internal representation of the response for DeregisterAgent()
+type DeregisterAgentResponse struct {
+	Err error
+}
@@ -12,12 +12,34 @@ const (
 	ErrAgentNotFound
 	ErrCustIDInvalid
 	ErrCounterNotFound
+	ErrTaskNotFound
+	ErrTaskAlreadyAccepted
+	ErrTaskNotOffered
+	ErrAgentStateInvalid
+	ErrAgentStateTransition
+	ErrTaskNotAccepted
+	ErrTaskAlreadyCompleted
+	ErrTaskStatusInvalid
+	ErrTaskStatusTransition
+	ErrRoutingStrategyInvalid
+	ErrSkillInvalid
+	ErrWatchSlowConsumer
+	ErrWatchClosed
+	ErrStreamReplaced
+	ErrStreamClosed
+	ErrHeartBeatMissed
+	ErrInvalidArgument
+	ErrTenantUnknown
+	ErrUnauthenticated
+	ErrPermissionDenied
 )
 
 // AgentMgmtError represents internal Boulder errors
 type AgentMgmtError struct {
 	Type   ErrorType
 	Detail string
+	// Field is the request field at fault (e.g. "agent_id"), empty if none
+	Field string
 }
 
 func (be *AgentMgmtError) Error() string {
@@ -32,6 +54,15 @@ func New(errType ErrorType, msg string, args ...interface{}) error {
 	}
 }
 
+// NewFieldError is New for an error caused by a field of the request
+func NewFieldError(errType ErrorType, field string, msg string, args ...interface{}) error {
+	return &AgentMgmtError{
+		Type:   errType,
+		Detail: fmt.Sprintf(msg, args...),
+		Field:  field,
+	}
+}
+
 // StrName is a convenience function for getting the string constant name
 func StrName(errType ErrorType) string {
 	switch errType {
@@ -45,6 +76,46 @@ func StrName(errType ErrorType) string {
 		return "ErrCustIDInvalid"
 	case ErrCounterNotFound:
 		return "ErrCounterNotFound"
+	case ErrTaskNotFound:
+		return "ErrTaskNotFound"
+	case ErrTaskAlreadyAccepted:
+		return "ErrTaskAlreadyAccepted"
+	case ErrTaskNotOffered:
+		return "ErrTaskNotOffered"
+	case ErrAgentStateInvalid:
+		return "ErrAgentStateInvalid"
+	case ErrAgentStateTransition:
+		return "ErrAgentStateTransition"
+	case ErrTaskNotAccepted:
+		return "ErrTaskNotAccepted"
+	case ErrTaskAlreadyCompleted:
+		return "ErrTaskAlreadyCompleted"
+	case ErrTaskStatusInvalid:
+		return "ErrTaskStatusInvalid"
+	case ErrTaskStatusTransition:
+		return "ErrTaskStatusTransition"
+	case ErrRoutingStrategyInvalid:
+		return "ErrRoutingStrategyInvalid"
+	case ErrSkillInvalid:
+		return "ErrSkillInvalid"
+	case ErrWatchSlowConsumer:
+		return "ErrWatchSlowConsumer"
+	case ErrWatchClosed:
+		return "ErrWatchClosed"
+	case ErrStreamReplaced:
+		return "ErrStreamReplaced"
+	case ErrStreamClosed:
+		return "ErrStreamClosed"
+	case ErrHeartBeatMissed:
+		return "ErrHeartBeatMissed"
+	case ErrInvalidArgument:
+		return "ErrInvalidArgument"
+	case ErrTenantUnknown:
+		return "ErrTenantUnknown"
+	case ErrUnauthenticated:
+		return "ErrUnauthenticated"
+	case ErrPermissionDenied:
+		return "ErrPermissionDenied"
 	}
 	return fmt.Sprintf("%v", errType)
 }
@@ -82,3 +153,103 @@ func ErrCustIDInvalidError(msg string, args ...interface{}) error {
 func ErrCounterNotFoundError(msg string, args ...interface{}) error {
 	return New(ErrCounterNotFound, msg, args...)
 }
+
+// ErrTaskNotFoundError returns when we cant find a task
+func ErrTaskNotFoundError(msg string, args ...interface{}) error {
+	return New(ErrTaskNotFound, msg, args...)
+}
+
+// ErrTaskAlreadyAcceptedError returns when a task has already been accepted by an agent
+func ErrTaskAlreadyAcceptedError(msg string, args ...interface{}) error {
+	return New(ErrTaskAlreadyAccepted, msg, args...)
+}
+
+// ErrTaskNotOfferedError returns when an agent accepts a task that was not offered to them
+func ErrTaskNotOfferedError(msg string, args ...interface{}) error {
+	return New(ErrTaskNotOffered, msg, args...)
+}
+
+// ErrAgentStateInvalidError returns when an unknown agent state is used
+func ErrAgentStateInvalidError(msg string, args ...interface{}) error {
+	return New(ErrAgentStateInvalid, msg, args...)
+}
+
+// ErrAgentStateTransitionError returns when an agent cannot move from its current state to the requested one
+func ErrAgentStateTransitionError(msg string, args ...interface{}) error {
+	return New(ErrAgentStateTransition, msg, args...)
+}
+
+// ErrTaskNotAcceptedError returns when an agent completes a task they have not accepted
+func ErrTaskNotAcceptedError(msg string, args ...interface{}) error {
+	return New(ErrTaskNotAccepted, msg, args...)
+}
+
+// ErrTaskAlreadyCompletedError returns when a task has already been completed
+func ErrTaskAlreadyCompletedError(msg string, args ...interface{}) error {
+	return New(ErrTaskAlreadyCompleted, msg, args...)
+}
+
+// ErrTaskStatusInvalidError returns when an unknown task status is used
+func ErrTaskStatusInvalidError(msg string, args ...interface{}) error {
+	return New(ErrTaskStatusInvalid, msg, args...)
+}
+
+// ErrTaskStatusTransitionError returns when a task cannot move from its current status to the requested one
+func ErrTaskStatusTransitionError(msg string, args ...interface{}) error {
+	return New(ErrTaskStatusTransition, msg, args...)
+}
+
+// ErrRoutingStrategyInvalidError returns when an unknown routing strategy is requested
+func ErrRoutingStrategyInvalidError(msg string, args ...interface{}) error {
+	return New(ErrRoutingStrategyInvalid, msg, args...)
+}
+
+// ErrSkillInvalidError returns when a skill or skill requirement is invalid
+func ErrSkillInvalidError(msg string, args ...interface{}) error {
+	return New(ErrSkillInvalid, msg, args...)
+}
+
+// ErrWatchSlowConsumerError returns when a watcher falls too far behind the agent events
+func ErrWatchSlowConsumerError(msg string, args ...interface{}) error {
+	return New(ErrWatchSlowConsumer, msg, args...)
+}
+
+// ErrWatchClosedError returns when agent events are no longer being sent (e.g. server shutdown)
+func ErrWatchClosedError(msg string, args ...interface{}) error {
+	return New(ErrWatchClosed, msg, args...)
+}
+
+// ErrStreamReplacedError returns when an agent opens a new heartbeat stream in place of this one
+func ErrStreamReplacedError(msg string, args ...interface{}) error {
+	return New(ErrStreamReplaced, msg, args...)
+}
+
+// ErrStreamClosedError returns when the server ends a heartbeat stream (e.g. shutdown, deregistered)
+func ErrStreamClosedError(msg string, args ...interface{}) error {
+	return New(ErrStreamClosed, msg, args...)
+}
+
+// ErrHeartBeatMissedError returns when a streaming agent stops sending heartbeats
+func ErrHeartBeatMissedError(msg string, args ...interface{}) error {
+	return New(ErrHeartBeatMissed, msg, args...)
+}
+
+// ErrInvalidArgumentError returns when a request is malformed (e.g. agent ID 0)
+func ErrInvalidArgumentError(msg string, args ...interface{}) error {
+	return New(ErrInvalidArgument, msg, args...)
+}
+
+// ErrTenantUnknownError returns when a call is not for one of the service's tenants
+func ErrTenantUnknownError(msg string, args ...interface{}) error {
+	return New(ErrTenantUnknown, msg, args...)
+}
+
+// ErrUnauthenticatedError returns when a caller has no valid credentials (e.g. an expired token)
+func ErrUnauthenticatedError(msg string, args ...interface{}) error {
+	return New(ErrUnauthenticated, msg, args...)
+}
+
+// ErrPermissionDeniedError returns when a caller may not make a call (e.g. for another agent)
+func ErrPermissionDeniedError(msg string, args ...interface{}) error {
+	return New(ErrPermissionDenied, msg, args...)
+}
@@ -0,0 +1,268 @@
+package heartbeat
+
+// buffer.go
+// Write-behind heartbeats: heartbeats are kept in memory and written to the
+// database in bulk every flush interval instead of one update per heartbeat.
+// The buffer is also the most up to date view of when agents last beat.
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	mgo "gopkg.in/mgo.v2"
+
+	"github.com/newtonsystems/agent-mgmt/app/config"
+	"github.com/newtonsystems/agent-mgmt/app/models"
+	"github.com/newtonsystems/agent-mgmt/app/tenant"
+)
+
+type nowFuncT func() time.Time
+
+var NowFunc nowFuncT
+
+func init() {
+	NowFunc = func() time.Time {
+		return time.Now()
+	}
+}
+
+// Buffer holds the heartbeats waiting to be flushed and the last heartbeat
+// of every agent seen since. A nil *Buffer is valid and holds nothing
+// (heartbeats are then written straight away by the service).
+type Buffer struct {
+	mu      sync.Mutex
+	pending map[key]time.Time
+	seen    map[key]time.Time
+}
+
+// NewBuffer returns an empty Buffer
+func NewBuffer() *Buffer {
+	return &Buffer{pending: make(map[key]time.Time), seen: make(map[key]time.Time)}
+}
+
+// Beat records a heartbeat from tenant's agent id at to be flushed
+func (b *Buffer) Beat(tenant string, agentID int32, at time.Time) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	k := key{tenant, agentID}
+	if at.After(b.pending[k]) {
+		b.pending[k] = at
+	}
+	if at.After(b.seen[k]) {
+		b.seen[k] = at
+	}
+}
+
+// Record records a heartbeat from tenant's agent id at that is already in the database
+func (b *Buffer) Record(tenant string, agentID int32, at time.Time) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if k := (key{tenant, agentID}); at.After(b.seen[k]) {
+		b.seen[k] = at
+	}
+}
+
+// LastBeat returns the last heartbeat seen from tenant's agent id
+func (b *Buffer) LastBeat(tenant string, agentID int32) (time.Time, bool) {
+	if b == nil {
+		return time.Time{}, false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	at, ok := b.seen[key{tenant, agentID}]
+	return at, ok
+}
+
+// Forget drops tenant's agent id so its next heartbeat is written straight
+// away (e.g. it went offline and the heartbeat has to make it available
+// again). A pending heartbeat is still flushed.
+func (b *Buffer) Forget(tenant string, agentID int32) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.seen, key{tenant, agentID})
+}
+
+// Overlay sets each of tenant's agents' LastHeartBeat to its last heartbeat
+// seen by the buffer if that is later than the one in the database
+func (b *Buffer) Overlay(tenant string, agents []models.Agent) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i := range agents {
+		if at, ok := b.seen[key{tenant, agents[i].AgentID}]; ok && at.After(agents[i].LastHeartBeat) {
+			agents[i].LastHeartBeat = at
+		}
+	}
+}
+
+// Pending returns how many heartbeats are waiting to be flushed
+func (b *Buffer) Pending() int {
+	if b == nil {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.pending)
+}
+
+// Flush writes the pending heartbeats of each tenant to the tenant's
+// database (see db) in bulk and returns how many were written. The
+// heartbeats of a tenant whose write fails are kept for the next flush (the
+// first error is returned). Agents that have not beat since before are
+// forgotten. Like a single heartbeat a flushed one makes an offline agent
+// available (e.g. one another pod's reaper marked offline).
+func (b *Buffer) Flush(ctx context.Context, db func(tenant string) models.DataLayer, before time.Time) (int, error) {
+	if b == nil {
+		return 0, nil
+	}
+
+	b.mu.Lock()
+	pending := make(map[string]map[int32]time.Time)
+	for k, at := range b.pending {
+		if pending[k.tenant] == nil {
+			pending[k.tenant] = make(map[int32]time.Time)
+		}
+		pending[k.tenant][k.agentID] = at
+	}
+	b.pending = make(map[key]time.Time)
+	for k, at := range b.seen {
+		if at.Before(before) {
+			delete(b.seen, k)
+		}
+	}
+	b.mu.Unlock()
+
+	var (
+		written  int
+		firstErr error
+	)
+	for tenant, beats := range pending {
+		if _, err := db(tenant).HeartBeats(ctx, beats); err != nil {
+			b.mu.Lock()
+			for agentID, at := range beats {
+				if k := (key{tenant, agentID}); at.After(b.pending[k]) {
+					b.pending[k] = at
+				}
+			}
+			b.mu.Unlock()
+
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		written += len(beats)
+	}
+
+	return written, firstErr
+}
+
+// Flusher flushes a Buffer to the database every cfg.HeartBeatFlushInterval
+type Flusher struct {
+	cfg     config.Config
+	buffer  *Buffer
+	session models.Session
+	db      string
+	logger  log.Logger
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewFlusher returns a Flusher of buffer to db (each tenant's heartbeats to
+// the tenant's database, see tenant.Database)
+func NewFlusher(cfg config.Config, buffer *Buffer, session models.Session, db string, logger log.Logger) *Flusher {
+	return &Flusher{
+		cfg:     cfg,
+		buffer:  buffer,
+		session: session,
+		db:      db,
+		logger:  logger,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Flush runs a single flush
+func (f *Flusher) Flush(ctx context.Context) (int, error) {
+	// NOTE: Concurrent requests will not work otherwises
+	// Request a socket connection from the session to process our query.
+	// Close the session when the goroutine exits and put the connection back
+	// into the pool.
+	sessionCopy := f.session.Copy()
+	sessionCopy.SetMode(mgo.Strong, false)
+	defer sessionCopy.Close()
+
+	db := func(id string) models.DataLayer {
+		return sessionCopy.DB(tenant.Database(f.db, id))
+	}
+	n, err := f.buffer.Flush(ctx, db, f.cfg.AvailableSince(NowFunc()))
+	// Otherwise every later flush would use the dead socket
+	if models.RefreshOnError(f.session, err) {
+		f.logger.Log("level", "warn", "msg", "Refreshed the mongo session after a connection error", "err", err)
+	}
+	return n, err
+}
+
+// Run flushes every cfg.HeartBeatFlushInterval until Stop is called, then
+// flushes one last time (returns immediately if heartbeats are not buffered)
+func (f *Flusher) Run() {
+	defer close(f.done)
+
+	if f.cfg.HeartBeatFlushInterval <= 0 {
+		f.logger.Log("level", "info", "msg", "Heartbeats are written straight away")
+		return
+	}
+
+	f.logger.Log("level", "info", "msg", "Heartbeat flusher started", "interval", f.cfg.HeartBeatFlushInterval)
+
+	ticker := time.NewTicker(f.cfg.HeartBeatFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			n, err := f.Flush(context.Background())
+			if err != nil {
+				f.logger.Log("level", "err", "msg", "Heartbeat flush failed", "pending", f.buffer.Pending(), "err", err)
+				continue
+			}
+			f.logger.Log("level", "debug", "msg", "Heartbeats flushed", "heartbeats", n)
+		case <-f.stop:
+			n, err := f.Flush(context.Background())
+			f.logger.Log("level", "info", "msg", "Heartbeat flusher stopped", "heartbeats", n, "err", err)
+			return
+		}
+	}
+}
+
+// Stop stops Run and waits for the last flush to finish
+func (f *Flusher) Stop() {
+	f.stopOnce.Do(func() { close(f.stop) })
+	<-f.done
+}
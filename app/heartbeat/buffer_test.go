@@ -0,0 +1,153 @@
+package heartbeat_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/newtonsystems/agent-mgmt/app/config"
+	"github.com/newtonsystems/agent-mgmt/app/heartbeat"
+	"github.com/newtonsystems/agent-mgmt/app/models"
+	"github.com/newtonsystems/agent-mgmt/app/tenant"
+	tu "github.com/newtonsystems/agent-mgmt/app/testutil"
+)
+
+// failingDatabase fails every bulk heartbeat write
+type failingDatabase struct {
+	tu.MockDatabase
+}
+
+func (db failingDatabase) HeartBeats(ctx context.Context, beats map[int32]time.Time) (int, error) {
+	return 0, errors.New("no reachable servers")
+}
+
+func TestBuffer(t *testing.T) {
+	session, db := tu.NewTestMemoryConnection()
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	now := time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)
+	tu.InsertCollectionToDB(t, db, "agents", []tu.TestModelInsert{
+		&models.Agent{AgentID: 1, State: models.AgentAvailable, LastHeartBeat: now.Add(-50 * time.Second)},
+		&models.Agent{AgentID: 2, State: models.AgentAvailable, LastHeartBeat: now.Add(-50 * time.Second)},
+	})
+
+	b := heartbeat.NewBuffer()
+	b.Beat("", 1, now)
+	b.Beat("", 1, now.Add(-time.Second))
+	b.Record("", 2, now.Add(-40*time.Second))
+	tu.Equals(t, 1, b.Pending())
+
+	at, ok := b.LastBeat("", 1)
+	tu.Assert(t, ok, "expected a heartbeat from agent 1")
+	tu.TimeEquals(t, now, at)
+
+	// The buffered heartbeats are newer than the database
+	agents, err := db.GetAgents(context.Background(), models.AgentAvailable, now.Add(-time.Minute), nil, models.AgentOrder{}, 0)
+	tu.Ok(t, err)
+	b.Overlay("", agents)
+	tu.TimeEquals(t, now, agents[0].LastHeartBeat)
+	tu.TimeEquals(t, now.Add(-40*time.Second), agents[1].LastHeartBeat)
+
+	// A failed flush is retried on the next one
+	n, err := b.Flush(context.Background(), func(string) models.DataLayer { return failingDatabase{} }, now.Add(-time.Minute))
+	tu.Assert(t, err != nil, "expected the flush to fail")
+	tu.Equals(t, 0, n)
+	tu.Equals(t, 1, b.Pending())
+
+	// Agent 2 has not beat since before so is forgotten
+	n, err = b.Flush(context.Background(), func(string) models.DataLayer { return db }, now.Add(-30*time.Second))
+	tu.Ok(t, err)
+	tu.Equals(t, 1, n)
+	tu.Equals(t, 0, b.Pending())
+	_, ok = b.LastBeat("", 2)
+	tu.Assert(t, !ok, "expected agent 2 to be forgotten")
+
+	agent, err := db.GetAgent(context.Background(), 1)
+	tu.Ok(t, err)
+	tu.TimeEquals(t, now, agent.LastHeartBeat)
+
+	b.Forget("", 1)
+	_, ok = b.LastBeat("", 1)
+	tu.Assert(t, !ok, "expected agent 1 to be forgotten")
+}
+
+func TestBufferTenants(t *testing.T) {
+	session, db := tu.NewTestMemoryConnection()
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	now := time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)
+	heartbeat.NowFunc = func() time.Time { return now }
+	defer func() { heartbeat.NowFunc = time.Now }()
+
+	// Both tenants have an agent 1
+	acme := session.DB(tenant.Database(tu.MongoDBName, "acme"))
+	for _, dl := range []models.DataLayer{db, acme} {
+		tu.InsertCollectionToDB(t, dl, "agents", []tu.TestModelInsert{
+			&models.Agent{AgentID: 1, State: models.AgentAvailable, LastHeartBeat: now.Add(-50 * time.Second)},
+		})
+	}
+
+	b := heartbeat.NewBuffer()
+	b.Beat("acme", 1, now)
+	_, ok := b.LastBeat("", 1)
+	tu.Assert(t, !ok, "expected no heartbeat from the other tenant's agent 1")
+
+	f := heartbeat.NewFlusher(config.Default(), b, session, tu.MongoDBName, log.NewNopLogger())
+	n, err := f.Flush(context.Background())
+	tu.Ok(t, err)
+	tu.Equals(t, 1, n)
+
+	agent, err := acme.GetAgent(context.Background(), 1)
+	tu.Ok(t, err)
+	tu.TimeEquals(t, now, agent.LastHeartBeat)
+
+	agent, err = db.GetAgent(context.Background(), 1)
+	tu.Ok(t, err)
+	tu.TimeEquals(t, now.Add(-50*time.Second), agent.LastHeartBeat)
+}
+
+func TestFlusherStop(t *testing.T) {
+	session, db := tu.NewTestMemoryConnection()
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	now := time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)
+	heartbeat.NowFunc = func() time.Time { return now }
+	defer func() { heartbeat.NowFunc = time.Now }()
+
+	tu.InsertCollectionToDB(t, db, "agents", []tu.TestModelInsert{
+		&models.Agent{AgentID: 1, State: models.AgentAvailable, LastHeartBeat: now.Add(-50 * time.Second)},
+	})
+
+	cfg := config.Default()
+	cfg.HeartBeatFlushInterval = time.Hour
+	b := heartbeat.NewBuffer()
+	f := heartbeat.NewFlusher(cfg, b, session, tu.MongoDBName, log.NewNopLogger())
+	go f.Run()
+
+	// Stopping (e.g. on SIGTERM) flushes what is left
+	b.Beat("", 1, now)
+	f.Stop()
+	tu.Equals(t, 0, b.Pending())
+
+	agent, err := db.GetAgent(context.Background(), 1)
+	tu.Ok(t, err)
+	tu.TimeEquals(t, now, agent.LastHeartBeat)
+}
+
+func TestNilBuffer(t *testing.T) {
+	var b *heartbeat.Buffer
+	b.Beat("", 1, time.Now())
+	b.Record("", 1, time.Now())
+	b.Forget("", 1)
+	b.Overlay("", []models.Agent{{AgentID: 1}})
+	tu.Equals(t, 0, b.Pending())
+
+	_, ok := b.LastBeat("", 1)
+	tu.Assert(t, !ok, "expected no heartbeats")
+	n, err := b.Flush(context.Background(), nil, time.Now())
+	tu.Ok(t, err)
+	tu.Equals(t, 0, n)
+}
@@ -0,0 +1,215 @@
+package heartbeat
+
+// heartbeat.go
+// Connected agents of the HeartBeatStream RPC. Commands for an agent (offer
+// task etc.) are pushed on to its stream through its Conn. Sending never
+// blocks: an agent that falls behind is cut off and has to reconnect.
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+)
+
+// DefaultBuffer is how many commands an agent can fall behind before it is cut off
+const DefaultBuffer = 16
+
+// CommandType is what the server wants the agent to do
+type CommandType string
+
+const (
+	// CommandChangeInterval agent should send its heartbeats every Interval
+	CommandChangeInterval CommandType = "change_interval"
+	// CommandOfferTask agent is offered TaskID for CustID
+	CommandOfferTask CommandType = "offer_task"
+)
+
+// Command is pushed to a connected agent
+type Command struct {
+	Type     CommandType
+	TaskID   int32
+	CustID   int32
+	Interval time.Duration
+}
+
+// key identifies an agent (agent IDs are only unique within a tenant, the
+// tenant is "" if the service is not multi-tenant)
+type key struct {
+	tenant  string
+	agentID int32
+}
+
+// Registry is the agents with an open heartbeat stream (at most one each)
+// A nil *Registry is valid and has no agents
+type Registry struct {
+	mu     sync.Mutex
+	buffer int
+	conns  map[key]*Conn
+	closed bool
+}
+
+// NewRegistry returns a Registry whose agents are cut off when buffer commands behind
+func NewRegistry(buffer int) *Registry {
+	if buffer <= 0 {
+		buffer = DefaultBuffer
+	}
+	return &Registry{buffer: buffer, conns: make(map[key]*Conn)}
+}
+
+// Connect returns a new connection for tenant's agent id. An existing
+// connection for the agent is ended (ErrStreamReplaced).
+func (r *Registry) Connect(tenant string, agentID int32) (*Conn, error) {
+	if r == nil {
+		return nil, amerrors.ErrStreamClosedError("heartbeat streams are not enabled")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil, amerrors.ErrStreamClosedError("server is shutting down")
+	}
+
+	if old, ok := r.conns[key{tenant, agentID}]; ok {
+		r.drop(old, amerrors.ErrStreamReplacedError("Agent(AgentID=%d) opened a new heartbeat stream", agentID))
+	}
+
+	c := make(chan Command, r.buffer)
+	conn := &Conn{Tenant: tenant, AgentID: agentID, C: c, c: c, registry: r}
+	r.conns[key{tenant, agentID}] = conn
+	return conn, nil
+}
+
+// Send pushes cmd to tenant's agent id without blocking. It returns false if
+// the agent is not connected (or was cut off for falling behind).
+func (r *Registry) Send(tenant string, agentID int32, cmd Command) bool {
+	if r == nil {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	conn, ok := r.conns[key{tenant, agentID}]
+	if !ok {
+		return false
+	}
+
+	select {
+	case conn.c <- cmd:
+		return true
+	default:
+		r.drop(conn, amerrors.ErrStreamClosedError("Agent(AgentID=%d) fell more than %d commands behind", agentID, r.buffer))
+		return false
+	}
+}
+
+// Disconnect ends tenant's agent id's connection (if any) with err
+func (r *Registry) Disconnect(tenant string, agentID int32, err error) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if conn, ok := r.conns[key{tenant, agentID}]; ok {
+		r.drop(conn, err)
+	}
+}
+
+// End ends conn with err if it is still its agent's connection
+func (r *Registry) End(conn *Conn, err error) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.drop(conn, err)
+}
+
+// AgentIDs returns tenant's connected agents in order
+func (r *Registry) AgentIDs(tenant string) []int32 {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	agentIDs := make([]int32, 0, len(r.conns))
+	for k := range r.conns {
+		if k.tenant == tenant {
+			agentIDs = append(agentIDs, k.agentID)
+		}
+	}
+	sort.Slice(agentIDs, func(i, j int) bool { return agentIDs[i] < agentIDs[j] })
+	return agentIDs
+}
+
+// Close ends every connection (ErrStreamClosed) and refuses new ones
+func (r *Registry) Close() {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closed = true
+	for _, conn := range r.conns {
+		r.drop(conn, amerrors.ErrStreamClosedError("server is shutting down"))
+	}
+}
+
+// drop removes the connection and closes its channel (caller must hold r.mu)
+func (r *Registry) drop(conn *Conn, err error) {
+	if r.conns[conn.key()] != conn {
+		return
+	}
+	delete(r.conns, conn.key())
+	conn.err = err
+	close(conn.c)
+}
+
+// Conn receives the commands for an agent on C until it is closed or ended
+// by the registry (C is then closed, see Err)
+type Conn struct {
+	Tenant  string
+	AgentID int32
+	C       <-chan Command
+
+	c        chan Command
+	registry *Registry
+	err      error
+}
+
+// Close removes the connection. It returns true if the connection was still
+// the agent's, i.e. the agent went away rather than being replaced or ended
+// by the server. Safe to call more than once.
+func (conn *Conn) Close() bool {
+	conn.registry.mu.Lock()
+	defer conn.registry.mu.Unlock()
+
+	if conn.registry.conns[conn.key()] != conn {
+		return false
+	}
+	conn.registry.drop(conn, nil)
+	return true
+}
+
+// Err returns why C was closed: ErrStreamReplaced, ErrStreamClosed or nil if
+// the connection was closed by Close. Only valid once C is closed.
+func (conn *Conn) Err() error {
+	conn.registry.mu.Lock()
+	defer conn.registry.mu.Unlock()
+	return conn.err
+}
+
+func (conn *Conn) key() key {
+	return key{conn.Tenant, conn.AgentID}
+}
@@ -0,0 +1,118 @@
+package heartbeat_test
+
+import (
+	"testing"
+
+	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+	"github.com/newtonsystems/agent-mgmt/app/heartbeat"
+	tu "github.com/newtonsystems/agent-mgmt/app/testutil"
+)
+
+// drain returns the commands on the connection until its channel is closed
+func drain(conn *heartbeat.Conn) []heartbeat.Command {
+	var cmds []heartbeat.Command
+	for cmd := range conn.C {
+		cmds = append(cmds, cmd)
+	}
+	return cmds
+}
+
+func TestSend(t *testing.T) {
+	r := heartbeat.NewRegistry(4)
+	conn1, err := r.Connect("", 1)
+	tu.Ok(t, err)
+	conn2, err := r.Connect("", 2)
+	tu.Ok(t, err)
+	tu.Equals(t, []int32{1, 2}, r.AgentIDs(""))
+
+	offer := heartbeat.Command{Type: heartbeat.CommandOfferTask, TaskID: 7, CustID: 3}
+	tu.Assert(t, r.Send("", 1, offer), "expected agent 1 to be sent the offer")
+	tu.Assert(t, !r.Send("", 3, offer), "expected agent 3 not to be connected")
+
+	// The agent went away
+	tu.Assert(t, conn1.Close(), "expected agent 1 to still be connected")
+	tu.Equals(t, []heartbeat.Command{offer}, drain(conn1))
+	tu.Ok(t, conn1.Err())
+	tu.Assert(t, !conn1.Close(), "expected agent 1 to already be disconnected")
+	tu.Equals(t, []int32{2}, r.AgentIDs(""))
+
+	conn2.Close()
+}
+
+func TestTenants(t *testing.T) {
+	r := heartbeat.NewRegistry(4)
+	acme, err := r.Connect("acme", 1)
+	tu.Ok(t, err)
+	globex, err := r.Connect("globex", 1)
+	tu.Ok(t, err)
+
+	// The other tenant's agent 1 is a different agent
+	tu.Equals(t, []int32{1}, r.AgentIDs("acme"))
+	tu.Equals(t, 0, len(r.AgentIDs("")))
+
+	offer := heartbeat.Command{Type: heartbeat.CommandOfferTask, TaskID: 7, CustID: 3}
+	tu.Assert(t, r.Send("acme", 1, offer), "expected acme's agent 1 to be sent the offer")
+	r.Disconnect("globex", 1, nil)
+	tu.Equals(t, 0, len(drain(globex)))
+	tu.Assert(t, acme.Close(), "expected acme's agent 1 to still be connected")
+	tu.Equals(t, []heartbeat.Command{offer}, drain(acme))
+}
+
+func TestReplace(t *testing.T) {
+	r := heartbeat.NewRegistry(0)
+	old, err := r.Connect("", 1)
+	tu.Ok(t, err)
+	conn, err := r.Connect("", 1)
+	tu.Ok(t, err)
+
+	// Closing the old stream must not disconnect the new one
+	tu.Equals(t, 0, len(drain(old)))
+	tu.IsAmError(t, amerrors.ErrStreamReplaced, old.Err())
+	tu.Assert(t, !old.Close(), "expected the old stream to be replaced")
+	tu.Equals(t, []int32{1}, r.AgentIDs(""))
+	tu.Assert(t, conn.Close(), "expected the new stream to still be connected")
+}
+
+func TestSlowAgent(t *testing.T) {
+	r := heartbeat.NewRegistry(1)
+	conn, err := r.Connect("", 1)
+	tu.Ok(t, err)
+
+	tu.Assert(t, r.Send("", 1, heartbeat.Command{Type: heartbeat.CommandOfferTask, TaskID: 1}), "expected the first offer to be sent")
+	tu.Assert(t, !r.Send("", 1, heartbeat.Command{Type: heartbeat.CommandOfferTask, TaskID: 2}), "expected the agent to be cut off")
+
+	tu.Equals(t, 1, len(drain(conn)))
+	tu.IsAmError(t, amerrors.ErrStreamClosed, conn.Err())
+	tu.Equals(t, 0, len(r.AgentIDs("")))
+}
+
+func TestDisconnectAndClose(t *testing.T) {
+	r := heartbeat.NewRegistry(0)
+	conn1, err := r.Connect("", 1)
+	tu.Ok(t, err)
+	conn2, err := r.Connect("", 2)
+	tu.Ok(t, err)
+
+	r.Disconnect("", 1, amerrors.ErrStreamClosedError("deregistered"))
+	drain(conn1)
+	tu.IsAmError(t, amerrors.ErrStreamClosed, conn1.Err())
+
+	r.Close()
+	drain(conn2)
+	tu.IsAmError(t, amerrors.ErrStreamClosed, conn2.Err())
+	tu.Assert(t, !conn2.Close(), "expected the server to have ended the stream")
+
+	_, err = r.Connect("", 3)
+	tu.IsAmError(t, amerrors.ErrStreamClosed, err)
+}
+
+func TestNilRegistry(t *testing.T) {
+	var r *heartbeat.Registry
+	tu.Assert(t, !r.Send("", 1, heartbeat.Command{Type: heartbeat.CommandOfferTask}), "expected nothing to be sent")
+	r.Disconnect("", 1, nil)
+	r.Close()
+	tu.Equals(t, 0, len(r.AgentIDs("")))
+
+	_, err := r.Connect("", 1)
+	tu.IsAmError(t, amerrors.ErrStreamClosed, err)
+}
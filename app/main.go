@@ -5,6 +5,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"net"
@@ -13,11 +14,16 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/term"
@@ -27,18 +33,28 @@ import (
 
 	//"github.com/go-kit/kit/endpoint"
 
-	"gopkg.in/mgo.v2"
 	//"github.com/newtonsystems/agent-mgmt/app"
+	"github.com/newtonsystems/agent-mgmt/app/auth"
+	"github.com/newtonsystems/agent-mgmt/app/certs"
+	"github.com/newtonsystems/agent-mgmt/app/config"
 	"github.com/newtonsystems/agent-mgmt/app/endpoint"
+	"github.com/newtonsystems/agent-mgmt/app/heartbeat"
+	"github.com/newtonsystems/agent-mgmt/app/migrate"
 	"github.com/newtonsystems/agent-mgmt/app/models"
+	"github.com/newtonsystems/agent-mgmt/app/reaper"
 	"github.com/newtonsystems/agent-mgmt/app/service"
+	"github.com/newtonsystems/agent-mgmt/app/tenant"
 	"github.com/newtonsystems/agent-mgmt/app/transport"
+	"github.com/newtonsystems/agent-mgmt/app/watch"
 	"github.com/newtonsystems/grpc_types/go/grpc_types"
 )
 
 const (
 	serviceName          = "agent-mgmt"
 	defaultMongoDatabase = "db1"
+	// defaultMongoURI the in cluster replica set (other environments set
+	// MONGO_URI, e.g. the dev-common replica set of master / featuretest)
+	defaultMongoURI      = "mongodb://mongo-0.mongo:27017,mongo-1.mongo:27017,mongo-2.mongo:27017"
 	defaultPort          = ":50000"
 	defaultDebugHTTPPort = ":9090"
 	defaultLinkerdHost   = "linkerd:4141"
@@ -60,6 +76,11 @@ func main() {
 		localConn = flag.Bool("conn.local", false, "Override mongo/linkerd connection (specific for mongo-external or defaults to minikube conn)")
 		// Mongo Debug enabled?
 		mongoDebug = flag.Bool("mongo.debug", false, "Turns on mongo debug.")
+		// Storage backend (memory is for local development / CI without a mongo replica set)
+		dbBackend = flag.String("db.backend", envString("DB_BACKEND", "mongo"), "Storage backend to use: mongo, mongo-driver (the official mongo driver instead of mgo), postgres (see -postgres.uri) or memory")
+
+		// Agent availability / heartbeat configuration (config file, env or flags)
+		configFlags = config.RegisterFlags(flag.CommandLine)
 	)
 
 	flag.Parse()
@@ -99,12 +120,21 @@ func main() {
 		logger = log.With(logger, "service", serviceName)
 	}
 
+	// Startup failures set exitCode and return so the deferred cleanup runs
+	// before the process exits (this defer runs last)
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+
 	// ---------------------------------------------------------------------------
 
 	var (
 		started      = time.Now()
 		container    string
-		mongoHosts   []string
+		mongoURI     string
 		l5dHost      string
 		l5dConn      *grpc.ClientConn
 		mongoSession models.Session
@@ -114,6 +144,11 @@ func main() {
 	// Error channel
 	errc := make(chan error, 2)
 
+	// ready is closed once the service has started, stage is what it is doing until then
+	ready := make(chan struct{})
+	var stage atomic.Value
+	stage.Store("loading configuration")
+
 	// Depending on the environment we connect to different hosts
 	// if local.conn is true we want to connecting by running the go service locally
 	// we therefore want to connect to the minikube's linkerd and mongo services
@@ -121,21 +156,10 @@ func main() {
 	if *localConn {
 		container = "localhost"
 		l5dHost = envString("LINKERD_SERVICE_HOST", "192.168.99.100") + ":" + envString("LINKERD_SERVICE_PORT", "31000")
-		mongoHosts = []string{
-			envString("MONGO_EXTERNAL_SERVICE_HOST", "192.168.99.100") + ":" + envString("MONGO_EXTERNAL_SERVICE_PORT", "31017"),
-		}
+		mongoURI = "mongodb://" + envString("MONGO_EXTERNAL_SERVICE_HOST", "192.168.99.100") + ":" + envString("MONGO_EXTERNAL_SERVICE_PORT", "31017")
 	} else {
 		l5dHost = defaultLinkerdHost
-		mongoHosts = []string{
-			"mongo-0.mongo:27017",
-			"mongo-1.mongo:27017",
-			"mongo-2.mongo:27017",
-			// dev environments for: master / featuretest
-			"mongo-0.mongo.dev-common.svc.cluster.local:27017",
-			"mongo-1.mongo.dev-common.svc.cluster.local:27017",
-			"mongo-2.mongo.dev-common.svc.cluster.local:27017",
-			"mongodb://mongo-0.mongo,mongo-1.mongo,mongo-2.mongo:27017",
-		}
+		mongoURI = defaultMongoURI
 
 		// Try and workout container id
 		cmd := exec.Command("cat", "/etc/hostname")
@@ -143,6 +167,7 @@ func main() {
 
 		if err != nil {
 			logger.Log("level", "error", "error", err.Error(), "msg", "Failed in cat command to workout hostname")
+			exitCode = 1
 			return
 		}
 
@@ -152,70 +177,72 @@ func main() {
 	logger.Log("level", "info", "container", container, "started", started, "msg", "starting ...", "stage", "#started")
 	defer logger.Log("msg", "goodbye")
 
-	// ---------------------------------------------------------------------------
-	//
-	// Mongo Setup
-	//
+	cfg, err := configFlags.Load(os.Getenv)
 
-	// Initialise mongodb connection
-	// Create a session which maintains a pool of socket connections to our MongoDB.
-	// Prepare the database
-	// We need this object to establish a session to our MongoDB.
-
-	mongoDBDialInfo := &mgo.DialInfo{
-		Addrs:    mongoHosts,
-		Timeout:  60 * time.Second,
-		Database: mongoDB,
-		// TODO: Add auth to mongo
-		//Username: MongoUsername,
-		//Password: MongoPassword,
+	if err != nil {
+		logger.Log("level", "crit", "msg", "Invalid configuration", "err", err)
+		exitCode = 1
+		return
 	}
 
-	mongoSession, mongoLogger = models.NewMongoSession(mongoDBDialInfo, logger, *mongoDebug)
-	defer mongoSession.Close()
+	logger.Log("level", "info", "msg", "configuration loaded", "staleness_window", cfg.StalenessWindow, "grace_period", cfg.GracePeriod, "heartbeat_interval", cfg.HeartBeatInterval, "heartbeat_flush_interval", cfg.HeartBeatFlushInterval, "tenants", strings.Join(cfg.Tenants, ","), "auth", cfg.AuthEnabled(), "tls", cfg.TLSCertFile != "", "debug_tls", cfg.DebugTLSCertFile != "", "linkerd_tls", cfg.LinkerdTLS())
 
-	models.PrepareDB(mongoSession, mongoDB, mongoLogger)
-
-	// ---------------------------------------------------------------------------
-	// LinkerD Setup
-	// If address is incorrect retries forever at the moment
-	// https://github.com/grpc/grpc-go/issues/133
-
-	var errL5d error
-
-	l5dLogger := log.With(logger, "connection", "linkerd")
-
-	l5dConn, errL5d = grpc.Dial(
-		l5dHost,
-		grpc.WithInsecure(),
-		grpc.WithTimeout(time.Second),
-	)
-
-	if errL5d != nil {
-		l5dLogger.Log("level", "crit", "msg", "Failed to connect to local linkerd")
-		errc <- errL5d
+	authn, err := newAuthenticator(cfg)
+	if err != nil {
+		logger.Log("level", "crit", "msg", "Invalid auth configuration", "err", err)
+		exitCode = 1
 		return
 	}
 
-	defer l5dConn.Close()
-	l5dLogger.Log("host", l5dHost, "msg", "successfully connected")
-
 	// ---------------------------------------------------------------------------
 	//
-	// Main
+	// TLS certificates (reloaded when their files change)
 	//
+	// The gRPC server, the debug HTTP server and the linkerd connection each
+	// have their own certificates (nil if they are plaintext)
+
+	var grpcCerts, debugCerts, l5dCerts *certs.Reloader
+	tlsCerts := make(map[string]*certs.Reloader)
+	for _, c := range []struct {
+		name              string
+		certs             **certs.Reloader
+		certFile, keyFile string
+		caFile            string
+		enabled           bool
+	}{
+		{"grpc", &grpcCerts, cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSClientCAFile, cfg.TLSCertFile != ""},
+		{"debug", &debugCerts, cfg.DebugTLSCertFile, cfg.DebugTLSKeyFile, cfg.DebugTLSClientCAFile, cfg.DebugTLSCertFile != ""},
+		{"linkerd", &l5dCerts, cfg.LinkerdTLSCertFile, cfg.LinkerdTLSKeyFile, cfg.LinkerdTLSCAFile, cfg.LinkerdTLS()},
+	} {
+		if !c.enabled {
+			continue
+		}
+		reloader, err := certs.New(c.certFile, c.keyFile, c.caFile, cfg.TLSReloadInterval, log.With(logger, "component", "certs", "certs", c.name))
+		if err != nil {
+			logger.Log("level", "crit", "msg", "Invalid TLS configuration", "certs", c.name, "err", err)
+			exitCode = 1
+			return
+		}
+		go reloader.Run()
+		defer reloader.Stop()
 
-	var (
-		tracer    = newTracer(logger, zipkinAddr)
-		metrics   = service.NewMetrics()
-		service   = service.NewService(logger, &metrics)
-		endpoints = endpoint.NewEndpoint(service, logger, metrics.Duration, tracer, mongoSession, mongoDB)
-	)
+		*c.certs = reloader
+		tlsCerts[c.name] = reloader
+	}
+
+	// Client certificates are optional (callers may have a bearer token instead)
+	var serverOptions []grpc.ServerOption
+	if grpcCerts != nil {
+		serverOptions = append(serverOptions, grpc.Creds(credentials.NewTLS(grpcCerts.ServerConfig(tls.VerifyClientCertIfGiven, "h2"))))
+	}
 
 	// ---------------------------------------------------------------------------
 	//
 	// HTTP server (Probes + For debug + prom stats)
 	//
+	// Started first so the readiness probe reports the service as starting
+	// (e.g. while mongo is unreachable) instead of the pod crash looping
+	//
 	httpLogger := log.With(logger, "component", "probe", "transport", "http")
 
 	// Liveness probe
@@ -234,10 +261,20 @@ func main() {
 		var ok = true
 		duration := time.Now().Sub(started)
 
+		// Not ready until mongo is connected and migrated and the servers run
+		select {
+		case <-ready:
+		default:
+			w.WriteHeader(503)
+			w.Write([]byte(fmt.Sprintf("starting: %v, duration: %v", stage.Load(), duration.Seconds())))
+			return
+		}
+
 		// Connected to mongo, check
 		if mongoSession != nil {
 			if errorMongo = mongoSession.Ping(); errorMongo != nil {
 				ok = false
+				models.RefreshOnError(mongoSession, errorMongo)
 			}
 		}
 
@@ -254,34 +291,249 @@ func main() {
 			}
 		}
 
+		// Certificate expiry (an expired certificate fails every handshake)
+		expiry := certExpiry(tlsCerts, time.Now())
+		var errorCerts error
+		for _, e := range expiry {
+			if e.expired {
+				errorCerts = fmt.Errorf("certificate %s expired at %v", e.name, e.notAfter)
+				ok = false
+			}
+		}
+
 		if ok {
 			w.WriteHeader(200)
 			w.Write([]byte("ok"))
+			for _, e := range expiry {
+				w.Write([]byte("\n" + e.String()))
+			}
 
 		} else {
-			httpLogger.Log("level", "error", "msg", fmt.Sprintf("Readiness Error linkerErr: %v, mongoErr: %v, duration: %v", errorLinker, errorMongo, duration.Seconds()))
+			httpLogger.Log("level", "error", "msg", fmt.Sprintf("Readiness Error linkerErr: %v, mongoErr: %v, certErr: %v, duration: %v", errorLinker, errorMongo, errorCerts, duration.Seconds()))
 			w.WriteHeader(500)
-			w.Write([]byte(fmt.Sprintf("linkerErr: %v, mongoErr: %v, duration: %v", errorLinker, errorMongo, duration.Seconds())))
+			w.Write([]byte(fmt.Sprintf("linkerErr: %v, mongoErr: %v, certErr: %v, duration: %v", errorLinker, errorMongo, errorCerts, duration.Seconds())))
+			for _, e := range expiry {
+				w.Write([]byte("\n" + e.String()))
+			}
 		}
 	})
 
-	// Debug metrics for go
-	http.HandleFunc("/debug/pprof/", http.HandlerFunc(pprof.Index))
-	http.HandleFunc("/debug/pprof/cmdline", http.HandlerFunc(pprof.Cmdline))
-	http.HandleFunc("/debug/pprof/profile", http.HandlerFunc(pprof.Profile))
-	http.HandleFunc("/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol))
-	http.HandleFunc("/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
+	// Debug metrics for go (only for clients with a certificate if there is a client CA)
+	requireCert := cfg.DebugTLSClientCAFile != ""
+	http.Handle("/debug/pprof/", clientCertRequired(requireCert, http.HandlerFunc(pprof.Index)))
+	http.Handle("/debug/pprof/cmdline", clientCertRequired(requireCert, http.HandlerFunc(pprof.Cmdline)))
+	http.Handle("/debug/pprof/profile", clientCertRequired(requireCert, http.HandlerFunc(pprof.Profile)))
+	http.Handle("/debug/pprof/symbol", clientCertRequired(requireCert, http.HandlerFunc(pprof.Symbol)))
+	http.Handle("/debug/pprof/trace", clientCertRequired(requireCert, http.HandlerFunc(pprof.Trace)))
 
 	// Metrics for prometheus
 	http.Handle("/metrics", promhttp.Handler())
 
 	go func() {
-		httpLogger.Log("addr", *debugAddr, "msg", "Running debug/probe/metrics http server")
-		errc <- http.ListenAndServe(*debugAddr, nil)
+		if debugCerts == nil {
+			httpLogger.Log("addr", *debugAddr, "msg", "Running debug/probe/metrics http server")
+			errc <- http.ListenAndServe(*debugAddr, nil)
+			return
+		}
+
+		ln, err := net.Listen("tcp", *debugAddr)
+		if err != nil {
+			errc <- err
+			return
+		}
+		// Probes and metrics scrapes have no client certificate (the pprof
+		// handlers require one)
+		httpLogger.Log("addr", *debugAddr, "msg", "Running debug/probe/metrics https server")
+		errc <- http.Serve(tls.NewListener(ln, debugCerts.ServerConfig(tls.VerifyClientCertIfGiven, "http/1.1")), nil)
 	}()
 
 	httpLogger.Log("msg", "successfully connected")
 
+	// ---------------------------------------------------------------------------
+	//
+	// Mongo Setup
+	//
+
+	// Initialise mongodb connection
+	// Create a session which maintains a pool of socket connections to our MongoDB.
+	// Prepare the database
+	// We need this object to establish a session to our MongoDB.
+
+	switch *dbBackend {
+	case "mongo", "mongo-driver":
+		if cfg.MongoURI != "" {
+			mongoURI = cfg.MongoURI
+		}
+		mongoSettings, err := models.ParseMongoURI(mongoURI)
+		if err != nil {
+			logger.Log("level", "crit", "msg", "Invalid mongo configuration", "err", err)
+			exitCode = 1
+			return
+		}
+		if cfg.MongoPassword != "" {
+			if mongoSettings.DialInfo.Username == "" {
+				logger.Log("level", "crit", "msg", "Invalid mongo configuration", "err", "a mongo password needs a user in the mongo uri")
+				exitCode = 1
+				return
+			}
+			mongoSettings.DialInfo.Password = cfg.MongoPassword
+		}
+
+		stage.Store("connecting to mongo")
+		ctx, cancel := context.Background(), func() {}
+		if cfg.DBStartupTimeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, cfg.DBStartupTimeout)
+		}
+		newSession := models.NewMongoSession
+		if *dbBackend == "mongo-driver" {
+			newSession = models.NewDriverSession
+		}
+		mongoSession, mongoLogger, err = newSession(ctx, mongoSettings, logger, *mongoDebug)
+		cancel()
+		if err != nil {
+			logger.Log("level", "crit", "msg", "Mongo is unreachable", "startup_timeout", cfg.DBStartupTimeout, "err", err)
+			exitCode = 1
+			return
+		}
+	case "postgres":
+		postgresSettings, err := models.ParsePostgresURI(cfg.PostgresURI)
+		if err != nil {
+			logger.Log("level", "crit", "msg", "Invalid postgres configuration", "err", err)
+			exitCode = 1
+			return
+		}
+
+		stage.Store("connecting to postgres")
+		ctx, cancel := context.Background(), func() {}
+		if cfg.DBStartupTimeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, cfg.DBStartupTimeout)
+		}
+		mongoSession, mongoLogger, err = models.NewPostgresSession(ctx, postgresSettings, logger)
+		cancel()
+		if err != nil {
+			logger.Log("level", "crit", "msg", "Postgres is unreachable", "startup_timeout", cfg.DBStartupTimeout, "err", err)
+			exitCode = 1
+			return
+		}
+	case "memory":
+		mongoSession, mongoLogger = models.NewMemorySession(logger)
+	default:
+		logger.Log("level", "crit", "msg", "Unknown storage backend: "+*dbBackend+" (expected mongo, mongo-driver, postgres or memory)")
+		exitCode = 1
+		return
+	}
+	defer mongoSession.Close()
+
+	// ---------------------------------------------------------------------------
+	//
+	// Migrations (of every tenant's database)
+	//
+	// "agent-mgmt [flags] migrate ..." only migrates (see runMigrate)
+
+	migrator, err := migrate.New(migrate.For(mongoSession), strings.TrimSpace(container)+"/"+strconv.Itoa(os.Getpid()), log.With(mongoLogger, "component", "migrate"))
+	if err != nil {
+		logger.Log("level", "crit", "msg", "Invalid migrations", "err", err)
+		exitCode = 1
+		return
+	}
+
+	stage.Store("migrating")
+	if flag.Arg(0) == "migrate" {
+		if err = runMigrate(context.Background(), migrator, mongoSession, mongoDB, cfg.Tenants, flag.Args()[1:], logger); err != nil {
+			logger.Log("level", "crit", "msg", "Migration failed", "err", err)
+			exitCode = 1
+		}
+		return
+	}
+
+	for _, id := range tenant.All(cfg.Tenants) {
+		db := tenant.Database(mongoDB, id)
+		if !cfg.MigrateOnStart {
+			_, pending, err := migrator.Status(context.Background(), mongoSession.DB(db))
+			if err != nil || len(pending) > 0 {
+				logger.Log("level", "warn", "msg", "Database is not migrated (run the migrate command)", "database", db, "pending", len(pending), "err", err)
+			}
+			continue
+		}
+
+		if _, err = migrator.Up(context.Background(), mongoSession.DB(db), 0); err != nil {
+			logger.Log("level", "crit", "msg", "Migration failed", "database", db, "err", err)
+			exitCode = 1
+			return
+		}
+	}
+
+	// ---------------------------------------------------------------------------
+	// LinkerD Setup
+	// If address is incorrect retries forever at the moment
+	// https://github.com/grpc/grpc-go/issues/133
+
+	var errL5d error
+	stage.Store("connecting to linkerd")
+
+	l5dLogger := log.With(logger, "connection", "linkerd")
+
+	l5dSecurity := grpc.WithInsecure()
+	if l5dCerts != nil {
+		l5dSecurity = grpc.WithTransportCredentials(l5dCerts.ClientCredentials(cfg.LinkerdTLSServerName))
+	}
+
+	l5dConn, errL5d = grpc.Dial(
+		l5dHost,
+		l5dSecurity,
+		grpc.WithTimeout(time.Second),
+	)
+
+	if errL5d != nil {
+		l5dLogger.Log("level", "crit", "msg", "Failed to connect to local linkerd")
+		errc <- errL5d
+		exitCode = 1
+		return
+	}
+
+	defer l5dConn.Close()
+	l5dLogger.Log("host", l5dHost, "msg", "successfully connected")
+
+	// ---------------------------------------------------------------------------
+	//
+	// Main
+	//
+
+	// Heartbeats are buffered and written in bulk unless the flush interval is 0
+	var beats *heartbeat.Buffer
+	if cfg.HeartBeatFlushInterval > 0 {
+		beats = heartbeat.NewBuffer()
+	}
+
+	var (
+		tracer  = newTracer(logger, zipkinAddr)
+		events  = watch.NewHub(watch.DefaultBuffer)
+		agents  = heartbeat.NewRegistry(heartbeat.DefaultBuffer)
+		metrics = service.NewMetrics()
+		svc     = service.NewService(cfg, models.NewTenantRepositories(mongoSession, mongoDB, cfg.Tenants), logger, &metrics, events, agents, beats)
+	)
+
+	// Outermost so the other middlewares see the tenant of the caller's token
+	if authn != nil {
+		svc = service.AuthMiddleware(authn, cfg.Tenants, logger)(svc)
+	}
+	endpoints := endpoint.NewEndpoint(svc, logger, metrics.Duration, tracer)
+
+	// ---------------------------------------------------------------------------
+	//
+	// Heartbeat flusher (writes buffered heartbeats to mongo in bulk)
+	//
+	flusher := heartbeat.NewFlusher(cfg, beats, mongoSession, mongoDB, log.With(logger, "component", "heartbeats"))
+	go flusher.Run()
+
+	// ---------------------------------------------------------------------------
+	//
+	// Reaper (cleans up stale agents, phone sessions and completed tasks)
+	//
+	reaperMetrics := reaper.NewMetrics()
+	dbReaper := reaper.New(cfg, mongoSession, mongoDB, log.With(logger, "component", "reaper"), &reaperMetrics, events, beats)
+	go dbReaper.Run()
+
 	// ---------------------------------------------------------------------------
 	//
 	// Interrupt Go-Routines (ctrl + c)
@@ -299,6 +551,8 @@ func main() {
 	// gRPC server (Main service)
 	//
 
+	s := grpc.NewServer(serverOptions...)
+
 	go func() {
 		gRPCLogger := log.With(logger, "component", "server", "transport", "gRPC")
 
@@ -313,8 +567,6 @@ func main() {
 		gRPCLogger.Log("addr", addr, "msg", "Running gRPC server")
 
 		srv := transport.GRPCServer(endpoints, tracer, gRPCLogger)
-		s := grpc.NewServer()
-		defer s.GracefulStop()
 		grpc_types.RegisterAgentMgmtServer(s, srv)
 
 		errc <- s.Serve(ln)
@@ -322,8 +574,22 @@ func main() {
 
 	// ---------------------------------------------------------------------------
 
+	close(ready)
+
 	// Exit!
 	logger.Log("exit", <-errc)
+
+	// End the WatchAgents and HeartBeatStream streams first otherwise
+	// GracefulStop waits on them forever (streaming agents are told to go away)
+	events.Close()
+	agents.Close()
+	s.GracefulStop()
+
+	// No more heartbeats can arrive so the buffered ones are flushed for good
+	flusher.Stop()
+
+	// Let an in-flight reaper pass finish before the mongo session is closed
+	dbReaper.Stop()
 }
 
 // ----
@@ -335,6 +601,152 @@ func envString(env, fallback string) string {
 	return e
 }
 
+// runMigrate runs the migrate command on every tenant's database:
+//
+//	migrate [up [version]]   applies the pending migrations (up to version)
+//	migrate down version     reverts the migrations after version
+//	migrate status           logs the applied and pending migrations
+func runMigrate(ctx context.Context, migrator *migrate.Migrator, session models.Session, mongoDB string, tenants []string, args []string, logger log.Logger) error {
+	command := "up"
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
+	target := 0
+	switch {
+	case command == "down" && len(args) != 1:
+		return fmt.Errorf("usage: migrate down version (0 reverts every migration)")
+	case command == "status" && len(args) != 0, len(args) > 1:
+		return fmt.Errorf("usage: migrate [up [version] | down version | status]")
+	case len(args) == 1:
+		var err error
+		if target, err = strconv.Atoi(args[0]); err != nil || target < 0 {
+			return fmt.Errorf("invalid version %q", args[0])
+		}
+	}
+
+	for _, id := range tenant.All(tenants) {
+		db := tenant.Database(mongoDB, id)
+		sessionCopy := session.Copy()
+
+		var err error
+		switch command {
+		case "up":
+			var n int
+			n, err = migrator.Up(ctx, sessionCopy.DB(db), target)
+			logger.Log("level", "info", "msg", "Migrated", "database", db, "applied", n)
+		case "down":
+			var n int
+			n, err = migrator.Down(ctx, sessionCopy.DB(db), target)
+			logger.Log("level", "info", "msg", "Migrated", "database", db, "reverted", n)
+		case "status":
+			var (
+				applied []models.AppliedMigration
+				pending []migrate.Migration
+			)
+			applied, pending, err = migrator.Status(ctx, sessionCopy.DB(db))
+			for _, a := range applied {
+				logger.Log("database", db, "version", a.Version, "name", a.Name, "applied_at", a.AppliedAt)
+			}
+			for _, m := range pending {
+				logger.Log("database", db, "version", m.Version, "name", m.Name, "applied_at", "pending")
+			}
+		default:
+			err = fmt.Errorf("unknown migrate command %q (expected up, down or status)", command)
+		}
+
+		sessionCopy.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", db, err)
+		}
+	}
+	return nil
+}
+
+// newAuthenticator returns the authenticator of the configured bearer token
+// keys and client CA (nil if auth is not enabled)
+func newAuthenticator(cfg config.Config) (auth.Authenticator, error) {
+	if !cfg.AuthEnabled() {
+		return nil, nil
+	}
+
+	var authenticators auth.Authenticators
+	if cfg.AuthHMACSecret != "" || cfg.AuthJWKSFile != "" {
+		var secret []byte
+		if cfg.AuthHMACSecret != "" {
+			secret = []byte(cfg.AuthHMACSecret)
+		}
+
+		var keys *auth.JWKS
+		if cfg.AuthJWKSFile != "" {
+			var err error
+			if keys, err = auth.LoadJWKS(cfg.AuthJWKSFile); err != nil {
+				return nil, err
+			}
+		}
+		authenticators = append(authenticators, auth.NewJWT(secret, keys, cfg.AuthIssuer, cfg.AuthAudience))
+	}
+	if cfg.TLSClientCAFile != "" {
+		authenticators = append(authenticators, auth.Certificates{})
+	}
+
+	roles := make(map[string][]auth.Role)
+	for subject, names := range cfg.AuthRoles {
+		for _, name := range names {
+			roles[subject] = append(roles[subject], auth.Role(name))
+		}
+	}
+	return auth.WithRoles(authenticators, roles), nil
+}
+
+// expiry is when a certificate expires
+type expiry struct {
+	name     string
+	notAfter time.Time
+	left     time.Duration
+	expired  bool
+}
+
+func (e expiry) String() string {
+	return fmt.Sprintf("certificate %s expires %s (in %v)", e.name, e.notAfter.UTC().Format(time.RFC3339), e.left)
+}
+
+// certExpiry returns when the certificates (with a certificate, not only a
+// CA) expire at time now, by name
+func certExpiry(tlsCerts map[string]*certs.Reloader, now time.Time) []expiry {
+	var names []string
+	for name := range tlsCerts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var expiries []expiry
+	for _, name := range names {
+		notAfter := tlsCerts[name].NotAfter()
+		if notAfter.IsZero() {
+			continue
+		}
+		left := notAfter.Sub(now).Truncate(time.Second)
+		expiries = append(expiries, expiry{name, notAfter, left, left <= 0})
+	}
+	return expiries
+}
+
+// clientCertRequired returns h refusing requests without a verified client
+// certificate if required
+func clientCertRequired(required bool, h http.Handler) http.Handler {
+	if !required {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "a client certificate is required", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
 func newTracer(logger log.Logger, zipkinAddr *string) stdopentracing.Tracer {
 	// Tracing domain.
 	var tracer stdopentracing.Tracer
@@ -0,0 +1,281 @@
+package migrate
+
+// migrate.go
+// Versioned schema migrations of a (tenant's) database. The versions applied
+// are recorded in models.MigrationsCollection and a lock (renewed while
+// migrating) stops two pods migrating the same database at once. Every step is idempotent so databases
+// prepared before migrations were recorded migrate cleanly.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/newtonsystems/agent-mgmt/app/models"
+)
+
+const (
+	// LockTTL how long the migration lock is held before another pod may take
+	// it over (in case its holder was killed mid migration)
+	LockTTL = 10 * time.Minute
+	// LockRetry how often a held lock is tried again
+	LockRetry = time.Second
+)
+
+// LockRenew how often the migration lock is renewed while migrating (well
+// within LockTTL, tests can shorten it)
+var LockRenew = LockTTL / 5
+
+// ErrLockLost is returned when the migration lock could not be renewed
+// before it expired (another process may be migrating)
+var ErrLockLost = errors.New("lost the migration lock")
+
+// NowFunc is used to get the current time (tests can override it)
+var NowFunc = time.Now
+
+// Migration is a versioned change to a database. Up and Down must be
+// idempotent (e.g. create an index or counter only if it is missing).
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, db models.DataLayer) error
+	Down    func(ctx context.Context, db models.DataLayer) error
+}
+
+// Migrator migrates databases with its migrations
+type Migrator struct {
+	migrations []Migration
+	owner      string
+	logger     log.Logger
+}
+
+// New returns a Migrator of migrations (in version order). owner identifies
+// the migrating process in the lock (e.g. its pod name).
+func New(migrations []Migration, owner string, logger log.Logger) (*Migrator, error) {
+	for i, m := range migrations {
+		if m.Version <= 0 {
+			return nil, fmt.Errorf("migration %s: version must be positive", m.Name)
+		}
+		if i > 0 && m.Version <= migrations[i-1].Version {
+			return nil, fmt.Errorf("migration %d (%s) is not after migration %d", m.Version, m.Name, migrations[i-1].Version)
+		}
+		if m.Up == nil || m.Down == nil {
+			return nil, fmt.Errorf("migration %d (%s) needs an up and a down step", m.Version, m.Name)
+		}
+	}
+	return &Migrator{migrations: migrations, owner: owner, logger: logger}, nil
+}
+
+// Latest returns the version of the last migration (0 without any)
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Status returns the migrations applied to db and those pending
+func (m *Migrator) Status(ctx context.Context, db models.DataLayer) ([]models.AppliedMigration, []Migration, error) {
+	applied, err := db.AppliedMigrations(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	done := make(map[int]bool)
+	for _, a := range applied {
+		done[a.Version] = true
+	}
+
+	var pending []Migration
+	for _, migration := range m.migrations {
+		if !done[migration.Version] {
+			pending = append(pending, migration)
+		}
+	}
+	return applied, pending, nil
+}
+
+// Up applies the migrations pending on db up to version target (all of them
+// if 0) and returns how many it applied
+func (m *Migrator) Up(ctx context.Context, db models.DataLayer, target int) (int, error) {
+	lock, err := m.lock(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.release()
+	ctx = lock.ctx
+
+	// Read under the lock, another pod may just have migrated db
+	_, pending, err := m.Status(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, migration := range pending {
+		if target > 0 && migration.Version > target {
+			break
+		}
+
+		m.logger.Log("level", "info", "msg", "Applying migration", "version", migration.Version, "name", migration.Name)
+		if err = migration.Up(ctx, db); err != nil || lock.err() != nil {
+			return n, fmt.Errorf("migration %d (%s) failed: %v", migration.Version, migration.Name, lock.errOr(err))
+		}
+		if err = db.AddMigration(ctx, models.AppliedMigration{Version: migration.Version, Name: migration.Name, AppliedAt: NowFunc()}); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Down reverts the migrations applied to db after version target (in reverse
+// order) and returns how many it reverted
+func (m *Migrator) Down(ctx context.Context, db models.DataLayer, target int) (int, error) {
+	lock, err := m.lock(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.release()
+	ctx = lock.ctx
+
+	applied, _, err := m.Status(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+
+	migrations := make(map[int]Migration)
+	for _, migration := range m.migrations {
+		migrations[migration.Version] = migration
+	}
+
+	n := 0
+	for i := len(applied) - 1; i >= 0 && applied[i].Version > target; i-- {
+		migration, ok := migrations[applied[i].Version]
+		if !ok {
+			return n, fmt.Errorf("migration %d (%s) is unknown to this version of the service", applied[i].Version, applied[i].Name)
+		}
+
+		m.logger.Log("level", "info", "msg", "Reverting migration", "version", migration.Version, "name", migration.Name)
+		if err = migration.Down(ctx, db); err != nil || lock.err() != nil {
+			return n, fmt.Errorf("reverting migration %d (%s) failed: %v", migration.Version, migration.Name, lock.errOr(err))
+		}
+		if err = db.RemoveMigration(ctx, migration.Version); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// heldLock is the migration lock of db held by owner. It is renewed every
+// LockRenew until it is released, its context is cancelled if it is lost.
+type heldLock struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	lost   int32
+
+	db     models.DataLayer
+	owner  string
+	logger log.Logger
+}
+
+// lock waits for the migration lock of db (until ctx is done) and returns it
+func (m *Migrator) lock(ctx context.Context, db models.DataLayer) (*heldLock, error) {
+	var expires time.Time
+	for {
+		now := NowFunc()
+		expires = now.Add(LockTTL)
+		locked, err := db.LockMigrations(ctx, m.owner, expires, now)
+		if err != nil {
+			return nil, err
+		}
+		if locked {
+			break
+		}
+
+		m.logger.Log("level", "info", "msg", "Waiting for another process to finish migrating")
+		select {
+		case <-time.After(LockRetry):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	l := &heldLock{done: make(chan struct{}), db: db, owner: m.owner, logger: m.logger}
+	l.ctx, l.cancel = context.WithCancel(ctx)
+	go l.renew(expires)
+	return l, nil
+}
+
+// renew renews the lock every LockRenew. A failed renewal is retried until
+// the lock is about to expire, then (or once another process holds it) the
+// lock is lost.
+func (l *heldLock) renew(expires time.Time) {
+	defer close(l.done)
+
+	ticker := time.NewTicker(LockRenew)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-l.ctx.Done():
+			return
+		}
+
+		next := NowFunc().Add(LockTTL)
+		renewed, err := l.db.RenewMigrationLock(l.ctx, l.owner, next)
+		if err == nil && renewed {
+			expires = next
+			continue
+		}
+		if l.ctx.Err() != nil {
+			return
+		}
+		if err != nil && NowFunc().Add(LockRenew).Before(expires) {
+			l.logger.Log("level", "warn", "msg", "Failed to renew the migration lock", "expires", expires, "err", err)
+			continue
+		}
+
+		l.logger.Log("level", "error", "msg", "Lost the migration lock, stopping", "err", err)
+		atomic.StoreInt32(&l.lost, 1)
+		l.cancel()
+		return
+	}
+}
+
+// err returns ErrLockLost once the lock is lost
+func (l *heldLock) err() error {
+	if atomic.LoadInt32(&l.lost) == 1 {
+		return ErrLockLost
+	}
+	return nil
+}
+
+// errOr returns ErrLockLost once the lock is lost, otherwise err
+func (l *heldLock) errOr(err error) error {
+	if lockErr := l.err(); lockErr != nil {
+		return lockErr
+	}
+	return err
+}
+
+// release stops renewing the lock and releases it (unless it was lost)
+func (l *heldLock) release() {
+	l.cancel()
+	<-l.done
+
+	if l.err() != nil {
+		return
+	}
+	// Released even if the migration's context is done
+	if err := l.db.UnlockMigrations(context.Background(), l.owner); err != nil {
+		l.logger.Log("level", "error", "msg", "Failed to release the migration lock (it expires after "+LockTTL.String()+")", "err", err)
+	}
+}
@@ -0,0 +1,237 @@
+package migrate_test
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/newtonsystems/agent-mgmt/app/migrate"
+	"github.com/newtonsystems/agent-mgmt/app/models"
+	tu "github.com/newtonsystems/agent-mgmt/app/testutil"
+)
+
+// newDB returns an empty (not migrated) in-memory database
+func newDB() models.DataLayer {
+	session, _ := models.NewMemorySession(log.NewNopLogger())
+	return session.DB("migrate_test")
+}
+
+func newMigrator(t *testing.T, owner string) *migrate.Migrator {
+	migrator, err := migrate.New(migrate.Migrations, owner, log.NewNopLogger())
+	tu.Ok(t, err)
+	return migrator
+}
+
+func versions(applied []models.AppliedMigration) []int {
+	var vs []int
+	for _, a := range applied {
+		vs = append(vs, a.Version)
+	}
+	return vs
+}
+
+func TestUpDown(t *testing.T) {
+	ctx := context.Background()
+	db := newDB()
+	migrator := newMigrator(t, "pod-1")
+
+	n, err := migrator.Up(ctx, db, 0)
+	tu.Ok(t, err)
+	tu.Equals(t, len(migrate.Migrations), n)
+
+	applied, pending, err := migrator.Status(ctx, db)
+	tu.Ok(t, err)
+	tu.Equals(t, migrator.Latest(), applied[len(applied)-1].Version)
+	tu.Equals(t, 0, len(pending))
+
+	// Counters and unique indexes are in place
+	taskID, err := db.GetNextSequence(ctx, "taskid")
+	tu.Ok(t, err)
+	tu.Equals(t, int32(2), taskID)
+	tu.Ok(t, db.C("agents").Insert(&models.Agent{AgentID: 1}))
+	tu.Assert(t, db.C("agents").Insert(&models.Agent{AgentID: 1}) != nil, "expected agent IDs to be unique")
+
+	// Nothing is left to apply
+	n, err = migrator.Up(ctx, db, 0)
+	tu.Ok(t, err)
+	tu.Equals(t, 0, n)
+
+	n, err = migrator.Down(ctx, db, 1)
+	tu.Ok(t, err)
+	tu.Equals(t, len(migrate.Migrations)-1, n)
+	applied, _, err = migrator.Status(ctx, db)
+	tu.Ok(t, err)
+	tu.Equals(t, []int{1}, versions(applied))
+	tu.Ok(t, db.C("agents").Insert(&models.Agent{AgentID: 1}))
+
+	// Reverting the counters keeps them so IDs are not issued again
+	n, err = migrator.Down(ctx, db, 0)
+	tu.Ok(t, err)
+	tu.Equals(t, 1, n)
+	taskID, err = db.GetNextSequence(ctx, "taskid")
+	tu.Ok(t, err)
+	tu.Equals(t, int32(3), taskID)
+
+	n, err = migrator.Up(ctx, db, 2)
+	tu.Ok(t, err)
+	tu.Equals(t, 2, n)
+	applied, pending, err = migrator.Status(ctx, db)
+	tu.Ok(t, err)
+	tu.Equals(t, []int{1, 2}, versions(applied))
+	tu.Equals(t, len(migrate.Migrations)-2, len(pending))
+	taskID, err = db.GetNextSequence(ctx, "taskid")
+	tu.Ok(t, err)
+	tu.Equals(t, int32(4), taskID)
+}
+
+// Databases prepared before migrations were recorded keep their counters
+func TestUpPreparedDatabase(t *testing.T) {
+	ctx := context.Background()
+	db := newDB()
+
+	tu.Ok(t, db.C("counters").Insert(bson.M{"_id": "taskid", "seq": 41}))
+	tu.Ok(t, db.C("agents").EnsureIndex(mgo.Index{Key: []string{"agentid"}, Unique: true, DropDups: true}))
+
+	_, err := newMigrator(t, "pod-1").Up(ctx, db, 0)
+	tu.Ok(t, err)
+
+	taskID, err := db.GetNextSequence(ctx, "taskid")
+	tu.Ok(t, err)
+	tu.Equals(t, int32(42), taskID)
+	agentID, err := db.GetNextSequence(ctx, "agentid")
+	tu.Ok(t, err)
+	tu.Equals(t, int32(2), agentID)
+}
+
+func TestLock(t *testing.T) {
+	db := newDB()
+
+	// Another pod is migrating
+	now := time.Now()
+	locked, err := db.LockMigrations(context.Background(), "pod-2", now.Add(migrate.LockTTL), now)
+	tu.Ok(t, err)
+	tu.Equals(t, true, locked)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = newMigrator(t, "pod-1").Up(ctx, db, 0)
+	tu.Equals(t, context.DeadlineExceeded, err)
+
+	// Once it is done the lock is released
+	tu.Ok(t, db.UnlockMigrations(context.Background(), "pod-2"))
+	n, err := newMigrator(t, "pod-1").Up(context.Background(), db, 0)
+	tu.Ok(t, err)
+	tu.Equals(t, len(migrate.Migrations), n)
+
+	// and left free
+	locked, err = db.LockMigrations(context.Background(), "pod-2", now.Add(migrate.LockTTL), now)
+	tu.Ok(t, err)
+	tu.Equals(t, true, locked)
+}
+
+// clock is a NowFunc the tests move forward
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) Add(d time.Duration) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	return c.now
+}
+
+func TestLockRenewed(t *testing.T) {
+	c := &clock{now: time.Now()}
+	migrate.NowFunc = c.Now
+	migrate.LockRenew = 5 * time.Millisecond
+	defer func() { migrate.NowFunc = time.Now; migrate.LockRenew = migrate.LockTTL / 5 }()
+
+	db := newDB()
+	ctx := context.Background()
+
+	// A migration taking longer than the lock's TTL keeps the lock
+	slow := func(ctx context.Context, db models.DataLayer) error {
+		for i := 0; i < 3; i++ {
+			now := c.Add(migrate.LockTTL / 2)
+			time.Sleep(50 * time.Millisecond)
+			locked, err := db.LockMigrations(ctx, "pod-2", now.Add(migrate.LockTTL), now)
+			tu.Ok(t, err)
+			tu.Equals(t, false, locked)
+		}
+		return nil
+	}
+	migrator, err := migrate.New([]migrate.Migration{{Version: 1, Name: "slow", Up: slow, Down: slow}}, "pod-1", log.NewNopLogger())
+	tu.Ok(t, err)
+	n, err := migrator.Up(ctx, db, 0)
+	tu.Ok(t, err)
+	tu.Equals(t, 1, n)
+
+	// A migration that loses the lock to another pod stops
+	lost := func(ctx context.Context, db models.DataLayer) error {
+		now := c.Add(2 * migrate.LockTTL)
+		locked, err := db.LockMigrations(ctx, "pod-2", now.Add(migrate.LockTTL), now)
+		tu.Ok(t, err)
+		tu.Equals(t, true, locked)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+			return nil
+		}
+	}
+	migrator, err = migrate.New([]migrate.Migration{{Version: 1, Name: "lost", Up: lost, Down: lost}}, "pod-1", log.NewNopLogger())
+	tu.Ok(t, err)
+	n, err = migrator.Up(ctx, newDB(), 0)
+	tu.Assert(t, err != nil && strings.Contains(err.Error(), migrate.ErrLockLost.Error()), "expected the migration to stop, got %v", err)
+	tu.Equals(t, 0, n)
+}
+
+func TestNew(t *testing.T) {
+	step := func(ctx context.Context, db models.DataLayer) error { return nil }
+
+	for _, migrations := range [][]migrate.Migration{
+		{{Version: 0, Name: "zero", Up: step, Down: step}},
+		{{Version: 2, Name: "two", Up: step, Down: step}, {Version: 1, Name: "one", Up: step, Down: step}},
+		{{Version: 1, Name: "one", Up: step, Down: step}, {Version: 1, Name: "again", Up: step, Down: step}},
+		{{Version: 1, Name: "one", Up: step}},
+	} {
+		_, err := migrate.New(migrations, "pod-1", log.NewNopLogger())
+		tu.Assert(t, err != nil, "expected an error for migrations %v", migrations)
+	}
+
+	// Migrations this version does not know cannot be reverted
+	ctx := context.Background()
+	db := newDB()
+	tu.Ok(t, db.AddMigration(ctx, models.AppliedMigration{Version: 99, Name: "future", AppliedAt: time.Now()}))
+	_, err := newMigrator(t, "pod-1").Down(ctx, db, 0)
+	tu.Assert(t, err != nil, "expected an error reverting an unknown migration")
+}
+
+func TestFor(t *testing.T) {
+	session, _ := models.NewMemorySession(log.NewNopLogger())
+	tu.Equals(t, len(migrate.Migrations), len(migrate.For(session)))
+	tu.Equals(t, len(migrate.PostgresMigrations), len(migrate.For(&models.PostgresSession{})))
+
+	// Postgres databases have the same migration versions
+	migrator, err := migrate.New(migrate.PostgresMigrations, "pod-1", log.NewNopLogger())
+	tu.Ok(t, err)
+	tu.Equals(t, newMigrator(t, "pod-1").Latest(), migrator.Latest())
+
+	// The SQL migrations only run on postgres
+	_, err = migrator.Up(context.Background(), newDB(), 0)
+	tu.Assert(t, err != nil, "expected an error running the SQL migrations on the in-memory database")
+}
@@ -0,0 +1,213 @@
+package migrate
+
+// migrations.go
+// The schema migrations of the service. Never change a migration once it has
+// been released, add a new version instead.
+
+import (
+	"context"
+	"fmt"
+
+	mgo "gopkg.in/mgo.v2"
+
+	"github.com/newtonsystems/agent-mgmt/app/models"
+)
+
+// Migrations are the migrations of every database (in version order)
+var Migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "counters",
+		Up:      createCounters("taskid", "agentid"),
+		// The counters are kept, dropping them would issue the IDs of the
+		// agents and tasks in the database again
+		Down: keepCounters,
+	},
+	{
+		Version: 2,
+		Name:    "unique_agent_and_session_ids",
+		Up: createIndexes(map[string]mgo.Index{
+			"agents":        {Key: []string{"agentid"}, Unique: true, DropDups: true},
+			"phonesessions": {Key: []string{"sessid"}, Unique: true, DropDups: true},
+		}),
+		Down: dropIndexes(map[string][]string{
+			"agents":        {"agentid"},
+			"phonesessions": {"sessid"},
+		}),
+	},
+	{
+		Version: 3,
+		Name:    "agent_skills_index",
+		// GetAgents matches required skills (skills.$elemMatch)
+		Up:   createIndexes(map[string]mgo.Index{"agents": {Key: []string{"skills.name", "skills.level"}}}),
+		Down: dropIndexes(map[string][]string{"agents": {"skills.name", "skills.level"}}),
+	},
+	{
+		Version: 4,
+		Name:    "task_status_index",
+		// ListTasks filters on status and customer
+		Up:   createIndexes(map[string]mgo.Index{"tasks": {Key: []string{"status", "custid"}}}),
+		Down: dropIndexes(map[string][]string{"tasks": {"status", "custid"}}),
+	},
+	{
+		Version: 5,
+		Name:    "agent_state_changed_index",
+		// GetAgents sorts the longest idle agents (AgentSortStateChangedAt)
+		Up:   createIndexes(map[string]mgo.Index{"agents": {Key: []string{"state", "statechangedat", "agentid"}}}),
+		Down: dropIndexes(map[string][]string{"agents": {"state", "statechangedat", "agentid"}}),
+	},
+}
+
+// createCounters returns the step creating the counters (see
+// GetNextSequence) that do not exist yet
+func createCounters(names ...string) func(ctx context.Context, db models.DataLayer) error {
+	return func(ctx context.Context, db models.DataLayer) error {
+		for _, name := range names {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			err := db.C("counters").Insert(&models.Count{ID: name, Seq: 1})
+			if err != nil && !mgo.IsDup(err) {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// keepCounters is the step reverting createCounters (it changes nothing)
+func keepCounters(ctx context.Context, db models.DataLayer) error {
+	return ctx.Err()
+}
+
+// createIndexes returns the step creating an index of each collection
+// (EnsureIndex leaves existing indexes be)
+func createIndexes(indexes map[string]mgo.Index) func(ctx context.Context, db models.DataLayer) error {
+	return func(ctx context.Context, db models.DataLayer) error {
+		for collection, index := range indexes {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := db.C(collection).EnsureIndex(index); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// dropIndexes returns the step dropping the index with key of each collection
+// (if it exists)
+func dropIndexes(keys map[string][]string) func(ctx context.Context, db models.DataLayer) error {
+	return func(ctx context.Context, db models.DataLayer) error {
+		for collection, key := range keys {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := db.C(collection).DropIndex(key...); err != nil && !models.IsIndexNotFound(err) {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// PostgresMigrations are the migrations of every postgres database (in
+// version order, see models.PostgresDatabase). They mirror Migrations.
+var PostgresMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "counters",
+		// Like the mongo counters the first ID is 2
+		Up: execSQL(`CREATE SEQUENCE IF NOT EXISTS taskid_seq AS integer START 2;
+			CREATE SEQUENCE IF NOT EXISTS agentid_seq AS integer START 2`),
+		Down: execSQL(`DROP SEQUENCE IF EXISTS taskid_seq;
+			DROP SEQUENCE IF EXISTS agentid_seq`),
+	},
+	{
+		Version: 2,
+		Name:    "tables",
+		Up: execSQL(`CREATE TABLE IF NOT EXISTS agents (
+				agentid integer PRIMARY KEY,
+				state text,
+				statechangedat timestamptz,
+				lastheartbeat timestamptz NOT NULL,
+				skills jsonb
+			);
+			CREATE TABLE IF NOT EXISTS phone_sessions (
+				sessid integer PRIMARY KEY,
+				agentid integer NOT NULL,
+				refid text NOT NULL,
+				createdat timestamptz
+			);
+			CREATE INDEX IF NOT EXISTS phone_sessions_refid ON phone_sessions (refid);
+			CREATE INDEX IF NOT EXISTS phone_sessions_createdat ON phone_sessions (createdat);
+			CREATE TABLE IF NOT EXISTS tasks (
+				taskid integer PRIMARY KEY,
+				custid integer NOT NULL,
+				agentids integer[],
+				requiredskills jsonb,
+				status text,
+				addedat timestamptz NOT NULL,
+				offeredat timestamptz,
+				acceptedby integer NOT NULL DEFAULT 0,
+				acceptedat timestamptz,
+				releasedagentids integer[],
+				startedat timestamptz,
+				completedat timestamptz,
+				abandonedat timestamptz,
+				cancelledat timestamptz
+			);
+			CREATE TABLE IF NOT EXISTS archived_tasks (LIKE tasks INCLUDING ALL)`),
+		Down: execSQL(`DROP TABLE IF EXISTS archived_tasks;
+			DROP TABLE IF EXISTS tasks;
+			DROP TABLE IF EXISTS phone_sessions;
+			DROP TABLE IF EXISTS agents`),
+	},
+	{
+		Version: 3,
+		Name:    "agent_skills_index",
+		// GetAgents matches required skills (skills @> ...)
+		Up:   execSQL(`CREATE INDEX IF NOT EXISTS agents_skills ON agents USING GIN (skills)`),
+		Down: execSQL(`DROP INDEX IF EXISTS agents_skills`),
+	},
+	{
+		Version: 4,
+		Name:    "task_status_index",
+		// ListTasks filters on status and customer
+		Up:   execSQL(`CREATE INDEX IF NOT EXISTS tasks_status_custid ON tasks (status, custid)`),
+		Down: execSQL(`DROP INDEX IF EXISTS tasks_status_custid`),
+	},
+	{
+		Version: 5,
+		Name:    "agent_state_changed_index",
+		// GetAgents sorts the longest idle agents (AgentSortStateChangedAt)
+		Up:   execSQL(`CREATE INDEX IF NOT EXISTS agents_state_statechangedat ON agents (state, statechangedat NULLS FIRST, agentid)`),
+		Down: execSQL(`DROP INDEX IF EXISTS agents_state_statechangedat`),
+	},
+}
+
+// For returns the migrations of the databases of session
+func For(session models.Session) []Migration {
+	if _, ok := session.(*models.PostgresSession); ok {
+		return PostgresMigrations
+	}
+	return Migrations
+}
+
+// sqlExecer is a database the SQL migrations can run on
+type sqlExecer interface {
+	ExecSQL(ctx context.Context, query string) error
+}
+
+// execSQL returns the step running the SQL statements query in the database
+// (see models.PostgresDatabase.ExecSQL)
+func execSQL(query string) func(ctx context.Context, db models.DataLayer) error {
+	return func(ctx context.Context, db models.DataLayer) error {
+		execer, ok := db.(sqlExecer)
+		if !ok {
+			return fmt.Errorf("%T cannot run SQL migrations", db)
+		}
+		return execer.ExecSQL(ctx, query)
+	}
+}
@@ -4,8 +4,10 @@ package models
 // Agent Model / Mongo Calls
 
 import (
+	"context"
 	// "errors"
 
+	"sort"
 	"strconv"
 	"time"
 
@@ -14,6 +16,7 @@ import (
 	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
 
 	"github.com/newtonsystems/agent-mgmt/app/utils"
+	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
@@ -29,16 +32,146 @@ func init() {
 	}
 }
 
+// maxAgentIDAttempts is how many sequence values AddAgent tries before giving up
+// when the allocated agent ID is already taken (unique agentid index)
+const maxAgentIDAttempts = 100
+
+// AgentState is the presence state of an agent
+type AgentState string
+
+const (
+	// AgentOffline agent is not connected (registered agents start offline)
+	AgentOffline AgentState = "offline"
+	// AgentAvailable agent can be offered calls
+	AgentAvailable AgentState = "available"
+	// AgentBusy agent is connected but doing other work
+	AgentBusy AgentState = "busy"
+	// AgentOnCall agent has accepted a call (see AcceptCall)
+	AgentOnCall AgentState = "on-call"
+	// AgentWrapUp agent has completed a call and is finishing up (see CompleteTask)
+	AgentWrapUp AgentState = "wrap-up"
+	// AgentAway agent is connected but away from their desk
+	AgentAway AgentState = "away"
+)
+
+// agentStateTransitions are the states an agent can move to from each state
+// An agent can always go offline (sign out or lose connection)
+var agentStateTransitions = map[AgentState][]AgentState{
+	AgentOffline:   {AgentAvailable},
+	AgentAvailable: {AgentBusy, AgentAway, AgentOnCall, AgentOffline},
+	AgentBusy:      {AgentAvailable, AgentAway, AgentOffline},
+	AgentAway:      {AgentAvailable, AgentBusy, AgentOffline},
+	AgentOnCall:    {AgentWrapUp, AgentOffline},
+	AgentWrapUp:    {AgentAvailable, AgentBusy, AgentAway, AgentOffline},
+}
+
+// ParseAgentState returns the AgentState for name or ErrAgentStateInvalid if unknown
+func ParseAgentState(name string) (AgentState, error) {
+	state := AgentState(name)
+	if _, ok := agentStateTransitions[state]; !ok {
+		return "", amerrors.ErrAgentStateInvalidError("unknown agent state: " + name)
+	}
+	return state, nil
+}
+
+// CanTransition returns whether an agent in state from can move to state to
+// Agents with no state (created before agent states) are treated as offline
+func CanTransition(from AgentState, to AgentState) bool {
+	if from == "" {
+		from = AgentOffline
+	}
+	for _, state := range agentStateTransitions[from] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Agent - StateChangedAt is when the agent entered its current state (used to
+// find the longest idle agents). Skills are the agent's skill profile (see SetAgentSkills)
 type Agent struct {
-	AgentID       int32     `bson:"agentid" json:"agentid"`
-	LastHeartBeat time.Time `bson:"lastheartbeat" json:"lastheartbeat"`
+	AgentID        int32      `bson:"agentid" json:"agentid"`
+	State          AgentState `bson:"state" json:"state"`
+	StateChangedAt time.Time  `bson:"statechangedat,omitempty" json:"statechangedat"`
+	LastHeartBeat  time.Time  `bson:"lastheartbeat" json:"lastheartbeat"`
+	Skills         []Skill    `bson:"skills,omitempty" json:"skills"`
+}
+
+// AgentSort is the field GetAgents sorts agents by
+type AgentSort string
+
+const (
+	// AgentSortNone leaves the agents in the database's order
+	AgentSortNone AgentSort = ""
+	// AgentSortID sorts agents by agent ID
+	AgentSortID AgentSort = "agentid"
+	// AgentSortStateChangedAt sorts the agents that entered their state first
+	// first (agents without the time first), then by agent ID
+	AgentSortStateChangedAt AgentSort = "statechangedat"
+)
+
+// AgentOrder is the order GetAgents returns agents in so a limit keeps the
+// first agents of that order
+type AgentOrder struct {
+	By AgentSort
+	// AfterAgentID only returns the agents with a greater agent ID (0 returns
+	// every agent)
+	AfterAgentID int32
+}
+
+// selector adds the agents o starts after to selector
+func (o AgentOrder) selector(selector bson.M) bson.M {
+	if o.AfterAgentID != 0 {
+		selector["agentid"] = bson.M{"$gt": o.AfterAgentID}
+	}
+	return selector
+}
+
+// fields returns the fields agents are sorted by (ascending)
+func (o AgentOrder) fields() []string {
+	switch o.By {
+	case AgentSortID:
+		return []string{"agentid"}
+	case AgentSortStateChangedAt:
+		return []string{"statechangedat", "agentid"}
+	}
+	return nil
+}
+
+// Apply returns the agents of agents o starts after in o's order, at most
+// limit (0 is no limit). It is how a data layer that can't sort orders agents.
+func (o AgentOrder) Apply(agents []Agent, limit int32) []Agent {
+	ordered := agents[:0]
+	for _, agent := range agents {
+		if agent.AgentID > o.AfterAgentID {
+			ordered = append(ordered, agent)
+		}
+	}
+
+	switch o.By {
+	case AgentSortID:
+		sort.Slice(ordered, func(i, j int) bool { return ordered[i].AgentID < ordered[j].AgentID })
+	case AgentSortStateChangedAt:
+		sort.Slice(ordered, func(i, j int) bool {
+			if !ordered[i].StateChangedAt.Equal(ordered[j].StateChangedAt) {
+				return ordered[i].StateChangedAt.Before(ordered[j].StateChangedAt)
+			}
+			return ordered[i].AgentID < ordered[j].AgentID
+		})
+	}
+
+	if limit > 0 && len(ordered) > int(limit) {
+		return ordered[:limit]
+	}
+	return ordered
 }
 
 // Mongo Calls
 
 // AgentExists check whether an agent exist based of its agent ID
-func (db *MongoDatabase) AgentExists(agentID int32) (bool, error) {
-	count, err := db.C("agents").Find(bson.M{"agentid": agentID}).Count()
+func (db *MongoDatabase) AgentExists(ctx context.Context, agentID int32) (bool, error) {
+	count, err := db.c(ctx, "agents").Find(bson.M{"agentid": agentID}).Count()
 
 	if err != nil {
 		return false, err
@@ -51,9 +184,23 @@ func (db *MongoDatabase) AgentExists(agentID int32) (bool, error) {
 	return true, nil
 }
 
+// GetAgent returns the agent with agent ID
+func (db *MongoDatabase) GetAgent(ctx context.Context, agentID int32) (Agent, error) {
+	var agent Agent
+
+	err := db.c(ctx, "agents").Find(bson.M{"agentid": agentID}).One(&agent)
+
+	if err == mgo.ErrNotFound {
+		return Agent{}, amerrors.ErrAgentNotFoundError("failed to find an Agent(AgentID=" + strconv.Itoa(int(agentID)) + ")")
+	}
+
+	return agent, err
+}
+
 // HeartBeat updates LastHeartBeat with current time now
-func (db *MongoDatabase) HeartBeat(agentID int32) error {
-	exists, err := db.AgentExists(agentID)
+// An offline agent becomes available on its heartbeat
+func (db *MongoDatabase) HeartBeat(ctx context.Context, agentID int32) error {
+	exists, err := db.AgentExists(ctx, agentID)
 
 	if !exists {
 		logger.Log("level", "err", "err", err)
@@ -62,19 +209,203 @@ func (db *MongoDatabase) HeartBeat(agentID int32) error {
 
 	selector := bson.M{"agentid": agentID}
 	update := bson.M{"$set": bson.M{"lastheartbeat": NowFunc()}}
-	err = db.C("agents").Update(selector, update)
+	err = db.c(ctx, "agents").Update(selector, update)
+
+	if err != nil {
+		return err
+	}
+
+	selector = bson.M{"agentid": agentID, "state": bson.M{"$in": []interface{}{AgentOffline, nil}}}
+	update = bson.M{"$set": bson.M{"state": AgentAvailable, "statechangedat": NowFunc()}}
+	err = db.c(ctx, "agents").Update(selector, update)
+
+	if err == mgo.ErrNotFound {
+		// Agent was not offline so there is nothing to do
+		return nil
+	}
 
 	return err
 }
 
-// GetAgents returns all Agents within a certain heartbeat
-func (db *MongoDatabase) GetAgents(timestamp time.Time, limit int32) ([]Agent, error) {
+// HeartBeats writes buffered heartbeats (agent id -> time) in a single bulk
+// update and returns how many agents were found. A heartbeat never moves an
+// agent's last heartbeat backwards. Like HeartBeat offline agents become
+// available (e.g. the reaper marked them offline while their heartbeats were
+// buffered).
+func (db *MongoDatabase) HeartBeats(ctx context.Context, beats map[int32]time.Time) (int, error) {
+	if len(beats) == 0 {
+		return 0, nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	bulk := db.Database.C("agents").Bulk()
+	bulk.Unordered()
+	for agentID, at := range beats {
+		bulk.Update(bson.M{"agentid": agentID}, bson.M{"$max": bson.M{"lastheartbeat": at}})
+	}
+
+	result, err := bulk.Run()
+
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = db.c(ctx, "agents").UpdateAll(offlineAgentsSelector(beats), bson.M{"$set": bson.M{"state": AgentAvailable, "statechangedat": NowFunc()}})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result.Matched, nil
+}
+
+// offlineAgentsSelector matches the offline agents (or those with no state) of beats
+func offlineAgentsSelector(beats map[int32]time.Time) bson.M {
+	agentIDs := make([]int32, 0, len(beats))
+	for agentID := range beats {
+		agentIDs = append(agentIDs, agentID)
+	}
+	return bson.M{"agentid": bson.M{"$in": agentIDs}, "state": bson.M{"$in": []interface{}{AgentOffline, nil}}}
+}
+
+// TouchAgents sets the last heartbeat of the agents to now without checking
+// they exist (see HeartBeatStream) and returns how many were updated
+func (db *MongoDatabase) TouchAgents(ctx context.Context, agentIDs []int32) (int, error) {
+	if len(agentIDs) == 0 {
+		return 0, nil
+	}
+
+	info, err := db.c(ctx, "agents").UpdateAll(bson.M{"agentid": bson.M{"$in": agentIDs}}, bson.M{"$set": bson.M{"lastheartbeat": NowFunc()}})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Updated, nil
+}
+
+// SetAgentState moves the agent from state from to state to. The update only
+// applies if the agent is still in state from so concurrent changes are safe.
+// It does not check the transition is allowed (see CanTransition)
+func (db *MongoDatabase) SetAgentState(ctx context.Context, agentID int32, from AgentState, to AgentState) error {
+	selector := bson.M{"agentid": agentID, "state": from}
+	if from == "" || from == AgentOffline {
+		selector["state"] = bson.M{"$in": []interface{}{AgentOffline, nil}}
+	}
+
+	err := db.c(ctx, "agents").Update(selector, bson.M{"$set": bson.M{"state": to, "statechangedat": NowFunc()}})
+
+	if err == mgo.ErrNotFound {
+		if _, err = db.GetAgent(ctx, agentID); err != nil {
+			return err
+		}
+		return amerrors.ErrAgentStateTransitionError("Agent(AgentID=" + strconv.Itoa(int(agentID)) + ") is no longer " + string(from))
+	}
+
+	return err
+}
+
+// SetAgentSkills replaces the agent's skill profile and returns the updated agent
+func (db *MongoDatabase) SetAgentSkills(ctx context.Context, agentID int32, skills []Skill) (Agent, error) {
+	err := db.c(ctx, "agents").Update(bson.M{"agentid": agentID}, bson.M{"$set": bson.M{"skills": skills}})
+
+	if err == mgo.ErrNotFound {
+		return Agent{}, amerrors.ErrAgentNotFoundError("failed to find an Agent(AgentID=" + strconv.Itoa(int(agentID)) + ")")
+	}
+
+	if err != nil {
+		return Agent{}, err
+	}
+
+	return db.GetAgent(ctx, agentID)
+}
+
+// ExpireAgents marks agents offline whose last heartbeat is before before
+// (missed heartbeats) and returns their agent IDs. With dryRun nothing is changed.
+func (db *MongoDatabase) ExpireAgents(ctx context.Context, before time.Time, dryRun bool) ([]int32, error) {
+	selector := bson.M{"state": bson.M{"$ne": AgentOffline}, "lastheartbeat": bson.M{"$lt": before}}
+
 	var agents []Agent
+	err := db.c(ctx, "agents").Find(selector).Select(bson.M{"agentid": 1}).All(&agents)
 
-	err := db.C("agents").Find(bson.M{"lastheartbeat": bson.M{"$gt": timestamp}}).Limit(int(limit)).All(&agents)
+	if err != nil || len(agents) == 0 || dryRun {
+		return agentIDs(agents), err
+	}
+
+	// Agents that heartbeat since the find are left alone
+	selector["agentid"] = bson.M{"$in": agentIDs(agents)}
+	_, err = db.c(ctx, "agents").UpdateAll(selector, bson.M{"$set": bson.M{"state": AgentOffline, "statechangedat": NowFunc()}})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return agentIDs(agents), nil
+}
+
+// agentIDs returns the agent ID of each agent
+func agentIDs(agents []Agent) []int32 {
+	var ids []int32
+	for _, agent := range agents {
+		ids = append(ids, agent.AgentID)
+	}
+	return ids
+}
+
+// GetAgents returns all Agents in state within a certain heartbeat with every
+// required skill in order (preferred skills are ranked by RankBySkills)
+func (db *MongoDatabase) GetAgents(ctx context.Context, state AgentState, timestamp time.Time, skills []SkillRequirement, order AgentOrder, limit int32) ([]Agent, error) {
+	var agents []Agent
+
+	query := db.c(ctx, "agents").Find(order.selector(agentsSelector(state, timestamp, skills)))
+	if fields := order.fields(); len(fields) > 0 {
+		query = query.Sort(fields...)
+	}
+	err := query.Limit(int(limit)).All(&agents)
 
 	if err != nil {
 		return agents, err
 	}
 	return agents, nil
 }
+
+// AddAgent creates a new agent with an agent ID allocated from the 'agentid' counter
+// Agent IDs already taken (unique agentid index) are skipped.
+// The agent starts offline so is not available until its first HeartBeat()
+func (db *MongoDatabase) AddAgent(ctx context.Context) (int32, error) {
+	for attempt := 0; attempt < maxAgentIDAttempts; attempt++ {
+		agentID, err := db.GetNextSequence(ctx, "agentid")
+
+		if err != nil {
+			return 0, err
+		}
+
+		err = db.c(ctx, "agents").Insert(&Agent{AgentID: agentID, State: AgentOffline, StateChangedAt: NowFunc()})
+
+		if err == nil {
+			return agentID, nil
+		}
+
+		if !mgo.IsDup(err) {
+			return 0, err
+		}
+
+		logger.Log("level", "warn", "msg", "Agent ID "+strconv.Itoa(int(agentID))+" already taken, trying next sequence")
+	}
+
+	return 0, amerrors.InternalServerError("failed to allocate a unique agent ID after %d attempts", maxAgentIDAttempts)
+}
+
+// RemoveAgent removes the agent with agent ID
+func (db *MongoDatabase) RemoveAgent(ctx context.Context, agentID int32) error {
+	err := db.c(ctx, "agents").Remove(bson.M{"agentid": agentID})
+
+	if err == mgo.ErrNotFound {
+		return amerrors.ErrAgentNotFoundError("failed to find an Agent(AgentID=" + strconv.Itoa(int(agentID)) + ")")
+	}
+
+	return err
+}
@@ -3,6 +3,7 @@ package models_test
 // Basic property + table driven tests for agent.go
 
 import (
+	"context"
 	"fmt"
 	"testing"
 	"time"
@@ -11,7 +12,6 @@ import (
 	"github.com/newtonsystems/agent-mgmt/app/models"
 	"github.com/newtonsystems/agent-mgmt/app/service"
 	tu "github.com/newtonsystems/agent-mgmt/app/testutil"
-	"gopkg.in/mgo.v2/bson"
 )
 
 func TestIndexAgentIDUnique(t *testing.T) {
@@ -129,7 +129,7 @@ func TestAgentExists(t *testing.T) {
 			defer tu.CleanAllCollectionsTestMongo(session)
 			tu.InsertCollectionToDB(t, db, "agents", tc.inserts)
 
-			exists, err := db.AgentExists(tc.agentID)
+			exists, err := db.AgentExists(context.Background(), tc.agentID)
 
 			tu.Equals(t, tc.expectedExists, exists)
 			tu.IsAmError(t, tc.expectedErr, err)
@@ -150,16 +150,19 @@ func TestHeartBeat(t *testing.T) {
 	tu.Equals(t, 1, count)
 
 	// Update heartbeat with an agent that doesnt exist
-	err := db.HeartBeat(11)
+	err := db.HeartBeat(context.Background(), 11)
 	tu.IsAmError(t, amerrors.ErrAgentNotFound, err)
 
 	// Update heartbeat on correct agent then check the timestamp has changed
-	err = db.HeartBeat(10)
+	err = db.HeartBeat(context.Background(), 10)
 	tu.Ok(t, err)
 
-	var agent models.Agent
-	_ = db.C("counters").Find(bson.M{"agentid": 10}).One(&agent)
+	agent, err := db.GetAgent(context.Background(), 10)
+	tu.Ok(t, err)
 	tu.NotEquals(t, originalTime, agent.LastHeartBeat)
+
+	// An offline agent becomes available on its heartbeat
+	tu.Equals(t, models.AgentAvailable, agent.State)
 }
 
 func TestGetAgents(t *testing.T) {
@@ -174,7 +177,22 @@ func TestGetAgents(t *testing.T) {
 		{
 			"get_agents",
 			[]tu.TestModelInsert{
-				&models.Agent{AgentID: 10, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 10, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)},
+			},
+			time.Date(2017, time.September, 21, 17, 50, 29, 0, time.UTC),
+			100,
+			[]models.Agent{
+				models.Agent{AgentID: 10, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)},
+			},
+			nil,
+		},
+		{
+			"get_agents_available_only",
+			[]tu.TestModelInsert{
+				&models.Agent{AgentID: 10, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 11, State: models.AgentOnCall, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 12, State: models.AgentAway, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 13, State: models.AgentOffline, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)},
 			},
 			time.Date(2017, time.September, 21, 17, 50, 29, 0, time.UTC),
 			100,
@@ -186,7 +204,7 @@ func TestGetAgents(t *testing.T) {
 		{
 			"get_agents_only_one",
 			[]tu.TestModelInsert{
-				&models.Agent{AgentID: 10, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 10, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)},
 			},
 			time.Date(2017, time.September, 21, 17, 50, 29, 0, time.UTC),
 			100,
@@ -198,10 +216,10 @@ func TestGetAgents(t *testing.T) {
 		{
 			"get_agents_multiple",
 			[]tu.TestModelInsert{
-				&models.Agent{AgentID: 10, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)},
-				&models.Agent{AgentID: 11, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 33, 0, time.UTC)},
-				&models.Agent{AgentID: 12, LastHeartBeat: time.Date(2017, time.September, 21, 17, 51, 31, 0, time.UTC)},
-				&models.Agent{AgentID: 13, LastHeartBeat: time.Date(2017, time.September, 21, 17, 52, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 10, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 11, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 33, 0, time.UTC)},
+				&models.Agent{AgentID: 12, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 51, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 13, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 52, 31, 0, time.UTC)},
 			},
 			time.Date(2017, time.September, 21, 17, 50, 29, 0, time.UTC),
 			100,
@@ -216,10 +234,10 @@ func TestGetAgents(t *testing.T) {
 		{
 			"get_agents_multiple_limit_1",
 			[]tu.TestModelInsert{
-				&models.Agent{AgentID: 10, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)},
-				&models.Agent{AgentID: 11, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 33, 0, time.UTC)},
-				&models.Agent{AgentID: 12, LastHeartBeat: time.Date(2017, time.September, 21, 17, 51, 31, 0, time.UTC)},
-				&models.Agent{AgentID: 13, LastHeartBeat: time.Date(2017, time.September, 21, 17, 52, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 10, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 11, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 33, 0, time.UTC)},
+				&models.Agent{AgentID: 12, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 51, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 13, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 52, 31, 0, time.UTC)},
 			},
 			time.Date(2017, time.September, 21, 17, 50, 29, 0, time.UTC),
 			1,
@@ -231,10 +249,10 @@ func TestGetAgents(t *testing.T) {
 		{
 			"get_agents_multiple_limit_2",
 			[]tu.TestModelInsert{
-				&models.Agent{AgentID: 10, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)},
-				&models.Agent{AgentID: 11, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 33, 0, time.UTC)},
-				&models.Agent{AgentID: 12, LastHeartBeat: time.Date(2017, time.September, 21, 17, 51, 31, 0, time.UTC)},
-				&models.Agent{AgentID: 13, LastHeartBeat: time.Date(2017, time.September, 21, 17, 52, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 10, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 11, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 33, 0, time.UTC)},
+				&models.Agent{AgentID: 12, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 51, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 13, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 52, 31, 0, time.UTC)},
 			},
 			time.Date(2017, time.September, 21, 17, 50, 29, 0, time.UTC),
 			2,
@@ -247,10 +265,10 @@ func TestGetAgents(t *testing.T) {
 		{
 			"get_agents_multiple_limit_3",
 			[]tu.TestModelInsert{
-				&models.Agent{AgentID: 10, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)},
-				&models.Agent{AgentID: 11, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 33, 0, time.UTC)},
-				&models.Agent{AgentID: 12, LastHeartBeat: time.Date(2017, time.September, 21, 17, 51, 31, 0, time.UTC)},
-				&models.Agent{AgentID: 13, LastHeartBeat: time.Date(2017, time.September, 21, 17, 52, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 10, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 11, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 33, 0, time.UTC)},
+				&models.Agent{AgentID: 12, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 51, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 13, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 52, 31, 0, time.UTC)},
 			},
 			time.Date(2017, time.September, 21, 17, 50, 29, 0, time.UTC),
 			3,
@@ -264,10 +282,10 @@ func TestGetAgents(t *testing.T) {
 		{
 			"get_agents_multiple_limit_4",
 			[]tu.TestModelInsert{
-				&models.Agent{AgentID: 10, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)},
-				&models.Agent{AgentID: 11, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 33, 0, time.UTC)},
-				&models.Agent{AgentID: 12, LastHeartBeat: time.Date(2017, time.September, 21, 17, 51, 31, 0, time.UTC)},
-				&models.Agent{AgentID: 13, LastHeartBeat: time.Date(2017, time.September, 21, 17, 52, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 10, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 11, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 33, 0, time.UTC)},
+				&models.Agent{AgentID: 12, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 51, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 13, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 52, 31, 0, time.UTC)},
 			},
 			time.Date(2017, time.September, 21, 17, 50, 29, 0, time.UTC),
 			4,
@@ -282,10 +300,10 @@ func TestGetAgents(t *testing.T) {
 		{
 			"get_agents_multiple_limit_5",
 			[]tu.TestModelInsert{
-				&models.Agent{AgentID: 10, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)},
-				&models.Agent{AgentID: 11, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 33, 0, time.UTC)},
-				&models.Agent{AgentID: 12, LastHeartBeat: time.Date(2017, time.September, 21, 17, 51, 31, 0, time.UTC)},
-				&models.Agent{AgentID: 13, LastHeartBeat: time.Date(2017, time.September, 21, 17, 52, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 10, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 11, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 33, 0, time.UTC)},
+				&models.Agent{AgentID: 12, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 51, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 13, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 52, 31, 0, time.UTC)},
 			},
 			time.Date(2017, time.September, 21, 17, 50, 29, 0, time.UTC),
 			5,
@@ -300,10 +318,10 @@ func TestGetAgents(t *testing.T) {
 		{
 			"get_agents_multiple_some_too_old",
 			[]tu.TestModelInsert{
-				&models.Agent{AgentID: 10, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)},
-				&models.Agent{AgentID: 11, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 33, 0, time.UTC)},
-				&models.Agent{AgentID: 12, LastHeartBeat: time.Date(2017, time.September, 21, 17, 51, 31, 0, time.UTC)},
-				&models.Agent{AgentID: 13, LastHeartBeat: time.Date(2017, time.September, 21, 17, 52, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 10, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 11, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 33, 0, time.UTC)},
+				&models.Agent{AgentID: 12, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 51, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 13, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 52, 31, 0, time.UTC)},
 			},
 			time.Date(2017, time.September, 21, 17, 51, 29, 0, time.UTC),
 			100,
@@ -316,10 +334,10 @@ func TestGetAgents(t *testing.T) {
 		{
 			"get_agents_multiple_all_too_old",
 			[]tu.TestModelInsert{
-				&models.Agent{AgentID: 10, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)},
-				&models.Agent{AgentID: 11, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 33, 0, time.UTC)},
-				&models.Agent{AgentID: 12, LastHeartBeat: time.Date(2017, time.September, 21, 17, 51, 31, 0, time.UTC)},
-				&models.Agent{AgentID: 13, LastHeartBeat: time.Date(2017, time.September, 21, 17, 52, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 10, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 11, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 33, 0, time.UTC)},
+				&models.Agent{AgentID: 12, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 51, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 13, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 52, 31, 0, time.UTC)},
 			},
 			time.Date(2017, time.September, 21, 17, 54, 29, 0, time.UTC),
 			100,
@@ -329,10 +347,10 @@ func TestGetAgents(t *testing.T) {
 		{
 			"get_agents_multiple_all_too_old_limit_1",
 			[]tu.TestModelInsert{
-				&models.Agent{AgentID: 10, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)},
-				&models.Agent{AgentID: 11, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 33, 0, time.UTC)},
-				&models.Agent{AgentID: 12, LastHeartBeat: time.Date(2017, time.September, 21, 17, 51, 31, 0, time.UTC)},
-				&models.Agent{AgentID: 13, LastHeartBeat: time.Date(2017, time.September, 21, 17, 52, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 10, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 11, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 33, 0, time.UTC)},
+				&models.Agent{AgentID: 12, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 51, 31, 0, time.UTC)},
+				&models.Agent{AgentID: 13, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 52, 31, 0, time.UTC)},
 			},
 			time.Date(2017, time.September, 21, 17, 54, 29, 0, time.UTC),
 			1,
@@ -364,7 +382,7 @@ func TestGetAgents(t *testing.T) {
 			defer tu.CleanAllCollectionsTestMongo(session)
 			tu.InsertCollectionToDB(t, db, "agents", tc.inserts)
 
-			agents, err := db.GetAgents(tc.timestamp, tc.limit)
+			agents, err := db.GetAgents(context.Background(), models.AgentAvailable, tc.timestamp, nil, models.AgentOrder{}, tc.limit)
 			tu.IsAmError(t, tc.expectedErr, err)
 
 			// Check lengths are the same
@@ -381,3 +399,98 @@ func TestGetAgents(t *testing.T) {
 	}
 
 }
+
+func TestAddAgent(t *testing.T) {
+	session, db := tu.NewTestMongoConnection(*tu.Debug, *tu.OutsideConn)
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	// agentid counter starts at 1 so the first agent registered is 2
+	agentID, err := db.AddAgent(context.Background())
+	tu.Ok(t, err)
+	tu.Equals(t, int32(2), agentID)
+
+	// Agent IDs already taken are skipped (unique agentid index)
+	db.C("agents").Insert(&models.Agent{AgentID: 3, LastHeartBeat: time.Now()})
+	db.C("agents").Insert(&models.Agent{AgentID: 4, LastHeartBeat: time.Now()})
+
+	agentID, err = db.AddAgent(context.Background())
+	tu.Ok(t, err)
+	tu.Equals(t, int32(5), agentID)
+
+	count, _ := db.C("agents").Count()
+	tu.Equals(t, 4, count)
+
+	exists, err := db.AgentExists(context.Background(), 5)
+	tu.Ok(t, err)
+	tu.Equals(t, true, exists)
+}
+
+func TestRemoveAgent(t *testing.T) {
+	session, db := tu.NewTestMongoConnection(*tu.Debug, *tu.OutsideConn)
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	db.C("agents").Insert(&models.Agent{AgentID: 10, State: models.AgentAvailable, LastHeartBeat: time.Now()})
+	db.C("agents").Insert(&models.Agent{AgentID: 11, State: models.AgentAvailable, LastHeartBeat: time.Now()})
+
+	// Remove an agent that doesnt exist
+	err := db.RemoveAgent(context.Background(), 12)
+	tu.IsAmError(t, amerrors.ErrAgentNotFound, err)
+
+	err = db.RemoveAgent(context.Background(), 10)
+	tu.Ok(t, err)
+
+	agents, err := db.GetAgents(context.Background(), models.AgentAvailable, time.Now().Add(-time.Minute), nil, models.AgentOrder{}, 0)
+	tu.Ok(t, err)
+	tu.Equals(t, 1, len(agents))
+	tu.Equals(t, int32(11), agents[0].AgentID)
+}
+
+func TestCanTransition(t *testing.T) {
+	testCases := []struct {
+		from     models.AgentState
+		to       models.AgentState
+		expected bool
+	}{
+		{models.AgentOffline, models.AgentAvailable, true},
+		{"", models.AgentAvailable, true},
+		{models.AgentOffline, models.AgentOnCall, false},
+		{models.AgentAvailable, models.AgentOnCall, true},
+		{models.AgentBusy, models.AgentOnCall, false},
+		{models.AgentAway, models.AgentOnCall, false},
+		{models.AgentOnCall, models.AgentOnCall, false},
+		{models.AgentOnCall, models.AgentAvailable, false},
+		{models.AgentOnCall, models.AgentWrapUp, true},
+		{models.AgentWrapUp, models.AgentAvailable, true},
+		{models.AgentAway, models.AgentOffline, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(string(tc.from)+"->"+string(tc.to), func(t *testing.T) {
+			tu.Equals(t, tc.expected, models.CanTransition(tc.from, tc.to))
+		})
+	}
+
+	_, err := models.ParseAgentState("lunch")
+	tu.IsAmError(t, amerrors.ErrAgentStateInvalid, err)
+}
+
+func TestSetAgentState(t *testing.T) {
+	session, db := tu.NewTestMongoConnection(*tu.Debug, *tu.OutsideConn)
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	db.C("agents").Insert(&models.Agent{AgentID: 10, State: models.AgentAvailable, LastHeartBeat: time.Now()})
+
+	err := db.SetAgentState(context.Background(), 11, models.AgentAvailable, models.AgentBusy)
+	tu.IsAmError(t, amerrors.ErrAgentNotFound, err)
+
+	// Agent is not in the from state
+	err = db.SetAgentState(context.Background(), 10, models.AgentBusy, models.AgentAway)
+	tu.IsAmError(t, amerrors.ErrAgentStateTransition, err)
+
+	err = db.SetAgentState(context.Background(), 10, models.AgentAvailable, models.AgentOnCall)
+	tu.Ok(t, err)
+
+	agent, err := db.GetAgent(context.Background(), 10)
+	tu.Ok(t, err)
+	tu.Equals(t, models.AgentOnCall, agent.State)
+}
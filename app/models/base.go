@@ -5,10 +5,13 @@ package models
 // gracefully ripped from: https://github.com/thylong/regexrace/blob/master/models/base.go
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	stdlog "log"
+	"net"
 	"os"
-	"strings"
 	"time"
 
 	//log "github.com/Sirupsen/logrus"
@@ -28,6 +31,21 @@ const MongoKey mongokey = "mongo"
 // ErrNotFound returned when an object is not found.
 var ErrNotFound = mgo.ErrNotFound
 
+// ErrNotSupported returned by DataLayer calls the backend cannot make (see
+// WithTransaction and WatchCollection)
+var ErrNotSupported = errors.New("not supported by this database")
+
+// ChangeStream is a stream of changes to a collection (see WatchCollection)
+type ChangeStream interface {
+	// Next waits for the next change, false once the stream failed (see Err)
+	// or ctx is done
+	Next(ctx context.Context) bool
+	// Decode unmarshals the current change into val
+	Decode(val interface{}) error
+	Err() error
+	Close(ctx context.Context) error
+}
+
 // MongoCollection wraps a mgo.Collection to embed methods in models.
 type MongoCollection struct {
 	*mgo.Collection
@@ -35,16 +53,16 @@ type MongoCollection struct {
 
 // Collection is an interface to access to the collection struct.
 type Collection interface {
-	Find(query interface{}) *mgo.Query
 	Count() (n int, err error)
-	FindId(id interface{}) *mgo.Query
 	Insert(docs ...interface{}) error
 	Remove(selector interface{}) error
 	Update(selector interface{}, update interface{}) error
 	UpdateId(id interface{}, update interface{}) error
 	Upsert(selector interface{}, update interface{}) (info *mgo.ChangeInfo, err error)
 	EnsureIndex(index mgo.Index) error
+	DropIndex(key ...string) error
 	RemoveAll(selector interface{}) (info *mgo.ChangeInfo, err error)
+	UpdateAll(selector interface{}, update interface{}) (info *mgo.ChangeInfo, err error)
 }
 
 // MongoDatabase wraps a mgo.Database to embed methods in models.
@@ -57,17 +75,153 @@ func (d MongoDatabase) C(name string) Collection {
 	return &MongoCollection{Collection: d.Database.C(name)}
 }
 
+// WithTransaction returns ErrNotSupported, mgo does not support transactions
+func (d MongoDatabase) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return ErrNotSupported
+}
+
+// WatchCollection returns ErrNotSupported, mgo does not support change streams
+func (d MongoDatabase) WatchCollection(ctx context.Context, collection string, pipeline interface{}) (ChangeStream, error) {
+	return nil, ErrNotSupported
+}
+
+// c returns the collection name for a call with ctx (see contextCollection)
+func (d MongoDatabase) c(ctx context.Context, name string) *contextCollection {
+	return &contextCollection{Collection: d.Database.C(name), ctx: ctx}
+}
+
+// contextCollection is a collection used on behalf of a call with ctx.
+// Operations are not started once ctx is done and queries are given up by
+// MongoDB at ctx's deadline (mgo cannot interrupt a query already sent, the
+// session's socket timeout bounds those, see CopySession).
+type contextCollection struct {
+	*mgo.Collection
+	ctx context.Context
+}
+
+// withDeadline limits q to the time left before ctx's deadline (if any)
+func withDeadline(ctx context.Context, q *mgo.Query) *mgo.Query {
+	if deadline, ok := ctx.Deadline(); ok {
+		q.SetMaxTime(timeLeft(deadline))
+	}
+	return q
+}
+
+// timeLeft returns the time until deadline (at least a millisecond, the
+// smallest limit MongoDB takes)
+func timeLeft(deadline time.Time) time.Duration {
+	if d := deadline.Sub(time.Now()); d > time.Millisecond {
+		return d
+	}
+	return time.Millisecond
+}
+
+func (c *contextCollection) Find(query interface{}) *mgo.Query {
+	return withDeadline(c.ctx, c.Collection.Find(query))
+}
+
+func (c *contextCollection) FindId(id interface{}) *mgo.Query {
+	return withDeadline(c.ctx, c.Collection.FindId(id))
+}
+
+func (c *contextCollection) Count() (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.Collection.Count()
+}
+
+func (c *contextCollection) Insert(docs ...interface{}) error {
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+	return c.Collection.Insert(docs...)
+}
+
+func (c *contextCollection) Remove(selector interface{}) error {
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+	return c.Collection.Remove(selector)
+}
+
+func (c *contextCollection) Update(selector interface{}, update interface{}) error {
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+	return c.Collection.Update(selector, update)
+}
+
+func (c *contextCollection) UpdateId(id interface{}, update interface{}) error {
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+	return c.Collection.UpdateId(id, update)
+}
+
+func (c *contextCollection) Upsert(selector interface{}, update interface{}) (*mgo.ChangeInfo, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.Collection.Upsert(selector, update)
+}
+
+func (c *contextCollection) RemoveAll(selector interface{}) (*mgo.ChangeInfo, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.Collection.RemoveAll(selector)
+}
+
+func (c *contextCollection) UpdateAll(selector interface{}, update interface{}) (*mgo.ChangeInfo, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.Collection.UpdateAll(selector, update)
+}
+
 // DataLayer is an interface to access to the database struct
-// (currently MongoDatabase).
+// (MongoDatabase, DriverDatabase, PostgresDatabase or MemoryDatabase).
 type DataLayer interface {
 	C(name string) Collection
-	AddTask(custID int32, agentIDs []int32) (int32, error)
-	AgentExists(agentID int32) (bool, error)
-	GetAgents(timestamp time.Time, limit int32) ([]Agent, error)
-	GetAgentIDFromRef(refID string) (int32, error)
-	HeartBeat(agentID int32) error
+	AddTask(ctx context.Context, custID int32, agentIDs []int32, skills []SkillRequirement) (int32, error)
+	AcceptTask(ctx context.Context, taskID int32, agentID int32) (Task, error)
+	CompleteTask(ctx context.Context, taskID int32, agentID int32) (Task, error)
+	GetTask(ctx context.Context, taskID int32) (Task, error)
+	ListTasks(ctx context.Context, filter TaskFilter, limit int32) ([]Task, error)
+	SetTaskStatus(ctx context.Context, taskID int32, from TaskStatus, to TaskStatus) (Task, error)
+	OfferTask(ctx context.Context, taskID int32, agentIDs []int32) (Task, error)
+	CountAcceptedTasks(ctx context.Context, agentIDs []int32, since time.Time) (map[int32]int, error)
+	AddAgent(ctx context.Context) (int32, error)
+	RemoveAgent(ctx context.Context, agentID int32) error
+	AgentExists(ctx context.Context, agentID int32) (bool, error)
+	GetAgent(ctx context.Context, agentID int32) (Agent, error)
+	SetAgentState(ctx context.Context, agentID int32, from AgentState, to AgentState) error
+	SetAgentSkills(ctx context.Context, agentID int32, skills []Skill) (Agent, error)
+	GetAgents(ctx context.Context, state AgentState, timestamp time.Time, skills []SkillRequirement, order AgentOrder, limit int32) ([]Agent, error)
+	GetAgentIDFromRef(ctx context.Context, refID string) (int32, error)
+	HeartBeat(ctx context.Context, agentID int32) error
+	TouchAgents(ctx context.Context, agentIDs []int32) (int, error)
+	HeartBeats(ctx context.Context, beats map[int32]time.Time) (int, error)
+	ExpireAgents(ctx context.Context, before time.Time, dryRun bool) ([]int32, error)
+	ExpirePhoneSessions(ctx context.Context, before time.Time, dryRun bool) (int, error)
+	ArchiveTasks(ctx context.Context, before time.Time, dryRun bool) (int, error)
 	DropDatabase() error
-	GetNextSequence(name string) (int32, error)
+	GetNextSequence(ctx context.Context, name string) (int32, error)
+	AppliedMigrations(ctx context.Context) ([]AppliedMigration, error)
+	AddMigration(ctx context.Context, m AppliedMigration) error
+	RemoveMigration(ctx context.Context, version int) error
+	LockMigrations(ctx context.Context, owner string, expires time.Time, now time.Time) (bool, error)
+	RenewMigrationLock(ctx context.Context, owner string, expires time.Time) (bool, error)
+	UnlockMigrations(ctx context.Context, owner string) error
+	// WithTransaction calls fn in a transaction (committed if fn returns nil,
+	// otherwise aborted), the calls fn makes with the context it is given are
+	// part of it. ErrNotSupported unless the backend supports transactions.
+	WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error
+	// WatchCollection returns a change stream of the changes to collection
+	// matching pipeline (nil for every change). ErrNotSupported unless the
+	// backend supports change streams.
+	WatchCollection(ctx context.Context, collection string, pipeline interface{}) (ChangeStream, error)
 	//Remove()
 	//GetQuestion(qid int) (Question, error)
 	//GetScores() ([]Score, error)
@@ -88,6 +242,17 @@ type Session interface {
 	Ping() error
 }
 
+// CopySession returns a copy of session (see Session.Copy) for a call with
+// ctx. The time left before ctx's deadline becomes the copy's socket timeout
+// so the database gives up when the caller does.
+func CopySession(ctx context.Context, session Session) Session {
+	sessionCopy := session.Copy()
+	if deadline, ok := ctx.Deadline(); ok {
+		sessionCopy.SetSocketTimeout(timeLeft(deadline))
+	}
+	return sessionCopy
+}
+
 // MongoSession is currently a Mongo session.
 type MongoSession struct {
 	*mgo.Session
@@ -124,24 +289,41 @@ func (s MongoSession) SetMode(consistency mgo.Mode, refresh bool) {
 	s.Session.SetMode(consistency, refresh)
 }
 
-// NewMongoSession returns a new Mongo Session.
-func NewMongoSession(mongoDBDialInfo *mgo.DialInfo, logger log.Logger, debug bool) (Session, log.Logger) {
+const (
+	// DialInitialBackoff how long to wait before dialling again after the
+	// first failed attempt (doubled after each attempt)
+	DialInitialBackoff = 500 * time.Millisecond
+	// DialMaxBackoff the longest wait between attempts
+	DialMaxBackoff = 30 * time.Second
+)
+
+// NewMongoSession returns a new Mongo Session connected with settings (see
+// ParseMongoURI). Failed dials are retried with exponential backoff until ctx
+// is done (e.g. its startup deadline), the last error is then returned.
+func NewMongoSession(ctx context.Context, settings MongoSettings, logger log.Logger, debug bool) (Session, log.Logger, error) {
 	// Initialise mongodb connection and logger
 	// Create a session which maintains a pool of socket connections to our MongoDB.
 	mongoLogger := log.With(logger, "connection", "mongo")
-	mongoLogger.Log("hosts", strings.Join(mongoDBDialInfo.Addrs, ", "))
-	mongoLogger.Log("db", mongoDBDialInfo.Database)
+	mongoLogger.Log(settings.Keyvals()...)
 
-	mongoSession, err := mgo.DialWithInfo(mongoDBDialInfo)
+	mongoDBDialInfo, err := settings.dialInfo()
+	if err != nil {
+		return nil, mongoLogger, err
+	}
 
-	// Can't connect? - bail!
+	var mongoSession *mgo.Session
+	err = dialWithBackoff(ctx, mongoDBDialInfo.Timeout, mongoLogger, func(timeout time.Duration) error {
+		info := *mongoDBDialInfo
+		info.Timeout = timeout
+		mongoSession, err = mgo.DialWithInfo(&info)
+		return err
+	})
 	if err != nil {
-		mongoLogger.Log("exit", err)
-		panic(err)
+		return nil, mongoLogger, err
 	}
 
-	// Optional. Switch the session to a monotonic behavior.
-	mongoSession.SetMode(mgo.Strong, true)
+	// Read from the members the read preference allows (the primary by default)
+	mongoSession.SetMode(settings.Mode, true)
 	mongoLogger.Log("msg", "successfully connected")
 
 	if debug {
@@ -159,7 +341,84 @@ func NewMongoSession(mongoDBDialInfo *mgo.DialInfo, logger log.Logger, debug boo
 	session.SetSyncTimeout(3 * time.Second)
 	session.SetSocketTimeout(3 * time.Second)
 
-	return session, mongoLogger
+	return session, mongoLogger, nil
+}
+
+// dialWithBackoff calls dial until it succeeds, waiting twice as long after
+// each failed attempt (up to DialMaxBackoff). Each attempt may take
+// timeout or the time left before ctx's deadline if that is sooner. Once ctx
+// is done the last error is returned.
+func dialWithBackoff(ctx context.Context, timeout time.Duration, logger log.Logger, dial func(timeout time.Duration) error) error {
+	for attempt, backoff := 1, DialInitialBackoff; ; attempt++ {
+		attemptTimeout := timeout
+		if deadline, ok := ctx.Deadline(); ok && timeLeft(deadline) < attemptTimeout {
+			attemptTimeout = timeLeft(deadline)
+		}
+		err := dial(attemptTimeout)
+		if err == nil {
+			return nil
+		}
+
+		logger.Log("level", "warn", "msg", "Failed to connect to the database", "attempt", attempt, "retry_in", backoff, "err", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return fmt.Errorf("failed to connect to the database after %d attempts: %v", attempt, err)
+		}
+		if backoff *= 2; backoff > DialMaxBackoff {
+			backoff = DialMaxBackoff
+		}
+	}
+}
+
+// IsConnectionError returns whether err is a broken or unreachable connection
+// (the session's sockets are then dead until it is refreshed)
+func IsConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	if isDriverConnectionError(err) {
+		return true
+	}
+	switch err.Error() {
+	case "no reachable servers", "Closed explicitly", "EOF":
+		return true
+	}
+	return false
+}
+
+// RefreshOnError refreshes session after a connection error so its later
+// copies dial again instead of reusing the dead socket. It returns whether it
+// did.
+func RefreshOnError(session Session, err error) bool {
+	if !IsConnectionError(err) {
+		return false
+	}
+	session.Refresh()
+	return true
+}
+
+// dbError returns err as the error of a call with ctx. Errors the service
+// knows (AgentMgmtErrors) and those of the caller's context are kept, any
+// other database error is an InternalServer error.
+func dbError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*amerrors.AgentMgmtError); ok {
+		return err
+	}
+	// e.g. a socket timeout because the caller's deadline passed
+	if err == context.Canceled || err == context.DeadlineExceeded || ctx.Err() != nil {
+		return err
+	}
+	return amerrors.InternalServerError("database error: %v", err)
 }
 
 type Count struct {
@@ -168,7 +427,7 @@ type Count struct {
 }
 
 // GetNextSequence returns the next sequence for 'name'
-func (db *MongoDatabase) GetNextSequence(name string) (int32, error) {
+func (db *MongoDatabase) GetNextSequence(ctx context.Context, name string) (int32, error) {
 	var doc Count
 	change := mgo.Change{
 		Update:    bson.M{"$inc": bson.M{"seq": 1}},
@@ -177,67 +436,24 @@ func (db *MongoDatabase) GetNextSequence(name string) (int32, error) {
 	}
 
 	//println(name)
-	count, err := db.C("counters").Find(bson.M{"_id": name}).Count()
+	count, err := db.c(ctx, "counters").Find(bson.M{"_id": name}).Count()
 
 	if err != nil {
-		logger.Log("level", "error", "msg", "Failed in get count of sequence name: "+name)
-		return 0, err
+		logger.Log("level", "error", "msg", "Failed in get count of sequence name: "+name, "err", err)
+		return 0, dbError(ctx, err)
 	}
 
 	if count == 0 {
 		return 0, amerrors.ErrCounterNotFoundError("failed to find an counter counters(_id=" + name + ")")
 	}
 
-	_, err = db.C("counters").Find(bson.M{"_id": name}).Apply(change, &doc)
+	_, err = db.c(ctx, "counters").Find(bson.M{"_id": name}).Apply(change, &doc)
 	//fmt.Println(doc)
+	// The caller's deadline can pass between the two queries
 	if err != nil {
-		panic("Creation of next sequence failed for " + name + " error: " + err.Error())
+		logger.Log("level", "error", "msg", "Creation of next sequence failed for "+name, "err", err)
+		return 0, dbError(ctx, err)
 	}
 
 	return doc.Seq, nil
 }
-
-// PrepareDB ensure presence of persistent and immutable data in the DB.
-func PrepareDB(session Session, db string, logger log.Logger) {
-	sessCopy := session.Copy()
-	defer sessCopy.Close()
-
-	logger.Log("level", "info", "tag", "#beforeprepare", "msg", "stats: "+fmt.Sprintf("%#v", mgo.GetStats()))
-
-	indexes := make(map[string]mgo.Index)
-	indexes["agents"] = mgo.Index{
-		Key:        []string{"agentid"},
-		Unique:     true,
-		DropDups:   true,
-		Background: false,
-	}
-	indexes["phonesessions"] = mgo.Index{
-		Key:        []string{"sessid"},
-		Unique:     true,
-		DropDups:   true,
-		Background: false,
-	}
-
-	for collectionName, index := range indexes {
-		err := sessCopy.DB(db).C(collectionName).EnsureIndex(index)
-		if err != nil {
-			panic("Cannot ensure index for " + collectionName + " error: " + err.Error())
-		}
-	}
-	logger.Log("level", "info", "msg", "Prepared database indexes.")
-
-	logger.Log("level", "info", "msg", "Setting up counters ...")
-	logger.Log("level", "debug", "msg", "Setting up taskid")
-
-	err := sessCopy.DB(db).C("counters").Insert(bson.M{
-		"_id": "taskid",
-		"seq": 1,
-	})
-
-	if err != nil {
-		logger.Log("level", "error", "msg", "Failed to set the taskid to its initial value")
-		panic(err)
-	}
-
-	logger.Log("level", "info", "tag", "#prepared", "msg", "stats: "+fmt.Sprintf("%#v", mgo.GetStats()))
-}
@@ -1,13 +1,19 @@
 package models_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"testing"
+	"time"
 
 	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
 	"github.com/newtonsystems/agent-mgmt/app/models"
 	tu "github.com/newtonsystems/agent-mgmt/app/testutil"
 	"github.com/newtonsystems/agent-mgmt/app/utils"
+	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
@@ -57,7 +63,7 @@ func TestGetNextSequence(t *testing.T) {
 		}
 
 		t.Run(tc.description, func(t *testing.T) {
-			seqID, err := db.GetNextSequence(tc.name)
+			seqID, err := db.GetNextSequence(context.Background(), tc.name)
 			tu.Equals(t, tc.expectedSeq, seqID)
 			tu.IsAmError(t, tc.expectedErr, err)
 		})
@@ -65,39 +71,40 @@ func TestGetNextSequence(t *testing.T) {
 
 }
 
-func TestPrepareDB(t *testing.T) {
-
+func TestIsConnectionError(t *testing.T) {
 	testCases := []struct {
 		description string
-		name        string
-		expectedSeq int32
+		err         error
+		expected    bool
 	}{
-		{"prepare_1", "taskid", 1},
-		{"wrong_seq", "wrongid", 0},
+		{"nil", nil, false},
+		{"eof", io.EOF, true},
+		{"net", &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}, true},
+		{"no_servers", errors.New("no reachable servers"), true},
+		{"closed", errors.New("Closed explicitly"), true},
+		{"not_found", mgo.ErrNotFound, false},
+		{"dup", &mgo.LastError{Code: 11000, Err: "duplicate key"}, false},
+		{"am_error", amerrors.ErrAgentNotFoundError("agent 1 not found"), false},
 	}
 
-	// Initialise mongo connection
-	session, db := tu.NewTestMongoConnection(*tu.Debug, *tu.OutsideConn)
-	defer tu.CleanUpTestMongoConnection(t, session)
-	// TODO: add option to make preparing db optionally
-	tu.DropTestMongoDB(t, session)
-
-	//
-	// Run table driven tests
-	//
 	for _, tc := range testCases {
-		if *tu.Verbose {
-			fmt.Printf("Running 'TestGetNextSequence' (" + tc.description + ")")
-		}
-
 		t.Run(tc.description, func(t *testing.T) {
-			models.PrepareDB(session, tu.MongoDBName, logger)
-			defer tu.DropTestMongoDB(t, session)
-
-			var doc models.Count
-			_ = db.C("counters").FindId(tc.name).One(&doc)
-
-			tu.Equals(t, tc.expectedSeq, doc.Seq)
+			tu.Equals(t, tc.expected, models.IsConnectionError(tc.err))
 		})
 	}
 }
+
+func TestNewMongoSessionUnreachable(t *testing.T) {
+	// Nothing listens on port 1
+	settings, err := models.ParseMongoURI("mongodb://127.0.0.1:1/?connect=direct")
+	tu.Ok(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, _, err = models.NewMongoSession(ctx, settings, logger, false)
+	tu.Assert(t, err != nil, "expected an error connecting to an unreachable server")
+	// Gives up at the deadline (each attempt is limited to the time left)
+	tu.Assert(t, time.Since(start) < 5*time.Second, "expected to give up at the deadline, took %v", time.Since(start))
+}
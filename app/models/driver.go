@@ -0,0 +1,1218 @@
+package models
+
+// driver.go
+// Implementation of Session / DataLayer / Collection on the official MongoDB
+// Go driver (go.mongodb.org/mongo-driver), mgo is no longer maintained.
+// The model calls store the same documents as the mgo ones so either can be
+// used on a database. Unlike the other backends a DriverDatabase on a replica
+// set (or sharded cluster) runs calls in a transaction (WithTransaction, which
+// AddTask uses) and watches collections (WatchCollection).
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	dbson "go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonoptions"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+)
+
+// DefaultDriverTimeout how long a call may take unless the session's socket
+// timeout is set (as NewMongoSession does for mgo)
+const DefaultDriverTimeout = 3 * time.Second
+
+// driverRegistry decodes times in the local time zone (as mgo does)
+var driverRegistry = func() *bsoncodec.Registry {
+	registry := dbson.NewRegistry()
+	registry.RegisterTypeDecoder(reflect.TypeOf(time.Time{}), bsoncodec.NewTimeCodec(bsonoptions.TimeCodec().SetUseLocalTimeZone(true)))
+	return registry
+}()
+
+// DriverSession satisfies Session on a mongo.Client. The client pools its
+// connections so copies and clones share it: closing a copy does nothing,
+// closing the session returned by NewDriverSession disconnects the client.
+type DriverSession struct {
+	client     *mongo.Client
+	copied     bool
+	mode       mgo.Mode
+	safe       *mgo.Safe
+	timeout    time.Duration
+	replicated bool
+}
+
+// NewDriverSession returns a new Session on the official driver connected
+// with settings (see ParseMongoURI). Like NewMongoSession failed connections
+// are retried with exponential backoff until ctx is done.
+func NewDriverSession(ctx context.Context, settings MongoSettings, logger log.Logger, debug bool) (Session, log.Logger, error) {
+	driverLogger := log.With(logger, "connection", "mongo-driver")
+	driverLogger.Log(settings.Keyvals()...)
+
+	opts, err := settings.clientOptions()
+	if err != nil {
+		return nil, driverLogger, err
+	}
+
+	if debug {
+		driverLogger.Log("msg", "Turning on mongo debug logging ...")
+		opts.SetMonitor(&event.CommandMonitor{
+			Started: func(_ context.Context, e *event.CommandStartedEvent) {
+				driverLogger.Log("level", "debug", "command", e.CommandName, "db", e.DatabaseName, "request_id", e.RequestID)
+			},
+		})
+	}
+
+	// The client connects in the background, a ping tells when it has
+	client, err := mongo.Connect(context.Background(), opts)
+	if err != nil {
+		return nil, driverLogger, err
+	}
+	err = dialWithBackoff(ctx, settings.DialInfo.Timeout, driverLogger, func(timeout time.Duration) error {
+		pingCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return client.Ping(pingCtx, readpref.Primary())
+	})
+	if err != nil {
+		client.Disconnect(context.Background())
+		return nil, driverLogger, err
+	}
+
+	replicated, err := isReplicated(ctx, client)
+	if err != nil {
+		client.Disconnect(context.Background())
+		return nil, driverLogger, err
+	}
+
+	driverLogger.Log("msg", "successfully connected", "replicated", replicated)
+
+	session := &DriverSession{client: client, mode: settings.Mode, safe: &mgo.Safe{}, timeout: DefaultDriverTimeout, replicated: replicated}
+	return session, driverLogger, nil
+}
+
+// isReplicated returns whether client is connected to a replica set or a
+// sharded cluster (transactions and change streams need one)
+func isReplicated(ctx context.Context, client *mongo.Client) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, DefaultDriverTimeout)
+	defer cancel()
+
+	var reply struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	err := client.Database("admin").RunCommand(ctx, dbson.D{{Key: "isMaster", Value: 1}}).Decode(&reply)
+	return reply.SetName != "" || reply.Msg == "isdbgrid", err
+}
+
+// clientOptions returns the driver's options connecting with the settings
+func (s MongoSettings) clientOptions() (*options.ClientOptions, error) {
+	info := s.DialInfo
+	opts := options.Client().
+		SetHosts(info.Addrs).
+		SetConnectTimeout(info.Timeout).
+		SetServerSelectionTimeout(info.Timeout).
+		SetReadPreference(readPref(s.Mode)).
+		SetRegistry(driverRegistry)
+
+	if info.Username != "" {
+		// mgo authenticates against the URI's database if authSource is not set
+		source := info.Source
+		if source == "" {
+			source = info.Database
+		}
+		opts.SetAuth(options.Credential{
+			AuthMechanism: info.Mechanism,
+			AuthSource:    source,
+			Username:      info.Username,
+			Password:      info.Password,
+		})
+	}
+	if info.ReplicaSetName != "" {
+		opts.SetReplicaSet(info.ReplicaSetName)
+	}
+	if info.Direct {
+		opts.SetDirect(true)
+	}
+	if s.TLS {
+		config, err := s.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(config)
+	}
+	return opts, opts.Validate()
+}
+
+// readPref returns the driver's read preference for mgo mode (monotonic and
+// eventual reads have no equivalent, the closest is used)
+func readPref(mode mgo.Mode) *readpref.ReadPref {
+	switch mode {
+	case mgo.PrimaryPreferred, mgo.Monotonic:
+		return readpref.PrimaryPreferred()
+	case mgo.Secondary:
+		return readpref.Secondary()
+	case mgo.SecondaryPreferred:
+		return readpref.SecondaryPreferred()
+	case mgo.Nearest, mgo.Eventual:
+		return readpref.Nearest()
+	}
+	return readpref.Primary()
+}
+
+// writeConcern returns the driver's write concern for mgo safe (nil is
+// unacknowledged)
+func writeConcern(safe *mgo.Safe) *writeconcern.WriteConcern {
+	if safe == nil {
+		return writeconcern.Unacknowledged()
+	}
+	wc := &writeconcern.WriteConcern{WTimeout: time.Duration(safe.WTimeout) * time.Millisecond}
+	switch {
+	case safe.WMode != "":
+		wc.W = safe.WMode
+	case safe.W > 0:
+		wc.W = safe.W
+	}
+	if safe.J || safe.FSync {
+		journal := true
+		wc.Journal = &journal
+	}
+	return wc
+}
+
+// DB returns the database 'name' read with the session's mode
+func (s *DriverSession) DB(name string) DataLayer {
+	database := s.client.Database(name, options.Database().
+		SetReadPreference(readPref(s.mode)).
+		SetWriteConcern(writeConcern(s.safe)))
+	return &DriverDatabase{Database: database, timeout: s.timeout, replicated: s.replicated}
+}
+
+func (s *DriverSession) SetSafe(safe *mgo.Safe) {
+	s.safe = safe
+}
+
+// SetSyncTimeout does nothing, the client's server selection timeout (the
+// settings' dial timeout) applies
+func (s *DriverSession) SetSyncTimeout(d time.Duration) {}
+
+func (s *DriverSession) SetMode(consistency mgo.Mode, refresh bool) {
+	s.mode = consistency
+}
+
+// SetSocketTimeout limits how long each call may take
+func (s *DriverSession) SetSocketTimeout(d time.Duration) {
+	s.timeout = d
+}
+
+func (s *DriverSession) Close() {
+	if !s.copied {
+		s.client.Disconnect(context.Background())
+	}
+}
+
+// Clone returns a session sharing the client
+func (s *DriverSession) Clone() Session {
+	return s.Copy()
+}
+
+// Copy returns a session sharing the client
+func (s *DriverSession) Copy() Session {
+	sessionCopy := *s
+	sessionCopy.copied = true
+	return &sessionCopy
+}
+
+// Refresh does nothing, the client replaces broken connections itself
+func (s *DriverSession) Refresh() {}
+
+func (s *DriverSession) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	return s.client.Ping(ctx, readPref(s.mode))
+}
+
+// isDriverConnectionError returns whether err is a network error, no server
+// could be selected or the client is disconnected (see IsConnectionError)
+func isDriverConnectionError(err error) bool {
+	return mongo.IsNetworkError(err) || err == mongo.ErrClientDisconnected ||
+		strings.Contains(err.Error(), "server selection error")
+}
+
+// DriverDatabase satisfies DataLayer on a mongo.Database
+type DriverDatabase struct {
+	*mongo.Database
+	timeout    time.Duration
+	replicated bool
+}
+
+// context limits a call with ctx to the session's socket timeout
+func (db *DriverDatabase) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if db.timeout > 0 {
+		return context.WithTimeout(ctx, db.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// C returns the collection 'name' with mgo's semantics (see DriverCollection)
+func (db *DriverDatabase) C(name string) Collection {
+	return &DriverCollection{Collection: db.Database.Collection(name), timeout: db.timeout}
+}
+
+// DropDatabase drops the database
+func (db *DriverDatabase) DropDatabase() error {
+	ctx, cancel := db.context(context.Background())
+	defer cancel()
+	return db.Database.Drop(ctx)
+}
+
+// WithTransaction calls fn in a transaction (committed if fn returns nil,
+// otherwise aborted). The calls fn makes on db with the context it is given
+// are part of the transaction, which is retried on transient errors.
+// Transactions need a replica set (ErrNotSupported otherwise).
+func (db *DriverDatabase) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if !db.replicated {
+		return ErrNotSupported
+	}
+
+	session, err := db.Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sessCtx)
+	})
+	return err
+}
+
+// WatchCollection returns a change stream of the changes to collection
+// matching pipeline (nil for every change). Updates come with the full
+// document. Change streams need a replica set (ErrNotSupported otherwise).
+func (db *DriverDatabase) WatchCollection(ctx context.Context, collection string, pipeline interface{}) (ChangeStream, error) {
+	if !db.replicated {
+		return nil, ErrNotSupported
+	}
+	if pipeline == nil {
+		pipeline = mongo.Pipeline{}
+	}
+	return db.Database.Collection(collection).Watch(ctx, pipeline, options.ChangeStream().SetFullDocument(options.UpdateLookup))
+}
+
+// DriverCollection satisfies Collection on a mongo.Collection with mgo's
+// semantics: Remove and Update return mgo.ErrNotFound when nothing matched
+// and duplicate keys are *mgo.LastError (see mgo.IsDup).
+type DriverCollection struct {
+	*mongo.Collection
+	timeout time.Duration
+}
+
+// context returns the context of a call (limited to the session's socket timeout)
+func (c *DriverCollection) context() (context.Context, context.CancelFunc) {
+	if c.timeout > 0 {
+		return context.WithTimeout(context.Background(), c.timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// driverError returns err as mgo would have
+func driverError(err error) error {
+	if err == mongo.ErrNoDocuments {
+		return mgo.ErrNotFound
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return &mgo.LastError{Code: 11000, Err: err.Error()}
+	}
+	return err
+}
+
+// filter returns selector as a filter (nil matches every document)
+func filter(selector interface{}) interface{} {
+	if selector == nil {
+		return bson.M{}
+	}
+	return selector
+}
+
+// isOperatorUpdate returns whether update is made of update operators ($set,
+// $inc, ...) rather than a replacement document
+func isOperatorUpdate(update interface{}) bool {
+	doc, err := dbson.Marshal(update)
+	if err != nil {
+		return false
+	}
+	elems, err := dbson.Raw(doc).Elements()
+	return err == nil && len(elems) > 0 && strings.HasPrefix(elems[0].Key(), "$")
+}
+
+// Count returns the number of documents in the collection.
+func (c *DriverCollection) Count() (int, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+	n, err := c.Collection.CountDocuments(ctx, bson.M{})
+	return int(n), err
+}
+
+func (c *DriverCollection) Insert(docs ...interface{}) error {
+	ctx, cancel := c.context()
+	defer cancel()
+	_, err := c.Collection.InsertMany(ctx, docs)
+	return driverError(err)
+}
+
+func (c *DriverCollection) Remove(selector interface{}) error {
+	ctx, cancel := c.context()
+	defer cancel()
+	result, err := c.Collection.DeleteOne(ctx, filter(selector))
+	if err != nil {
+		return driverError(err)
+	}
+	if result.DeletedCount == 0 {
+		return mgo.ErrNotFound
+	}
+	return nil
+}
+
+func (c *DriverCollection) Update(selector interface{}, update interface{}) error {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	var result *mongo.UpdateResult
+	var err error
+	if isOperatorUpdate(update) {
+		result, err = c.Collection.UpdateOne(ctx, filter(selector), update)
+	} else {
+		result, err = c.Collection.ReplaceOne(ctx, filter(selector), update)
+	}
+	if err != nil {
+		return driverError(err)
+	}
+	if result.MatchedCount == 0 {
+		return mgo.ErrNotFound
+	}
+	return nil
+}
+
+func (c *DriverCollection) UpdateId(id interface{}, update interface{}) error {
+	return c.Update(bson.M{"_id": id}, update)
+}
+
+func (c *DriverCollection) Upsert(selector interface{}, update interface{}) (*mgo.ChangeInfo, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	var result *mongo.UpdateResult
+	var err error
+	if isOperatorUpdate(update) {
+		result, err = c.Collection.UpdateOne(ctx, filter(selector), update, options.Update().SetUpsert(true))
+	} else {
+		result, err = c.Collection.ReplaceOne(ctx, filter(selector), update, options.Replace().SetUpsert(true))
+	}
+	if err != nil {
+		return nil, driverError(err)
+	}
+	return &mgo.ChangeInfo{Updated: int(result.ModifiedCount), Matched: int(result.MatchedCount), UpsertedId: result.UpsertedID}, nil
+}
+
+// indexKeys returns the keys of an mgo index key ("-" prefixed fields are
+// descending) and the index's name as mgo names it
+func indexKeys(key []string) (dbson.D, string) {
+	keys := dbson.D{}
+	var names []string
+	for _, field := range key {
+		order := 1
+		if strings.HasPrefix(field, "-") {
+			field, order = field[1:], -1
+		}
+		keys = append(keys, dbson.E{Key: field, Value: order})
+		names = append(names, field+"_"+strconv.Itoa(order))
+	}
+	return keys, strings.Join(names, "_")
+}
+
+// EnsureIndex creates index unless it exists. DropDups is not supported by
+// MongoDB 3.0 onwards and is ignored.
+func (c *DriverCollection) EnsureIndex(index mgo.Index) error {
+	keys, name := indexKeys(index.Key)
+	if index.Name != "" {
+		name = index.Name
+	}
+	opts := options.Index().SetName(name).SetUnique(index.Unique).SetSparse(index.Sparse)
+	if index.ExpireAfter > 0 {
+		opts.SetExpireAfterSeconds(int32(index.ExpireAfter / time.Second))
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	_, err := c.Collection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: keys, Options: opts})
+	return driverError(err)
+}
+
+// DropIndex drops the index with key (see IsIndexNotFound)
+func (c *DriverCollection) DropIndex(key ...string) error {
+	_, name := indexKeys(key)
+
+	ctx, cancel := c.context()
+	defer cancel()
+	_, err := c.Collection.Indexes().DropOne(ctx, name)
+	return err
+}
+
+func (c *DriverCollection) RemoveAll(selector interface{}) (*mgo.ChangeInfo, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+	result, err := c.Collection.DeleteMany(ctx, filter(selector))
+	if err != nil {
+		return nil, driverError(err)
+	}
+	return &mgo.ChangeInfo{Removed: int(result.DeletedCount)}, nil
+}
+
+func (c *DriverCollection) UpdateAll(selector interface{}, update interface{}) (*mgo.ChangeInfo, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+	result, err := c.Collection.UpdateMany(ctx, filter(selector), update)
+	if err != nil {
+		return nil, driverError(err)
+	}
+	return &mgo.ChangeInfo{Updated: int(result.ModifiedCount), Matched: int(result.MatchedCount)}, nil
+}
+
+// Mongo Calls
+// (the same queries as the mgo calls in agent.go, task.go, session.go,
+// migration.go and base.go)
+
+// GetNextSequence returns the next sequence for 'name'
+func (db *DriverDatabase) GetNextSequence(ctx context.Context, name string) (int32, error) {
+	callCtx, cancel := db.context(ctx)
+	defer cancel()
+
+	var doc Count
+	err := db.Collection("counters").FindOneAndUpdate(callCtx,
+		bson.M{"_id": name},
+		bson.M{"$inc": bson.M{"seq": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&doc)
+
+	if err == mongo.ErrNoDocuments {
+		return 0, amerrors.ErrCounterNotFoundError("failed to find an counter counters(_id=" + name + ")")
+	}
+
+	if err != nil {
+		logger.Log("level", "error", "msg", "Creation of next sequence failed for "+name, "err", err)
+		return 0, dbError(ctx, err)
+	}
+
+	return doc.Seq, nil
+}
+
+// AgentExists check whether an agent exist based of its agent ID
+func (db *DriverDatabase) AgentExists(ctx context.Context, agentID int32) (bool, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	count, err := db.Collection("agents").CountDocuments(ctx, bson.M{"agentid": agentID})
+
+	if err != nil {
+		return false, err
+	}
+
+	if count == 0 {
+		return false, amerrors.ErrAgentNotFoundError("failed to find an Agent(AgentID=" + strconv.Itoa(int(agentID)) + ")")
+	}
+
+	return true, nil
+}
+
+// GetAgent returns the agent with agent ID
+func (db *DriverDatabase) GetAgent(ctx context.Context, agentID int32) (Agent, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	var agent Agent
+	err := db.Collection("agents").FindOne(ctx, bson.M{"agentid": agentID}).Decode(&agent)
+
+	if err == mongo.ErrNoDocuments {
+		return Agent{}, amerrors.ErrAgentNotFoundError("failed to find an Agent(AgentID=" + strconv.Itoa(int(agentID)) + ")")
+	}
+
+	return agent, err
+}
+
+// HeartBeat updates LastHeartBeat with current time now
+// An offline agent becomes available on its heartbeat
+func (db *DriverDatabase) HeartBeat(ctx context.Context, agentID int32) error {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	result, err := db.Collection("agents").UpdateOne(ctx, bson.M{"agentid": agentID}, bson.M{"$set": bson.M{"lastheartbeat": NowFunc()}})
+
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		err = amerrors.ErrAgentNotFoundError("failed to find an Agent(AgentID=" + strconv.Itoa(int(agentID)) + ")")
+		logger.Log("level", "err", "err", err)
+		return err
+	}
+
+	// Agents that were not offline are left alone
+	selector := bson.M{"agentid": agentID, "state": bson.M{"$in": []interface{}{AgentOffline, nil}}}
+	update := bson.M{"$set": bson.M{"state": AgentAvailable, "statechangedat": NowFunc()}}
+	_, err = db.Collection("agents").UpdateOne(ctx, selector, update)
+
+	return err
+}
+
+// HeartBeats writes buffered heartbeats (agent id -> time) in a single bulk
+// update and returns how many agents were found. A heartbeat never moves an
+// agent's last heartbeat backwards and offline agents become available.
+func (db *DriverDatabase) HeartBeats(ctx context.Context, beats map[int32]time.Time) (int, error) {
+	if len(beats) == 0 {
+		return 0, nil
+	}
+
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	var updates []mongo.WriteModel
+	for agentID, at := range beats {
+		updates = append(updates, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"agentid": agentID}).
+			SetUpdate(bson.M{"$max": bson.M{"lastheartbeat": at}}))
+	}
+
+	result, err := db.Collection("agents").BulkWrite(ctx, updates, options.BulkWrite().SetOrdered(false))
+
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = db.Collection("agents").UpdateMany(ctx, offlineAgentsSelector(beats), bson.M{"$set": bson.M{"state": AgentAvailable, "statechangedat": NowFunc()}})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return int(result.MatchedCount), nil
+}
+
+// TouchAgents sets the last heartbeat of the agents to now without checking
+// they exist (see HeartBeatStream) and returns how many were updated
+func (db *DriverDatabase) TouchAgents(ctx context.Context, agentIDs []int32) (int, error) {
+	if len(agentIDs) == 0 {
+		return 0, nil
+	}
+
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	result, err := db.Collection("agents").UpdateMany(ctx, bson.M{"agentid": bson.M{"$in": agentIDs}}, bson.M{"$set": bson.M{"lastheartbeat": NowFunc()}})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return int(result.ModifiedCount), nil
+}
+
+// SetAgentState moves the agent from state from to state to. The update only
+// applies if the agent is still in state from so concurrent changes are safe.
+// It does not check the transition is allowed (see CanTransition)
+func (db *DriverDatabase) SetAgentState(ctx context.Context, agentID int32, from AgentState, to AgentState) error {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	selector := bson.M{"agentid": agentID, "state": from}
+	if from == "" || from == AgentOffline {
+		selector["state"] = bson.M{"$in": []interface{}{AgentOffline, nil}}
+	}
+
+	result, err := db.Collection("agents").UpdateOne(ctx, selector, bson.M{"$set": bson.M{"state": to, "statechangedat": NowFunc()}})
+
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		if _, err = db.GetAgent(ctx, agentID); err != nil {
+			return err
+		}
+		return amerrors.ErrAgentStateTransitionError("Agent(AgentID=" + strconv.Itoa(int(agentID)) + ") is no longer " + string(from))
+	}
+
+	return nil
+}
+
+// SetAgentSkills replaces the agent's skill profile and returns the updated agent
+func (db *DriverDatabase) SetAgentSkills(ctx context.Context, agentID int32, skills []Skill) (Agent, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	var agent Agent
+	err := db.Collection("agents").FindOneAndUpdate(ctx,
+		bson.M{"agentid": agentID},
+		bson.M{"$set": bson.M{"skills": skills}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&agent)
+
+	if err == mongo.ErrNoDocuments {
+		return Agent{}, amerrors.ErrAgentNotFoundError("failed to find an Agent(AgentID=" + strconv.Itoa(int(agentID)) + ")")
+	}
+
+	if err != nil {
+		return Agent{}, err
+	}
+
+	return agent, nil
+}
+
+// ExpireAgents marks agents offline whose last heartbeat is before before
+// (missed heartbeats) and returns their agent IDs. With dryRun nothing is changed.
+func (db *DriverDatabase) ExpireAgents(ctx context.Context, before time.Time, dryRun bool) ([]int32, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	selector := bson.M{"state": bson.M{"$ne": AgentOffline}, "lastheartbeat": bson.M{"$lt": before}}
+
+	var agents []Agent
+	err := db.findAll(ctx, "agents", selector, options.Find().SetProjection(bson.M{"agentid": 1}), &agents)
+
+	if err != nil || len(agents) == 0 || dryRun {
+		return agentIDs(agents), err
+	}
+
+	// Agents that heartbeat since the find are left alone
+	selector["agentid"] = bson.M{"$in": agentIDs(agents)}
+	_, err = db.Collection("agents").UpdateMany(ctx, selector, bson.M{"$set": bson.M{"state": AgentOffline, "statechangedat": NowFunc()}})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return agentIDs(agents), nil
+}
+
+// findAll decodes the documents of collection matching selector into results
+func (db *DriverDatabase) findAll(ctx context.Context, collection string, selector interface{}, opts *options.FindOptions, results interface{}) error {
+	cursor, err := db.Collection(collection).Find(ctx, selector, opts)
+	if err != nil {
+		return err
+	}
+	return cursor.All(ctx, results)
+}
+
+// GetAgents returns all Agents in state within a certain heartbeat with every
+// required skill in order (preferred skills are ranked by RankBySkills)
+func (db *DriverDatabase) GetAgents(ctx context.Context, state AgentState, timestamp time.Time, skills []SkillRequirement, order AgentOrder, limit int32) ([]Agent, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	opts := options.Find().SetLimit(int64(limit))
+	if fields := order.fields(); len(fields) > 0 {
+		sort := dbson.D{}
+		for _, field := range fields {
+			sort = append(sort, dbson.E{Key: field, Value: 1})
+		}
+		opts.SetSort(sort)
+	}
+
+	var agents []Agent
+	err := db.findAll(ctx, "agents", order.selector(agentsSelector(state, timestamp, skills)), opts, &agents)
+
+	return agents, err
+}
+
+// AddAgent creates a new agent with an agent ID allocated from the 'agentid' counter
+// Agent IDs already taken (unique agentid index) are skipped.
+// The agent starts offline so is not available until its first HeartBeat()
+func (db *DriverDatabase) AddAgent(ctx context.Context) (int32, error) {
+	for attempt := 0; attempt < maxAgentIDAttempts; attempt++ {
+		agentID, err := db.GetNextSequence(ctx, "agentid")
+
+		if err != nil {
+			return 0, err
+		}
+
+		insertCtx, cancel := db.context(ctx)
+		_, err = db.Collection("agents").InsertOne(insertCtx, &Agent{AgentID: agentID, State: AgentOffline, StateChangedAt: NowFunc()})
+		cancel()
+
+		if err == nil {
+			return agentID, nil
+		}
+
+		if !mongo.IsDuplicateKeyError(err) {
+			return 0, err
+		}
+
+		logger.Log("level", "warn", "msg", "Agent ID "+strconv.Itoa(int(agentID))+" already taken, trying next sequence")
+	}
+
+	return 0, amerrors.InternalServerError("failed to allocate a unique agent ID after %d attempts", maxAgentIDAttempts)
+}
+
+// RemoveAgent removes the agent with agent ID
+func (db *DriverDatabase) RemoveAgent(ctx context.Context, agentID int32) error {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	result, err := db.Collection("agents").DeleteOne(ctx, bson.M{"agentid": agentID})
+
+	if err != nil {
+		return err
+	}
+
+	if result.DeletedCount == 0 {
+		return amerrors.ErrAgentNotFoundError("failed to find an Agent(AgentID=" + strconv.Itoa(int(agentID)) + ")")
+	}
+
+	return nil
+}
+
+// AddTask add a task to mongo and returns the newly created Task's id if successful
+// On a replica set the task ID is only taken if the task is inserted (both
+// are in a transaction).
+func (db *DriverDatabase) AddTask(ctx context.Context, custID int32, agentIDs []int32, skills []SkillRequirement) (int32, error) {
+	if custID <= 0 {
+		return 0, amerrors.ErrCustIDInvalidError("Invalid Cust ID: " + strconv.Itoa(int(custID)))
+	}
+
+	if err := ValidateSkillRequirements(skills); err != nil {
+		return 0, err
+	}
+
+	var taskID int32
+	err := db.transaction(ctx, func(ctx context.Context) error {
+		var err error
+		taskID, err = db.GetNextSequence(ctx, "taskid")
+
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := db.context(ctx)
+		defer cancel()
+
+		_, err = db.Collection("tasks").InsertOne(ctx, newTask(taskID, custID, agentIDs, skills))
+		return err
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return taskID, nil
+}
+
+// transaction calls fn in a transaction if db supports them (see
+// WithTransaction), otherwise fn is called directly
+func (db *DriverDatabase) transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if !db.replicated {
+		return fn(ctx)
+	}
+	return db.WithTransaction(ctx, fn)
+}
+
+// AcceptTask marks the task as accepted by agentID (recording when) and releases
+// the other candidate agents. The update only applies if the task has not
+// already been accepted and was offered to agentID so concurrent accepts are safe.
+// Cancelled and abandoned tasks cannot be accepted.
+func (db *DriverDatabase) AcceptTask(ctx context.Context, taskID int32, agentID int32) (Task, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	selector := bson.M{
+		"_id":        taskID,
+		"agentids":   agentID,
+		"acceptedby": bson.M{"$in": []interface{}{0, nil}},
+		"status":     statusSelector(TaskOffered),
+	}
+
+	// Find the task first so we know which candidates to release
+	var task Task
+	err := db.Collection("tasks").FindOne(ctx, selector).Decode(&task)
+
+	if err == nil {
+		task.AcceptedBy = agentID
+		task.setStatus(TaskAccepted, NowFunc())
+		task.ReleasedAgentIDs = releasedAgentIDs(task.AgentIDs, agentID)
+		task.AgentIDs = []int32{agentID}
+
+		var result *mongo.UpdateResult
+		result, err = db.Collection("tasks").UpdateOne(ctx, selector, bson.M{"$set": bson.M{
+			"status":           task.Status,
+			"acceptedby":       task.AcceptedBy,
+			"acceptedat":       task.AcceptedAt,
+			"agentids":         task.AgentIDs,
+			"releasedagentids": task.ReleasedAgentIDs,
+		}})
+		if err == nil && result.MatchedCount == 0 {
+			err = mongo.ErrNoDocuments
+		}
+	}
+
+	if err == mongo.ErrNoDocuments {
+		var current Task
+		if err = db.findTask(ctx, taskID, &current); err != nil {
+			return Task{}, err
+		}
+		return Task{}, taskNotAcceptableError(current, agentID)
+	}
+
+	if err != nil {
+		return Task{}, err
+	}
+
+	return task, nil
+}
+
+// findTask decodes the task with task ID into task (ErrTaskNotFound if there is none)
+func (db *DriverDatabase) findTask(ctx context.Context, taskID int32, task *Task) error {
+	err := db.Collection("tasks").FindOne(ctx, bson.M{"_id": taskID}).Decode(task)
+
+	if err == mongo.ErrNoDocuments {
+		return amerrors.ErrTaskNotFoundError("failed to find a Task(TaskID=" + strconv.Itoa(int(taskID)) + ")")
+	}
+
+	return err
+}
+
+// CompleteTask marks the task accepted by agentID as completed (recording when).
+// The update only applies if the task was accepted by agentID and has not
+// already been completed (or cancelled/abandoned).
+func (db *DriverDatabase) CompleteTask(ctx context.Context, taskID int32, agentID int32) (Task, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	selector := bson.M{
+		"_id":         taskID,
+		"acceptedby":  agentID,
+		"completedat": nil,
+		"status":      statusSelector(TaskAccepted, TaskInProgress),
+	}
+
+	var task Task
+	err := db.Collection("tasks").FindOne(ctx, selector).Decode(&task)
+
+	if err == nil {
+		task.setStatus(TaskCompleted, NowFunc())
+
+		var result *mongo.UpdateResult
+		result, err = db.Collection("tasks").UpdateOne(ctx, selector, bson.M{"$set": statusUpdate(task.Status, task.CompletedAt)})
+		if err == nil && result.MatchedCount == 0 {
+			err = mongo.ErrNoDocuments
+		}
+	}
+
+	if err == mongo.ErrNoDocuments {
+		var current Task
+		if err = db.findTask(ctx, taskID, &current); err != nil {
+			return Task{}, err
+		}
+		return Task{}, taskNotCompletableError(current, agentID)
+	}
+
+	if err != nil {
+		return Task{}, err
+	}
+
+	return task, nil
+}
+
+// CountAcceptedTasks returns how many tasks each of agentIDs accepted since since
+// (agents with no tasks are not in the map)
+func (db *DriverDatabase) CountAcceptedTasks(ctx context.Context, agentIDs []int32, since time.Time) (map[int32]int, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	counts := make(map[int32]int)
+
+	var tasks []Task
+	err := db.findAll(ctx, "tasks", acceptedTasksSelector(agentIDs, since), options.Find().SetProjection(bson.M{"acceptedby": 1}), &tasks)
+
+	if err != nil {
+		return counts, err
+	}
+
+	for _, task := range tasks {
+		counts[task.AcceptedBy]++
+	}
+
+	return counts, nil
+}
+
+// GetTask returns the task with task ID
+func (db *DriverDatabase) GetTask(ctx context.Context, taskID int32) (Task, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	var task Task
+	if err := db.findTask(ctx, taskID, &task); err != nil {
+		return Task{}, err
+	}
+
+	task.Status = task.CurrentStatus()
+	return task, nil
+}
+
+// ListTasks returns the tasks matching filter (oldest first, limit 0 is no limit)
+func (db *DriverDatabase) ListTasks(ctx context.Context, filter TaskFilter, limit int32) ([]Task, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	var tasks []Task
+	err := db.findAll(ctx, "tasks", filter.selector(), options.Find().SetSort(bson.M{"_id": 1}).SetLimit(int64(limit)), &tasks)
+
+	if err != nil {
+		return tasks, err
+	}
+
+	for i := range tasks {
+		tasks[i].Status = tasks[i].CurrentStatus()
+	}
+
+	return tasks, nil
+}
+
+// SetTaskStatus moves the task from status from to status to (only if it is
+// still in status from) recording when. Returns the updated task.
+func (db *DriverDatabase) SetTaskStatus(ctx context.Context, taskID int32, from TaskStatus, to TaskStatus) (Task, error) {
+	task, err := db.GetTask(ctx, taskID)
+
+	if err != nil {
+		return Task{}, err
+	}
+
+	if task.Status != from {
+		return Task{}, taskStatusTransitionError(taskID, from, to)
+	}
+
+	now := NowFunc()
+	task.setStatus(to, now)
+
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	result, err := db.Collection("tasks").UpdateOne(ctx, bson.M{"_id": taskID, "status": statusSelector(from)}, bson.M{"$set": statusUpdate(to, now)})
+
+	if err != nil {
+		return Task{}, err
+	}
+
+	if result.MatchedCount == 0 {
+		return Task{}, taskStatusTransitionError(taskID, from, to)
+	}
+
+	return task, nil
+}
+
+// OfferTask offers the queued task to agentIDs (recording when). The update
+// only applies if the task is still queued. Returns the updated task.
+func (db *DriverDatabase) OfferTask(ctx context.Context, taskID int32, agentIDs []int32) (Task, error) {
+	task, err := db.GetTask(ctx, taskID)
+
+	if err != nil {
+		return Task{}, err
+	}
+
+	if task.Status != TaskQueued {
+		return Task{}, taskStatusTransitionError(taskID, task.Status, TaskOffered)
+	}
+
+	task.AgentIDs = agentIDs
+	task.setStatus(TaskOffered, NowFunc())
+
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	result, err := db.Collection("tasks").UpdateOne(ctx, bson.M{"_id": taskID, "status": statusSelector(TaskQueued)}, bson.M{"$set": offerUpdate(task)})
+
+	if err != nil {
+		return Task{}, err
+	}
+
+	if result.MatchedCount == 0 {
+		return Task{}, taskStatusTransitionError(taskID, TaskQueued, TaskOffered)
+	}
+
+	return task, nil
+}
+
+// ArchiveTasks moves tasks completed, abandoned or cancelled before before into
+// the archived tasks collection and returns how many. With dryRun nothing is moved.
+func (db *DriverDatabase) ArchiveTasks(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	archived := 0
+
+	for _, field := range endedTaskFields {
+		selector := bson.M{field: bson.M{"$lt": before}}
+
+		if dryRun {
+			n, err := db.Collection("tasks").CountDocuments(ctx, selector)
+			if err != nil {
+				return archived, err
+			}
+			archived += int(n)
+			continue
+		}
+
+		var tasks []Task
+		err := db.findAll(ctx, "tasks", selector, nil, &tasks)
+
+		if err != nil {
+			return archived, err
+		}
+
+		for _, task := range tasks {
+			// A previous run may have archived the task but failed to remove it
+			_, err = db.Collection(archivedTasksCollection).InsertOne(ctx, &task)
+			if err != nil && !mongo.IsDuplicateKeyError(err) {
+				return archived, err
+			}
+
+			if _, err = db.Collection("tasks").DeleteOne(ctx, bson.M{"_id": task.TaskID}); err != nil {
+				return archived, err
+			}
+			archived++
+		}
+	}
+
+	return archived, nil
+}
+
+// GetAgentIDFromRef returns the Agent ID from a Reference
+func (db *DriverDatabase) GetAgentIDFromRef(ctx context.Context, refID string) (int32, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	var pSess PhoneSession
+	err := db.Collection("phonesessions").FindOne(ctx, bson.M{"refid": refID}, options.FindOne().SetProjection(bson.M{"agentid": 1})).Decode(&pSess)
+
+	if err == mongo.ErrNoDocuments {
+		return 0, amerrors.ErrAgentIDNotFoundError("failed to find an Agent from ref id " + refID)
+	}
+	if err != nil {
+		return 0, driverError(err)
+	}
+
+	return pSess.AgentID, nil
+}
+
+// ExpirePhoneSessions removes phone sessions created before before and returns
+// how many. With dryRun nothing is removed.
+func (db *DriverDatabase) ExpirePhoneSessions(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	selector := bson.M{"createdat": bson.M{"$lt": before}}
+
+	if dryRun {
+		n, err := db.Collection("phonesessions").CountDocuments(ctx, selector)
+		return int(n), err
+	}
+
+	result, err := db.Collection("phonesessions").DeleteMany(ctx, selector)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return int(result.DeletedCount), nil
+}
+
+// AppliedMigrations returns the migrations applied to the database by version
+func (db *DriverDatabase) AppliedMigrations(ctx context.Context) ([]AppliedMigration, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	var applied []AppliedMigration
+	err := db.findAll(ctx, MigrationsCollection, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}), &applied)
+	return applied, err
+}
+
+// AddMigration records that migration m has been applied
+func (db *DriverDatabase) AddMigration(ctx context.Context, m AppliedMigration) error {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	_, err := db.Collection(MigrationsCollection).UpdateOne(ctx,
+		bson.M{"_id": m.Version},
+		bson.M{"$set": bson.M{"name": m.Name, "appliedat": m.AppliedAt}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// RemoveMigration records that migration version has been reverted
+func (db *DriverDatabase) RemoveMigration(ctx context.Context, version int) error {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	_, err := db.Collection(MigrationsCollection).DeleteOne(ctx, bson.M{"_id": version})
+	return err
+}
+
+// LockMigrations takes the migration lock for owner until expires and returns
+// whether it did (false while another owner holds it, unless it expired
+// before now)
+func (db *DriverDatabase) LockMigrations(ctx context.Context, owner string, expires time.Time, now time.Time) (bool, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	_, err := db.Collection(MigrationLockCollection).InsertOne(ctx, &MigrationLock{ID: migrationLockID, Owner: owner, Expires: expires})
+	if err == nil {
+		return true, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return false, err
+	}
+
+	result, err := db.Collection(MigrationLockCollection).UpdateOne(ctx,
+		bson.M{"_id": migrationLockID, "expires": bson.M{"$lt": now}},
+		bson.M{"$set": bson.M{"owner": owner, "expires": expires}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+// RenewMigrationLock extends the migration lock held by owner until expires
+// and returns whether owner still held it
+func (db *DriverDatabase) RenewMigrationLock(ctx context.Context, owner string, expires time.Time) (bool, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	result, err := db.Collection(MigrationLockCollection).UpdateOne(ctx,
+		bson.M{"_id": migrationLockID, "owner": owner},
+		bson.M{"$set": bson.M{"expires": expires}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+// UnlockMigrations releases the migration lock if owner holds it
+func (db *DriverDatabase) UnlockMigrations(ctx context.Context, owner string) error {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	_, err := db.Collection(MigrationLockCollection).DeleteOne(ctx, bson.M{"_id": migrationLockID, "owner": owner})
+	return err
+}
@@ -0,0 +1,120 @@
+package models_test
+
+// Tests for driver.go (the model calls run through the same test suite with
+// the -driver flag)
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/newtonsystems/agent-mgmt/app/models"
+	tu "github.com/newtonsystems/agent-mgmt/app/testutil"
+)
+
+func TestNewDriverSessionUnreachable(t *testing.T) {
+	// Nothing listens on port 1
+	settings, err := models.ParseMongoURI("mongodb://127.0.0.1:1/?connect=direct")
+	tu.Ok(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, _, err = models.NewDriverSession(ctx, settings, logger, false)
+	tu.Assert(t, err != nil, "expected an error connecting to an unreachable server")
+	tu.Assert(t, time.Since(start) < 5*time.Second, "expected to give up at the deadline, took %v", time.Since(start))
+}
+
+func TestIsConnectionErrorDriver(t *testing.T) {
+	tu.Equals(t, true, models.IsConnectionError(mongo.ErrClientDisconnected))
+	tu.Equals(t, true, models.IsConnectionError(errors.New("server selection error: context deadline exceeded")))
+	tu.Equals(t, false, models.IsConnectionError(mongo.ErrNoDocuments))
+}
+
+// driverDatabase returns the test database on the official driver (the test
+// is skipped without the -driver flag)
+func driverDatabase(t *testing.T) (models.Session, *models.DriverDatabase) {
+	if !*tu.Driver {
+		t.Skip("needs mongo with the official driver (-driver)")
+	}
+	session, db := tu.NewTestMongoConnection(*tu.Debug, *tu.OutsideConn)
+	return session, db.(*models.DriverDatabase)
+}
+
+func TestDriverWithTransaction(t *testing.T) {
+	session, db := driverDatabase(t)
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	ctx := context.Background()
+	agentID, err := db.AddAgent(ctx)
+	tu.Ok(t, err)
+
+	// An aborted transaction changes nothing
+	aborted := errors.New("aborted")
+	err = db.WithTransaction(ctx, func(ctx context.Context) error {
+		if err := db.SetAgentState(ctx, agentID, models.AgentOffline, models.AgentAvailable); err != nil {
+			return err
+		}
+		return aborted
+	})
+	tu.Equals(t, aborted, err)
+	agent, err := db.GetAgent(ctx, agentID)
+	tu.Ok(t, err)
+	tu.Equals(t, models.AgentOffline, agent.State)
+
+	err = db.WithTransaction(ctx, func(ctx context.Context) error {
+		return db.SetAgentState(ctx, agentID, models.AgentOffline, models.AgentAvailable)
+	})
+	tu.Ok(t, err)
+	agent, err = db.GetAgent(ctx, agentID)
+	tu.Ok(t, err)
+	tu.Equals(t, models.AgentAvailable, agent.State)
+}
+
+func TestDriverAddTaskTransaction(t *testing.T) {
+	session, db := driverDatabase(t)
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	ctx := context.Background()
+	next, err := db.GetNextSequence(ctx, "taskid")
+	tu.Ok(t, err)
+
+	// The insert fails on the duplicate task ID so its ID is not taken
+	tu.Ok(t, db.C("tasks").Insert(&models.Task{TaskID: next + 1, CustID: 1}))
+	_, err = db.AddTask(ctx, 5, nil, nil)
+	tu.Assert(t, err != nil, "expected a duplicate key error")
+
+	tu.Ok(t, db.C("tasks").Remove(bson.M{"_id": next + 1}))
+	taskID, err := db.AddTask(ctx, 5, nil, nil)
+	tu.Ok(t, err)
+	tu.Equals(t, next+1, taskID)
+}
+
+func TestDriverWatchCollection(t *testing.T) {
+	session, _ := driverDatabase(t)
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Change streams are reached through the Session like every other call
+	db := session.DB(tu.MongoDBName)
+	stream, err := db.WatchCollection(ctx, "agents", []bson.M{{"$match": bson.M{"operationType": "insert"}}})
+	tu.Ok(t, err)
+	defer stream.Close(ctx)
+
+	agentID, err := db.AddAgent(ctx)
+	tu.Ok(t, err)
+
+	tu.Assert(t, stream.Next(ctx), "expected a change: %v", stream.Err())
+	var change struct {
+		FullDocument models.Agent `bson:"fullDocument"`
+	}
+	tu.Ok(t, stream.Decode(&change))
+	tu.Equals(t, agentID, change.FullDocument.AgentID)
+}
@@ -0,0 +1,1503 @@
+package models
+
+// memory.go
+// In-memory implementation of Session / DataLayer / Collection
+// Useful for local development and CI when no mongo replica set is available.
+// Documents are stored as bson.M (round-tripped through the mgo bson codec) so
+// they behave the same way as they would when read back from mongo. Calls
+// made once their context is done fail with its error (nothing is changed).
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+)
+
+// memoryStore holds every in-memory database for a MemorySession (and its copies).
+type memoryStore struct {
+	mu  sync.Mutex
+	dbs map[string]*MemoryDatabase
+}
+
+func (s *memoryStore) db(name string) *MemoryDatabase {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	db, ok := s.dbs[name]
+	if !ok {
+		db = newMemoryDatabase(name)
+		s.dbs[name] = db
+	}
+	return db
+}
+
+// MemorySession satisfies Session and keeps all data in process memory.
+// Copies and clones share the same underlying store.
+type MemorySession struct {
+	store *memoryStore
+}
+
+// NewMemorySession returns a new in-memory Session.
+func NewMemorySession(logger log.Logger) (Session, log.Logger) {
+	memoryLogger := log.With(logger, "connection", "memory")
+	memoryLogger.Log("level", "warn", "msg", "Using in-memory database. Data will be lost on exit.")
+
+	session := MemorySession{store: &memoryStore{dbs: make(map[string]*MemoryDatabase)}}
+	return session, memoryLogger
+}
+
+// DB returns the in-memory database 'name' (created if it does not exist).
+func (s MemorySession) DB(name string) DataLayer {
+	return s.store.db(name)
+}
+
+func (s MemorySession) SetSafe(safe *mgo.Safe) {}
+
+func (s MemorySession) SetSyncTimeout(d time.Duration) {}
+
+func (s MemorySession) SetMode(consistency mgo.Mode, refresh bool) {}
+
+func (s MemorySession) SetSocketTimeout(d time.Duration) {}
+
+func (s MemorySession) Close() {}
+
+func (s MemorySession) Refresh() {}
+
+// Copy returns a session sharing the same store
+func (s MemorySession) Copy() Session {
+	return MemorySession{store: s.store}
+}
+
+// Clone returns a session sharing the same store
+func (s MemorySession) Clone() Session {
+	return MemorySession{store: s.store}
+}
+
+func (s MemorySession) Ping() error {
+	return nil
+}
+
+// MemoryDatabase satisfies DataLayer. A single lock guards all of its
+// collections so the model calls (e.g. GetNextSequence) are atomic.
+type MemoryDatabase struct {
+	name        string
+	mu          sync.RWMutex
+	collections map[string]*memoryCollectionData
+}
+
+type memoryCollectionData struct {
+	docs    []bson.M
+	indexes []mgo.Index
+}
+
+func newMemoryDatabase(name string) *MemoryDatabase {
+	return &MemoryDatabase{
+		name:        name,
+		collections: make(map[string]*memoryCollectionData),
+	}
+}
+
+// collection returns the data for collection 'name'. Caller must hold db.mu.
+func (db *MemoryDatabase) collection(name string) *memoryCollectionData {
+	c, ok := db.collections[name]
+	if !ok {
+		c = &memoryCollectionData{}
+		db.collections[name] = c
+	}
+	return c
+}
+
+// C returns a Collection backed by memory.
+func (db *MemoryDatabase) C(name string) Collection {
+	return &MemoryCollection{db: db, name: name}
+}
+
+// DropDatabase removes all collections (and their indexes).
+func (db *MemoryDatabase) DropDatabase() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.collections = make(map[string]*memoryCollectionData)
+	return nil
+}
+
+// WithTransaction returns ErrNotSupported, the in-memory database has no
+// transactions
+func (db *MemoryDatabase) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return ErrNotSupported
+}
+
+// WatchCollection returns ErrNotSupported, the in-memory database has no
+// change streams
+func (db *MemoryDatabase) WatchCollection(ctx context.Context, collection string, pipeline interface{}) (ChangeStream, error) {
+	return nil, ErrNotSupported
+}
+
+// MemoryCollection satisfies Collection.
+type MemoryCollection struct {
+	db   *MemoryDatabase
+	name string
+}
+
+// Count returns the number of documents in the collection.
+func (c *MemoryCollection) Count() (n int, err error) {
+	c.db.mu.RLock()
+	defer c.db.mu.RUnlock()
+	if coll, ok := c.db.collections[c.name]; ok {
+		return len(coll.docs), nil
+	}
+	return 0, nil
+}
+
+// Insert inserts one or more documents respecting unique indexes.
+func (c *MemoryCollection) Insert(docs ...interface{}) error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	return c.db.insert(c.name, docs...)
+}
+
+// Remove removes the first document matching selector.
+func (c *MemoryCollection) Remove(selector interface{}) error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	n, err := c.db.remove(c.name, selector, false)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RemoveAll removes all documents matching selector.
+func (c *MemoryCollection) RemoveAll(selector interface{}) (info *mgo.ChangeInfo, err error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	n, err := c.db.remove(c.name, selector, true)
+	if err != nil {
+		return nil, err
+	}
+	return &mgo.ChangeInfo{Removed: n, Matched: n}, nil
+}
+
+// Update updates the first document matching selector.
+func (c *MemoryCollection) Update(selector interface{}, update interface{}) error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	n, err := c.db.update(c.name, selector, update, false)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// UpdateAll updates all documents matching selector.
+func (c *MemoryCollection) UpdateAll(selector interface{}, update interface{}) (info *mgo.ChangeInfo, err error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	n, err := c.db.update(c.name, selector, update, true)
+	if err != nil {
+		return nil, err
+	}
+	return &mgo.ChangeInfo{Updated: n, Matched: n}, nil
+}
+
+// UpdateId updates the document with _id.
+func (c *MemoryCollection) UpdateId(id interface{}, update interface{}) error {
+	return c.Update(bson.M{"_id": id}, update)
+}
+
+// Upsert updates the first document matching selector or inserts a new one.
+func (c *MemoryCollection) Upsert(selector interface{}, update interface{}) (info *mgo.ChangeInfo, err error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	n, err := c.db.update(c.name, selector, update, false)
+	if err != nil {
+		return nil, err
+	}
+	if n > 0 {
+		return &mgo.ChangeInfo{Updated: n, Matched: n}, nil
+	}
+
+	doc, err := c.db.upsertDoc(selector, update)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.db.insert(c.name, doc); err != nil {
+		return nil, err
+	}
+	return &mgo.ChangeInfo{UpsertedId: doc["_id"]}, nil
+}
+
+// EnsureIndex records the index. Unique indexes are enforced on insert/update.
+func (c *MemoryCollection) EnsureIndex(index mgo.Index) error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	coll := c.db.collection(c.name)
+	for _, existing := range coll.indexes {
+		if reflect.DeepEqual(existing.Key, index.Key) {
+			return nil
+		}
+	}
+
+	if index.Unique {
+		var kept []bson.M
+		for _, doc := range coll.docs {
+			if indexConflict(kept, doc, index) {
+				if !index.DropDups {
+					return &mgo.LastError{Code: 11000, Err: "E11000 duplicate key error index: " + c.db.name + "." + c.name + " " + strings.Join(index.Key, ",")}
+				}
+				continue
+			}
+			kept = append(kept, doc)
+		}
+		coll.docs = kept
+	}
+
+	coll.indexes = append(coll.indexes, index)
+	return nil
+}
+
+// DropIndex removes the index with key.
+func (c *MemoryCollection) DropIndex(key ...string) error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	coll := c.db.collection(c.name)
+	for i, index := range coll.indexes {
+		if reflect.DeepEqual(index.Key, key) {
+			coll.indexes = append(coll.indexes[:i], coll.indexes[i+1:]...)
+			return nil
+		}
+	}
+	return &mgo.QueryError{Code: 27, Message: "index not found with key " + strings.Join(key, ",")}
+}
+
+// -----------------------------------------------------------------------------
+// Helpers (caller must hold db.mu)
+
+func (db *MemoryDatabase) insert(name string, docs ...interface{}) error {
+	coll := db.collection(name)
+
+	for _, d := range docs {
+		doc, err := toDoc(d)
+		if err != nil {
+			return err
+		}
+		if _, ok := doc["_id"]; !ok {
+			doc["_id"] = bson.NewObjectId()
+		}
+		if err = db.checkUnique(name, coll.docs, doc); err != nil {
+			return err
+		}
+		coll.docs = append(coll.docs, doc)
+	}
+	return nil
+}
+
+func (db *MemoryDatabase) checkUnique(name string, docs []bson.M, doc bson.M) error {
+	indexes := append([]mgo.Index{{Key: []string{"_id"}, Unique: true}}, db.collection(name).indexes...)
+
+	for _, index := range indexes {
+		if index.Unique && indexConflict(docs, doc, index) {
+			return &mgo.LastError{Code: 11000, Err: "E11000 duplicate key error index: " + db.name + "." + name + " " + strings.Join(index.Key, ",")}
+		}
+	}
+	return nil
+}
+
+func (db *MemoryDatabase) find(name string, selector interface{}, limit int) ([]bson.M, error) {
+	sel, err := toDoc(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read only: do not create the collection (caller may only hold a read lock)
+	coll, ok := db.collections[name]
+	if !ok {
+		return nil, nil
+	}
+
+	var found []bson.M
+	for _, doc := range coll.docs {
+		if limit > 0 && len(found) == limit {
+			break
+		}
+		if matches(doc, sel) {
+			found = append(found, doc)
+		}
+	}
+	return found, nil
+}
+
+func (db *MemoryDatabase) remove(name string, selector interface{}, all bool) (int, error) {
+	sel, err := toDoc(selector)
+	if err != nil {
+		return 0, err
+	}
+
+	coll := db.collection(name)
+	var kept []bson.M
+	removed := 0
+	for _, doc := range coll.docs {
+		if (all || removed == 0) && matches(doc, sel) {
+			removed++
+			continue
+		}
+		kept = append(kept, doc)
+	}
+	coll.docs = kept
+	return removed, nil
+}
+
+func (db *MemoryDatabase) update(name string, selector interface{}, update interface{}, all bool) (int, error) {
+	sel, err := toDoc(selector)
+	if err != nil {
+		return 0, err
+	}
+	upd, err := toDoc(update)
+	if err != nil {
+		return 0, err
+	}
+
+	coll := db.collection(name)
+	updated := 0
+	for i, doc := range coll.docs {
+		if !matches(doc, sel) {
+			continue
+		}
+
+		newDoc, err := applyUpdate(doc, upd)
+		if err != nil {
+			return updated, err
+		}
+
+		others := append(append([]bson.M{}, coll.docs[:i]...), coll.docs[i+1:]...)
+		if err = db.checkUnique(name, others, newDoc); err != nil {
+			return updated, err
+		}
+
+		coll.docs[i] = newDoc
+		updated++
+		if !all {
+			break
+		}
+	}
+	return updated, nil
+}
+
+// upsertDoc builds the document inserted by an upsert (equality fields of the
+// selector plus the update).
+func (db *MemoryDatabase) upsertDoc(selector interface{}, update interface{}) (bson.M, error) {
+	sel, err := toDoc(selector)
+	if err != nil {
+		return nil, err
+	}
+	upd, err := toDoc(update)
+	if err != nil {
+		return nil, err
+	}
+
+	base := bson.M{}
+	for k, v := range sel {
+		if _, isOp := v.(bson.M); !isOp && !strings.HasPrefix(k, "$") {
+			base[k] = v
+		}
+	}
+	return applyUpdate(base, upd)
+}
+
+// toDoc converts a struct, pointer or map into a bson.M via the mgo bson codec.
+func toDoc(v interface{}) (bson.M, error) {
+	if v == nil {
+		return bson.M{}, nil
+	}
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := bson.M{}
+	if err = bson.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// fromDoc decodes a stored document into out.
+func fromDoc(doc bson.M, out interface{}) error {
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(raw, out)
+}
+
+// applyUpdate supports $set, $unset, $inc, $max and whole document replacement.
+func applyUpdate(doc bson.M, update bson.M) (bson.M, error) {
+	newDoc := bson.M{}
+	for k, v := range doc {
+		newDoc[k] = v
+	}
+
+	hasOps := false
+	for op := range update {
+		if strings.HasPrefix(op, "$") {
+			hasOps = true
+			break
+		}
+	}
+
+	// Replacement keeps the original _id
+	if !hasOps {
+		replaced := bson.M{}
+		for k, v := range update {
+			replaced[k] = v
+		}
+		if id, ok := doc["_id"]; ok {
+			replaced["_id"] = id
+		}
+		return replaced, nil
+	}
+
+	for op, fields := range update {
+		fieldsDoc, ok := fields.(bson.M)
+		if !ok {
+			return nil, fmt.Errorf("invalid update for %s: %#v", op, fields)
+		}
+
+		switch op {
+		case "$set":
+			for k, v := range fieldsDoc {
+				newDoc[k] = v
+			}
+		case "$unset":
+			for k := range fieldsDoc {
+				delete(newDoc, k)
+			}
+		case "$inc":
+			for k, v := range fieldsDoc {
+				inc, ok := toFloat(v)
+				if !ok {
+					return nil, fmt.Errorf("cannot $inc with non-numeric value %#v", v)
+				}
+				current, _ := toFloat(newDoc[k])
+				newDoc[k] = numberLike(v, current+inc)
+			}
+		case "$max":
+			for k, v := range fieldsDoc {
+				current, exists := newDoc[k]
+				if cmp, ok := compareValues(v, current); !exists || (ok && cmp > 0) {
+					newDoc[k] = v
+				}
+			}
+		default:
+			return nil, fmt.Errorf("update operator %s is not supported by the in-memory database", op)
+		}
+	}
+	return newDoc, nil
+}
+
+// matches reports whether doc satisfies selector. Supports equality plus
+// $gt, $gte, $lt, $lte, $ne, $in, $exists, $elemMatch and a top level $and.
+func matches(doc bson.M, selector bson.M) bool {
+	for key, cond := range selector {
+		if key == "$and" {
+			list, _ := cond.([]interface{})
+			for _, item := range list {
+				sel, _ := item.(bson.M)
+				if !matches(doc, sel) {
+					return false
+				}
+			}
+			continue
+		}
+
+		value, exists := doc[key]
+
+		ops, isOps := cond.(bson.M)
+		if !isOps || !hasOperators(ops) {
+			if !fieldEquals(value, exists, cond) {
+				return false
+			}
+			continue
+		}
+
+		for op, operand := range ops {
+			switch op {
+			case "$exists":
+				want, _ := operand.(bool)
+				if exists != want {
+					return false
+				}
+			case "$ne":
+				if exists && valueEquals(value, operand) {
+					return false
+				}
+			case "$in":
+				list, _ := operand.([]interface{})
+				found := false
+				for _, item := range list {
+					if fieldEquals(value, exists, item) {
+						found = true
+						break
+					}
+				}
+				if !found {
+					return false
+				}
+			case "$gt", "$gte", "$lt", "$lte":
+				if !exists {
+					return false
+				}
+				cmp, ok := compareValues(value, operand)
+				if !ok {
+					return false
+				}
+				if (op == "$gt" && cmp <= 0) || (op == "$gte" && cmp < 0) ||
+					(op == "$lt" && cmp >= 0) || (op == "$lte" && cmp > 0) {
+					return false
+				}
+			case "$elemMatch":
+				sel, _ := operand.(bson.M)
+				list, _ := value.([]interface{})
+				found := false
+				for _, item := range list {
+					if elem, ok := item.(bson.M); ok && matches(elem, sel) {
+						found = true
+						break
+					}
+				}
+				if !found {
+					return false
+				}
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// fieldEquals compares a (possibly missing) field with want. As in mongo
+// a nil want matches a missing field.
+func fieldEquals(value interface{}, exists bool, want interface{}) bool {
+	if want == nil {
+		return !exists || value == nil
+	}
+	return exists && valueEquals(value, want)
+}
+
+func hasOperators(doc bson.M) bool {
+	for k := range doc {
+		if strings.HasPrefix(k, "$") {
+			return true
+		}
+	}
+	return false
+}
+
+// valueEquals compares two stored values. An array matches a scalar if it
+// contains it (as mongo does).
+func valueEquals(a, b interface{}) bool {
+	if cmp, ok := compareValues(a, b); ok {
+		return cmp == 0
+	}
+	if list, ok := a.([]interface{}); ok {
+		if _, isList := b.([]interface{}); !isList {
+			for _, item := range list {
+				if valueEquals(item, b) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func compareValues(a, b interface{}) (int, bool) {
+	if fa, ok := toFloat(a); ok {
+		fb, ok := toFloat(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case fa < fb:
+			return -1, true
+		case fa > fb:
+			return 1, true
+		}
+		return 0, true
+	}
+
+	switch av := a.(type) {
+	case string:
+		bv, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(av, bv), true
+	case time.Time:
+		bv, ok := b.(time.Time)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case av.Before(bv):
+			return -1, true
+		case av.After(bv):
+			return 1, true
+		}
+		return 0, true
+	case bool:
+		bv, ok := b.(bool)
+		if !ok || av != bv {
+			return 0, false
+		}
+		return 0, true
+	case bson.ObjectId:
+		bv, ok := b.(bson.ObjectId)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(string(av), string(bv)), true
+	}
+	return 0, false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// numberLike returns f using the same type as the template value.
+func numberLike(template interface{}, f float64) interface{} {
+	switch template.(type) {
+	case float64:
+		return f
+	case int64:
+		return int64(f)
+	}
+	return int(f)
+}
+
+func indexConflict(docs []bson.M, doc bson.M, index mgo.Index) bool {
+	for _, other := range docs {
+		same := true
+		for _, key := range index.Key {
+			key = strings.TrimLeft(key, "+-")
+			a, aok := other[key]
+			b, bok := doc[key]
+			if aok != bok || (aok && !valueEquals(a, b)) {
+				same = false
+				break
+			}
+		}
+		if same {
+			return true
+		}
+	}
+	return false
+}
+
+// -----------------------------------------------------------------------------
+// Model calls (mirror the mongo implementations in agent.go, session.go, task.go and base.go)
+
+// GetNextSequence returns the next sequence for 'name'
+func (db *MemoryDatabase) GetNextSequence(ctx context.Context, name string) (int32, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.nextSequence(name)
+}
+
+func (db *MemoryDatabase) nextSequence(name string) (int32, error) {
+	counters, err := db.find("counters", bson.M{"_id": name}, 1)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(counters) == 0 {
+		return 0, amerrors.ErrCounterNotFoundError("failed to find an counter counters(_id=" + name + ")")
+	}
+
+	if _, err = db.update("counters", bson.M{"_id": name}, bson.M{"$inc": bson.M{"seq": 1}}, false); err != nil {
+		return 0, err
+	}
+
+	var doc Count
+	counters, _ = db.find("counters", bson.M{"_id": name}, 1)
+	if err = fromDoc(counters[0], &doc); err != nil {
+		return 0, err
+	}
+	return doc.Seq, nil
+}
+
+// AgentExists check whether an agent exist based of its agent ID
+func (db *MemoryDatabase) AgentExists(ctx context.Context, agentID int32) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.agentExists(agentID)
+}
+
+func (db *MemoryDatabase) agentExists(agentID int32) (bool, error) {
+	agents, err := db.find("agents", bson.M{"agentid": agentID}, 1)
+	if err != nil {
+		return false, err
+	}
+
+	if len(agents) == 0 {
+		return false, amerrors.ErrAgentNotFoundError("failed to find an Agent(AgentID=" + strconv.Itoa(int(agentID)) + ")")
+	}
+
+	return true, nil
+}
+
+// AddAgent creates a new agent with an agent ID allocated from the 'agentid' counter
+func (db *MemoryDatabase) AddAgent(ctx context.Context) (int32, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for attempt := 0; attempt < maxAgentIDAttempts; attempt++ {
+		agentID, err := db.nextSequence("agentid")
+		if err != nil {
+			return 0, err
+		}
+
+		err = db.insert("agents", &Agent{AgentID: agentID, State: AgentOffline, StateChangedAt: NowFunc()})
+		if err == nil {
+			return agentID, nil
+		}
+		if !mgo.IsDup(err) {
+			return 0, err
+		}
+	}
+
+	return 0, amerrors.InternalServerError("failed to allocate a unique agent ID after %d attempts", maxAgentIDAttempts)
+}
+
+// RemoveAgent removes the agent with agent ID
+func (db *MemoryDatabase) RemoveAgent(ctx context.Context, agentID int32) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	n, err := db.remove("agents", bson.M{"agentid": agentID}, false)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return amerrors.ErrAgentNotFoundError("failed to find an Agent(AgentID=" + strconv.Itoa(int(agentID)) + ")")
+	}
+	return nil
+}
+
+// GetAgent returns the agent with agent ID
+func (db *MemoryDatabase) GetAgent(ctx context.Context, agentID int32) (Agent, error) {
+	if err := ctx.Err(); err != nil {
+		return Agent{}, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.getAgent(agentID)
+}
+
+func (db *MemoryDatabase) getAgent(agentID int32) (Agent, error) {
+	docs, err := db.find("agents", bson.M{"agentid": agentID}, 1)
+	if err != nil {
+		return Agent{}, err
+	}
+	if len(docs) == 0 {
+		return Agent{}, amerrors.ErrAgentNotFoundError("failed to find an Agent(AgentID=" + strconv.Itoa(int(agentID)) + ")")
+	}
+
+	var agent Agent
+	err = fromDoc(docs[0], &agent)
+	return agent, err
+}
+
+// HeartBeat updates LastHeartBeat with current time now
+// An offline agent becomes available on its heartbeat
+func (db *MemoryDatabase) HeartBeat(ctx context.Context, agentID int32) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	agent, err := db.getAgent(agentID)
+	if err != nil {
+		logger.Log("level", "err", "err", err)
+		return err
+	}
+
+	now := NowFunc()
+	update := bson.M{"lastheartbeat": now}
+	if agent.State == "" || agent.State == AgentOffline {
+		update["state"] = AgentAvailable
+		update["statechangedat"] = now
+	}
+
+	_, err = db.update("agents", bson.M{"agentid": agentID}, bson.M{"$set": update}, false)
+	return err
+}
+
+// HeartBeats sets the last heartbeat of each agent unless it already has a
+// later one (offline agents become available)
+func (db *MemoryDatabase) HeartBeats(ctx context.Context, beats map[int32]time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	matched := 0
+	for agentID, at := range beats {
+		n, err := db.update("agents", bson.M{"agentid": agentID}, bson.M{"$max": bson.M{"lastheartbeat": at}}, false)
+		if err != nil {
+			return matched, err
+		}
+		matched += n
+	}
+
+	if len(beats) > 0 {
+		if _, err := db.update("agents", offlineAgentsSelector(beats), bson.M{"$set": bson.M{"state": AgentAvailable, "statechangedat": NowFunc()}}, true); err != nil {
+			return matched, err
+		}
+	}
+	return matched, nil
+}
+
+// TouchAgents sets the last heartbeat of the agents to now
+func (db *MemoryDatabase) TouchAgents(ctx context.Context, agentIDs []int32) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if len(agentIDs) == 0 {
+		return 0, nil
+	}
+
+	return db.update("agents", bson.M{"agentid": bson.M{"$in": agentIDs}}, bson.M{"$set": bson.M{"lastheartbeat": NowFunc()}}, true)
+}
+
+// SetAgentState moves the agent from state from to state to (only if it is still in state from)
+func (db *MemoryDatabase) SetAgentState(ctx context.Context, agentID int32, from AgentState, to AgentState) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	agent, err := db.getAgent(agentID)
+	if err != nil {
+		return err
+	}
+
+	current := agent.State
+	if current == "" {
+		current = AgentOffline
+	}
+	if from == "" {
+		from = AgentOffline
+	}
+	if current != from {
+		return amerrors.ErrAgentStateTransitionError("Agent(AgentID=" + strconv.Itoa(int(agentID)) + ") is no longer " + string(from))
+	}
+
+	_, err = db.update("agents", bson.M{"agentid": agentID}, bson.M{"$set": bson.M{"state": to, "statechangedat": NowFunc()}}, false)
+	return err
+}
+
+// SetAgentSkills replaces the agent's skill profile and returns the updated agent
+func (db *MemoryDatabase) SetAgentSkills(ctx context.Context, agentID int32, skills []Skill) (Agent, error) {
+	if err := ctx.Err(); err != nil {
+		return Agent{}, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, err := db.getAgent(agentID); err != nil {
+		return Agent{}, err
+	}
+
+	if _, err := db.update("agents", bson.M{"agentid": agentID}, bson.M{"$set": bson.M{"skills": skills}}, false); err != nil {
+		return Agent{}, err
+	}
+
+	return db.getAgent(agentID)
+}
+
+// ExpireAgents marks agents offline whose last heartbeat is before before
+// (missed heartbeats) and returns their agent IDs. With dryRun nothing is changed.
+func (db *MemoryDatabase) ExpireAgents(ctx context.Context, before time.Time, dryRun bool) ([]int32, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	selector := bson.M{"state": bson.M{"$ne": AgentOffline}, "lastheartbeat": bson.M{"$lt": before}}
+
+	docs, err := db.find("agents", selector, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var agents []Agent
+	for _, doc := range docs {
+		var agent Agent
+		if err = fromDoc(doc, &agent); err != nil {
+			return nil, err
+		}
+		agents = append(agents, agent)
+	}
+
+	if dryRun || len(agents) == 0 {
+		return agentIDs(agents), nil
+	}
+
+	if _, err = db.update("agents", selector, bson.M{"$set": bson.M{"state": AgentOffline, "statechangedat": NowFunc()}}, true); err != nil {
+		return nil, err
+	}
+	return agentIDs(agents), nil
+}
+
+// GetAgents returns all Agents in state within a certain heartbeat with every required skill in order
+func (db *MemoryDatabase) GetAgents(ctx context.Context, state AgentState, timestamp time.Time, skills []SkillRequirement, order AgentOrder, limit int32) ([]Agent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	// Sorted agents are limited once sorted
+	findLimit := int(limit)
+	if order.By != AgentSortNone {
+		findLimit = 0
+	}
+
+	var agents []Agent
+	docs, err := db.find("agents", order.selector(agentsSelector(state, timestamp, skills)), findLimit)
+	if err != nil {
+		return agents, err
+	}
+
+	for _, doc := range docs {
+		var agent Agent
+		if err = fromDoc(doc, &agent); err != nil {
+			return agents, err
+		}
+		agents = append(agents, agent)
+	}
+
+	return order.Apply(agents, limit), nil
+}
+
+// GetAgentIDFromRef returns the Agent ID from a Reference
+func (db *MemoryDatabase) GetAgentIDFromRef(ctx context.Context, refID string) (int32, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	docs, err := db.find("phonesessions", bson.M{"refid": refID}, 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(docs) == 0 {
+		return 0, amerrors.ErrAgentIDNotFoundError("failed to find an Agent from ref id " + refID)
+	}
+
+	var pSess PhoneSession
+	if err = fromDoc(docs[0], &pSess); err != nil {
+		return 0, err
+	}
+
+	logger.Log("level", "debug", "msg", "Found agent ID: "+fmt.Sprintf("%#v", pSess.AgentID))
+	return pSess.AgentID, nil
+}
+
+// ExpirePhoneSessions removes phone sessions created before before and returns
+// how many. With dryRun nothing is removed.
+func (db *MemoryDatabase) ExpirePhoneSessions(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	selector := bson.M{"createdat": bson.M{"$lt": before}}
+
+	if dryRun {
+		docs, err := db.find("phonesessions", selector, 0)
+		return len(docs), err
+	}
+
+	return db.remove("phonesessions", selector, true)
+}
+
+// AddTask add a task and returns the newly created Task's id if successful
+func (db *MemoryDatabase) AddTask(ctx context.Context, custID int32, agentIDs []int32, skills []SkillRequirement) (int32, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if custID <= 0 {
+		return 0, amerrors.ErrCustIDInvalidError("Invalid Cust ID: " + strconv.Itoa(int(custID)))
+	}
+
+	if err := ValidateSkillRequirements(skills); err != nil {
+		return 0, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	taskID, err := db.nextSequence("taskid")
+	if err != nil {
+		return 0, err
+	}
+	logger.Log("level", "debug", "msg", "Created new sequence "+strconv.Itoa(int(taskID)))
+
+	err = db.insert("tasks", newTask(taskID, custID, agentIDs, skills))
+
+	if err != nil {
+		return 0, err
+	}
+
+	return taskID, nil
+}
+
+// AcceptTask marks the task as accepted by agentID and releases the other candidate agents
+func (db *MemoryDatabase) AcceptTask(ctx context.Context, taskID int32, agentID int32) (Task, error) {
+	if err := ctx.Err(); err != nil {
+		return Task{}, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	docs, err := db.find("tasks", bson.M{"_id": taskID}, 1)
+	if err != nil {
+		return Task{}, err
+	}
+	if len(docs) == 0 {
+		return Task{}, amerrors.ErrTaskNotFoundError("failed to find a Task(TaskID=" + strconv.Itoa(int(taskID)) + ")")
+	}
+
+	var task Task
+	if err = fromDoc(docs[0], &task); err != nil {
+		return Task{}, err
+	}
+
+	offered := false
+	for _, id := range task.AgentIDs {
+		if id == agentID {
+			offered = true
+			break
+		}
+	}
+	if task.AcceptedBy != 0 || !offered || task.CurrentStatus() != TaskOffered {
+		return Task{}, taskNotAcceptableError(task, agentID)
+	}
+
+	task.AcceptedBy = agentID
+	task.setStatus(TaskAccepted, NowFunc())
+	task.ReleasedAgentIDs = releasedAgentIDs(task.AgentIDs, agentID)
+	task.AgentIDs = []int32{agentID}
+
+	_, err = db.update("tasks", bson.M{"_id": taskID}, bson.M{"$set": bson.M{
+		"status":           task.Status,
+		"acceptedby":       task.AcceptedBy,
+		"acceptedat":       task.AcceptedAt,
+		"agentids":         task.AgentIDs,
+		"releasedagentids": task.ReleasedAgentIDs,
+	}}, false)
+	if err != nil {
+		return Task{}, err
+	}
+
+	return task, nil
+}
+
+// CompleteTask marks the task accepted by agentID as completed
+func (db *MemoryDatabase) CompleteTask(ctx context.Context, taskID int32, agentID int32) (Task, error) {
+	if err := ctx.Err(); err != nil {
+		return Task{}, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	docs, err := db.find("tasks", bson.M{"_id": taskID}, 1)
+	if err != nil {
+		return Task{}, err
+	}
+	if len(docs) == 0 {
+		return Task{}, amerrors.ErrTaskNotFoundError("failed to find a Task(TaskID=" + strconv.Itoa(int(taskID)) + ")")
+	}
+
+	var task Task
+	if err = fromDoc(docs[0], &task); err != nil {
+		return Task{}, err
+	}
+
+	if status := task.CurrentStatus(); task.AcceptedBy != agentID || !CanTransitionTask(status, TaskCompleted) {
+		return Task{}, taskNotCompletableError(task, agentID)
+	}
+
+	task.setStatus(TaskCompleted, NowFunc())
+
+	_, err = db.update("tasks", bson.M{"_id": taskID}, bson.M{"$set": statusUpdate(task.Status, task.CompletedAt)}, false)
+	if err != nil {
+		return Task{}, err
+	}
+
+	return task, nil
+}
+
+// CountAcceptedTasks returns how many tasks each of agentIDs accepted since since
+// (agents with no tasks are not in the map)
+func (db *MemoryDatabase) CountAcceptedTasks(ctx context.Context, agentIDs []int32, since time.Time) (map[int32]int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	counts := make(map[int32]int)
+	docs, err := db.find("tasks", acceptedTasksSelector(agentIDs, since), 0)
+	if err != nil {
+		return counts, err
+	}
+
+	for _, doc := range docs {
+		var task Task
+		if err = fromDoc(doc, &task); err != nil {
+			return counts, err
+		}
+		counts[task.AcceptedBy]++
+	}
+	return counts, nil
+}
+
+// GetTask returns the task with task ID
+func (db *MemoryDatabase) GetTask(ctx context.Context, taskID int32) (Task, error) {
+	if err := ctx.Err(); err != nil {
+		return Task{}, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.getTask(taskID)
+}
+
+func (db *MemoryDatabase) getTask(taskID int32) (Task, error) {
+	docs, err := db.find("tasks", bson.M{"_id": taskID}, 1)
+	if err != nil {
+		return Task{}, err
+	}
+	if len(docs) == 0 {
+		return Task{}, amerrors.ErrTaskNotFoundError("failed to find a Task(TaskID=" + strconv.Itoa(int(taskID)) + ")")
+	}
+
+	var task Task
+	if err = fromDoc(docs[0], &task); err != nil {
+		return Task{}, err
+	}
+	task.Status = task.CurrentStatus()
+	return task, nil
+}
+
+// ListTasks returns the tasks matching filter (oldest first, limit 0 is no limit)
+func (db *MemoryDatabase) ListTasks(ctx context.Context, filter TaskFilter, limit int32) ([]Task, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var tasks []Task
+	docs, err := db.find("tasks", filter.selector(), 0)
+	if err != nil {
+		return tasks, err
+	}
+
+	for _, doc := range docs {
+		var task Task
+		if err = fromDoc(doc, &task); err != nil {
+			return tasks, err
+		}
+		task.Status = task.CurrentStatus()
+		tasks = append(tasks, task)
+	}
+
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].TaskID < tasks[j].TaskID })
+	if limit > 0 && len(tasks) > int(limit) {
+		tasks = tasks[:limit]
+	}
+	return tasks, nil
+}
+
+// SetTaskStatus moves the task from status from to status to (only if it is
+// still in status from) recording when. Returns the updated task.
+func (db *MemoryDatabase) SetTaskStatus(ctx context.Context, taskID int32, from TaskStatus, to TaskStatus) (Task, error) {
+	if err := ctx.Err(); err != nil {
+		return Task{}, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	task, err := db.getTask(taskID)
+	if err != nil {
+		return Task{}, err
+	}
+	if task.Status != from {
+		return Task{}, taskStatusTransitionError(taskID, from, to)
+	}
+
+	now := NowFunc()
+	task.setStatus(to, now)
+
+	_, err = db.update("tasks", bson.M{"_id": taskID}, bson.M{"$set": statusUpdate(to, now)}, false)
+	if err != nil {
+		return Task{}, err
+	}
+	return task, nil
+}
+
+// OfferTask offers the queued task to agentIDs (recording when). Returns the
+// updated task.
+func (db *MemoryDatabase) OfferTask(ctx context.Context, taskID int32, agentIDs []int32) (Task, error) {
+	if err := ctx.Err(); err != nil {
+		return Task{}, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	task, err := db.getTask(taskID)
+	if err != nil {
+		return Task{}, err
+	}
+	if task.Status != TaskQueued {
+		return Task{}, taskStatusTransitionError(taskID, task.Status, TaskOffered)
+	}
+
+	task.AgentIDs = agentIDs
+	task.setStatus(TaskOffered, NowFunc())
+
+	_, err = db.update("tasks", bson.M{"_id": taskID}, bson.M{"$set": offerUpdate(task)}, false)
+	if err != nil {
+		return Task{}, err
+	}
+	return task, nil
+}
+
+// ArchiveTasks moves tasks completed, abandoned or cancelled before before into
+// the archived tasks collection and returns how many. With dryRun nothing is moved.
+func (db *MemoryDatabase) ArchiveTasks(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	archived := 0
+	for _, field := range endedTaskFields {
+		selector := bson.M{field: bson.M{"$lt": before}}
+
+		docs, err := db.find("tasks", selector, 0)
+		if err != nil {
+			return archived, err
+		}
+		if dryRun {
+			archived += len(docs)
+			continue
+		}
+
+		for _, doc := range docs {
+			err = db.insert(archivedTasksCollection, doc)
+			if err != nil && !mgo.IsDup(err) {
+				return archived, err
+			}
+		}
+
+		n, err := db.remove("tasks", selector, true)
+		if err != nil {
+			return archived, err
+		}
+		archived += n
+	}
+	return archived, nil
+}
+
+// AppliedMigrations returns the migrations applied to the database by version
+func (db *MemoryDatabase) AppliedMigrations(ctx context.Context) ([]AppliedMigration, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	docs, err := db.find(MigrationsCollection, bson.M{}, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make([]AppliedMigration, len(docs))
+	for i, doc := range docs {
+		if err = fromDoc(doc, &applied[i]); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(applied, func(i, j int) bool { return applied[i].Version < applied[j].Version })
+	return applied, nil
+}
+
+// AddMigration records that migration m has been applied
+func (db *MemoryDatabase) AddMigration(ctx context.Context, m AppliedMigration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	_, err := db.C(MigrationsCollection).Upsert(
+		bson.M{"_id": m.Version},
+		bson.M{"$set": bson.M{"name": m.Name, "appliedat": m.AppliedAt}},
+	)
+	return err
+}
+
+// RemoveMigration records that migration version has been reverted
+func (db *MemoryDatabase) RemoveMigration(ctx context.Context, version int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	_, err := db.remove(MigrationsCollection, bson.M{"_id": version}, false)
+	return err
+}
+
+// LockMigrations takes the migration lock for owner until expires and returns
+// whether it did (false while another owner holds it, unless it expired
+// before now)
+func (db *MemoryDatabase) LockMigrations(ctx context.Context, owner string, expires time.Time, now time.Time) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	err := db.insert(MigrationLockCollection, &MigrationLock{ID: migrationLockID, Owner: owner, Expires: expires})
+	if err == nil {
+		return true, nil
+	}
+	if !mgo.IsDup(err) {
+		return false, err
+	}
+
+	n, err := db.update(MigrationLockCollection,
+		bson.M{"_id": migrationLockID, "expires": bson.M{"$lt": now}},
+		bson.M{"$set": bson.M{"owner": owner, "expires": expires}},
+		false,
+	)
+	return n > 0, err
+}
+
+// RenewMigrationLock extends the migration lock held by owner until expires
+// and returns whether owner still held it
+func (db *MemoryDatabase) RenewMigrationLock(ctx context.Context, owner string, expires time.Time) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	n, err := db.update(MigrationLockCollection,
+		bson.M{"_id": migrationLockID, "owner": owner},
+		bson.M{"$set": bson.M{"expires": expires}},
+		false,
+	)
+	return n > 0, err
+}
+
+// UnlockMigrations releases the migration lock if owner holds it
+func (db *MemoryDatabase) UnlockMigrations(ctx context.Context, owner string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	_, err := db.remove(MigrationLockCollection, bson.M{"_id": migrationLockID, "owner": owner}, false)
+	return err
+}
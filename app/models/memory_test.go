@@ -0,0 +1,540 @@
+package models_test
+
+// Tests for the in-memory DataLayer (no mongo required)
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+	"github.com/newtonsystems/agent-mgmt/app/models"
+	tu "github.com/newtonsystems/agent-mgmt/app/testutil"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestMemoryIndexUnique(t *testing.T) {
+	session, db := tu.NewTestMemoryConnection()
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	db.C("agents").Insert(&models.Agent{AgentID: 10, State: models.AgentAvailable, LastHeartBeat: time.Now()})
+	err := db.C("agents").Insert(&models.Agent{AgentID: 10, State: models.AgentAvailable, LastHeartBeat: time.Now()})
+	tu.Assert(t, err != nil, "expected duplicate key error")
+
+	count, _ := db.C("agents").Count()
+	tu.Equals(t, 1, count)
+
+	db.C("phonesessions").Insert(&models.PhoneSession{SessID: 10, AgentID: 1, RefID: "ref8933"})
+	db.C("phonesessions").Insert(&models.PhoneSession{SessID: 10, AgentID: 2, RefID: "ref8934"})
+	count, _ = db.C("phonesessions").Count()
+	tu.Equals(t, 1, count)
+}
+
+func TestMemoryAgents(t *testing.T) {
+	session, db := tu.NewTestMemoryConnection()
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	models.NowFunc = func() time.Time {
+		return time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)
+	}
+	defer func() { models.NowFunc = time.Now }()
+
+	inserts := []tu.TestModelInsert{
+		&models.Agent{AgentID: 10, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)},
+		&models.Agent{AgentID: 11, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 48, 33, 0, time.UTC)},
+		&models.Agent{AgentID: 12, State: models.AgentAvailable, LastHeartBeat: time.Date(2017, time.September, 21, 17, 51, 31, 0, time.UTC)},
+	}
+	tu.InsertCollectionToDB(t, db, "agents", inserts)
+
+	exists, err := db.AgentExists(context.Background(), 10)
+	tu.Ok(t, err)
+	tu.Equals(t, true, exists)
+
+	exists, err = db.AgentExists(context.Background(), 13)
+	tu.Equals(t, false, exists)
+	tu.IsAmError(t, amerrors.ErrAgentNotFound, err)
+
+	since := time.Date(2017, time.September, 21, 17, 49, 31, 0, time.UTC)
+	agents, err := db.GetAgents(context.Background(), models.AgentAvailable, since, nil, models.AgentOrder{}, 0)
+	tu.Ok(t, err)
+	tu.Equals(t, 2, len(agents))
+	tu.Equals(t, int32(10), agents[0].AgentID)
+	tu.Equals(t, int32(12), agents[1].AgentID)
+
+	agents, err = db.GetAgents(context.Background(), models.AgentAvailable, since, nil, models.AgentOrder{}, 1)
+	tu.Ok(t, err)
+	tu.Equals(t, 1, len(agents))
+
+	// Heartbeat brings agent 11 back into the window
+	tu.IsAmError(t, amerrors.ErrAgentNotFound, db.HeartBeat(context.Background(), 13))
+	tu.Ok(t, db.HeartBeat(context.Background(), 11))
+
+	agents, err = db.GetAgents(context.Background(), models.AgentAvailable, since, nil, models.AgentOrder{}, 0)
+	tu.Ok(t, err)
+	tu.Equals(t, 3, len(agents))
+	tu.TimeEquals(t, models.NowFunc(), agents[1].LastHeartBeat)
+
+	// Touching only updates the agents that exist
+	n, err := db.TouchAgents(context.Background(), []int32{10, 13})
+	tu.Ok(t, err)
+	tu.Equals(t, 1, n)
+	n, err = db.TouchAgents(context.Background(), nil)
+	tu.Ok(t, err)
+	tu.Equals(t, 0, n)
+
+	// Buffered heartbeats never move a heartbeat backwards
+	n, err = db.HeartBeats(context.Background(), map[int32]time.Time{
+		10: time.Date(2017, time.September, 21, 17, 49, 31, 0, time.UTC),
+		12: time.Date(2017, time.September, 21, 17, 52, 31, 0, time.UTC),
+		13: time.Date(2017, time.September, 21, 17, 52, 31, 0, time.UTC),
+	})
+	tu.Ok(t, err)
+	tu.Equals(t, 2, n)
+	agent, err := db.GetAgent(context.Background(), 10)
+	tu.Ok(t, err)
+	tu.TimeEquals(t, models.NowFunc(), agent.LastHeartBeat)
+	agent, err = db.GetAgent(context.Background(), 12)
+	tu.Ok(t, err)
+	tu.TimeEquals(t, time.Date(2017, time.September, 21, 17, 52, 31, 0, time.UTC), agent.LastHeartBeat)
+}
+
+func TestMemoryGetAgentIDFromRef(t *testing.T) {
+	session, db := tu.NewTestMemoryConnection()
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	inserts := []tu.TestModelInsert{
+		&models.PhoneSession{SessID: 1, AgentID: 3, RefID: "ref001a"},
+		&models.PhoneSession{SessID: 2, AgentID: 4, RefID: "ref002a"},
+	}
+	tu.InsertCollectionToDB(t, db, "phonesessions", inserts)
+
+	agentID, err := db.GetAgentIDFromRef(context.Background(), "ref002a")
+	tu.Ok(t, err)
+	tu.Equals(t, int32(4), agentID)
+
+	agentID, err = db.GetAgentIDFromRef(context.Background(), "refwrong")
+	tu.IsAmError(t, amerrors.ErrAgentIDNotFound, err)
+	tu.Equals(t, int32(0), agentID)
+}
+
+func TestMemoryAddTask(t *testing.T) {
+	session, db := tu.NewTestMemoryConnection()
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	_, err := db.AddTask(context.Background(), 0, []int32{1}, nil)
+	tu.IsAmError(t, amerrors.ErrCustIDInvalid, err)
+
+	taskID, err := db.AddTask(context.Background(), 1, []int32{1, 2, 3}, nil)
+	tu.Ok(t, err)
+	tu.Equals(t, int32(2), taskID)
+
+	count, _ := db.C("tasks").Count()
+	tu.Equals(t, 1, count)
+
+	// Unknown counter
+	_, err = db.GetNextSequence(context.Background(), "wrongid")
+	tu.IsAmError(t, amerrors.ErrCounterNotFound, err)
+}
+
+func TestMemoryNotSupported(t *testing.T) {
+	session, db := tu.NewTestMemoryConnection()
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	ctx := context.Background()
+	called := false
+	err := db.WithTransaction(ctx, func(ctx context.Context) error {
+		called = true
+		return nil
+	})
+	tu.Equals(t, models.ErrNotSupported, err)
+	tu.Assert(t, !called, "expected fn not to be called without transactions")
+
+	_, err = db.WatchCollection(ctx, "agents", nil)
+	tu.Equals(t, models.ErrNotSupported, err)
+}
+
+func TestMemoryGetNextSequenceConcurrent(t *testing.T) {
+	session, db := tu.NewTestMemoryConnection()
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	tu.Ok(t, db.C("counters").Insert(bson.M{"_id": "genericid", "seq": 1}))
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		seen = make(map[int32]bool)
+	)
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			seq, err := session.Copy().DB(tu.MongoDBName).GetNextSequence(context.Background(), "genericid")
+			tu.Ok(t, err)
+
+			mu.Lock()
+			defer mu.Unlock()
+			tu.Assert(t, !seen[seq], "sequence %d handed out twice", seq)
+			seen[seq] = true
+		}()
+	}
+	wg.Wait()
+
+	tu.Equals(t, 50, len(seen))
+}
+
+func TestMemoryAcceptTask(t *testing.T) {
+	session, db := tu.NewTestMemoryConnection()
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	taskID, err := db.AddTask(context.Background(), 1, []int32{1, 2, 3}, nil)
+	tu.Ok(t, err)
+
+	_, err = db.AcceptTask(context.Background(), taskID, 4)
+	tu.IsAmError(t, amerrors.ErrTaskNotOffered, err)
+
+	task, err := db.AcceptTask(context.Background(), taskID, 2)
+	tu.Ok(t, err)
+	tu.Equals(t, int32(2), task.AcceptedBy)
+	tu.Equals(t, []int32{2}, task.AgentIDs)
+	tu.Equals(t, []int32{1, 3}, task.ReleasedAgentIDs)
+
+	_, err = db.AcceptTask(context.Background(), taskID, 2)
+	tu.IsAmError(t, amerrors.ErrTaskAlreadyAccepted, err)
+
+	_, err = db.AcceptTask(context.Background(), 20, 2)
+	tu.IsAmError(t, amerrors.ErrTaskNotFound, err)
+}
+
+func TestMemoryAgentState(t *testing.T) {
+	session, db := tu.NewTestMemoryConnection()
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	agentID, err := db.AddAgent(context.Background())
+	tu.Ok(t, err)
+
+	agent, err := db.GetAgent(context.Background(), agentID)
+	tu.Ok(t, err)
+	tu.Equals(t, models.AgentOffline, agent.State)
+
+	// Heartbeat brings an offline agent online
+	tu.Ok(t, db.HeartBeat(context.Background(), agentID))
+	agent, _ = db.GetAgent(context.Background(), agentID)
+	tu.Equals(t, models.AgentAvailable, agent.State)
+
+	tu.Ok(t, db.SetAgentState(context.Background(), agentID, models.AgentAvailable, models.AgentOnCall))
+	tu.IsAmError(t, amerrors.ErrAgentStateTransition, db.SetAgentState(context.Background(), agentID, models.AgentAvailable, models.AgentOnCall))
+
+	// Heartbeat does not change the state of an agent on a call
+	tu.Ok(t, db.HeartBeat(context.Background(), agentID))
+	agent, _ = db.GetAgent(context.Background(), agentID)
+	tu.Equals(t, models.AgentOnCall, agent.State)
+
+	agents, err := db.GetAgents(context.Background(), models.AgentAvailable, time.Time{}, nil, models.AgentOrder{}, 0)
+	tu.Ok(t, err)
+	tu.Equals(t, 0, len(agents))
+
+	_, err = db.GetAgent(context.Background(), agentID+1)
+	tu.IsAmError(t, amerrors.ErrAgentNotFound, err)
+}
+
+func TestMemoryAgentOrder(t *testing.T) {
+	session, db := tu.NewTestMemoryConnection()
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	now := time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)
+	inserts := []tu.TestModelInsert{
+		&models.Agent{AgentID: 3, State: models.AgentAvailable, LastHeartBeat: now, StateChangedAt: now.Add(-5 * time.Minute)},
+		&models.Agent{AgentID: 1, State: models.AgentAvailable, LastHeartBeat: now, StateChangedAt: now.Add(-10 * time.Minute)},
+		&models.Agent{AgentID: 4, State: models.AgentAvailable, LastHeartBeat: now, StateChangedAt: now.Add(-30 * time.Minute)},
+		&models.Agent{AgentID: 2, State: models.AgentAvailable, LastHeartBeat: now, StateChangedAt: now.Add(-10 * time.Minute)},
+	}
+	tu.InsertCollectionToDB(t, db, "agents", inserts)
+
+	agentIDs := func(order models.AgentOrder, limit int32) []int32 {
+		agents, err := db.GetAgents(context.Background(), models.AgentAvailable, time.Time{}, nil, order, limit)
+		tu.Ok(t, err)
+
+		var ids []int32
+		for _, agent := range agents {
+			ids = append(ids, agent.AgentID)
+		}
+		return ids
+	}
+
+	// The limit keeps the first agents of the order
+	tu.Equals(t, []int32{1, 2, 3, 4}, agentIDs(models.AgentOrder{By: models.AgentSortID}, 0))
+	tu.Equals(t, []int32{1, 2}, agentIDs(models.AgentOrder{By: models.AgentSortID}, 2))
+	tu.Equals(t, []int32{3}, agentIDs(models.AgentOrder{By: models.AgentSortID, AfterAgentID: 2}, 1))
+	tu.Equals(t, []int32{4, 1, 2, 3}, agentIDs(models.AgentOrder{By: models.AgentSortStateChangedAt}, 0))
+	tu.Equals(t, []int32{4, 1}, agentIDs(models.AgentOrder{By: models.AgentSortStateChangedAt}, 2))
+}
+
+func TestMemorySkills(t *testing.T) {
+	session, db := tu.NewTestMemoryConnection()
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	now := time.Now()
+	inserts := []tu.TestModelInsert{
+		&models.Agent{AgentID: 1, State: models.AgentAvailable, LastHeartBeat: now},
+		&models.Agent{AgentID: 2, State: models.AgentAvailable, LastHeartBeat: now},
+		&models.Agent{AgentID: 3, State: models.AgentAvailable, LastHeartBeat: now},
+	}
+	tu.InsertCollectionToDB(t, db, "agents", inserts)
+
+	agent, err := db.SetAgentSkills(context.Background(), 1, []models.Skill{{Name: "language:fr", Level: 2}})
+	tu.Ok(t, err)
+	tu.Equals(t, []models.Skill{{Name: "language:fr", Level: 2}}, agent.Skills)
+
+	_, err = db.SetAgentSkills(context.Background(), 2, []models.Skill{{Name: "language:fr", Level: 4}, {Name: "product:billing", Level: 1}})
+	tu.Ok(t, err)
+
+	_, err = db.SetAgentSkills(context.Background(), 4, nil)
+	tu.IsAmError(t, amerrors.ErrAgentNotFound, err)
+
+	// Required skills are matched in the query
+	reqs := []models.SkillRequirement{{Name: "language:fr", MinLevel: 3, Required: true}}
+	agents, err := db.GetAgents(context.Background(), models.AgentAvailable, time.Time{}, reqs, models.AgentOrder{}, 0)
+	tu.Ok(t, err)
+	tu.Equals(t, 1, len(agents))
+	tu.Equals(t, int32(2), agents[0].AgentID)
+
+	// Preferred skills only change the ranking
+	reqs = []models.SkillRequirement{{Name: "language:fr", Weight: 1}, {Name: "product:billing", Weight: 2}}
+	agents, err = db.GetAgents(context.Background(), models.AgentAvailable, time.Time{}, reqs, models.AgentOrder{}, 0)
+	tu.Ok(t, err)
+	tu.Equals(t, 3, len(agents))
+
+	var ranked []int32
+	for _, agent := range models.RankBySkills(agents, reqs) {
+		ranked = append(ranked, agent.AgentID)
+	}
+	tu.Equals(t, []int32{2, 1, 3}, ranked)
+
+	score, ok := agents[1].MatchSkills(reqs)
+	tu.Equals(t, true, ok)
+	tu.Equals(t, int32(3), score)
+
+	// Tasks keep their required skills
+	taskID, err := db.AddTask(context.Background(), 1, nil, []models.SkillRequirement{{Name: "language:fr", Required: true}})
+	tu.Ok(t, err)
+	task, err := db.GetTask(context.Background(), taskID)
+	tu.Ok(t, err)
+	tu.Equals(t, []models.SkillRequirement{{Name: "language:fr", Required: true}}, task.RequiredSkills)
+
+	_, err = db.AddTask(context.Background(), 1, nil, []models.SkillRequirement{{Name: "language:fr", Weight: -1}})
+	tu.IsAmError(t, amerrors.ErrSkillInvalid, err)
+}
+
+func TestMemoryCompleteTask(t *testing.T) {
+	session, db := tu.NewTestMemoryConnection()
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	taskID, err := db.AddTask(context.Background(), 1, []int32{1, 2}, nil)
+	tu.Ok(t, err)
+
+	_, err = db.CompleteTask(context.Background(), taskID, 1)
+	tu.IsAmError(t, amerrors.ErrTaskNotAccepted, err)
+
+	_, err = db.AcceptTask(context.Background(), taskID, 1)
+	tu.Ok(t, err)
+
+	_, err = db.CompleteTask(context.Background(), taskID, 2)
+	tu.IsAmError(t, amerrors.ErrTaskNotAccepted, err)
+
+	task, err := db.CompleteTask(context.Background(), taskID, 1)
+	tu.Ok(t, err)
+	tu.Assert(t, !task.CompletedAt.IsZero(), "expected completedat to be set")
+
+	_, err = db.CompleteTask(context.Background(), taskID, 1)
+	tu.IsAmError(t, amerrors.ErrTaskAlreadyCompleted, err)
+
+	_, err = db.CompleteTask(context.Background(), 20, 1)
+	tu.IsAmError(t, amerrors.ErrTaskNotFound, err)
+}
+
+func TestMemoryExpire(t *testing.T) {
+	session, db := tu.NewTestMemoryConnection()
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	now := time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)
+	before := now.Add(-time.Minute)
+
+	db.C("agents").Insert(
+		&models.Agent{AgentID: 1, State: models.AgentAvailable, LastHeartBeat: now},
+		&models.Agent{AgentID: 2, State: models.AgentOnCall, LastHeartBeat: now.Add(-time.Hour)},
+		&models.Agent{AgentID: 3, State: models.AgentOffline, LastHeartBeat: now.Add(-time.Hour)},
+	)
+	db.C("phonesessions").Insert(
+		&models.PhoneSession{SessID: 1, AgentID: 1, RefID: "ref1", CreatedAt: now},
+		&models.PhoneSession{SessID: 2, AgentID: 2, RefID: "ref2", CreatedAt: now.Add(-time.Hour)},
+		&models.PhoneSession{SessID: 3, AgentID: 3, RefID: "ref3"},
+	)
+	db.C("tasks").Insert(
+		&models.Task{TaskID: 1, CustID: 1, AddedAt: now},
+		&models.Task{TaskID: 2, CustID: 1, AddedAt: now, AcceptedBy: 1, CompletedAt: now.Add(-time.Hour)},
+	)
+
+	// Dry run only counts
+	agentIDs, err := db.ExpireAgents(context.Background(), before, true)
+	tu.Ok(t, err)
+	tu.Equals(t, []int32{2}, agentIDs)
+	n, err := db.ExpirePhoneSessions(context.Background(), before, true)
+	tu.Ok(t, err)
+	tu.Equals(t, 1, n)
+	n, err = db.ArchiveTasks(context.Background(), before, true)
+	tu.Ok(t, err)
+	tu.Equals(t, 1, n)
+
+	agent, err := db.GetAgent(context.Background(), 2)
+	tu.Ok(t, err)
+	tu.Equals(t, models.AgentOnCall, agent.State)
+
+	agentIDs, err = db.ExpireAgents(context.Background(), before, false)
+	tu.Ok(t, err)
+	tu.Equals(t, []int32{2}, agentIDs)
+	agent, err = db.GetAgent(context.Background(), 2)
+	tu.Ok(t, err)
+	tu.Equals(t, models.AgentOffline, agent.State)
+
+	n, err = db.ExpirePhoneSessions(context.Background(), before, false)
+	tu.Ok(t, err)
+	tu.Equals(t, 1, n)
+	_, err = db.GetAgentIDFromRef(context.Background(), "ref2")
+	tu.IsAmError(t, amerrors.ErrAgentIDNotFound, err)
+	_, err = db.GetAgentIDFromRef(context.Background(), "ref3")
+	tu.Ok(t, err)
+
+	n, err = db.ArchiveTasks(context.Background(), before, false)
+	tu.Ok(t, err)
+	tu.Equals(t, 1, n)
+	count, _ := db.C("tasks").Count()
+	tu.Equals(t, 1, count)
+	count, _ = db.C("archivedtasks").Count()
+	tu.Equals(t, 1, count)
+
+	// Nothing left to do
+	n, err = db.ArchiveTasks(context.Background(), before, false)
+	tu.Ok(t, err)
+	tu.Equals(t, 0, n)
+}
+
+func TestMemoryTaskLifecycle(t *testing.T) {
+	session, db := tu.NewTestMemoryConnection()
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	queuedID, err := db.AddTask(context.Background(), 1, nil, nil)
+	tu.Ok(t, err)
+	task, err := db.GetTask(context.Background(), queuedID)
+	tu.Ok(t, err)
+	tu.Equals(t, models.TaskQueued, task.Status)
+	tu.Assert(t, task.OfferedAt.IsZero(), "expected a queued task to have no offeredat")
+
+	taskID, err := db.AddTask(context.Background(), 1, []int32{1, 2}, nil)
+	tu.Ok(t, err)
+	task, err = db.GetTask(context.Background(), taskID)
+	tu.Ok(t, err)
+	tu.Equals(t, models.TaskOffered, task.Status)
+	tu.Assert(t, !task.OfferedAt.IsZero(), "expected offeredat to be set")
+
+	task, err = db.AcceptTask(context.Background(), taskID, 1)
+	tu.Ok(t, err)
+	tu.Equals(t, models.TaskAccepted, task.Status)
+
+	_, err = db.SetTaskStatus(context.Background(), taskID, models.TaskOffered, models.TaskInProgress)
+	tu.IsAmError(t, amerrors.ErrTaskStatusTransition, err)
+
+	task, err = db.SetTaskStatus(context.Background(), taskID, models.TaskAccepted, models.TaskInProgress)
+	tu.Ok(t, err)
+	tu.Assert(t, !task.StartedAt.IsZero(), "expected startedat to be set")
+
+	task, err = db.CompleteTask(context.Background(), taskID, 1)
+	tu.Ok(t, err)
+	tu.Equals(t, models.TaskCompleted, task.Status)
+
+	// Cancelled tasks can not be accepted or completed
+	cancelledID, err := db.AddTask(context.Background(), 2, []int32{1}, nil)
+	tu.Ok(t, err)
+	task, err = db.SetTaskStatus(context.Background(), cancelledID, models.TaskOffered, models.TaskCancelled)
+	tu.Ok(t, err)
+	tu.Assert(t, !task.CancelledAt.IsZero(), "expected cancelledat to be set")
+	_, err = db.AcceptTask(context.Background(), cancelledID, 1)
+	tu.IsAmError(t, amerrors.ErrTaskStatusTransition, err)
+
+	tasks, err := db.ListTasks(context.Background(), models.TaskFilter{CustID: 1}, 0)
+	tu.Ok(t, err)
+	tu.Equals(t, 2, len(tasks))
+	tu.Equals(t, queuedID, tasks[0].TaskID)
+
+	tasks, err = db.ListTasks(context.Background(), models.TaskFilter{AgentID: 1, Status: models.TaskCompleted}, 0)
+	tu.Ok(t, err)
+	tu.Equals(t, 1, len(tasks))
+	tu.Equals(t, taskID, tasks[0].TaskID)
+
+	tasks, err = db.ListTasks(context.Background(), models.TaskFilter{}, 1)
+	tu.Ok(t, err)
+	tu.Equals(t, 1, len(tasks))
+
+	_, err = db.GetTask(context.Background(), 20)
+	tu.IsAmError(t, amerrors.ErrTaskNotFound, err)
+}
+
+func TestMemoryContext(t *testing.T) {
+	session, db := tu.NewTestMemoryConnection()
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// A cancelled call changes nothing
+	_, err := db.AddAgent(ctx)
+	tu.Equals(t, context.Canceled, err)
+	_, err = db.AddTask(ctx, 1, []int32{1}, nil)
+	tu.Equals(t, context.Canceled, err)
+	tu.Equals(t, context.Canceled, db.HeartBeat(ctx, 1))
+
+	count, _ := db.C("agents").Count()
+	tu.Equals(t, 0, count)
+	count, _ = db.C("tasks").Count()
+	tu.Equals(t, 0, count)
+}
+
+// timeoutSession records the socket timeouts of its copies
+type timeoutSession struct {
+	models.Session
+	timeouts *[]time.Duration
+}
+
+func (s timeoutSession) Copy() models.Session {
+	return timeoutSession{s.Session.Copy(), s.timeouts}
+}
+
+func (s timeoutSession) SetSocketTimeout(d time.Duration) {
+	*s.timeouts = append(*s.timeouts, d)
+}
+
+func TestCopySession(t *testing.T) {
+	session, _ := tu.NewTestMemoryConnection()
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	var timeouts []time.Duration
+	s := timeoutSession{session, &timeouts}
+
+	// No deadline keeps the session's socket timeout
+	models.CopySession(context.Background(), s).Close()
+	tu.Equals(t, 0, len(timeouts))
+
+	// The time left before the deadline becomes the socket timeout
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	models.CopySession(ctx, s).Close()
+	tu.Equals(t, 1, len(timeouts))
+	tu.Assert(t, timeouts[0] > 50*time.Second && timeouts[0] <= time.Minute, "expected a socket timeout of about a minute, got %s", timeouts[0])
+
+	// A deadline that has passed is the shortest timeout
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	models.CopySession(expired, s).Close()
+	tu.Equals(t, time.Millisecond, timeouts[1])
+}
@@ -0,0 +1,119 @@
+package models
+
+// migration.go
+// Migration Model / Mongo Calls
+// The schema migrations applied to a database (see the migrate package) and
+// the lock that stops two pods migrating the same database at once
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// MigrationsCollection the applied migrations (by version)
+	MigrationsCollection = "schema_migrations"
+	// MigrationLockCollection holds the migration lock (a single document)
+	MigrationLockCollection = "schema_migrations_lock"
+
+	migrationLockID = "lock"
+)
+
+// AppliedMigration is a migration applied to a database
+type AppliedMigration struct {
+	Version   int       `bson:"_id" json:"version"`
+	Name      string    `bson:"name" json:"name"`
+	AppliedAt time.Time `bson:"appliedat" json:"appliedat"`
+}
+
+// MigrationLock is held by the process migrating a database until it is
+// done or the lock expires (e.g. its pod was killed)
+type MigrationLock struct {
+	ID      string    `bson:"_id" json:"id"`
+	Owner   string    `bson:"owner" json:"owner"`
+	Expires time.Time `bson:"expires" json:"expires"`
+}
+
+// IsIndexNotFound returns whether err is the error of dropping an index that
+// does not exist
+func IsIndexNotFound(err error) bool {
+	if qerr, ok := err.(*mgo.QueryError); ok && qerr.Code == 27 {
+		return true
+	}
+	return err != nil && strings.Contains(err.Error(), "index not found")
+}
+
+// Mongo Calls
+
+// AppliedMigrations returns the migrations applied to the database by version
+func (db *MongoDatabase) AppliedMigrations(ctx context.Context) ([]AppliedMigration, error) {
+	var applied []AppliedMigration
+	err := db.c(ctx, MigrationsCollection).Find(nil).Sort("_id").All(&applied)
+	return applied, err
+}
+
+// AddMigration records that migration m has been applied
+func (db *MongoDatabase) AddMigration(ctx context.Context, m AppliedMigration) error {
+	_, err := db.c(ctx, MigrationsCollection).Upsert(
+		bson.M{"_id": m.Version},
+		bson.M{"$set": bson.M{"name": m.Name, "appliedat": m.AppliedAt}},
+	)
+	return err
+}
+
+// RemoveMigration records that migration version has been reverted
+func (db *MongoDatabase) RemoveMigration(ctx context.Context, version int) error {
+	err := db.c(ctx, MigrationsCollection).Remove(bson.M{"_id": version})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// LockMigrations takes the migration lock for owner until expires and returns
+// whether it did (false while another owner holds it, unless it expired
+// before now)
+func (db *MongoDatabase) LockMigrations(ctx context.Context, owner string, expires time.Time, now time.Time) (bool, error) {
+	err := db.c(ctx, MigrationLockCollection).Insert(&MigrationLock{ID: migrationLockID, Owner: owner, Expires: expires})
+	if err == nil {
+		return true, nil
+	}
+	if !mgo.IsDup(err) {
+		return false, err
+	}
+
+	err = db.c(ctx, MigrationLockCollection).Update(
+		bson.M{"_id": migrationLockID, "expires": bson.M{"$lt": now}},
+		bson.M{"$set": bson.M{"owner": owner, "expires": expires}},
+	)
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// RenewMigrationLock extends the migration lock held by owner until expires
+// and returns whether owner still held it
+func (db *MongoDatabase) RenewMigrationLock(ctx context.Context, owner string, expires time.Time) (bool, error) {
+	err := db.c(ctx, MigrationLockCollection).Update(
+		bson.M{"_id": migrationLockID, "owner": owner},
+		bson.M{"$set": bson.M{"expires": expires}},
+	)
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// UnlockMigrations releases the migration lock if owner holds it
+func (db *MongoDatabase) UnlockMigrations(ctx context.Context, owner string) error {
+	err := db.c(ctx, MigrationLockCollection).Remove(bson.M{"_id": migrationLockID, "owner": owner})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
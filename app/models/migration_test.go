@@ -0,0 +1,84 @@
+package models_test
+
+// Table driven tests for migration.go
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/newtonsystems/agent-mgmt/app/models"
+	tu "github.com/newtonsystems/agent-mgmt/app/testutil"
+)
+
+func TestAppliedMigrations(t *testing.T) {
+	session, db := tu.NewTestMongoConnection(*tu.Debug, *tu.OutsideConn)
+	defer tu.CleanUpTestMongoConnection(t, session)
+	ctx := context.Background()
+
+	// The test database is migrated
+	applied, err := db.AppliedMigrations(ctx)
+	tu.Ok(t, err)
+	tu.Assert(t, len(applied) > 0, "expected the test database to be migrated")
+
+	_, err = db.C(models.MigrationsCollection).RemoveAll(nil)
+	tu.Ok(t, err)
+	now := time.Date(2017, time.October, 2, 9, 30, 0, 0, time.UTC)
+	for _, m := range []models.AppliedMigration{{Version: 3, Name: "three", AppliedAt: now}, {Version: 1, Name: "one", AppliedAt: now}} {
+		tu.Ok(t, db.AddMigration(ctx, m))
+	}
+	// Recording a migration twice is harmless
+	tu.Ok(t, db.AddMigration(ctx, models.AppliedMigration{Version: 1, Name: "one", AppliedAt: now}))
+
+	applied, err = db.AppliedMigrations(ctx)
+	tu.Ok(t, err)
+	tu.Equals(t, 2, len(applied))
+	tu.Equals(t, []int{1, 3}, []int{applied[0].Version, applied[1].Version})
+	tu.Equals(t, "one", applied[0].Name)
+	tu.TimeEquals(t, now, applied[0].AppliedAt)
+
+	tu.Ok(t, db.RemoveMigration(ctx, 3))
+	tu.Ok(t, db.RemoveMigration(ctx, 3))
+	applied, err = db.AppliedMigrations(ctx)
+	tu.Ok(t, err)
+	tu.Equals(t, 1, len(applied))
+}
+
+func TestLockMigrations(t *testing.T) {
+	session, db := tu.NewTestMongoConnection(*tu.Debug, *tu.OutsideConn)
+	defer tu.CleanUpTestMongoConnection(t, session)
+	ctx := context.Background()
+
+	now := time.Now()
+	testCases := []struct {
+		description string
+		owner       string
+		now         time.Time
+		locked      bool
+	}{
+		{"free", "pod-1", now, true},
+		{"held", "pod-2", now.Add(time.Minute), false},
+		{"held_by_owner", "pod-1", now.Add(time.Minute), false},
+		{"expired", "pod-2", now.Add(11 * time.Minute), true},
+		{"taken_over", "pod-1", now.Add(12 * time.Minute), false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			locked, err := db.LockMigrations(ctx, tc.owner, tc.now.Add(10*time.Minute), tc.now)
+			tu.Ok(t, err)
+			tu.Equals(t, tc.locked, locked)
+		})
+	}
+
+	// Only the owner releases the lock
+	tu.Ok(t, db.UnlockMigrations(ctx, "pod-1"))
+	locked, err := db.LockMigrations(ctx, "pod-3", now.Add(13*time.Minute), now.Add(12*time.Minute))
+	tu.Ok(t, err)
+	tu.Equals(t, false, locked)
+
+	tu.Ok(t, db.UnlockMigrations(ctx, "pod-2"))
+	locked, err = db.LockMigrations(ctx, "pod-3", now.Add(13*time.Minute), now.Add(12*time.Minute))
+	tu.Ok(t, err)
+	tu.Equals(t, true, locked)
+}
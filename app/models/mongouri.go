@@ -0,0 +1,164 @@
+package models
+
+// mongouri.go
+// Mongo connection settings from a mongodb:// URI
+// (https://docs.mongodb.com/manual/reference/connection-string/)
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+)
+
+// DefaultMongoDialTimeout how long an attempt to connect to the servers may
+// take (see NewMongoSession)
+const DefaultMongoDialTimeout = 10 * time.Second
+
+// readPreferences the mgo mode of each readPreference URI option
+var readPreferences = map[string]mgo.Mode{
+	"primary":            mgo.Primary,
+	"primaryPreferred":   mgo.PrimaryPreferred,
+	"secondary":          mgo.Secondary,
+	"secondaryPreferred": mgo.SecondaryPreferred,
+	"nearest":            mgo.Nearest,
+}
+
+// MongoSettings are the connection settings of a mongodb:// URI
+type MongoSettings struct {
+	// DialInfo the hosts, credentials (and their auth source and mechanism)
+	// and replica set name
+	DialInfo *mgo.DialInfo
+	// TLS connects to the servers with TLS (URI option tls or ssl)
+	TLS bool
+	// TLSCAFile verifies the servers' certificates (URI option tlsCAFile, the
+	// system CAs if "")
+	TLSCAFile string
+	// ReadPreference which members are read from (URI option readPreference,
+	// the primary if not set)
+	ReadPreference string
+	// Mode is the mgo mode of ReadPreference
+	Mode mgo.Mode
+}
+
+// ParseMongoURI returns the connection settings of uri. Besides the options mgo
+// understands (authSource, authMechanism, replicaSet, ...) it takes tls (or
+// ssl), tlsCAFile and readPreference.
+func ParseMongoURI(uri string) (MongoSettings, error) {
+	settings := MongoSettings{ReadPreference: "primary", Mode: mgo.Primary}
+	if !strings.HasPrefix(uri, "mongodb://") {
+		return settings, errors.New("mongo uri must start with mongodb://")
+	}
+
+	// mgo rejects the options it does not know so take ours out
+	base, options := uri, []string{}
+	if i := strings.Index(uri, "?"); i != -1 {
+		base = uri[:i]
+		for _, pair := range strings.FieldsFunc(uri[i+1:], func(r rune) bool { return r == '&' || r == ';' }) {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				options = append(options, pair)
+				continue
+			}
+
+			var err error
+			switch kv[0] {
+			case "tls", "ssl":
+				if settings.TLS, err = strconv.ParseBool(kv[1]); err != nil {
+					return settings, fmt.Errorf("bad value for %s in mongo uri: %s", kv[0], kv[1])
+				}
+			case "tlsCAFile":
+				settings.TLSCAFile = kv[1]
+			case "readPreference":
+				mode, ok := readPreferences[kv[1]]
+				if !ok {
+					return settings, fmt.Errorf("unknown readPreference in mongo uri: %s", kv[1])
+				}
+				settings.ReadPreference, settings.Mode = kv[1], mode
+			default:
+				options = append(options, pair)
+			}
+		}
+	}
+	if len(options) > 0 {
+		base += "?" + strings.Join(options, "&")
+	}
+
+	info, err := mgo.ParseURL(base)
+	if err != nil {
+		return settings, fmt.Errorf("invalid mongo uri: %v", err)
+	}
+	if len(info.Addrs) == 0 || info.Addrs[0] == "" {
+		return settings, errors.New("mongo uri has no hosts")
+	}
+	if settings.TLSCAFile != "" && !settings.TLS {
+		return settings, errors.New("mongo uri sets tlsCAFile without tls=true")
+	}
+	info.Timeout = DefaultMongoDialTimeout
+	settings.DialInfo = info
+	return settings, nil
+}
+
+// tlsConfig returns the TLS config verifying the servers' certificates with
+// the CAs in TLSCAFile (if set)
+func (s MongoSettings) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if s.TLSCAFile == "" {
+		return config, nil
+	}
+
+	pem, err := ioutil.ReadFile(s.TLSCAFile)
+	if err != nil {
+		return nil, err
+	}
+	config.RootCAs = x509.NewCertPool()
+	if !config.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in mongo tls ca file %s", s.TLSCAFile)
+	}
+	return config, nil
+}
+
+// dialInfo returns the DialInfo connecting with the settings
+func (s MongoSettings) dialInfo() (*mgo.DialInfo, error) {
+	info := *s.DialInfo
+	if !s.TLS {
+		return &info, nil
+	}
+
+	config, err := s.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+		// The server name is taken from the address
+		return tls.DialWithDialer(&net.Dialer{Timeout: info.Timeout}, "tcp", addr.String(), config)
+	}
+	return &info, nil
+}
+
+// Keyvals returns the settings to log (never the password)
+func (s MongoSettings) Keyvals() []interface{} {
+	info := s.DialInfo
+	password := ""
+	if info.Password != "" {
+		password = "REDACTED"
+	}
+	return []interface{}{
+		"hosts", strings.Join(info.Addrs, ", "),
+		"db", info.Database,
+		"user", info.Username,
+		"password", password,
+		"auth_source", info.Source,
+		"auth_mechanism", info.Mechanism,
+		"replica_set", info.ReplicaSetName,
+		"tls", s.TLS,
+		"read_preference", s.ReadPreference,
+	}
+}
@@ -0,0 +1,1314 @@
+package models
+
+// postgres.go
+// PostgreSQL implementation of Session / DataLayer / Collection
+// Each database (e.g. a tenant's, see tenant.Database) is a schema with the
+// tables agents, phone_sessions, tasks and archived_tasks and the sequences
+// agentid_seq and taskid_seq (created by migrate.PostgresMigrations). Empty
+// strings and zero times are stored as NULL (as the mgo omitempty fields are
+// left out), skills are jsonb.
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/lib/pq"
+	mgo "gopkg.in/mgo.v2"
+
+	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+)
+
+// DefaultPostgresDialTimeout how long an attempt to connect to postgres may
+// take (see NewPostgresSession)
+const DefaultPostgresDialTimeout = 10 * time.Second
+
+// postgres error codes (https://www.postgresql.org/docs/current/errcodes-appendix.html)
+const (
+	pqUniqueViolation = "23505"
+	pqUndefinedTable  = "42P01"
+)
+
+// postgresTables the table of each collection
+var postgresTables = map[string]string{
+	"agents":                "agents",
+	"phonesessions":         "phone_sessions",
+	"tasks":                 "tasks",
+	archivedTasksCollection: "archived_tasks",
+	MigrationsCollection:    MigrationsCollection,
+	MigrationLockCollection: MigrationLockCollection,
+}
+
+// PostgresSettings are the connection settings of a postgres:// URI
+// (https://www.postgresql.org/docs/current/libpq-connect.html#LIBPQ-CONNSTRING)
+type PostgresSettings struct {
+	URL *url.URL
+}
+
+// ParsePostgresURI returns the connection settings of uri (postgres:// or
+// postgresql://). Its options (e.g. sslmode) are passed to lib/pq.
+func ParsePostgresURI(uri string) (PostgresSettings, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return PostgresSettings{}, fmt.Errorf("invalid postgres uri: %v", err)
+	}
+	if u.Scheme != "postgres" && u.Scheme != "postgresql" {
+		return PostgresSettings{}, errors.New("postgres uri must start with postgres:// or postgresql://")
+	}
+	if u.Host == "" {
+		return PostgresSettings{}, errors.New("postgres uri has no host")
+	}
+	if strings.Trim(u.Path, "/") == "" {
+		return PostgresSettings{}, errors.New("postgres uri has no database")
+	}
+	return PostgresSettings{URL: u}, nil
+}
+
+// Keyvals returns the settings to log (never the password)
+func (s PostgresSettings) Keyvals() []interface{} {
+	user, password := "", ""
+	if s.URL.User != nil {
+		user = s.URL.User.Username()
+		if _, ok := s.URL.User.Password(); ok {
+			password = "REDACTED"
+		}
+	}
+	return []interface{}{
+		"host", s.URL.Host,
+		"db", strings.Trim(s.URL.Path, "/"),
+		"user", user,
+		"password", password,
+		"sslmode", s.URL.Query().Get("sslmode"),
+	}
+}
+
+// PostgresSession satisfies Session on a database/sql connection pool. Copies
+// and clones share the pool: closing a copy does nothing, closing the session
+// returned by NewPostgresSession closes the pool.
+type PostgresSession struct {
+	db      *sql.DB
+	copied  bool
+	timeout time.Duration
+}
+
+// NewPostgresSession returns a new Session connected to postgres with
+// settings (see ParsePostgresURI). Like NewMongoSession failed connections
+// are retried with exponential backoff until ctx is done.
+func NewPostgresSession(ctx context.Context, settings PostgresSettings, logger log.Logger) (Session, log.Logger, error) {
+	postgresLogger := log.With(logger, "connection", "postgres")
+	postgresLogger.Log(settings.Keyvals()...)
+
+	db, err := sql.Open("postgres", settings.URL.String())
+	if err != nil {
+		return nil, postgresLogger, err
+	}
+	err = dialWithBackoff(ctx, DefaultPostgresDialTimeout, postgresLogger, func(timeout time.Duration) error {
+		pingCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return db.PingContext(pingCtx)
+	})
+	if err != nil {
+		db.Close()
+		return nil, postgresLogger, err
+	}
+
+	postgresLogger.Log("msg", "successfully connected")
+
+	return &PostgresSession{db: db, timeout: 3 * time.Second}, postgresLogger, nil
+}
+
+// DB returns the database 'name' (the schema 'name')
+func (s *PostgresSession) DB(name string) DataLayer {
+	return &PostgresDatabase{db: s.db, schema: pq.QuoteIdentifier(name), timeout: s.timeout}
+}
+
+func (s *PostgresSession) SetSafe(safe *mgo.Safe) {}
+
+func (s *PostgresSession) SetSyncTimeout(d time.Duration) {}
+
+func (s *PostgresSession) SetMode(consistency mgo.Mode, refresh bool) {}
+
+// SetSocketTimeout limits how long each call may take
+func (s *PostgresSession) SetSocketTimeout(d time.Duration) {
+	s.timeout = d
+}
+
+func (s *PostgresSession) Close() {
+	if !s.copied {
+		s.db.Close()
+	}
+}
+
+// Clone returns a session sharing the connection pool
+func (s *PostgresSession) Clone() Session {
+	return s.Copy()
+}
+
+// Copy returns a session sharing the connection pool
+func (s *PostgresSession) Copy() Session {
+	sessionCopy := *s
+	sessionCopy.copied = true
+	return &sessionCopy
+}
+
+// Refresh does nothing, the pool replaces broken connections itself
+func (s *PostgresSession) Refresh() {}
+
+func (s *PostgresSession) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	return s.db.PingContext(ctx)
+}
+
+// pqErrorCode returns the postgres error code of err ("" if it has none)
+func pqErrorCode(err error) pq.ErrorCode {
+	if pqErr, ok := err.(*pq.Error); ok {
+		return pqErr.Code
+	}
+	return ""
+}
+
+// postgresError returns err as mgo would have
+func postgresError(err error) error {
+	if err == sql.ErrNoRows {
+		return mgo.ErrNotFound
+	}
+	if pqErrorCode(err) == pqUniqueViolation {
+		return &mgo.LastError{Code: 11000, Err: err.Error()}
+	}
+	return err
+}
+
+// querier runs queries on the pool or in a transaction
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// scanner scans a row (a *sql.Row or *sql.Rows)
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// nullString stores "" as NULL
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// nullTime stores the zero time as NULL
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+// localTime returns t in the local time zone (as mgo does, zero if t is NULL)
+func localTime(t pq.NullTime) time.Time {
+	if !t.Valid {
+		return time.Time{}
+	}
+	return t.Time.Local()
+}
+
+// jsonb stores v as jsonb (nil slices as NULL)
+func jsonb(v interface{}) (interface{}, error) {
+	switch s := v.(type) {
+	case []Skill:
+		if s == nil {
+			return nil, nil
+		}
+	case []SkillRequirement:
+		if s == nil {
+			return nil, nil
+		}
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// PostgresDatabase satisfies DataLayer on a postgres schema
+type PostgresDatabase struct {
+	db      *sql.DB
+	schema  string
+	timeout time.Duration
+}
+
+// context limits a call with ctx to the session's socket timeout
+func (db *PostgresDatabase) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if db.timeout > 0 {
+		return context.WithTimeout(ctx, db.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// sql returns query with {schema} replaced by the database's schema
+func (db *PostgresDatabase) sql(query string) string {
+	return strings.Replace(query, "{schema}", db.schema, -1)
+}
+
+// C returns the table of collection 'name' (see PostgresCollection)
+func (db *PostgresDatabase) C(name string) Collection {
+	return &PostgresCollection{db: db, name: name}
+}
+
+// DropDatabase drops the schema (and everything in it)
+func (db *PostgresDatabase) DropDatabase() error {
+	ctx, cancel := db.context(context.Background())
+	defer cancel()
+	_, err := db.db.ExecContext(ctx, db.sql("DROP SCHEMA IF EXISTS {schema} CASCADE"))
+	return err
+}
+
+// ExecSQL runs the SQL statements in query in the database's schema (its
+// search_path) in a transaction. The schema is created if it does not exist.
+// It is how the postgres migrations are applied (see migrate.PostgresMigrations).
+func (db *PostgresDatabase) ExecSQL(ctx context.Context, query string) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, db.sql("CREATE SCHEMA IF NOT EXISTS {schema}; SET LOCAL search_path TO {schema}")); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, query); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// WithTransaction returns ErrNotSupported, each postgres call runs in its own
+// transaction (AddTask, AcceptTask etc. are transactional)
+func (db *PostgresDatabase) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return ErrNotSupported
+}
+
+// WatchCollection returns ErrNotSupported, postgres has no change streams
+func (db *PostgresDatabase) WatchCollection(ctx context.Context, collection string, pipeline interface{}) (ChangeStream, error) {
+	return nil, ErrNotSupported
+}
+
+// PostgresCollection satisfies Collection on the table of a collection (see
+// postgresTables). Only what the tests and fixtures need is supported:
+// inserting agents, phone sessions and tasks, counting and removing every
+// row. Duplicate keys are *mgo.LastError (see mgo.IsDup). Use the DataLayer
+// calls for anything else.
+type PostgresCollection struct {
+	db   *PostgresDatabase
+	name string
+}
+
+// unsupported returns the error of the Collection calls the postgres backend
+// does not support
+func (c *PostgresCollection) unsupported(call string) error {
+	return fmt.Errorf("%s on %s is not supported by the postgres backend, use the DataLayer calls instead", call, c.name)
+}
+
+// table returns the schema qualified table of the collection
+func (c *PostgresCollection) table() (string, error) {
+	table, ok := postgresTables[c.name]
+	if !ok {
+		return "", fmt.Errorf("no postgres table for collection %s", c.name)
+	}
+	return c.db.schema + "." + table, nil
+}
+
+// Count returns the number of rows in the table.
+func (c *PostgresCollection) Count() (int, error) {
+	table, err := c.table()
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := c.db.context(context.Background())
+	defer cancel()
+	var n int
+	err = c.db.db.QueryRowContext(ctx, "SELECT count(*) FROM "+table).Scan(&n)
+	return n, err
+}
+
+// Insert inserts agents, phone sessions or tasks (values or pointers)
+func (c *PostgresCollection) Insert(docs ...interface{}) error {
+	table, err := c.table()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := c.db.context(context.Background())
+	defer cancel()
+	for _, doc := range docs {
+		switch d := doc.(type) {
+		case Agent:
+			err = insertAgent(ctx, c.db.db, table, &d)
+		case *Agent:
+			err = insertAgent(ctx, c.db.db, table, d)
+		case PhoneSession:
+			err = insertPhoneSession(ctx, c.db.db, table, &d)
+		case *PhoneSession:
+			err = insertPhoneSession(ctx, c.db.db, table, d)
+		case Task:
+			err = insertTask(ctx, c.db.db, table, &d)
+		case *Task:
+			err = insertTask(ctx, c.db.db, table, d)
+		default:
+			err = fmt.Errorf("cannot insert %T into %s with the postgres backend", doc, c.name)
+		}
+		if err != nil {
+			return postgresError(err)
+		}
+	}
+	return nil
+}
+
+// Remove is not supported by the postgres backend.
+func (c *PostgresCollection) Remove(selector interface{}) error {
+	return c.unsupported("Remove")
+}
+
+// Update is not supported by the postgres backend.
+func (c *PostgresCollection) Update(selector interface{}, update interface{}) error {
+	return c.unsupported("Update")
+}
+
+// UpdateId is not supported by the postgres backend.
+func (c *PostgresCollection) UpdateId(id interface{}, update interface{}) error {
+	return c.unsupported("UpdateId")
+}
+
+// Upsert is not supported by the postgres backend.
+func (c *PostgresCollection) Upsert(selector interface{}, update interface{}) (*mgo.ChangeInfo, error) {
+	return nil, c.unsupported("Upsert")
+}
+
+// EnsureIndex is not supported by the postgres backend (indexes are created
+// by the SQL migrations).
+func (c *PostgresCollection) EnsureIndex(index mgo.Index) error {
+	return c.unsupported("EnsureIndex")
+}
+
+// DropIndex is not supported by the postgres backend.
+func (c *PostgresCollection) DropIndex(key ...string) error {
+	return c.unsupported("DropIndex")
+}
+
+// RemoveAll removes every row (only a nil selector is supported)
+func (c *PostgresCollection) RemoveAll(selector interface{}) (*mgo.ChangeInfo, error) {
+	if selector != nil {
+		return nil, c.unsupported("RemoveAll with a selector")
+	}
+	table, err := c.table()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := c.db.context(context.Background())
+	defer cancel()
+	result, err := c.db.db.ExecContext(ctx, "DELETE FROM "+table)
+	if err != nil {
+		return nil, err
+	}
+	n, err := result.RowsAffected()
+	return &mgo.ChangeInfo{Removed: int(n)}, err
+}
+
+// UpdateAll is not supported by the postgres backend.
+func (c *PostgresCollection) UpdateAll(selector interface{}, update interface{}) (*mgo.ChangeInfo, error) {
+	return nil, c.unsupported("UpdateAll")
+}
+
+// SQL Calls
+
+const agentColumns = "agentid, state, statechangedat, lastheartbeat, skills"
+
+func insertAgent(ctx context.Context, q querier, table string, agent *Agent) error {
+	skills, err := jsonb(agent.Skills)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx, "INSERT INTO "+table+" ("+agentColumns+") VALUES ($1, $2, $3, $4, $5)",
+		agent.AgentID, nullString(string(agent.State)), nullTime(agent.StateChangedAt), agent.LastHeartBeat, skills)
+	return err
+}
+
+func scanAgent(row scanner) (Agent, error) {
+	var agent Agent
+	var state sql.NullString
+	var stateChangedAt, lastHeartBeat pq.NullTime
+	var skills []byte
+
+	if err := row.Scan(&agent.AgentID, &state, &stateChangedAt, &lastHeartBeat, &skills); err != nil {
+		return Agent{}, err
+	}
+	agent.State = AgentState(state.String)
+	agent.StateChangedAt = localTime(stateChangedAt)
+	agent.LastHeartBeat = localTime(lastHeartBeat)
+	if skills != nil {
+		if err := json.Unmarshal(skills, &agent.Skills); err != nil {
+			return Agent{}, err
+		}
+	}
+	return agent, nil
+}
+
+func insertPhoneSession(ctx context.Context, q querier, table string, pSess *PhoneSession) error {
+	_, err := q.ExecContext(ctx, "INSERT INTO "+table+" (sessid, agentid, refid, createdat) VALUES ($1, $2, $3, $4)",
+		pSess.SessID, pSess.AgentID, pSess.RefID, nullTime(pSess.CreatedAt))
+	return err
+}
+
+const taskColumns = "taskid, custid, agentids, requiredskills, status, addedat, offeredat, acceptedby, acceptedat, releasedagentids, startedat, completedat, abandonedat, cancelledat"
+
+func insertTask(ctx context.Context, q querier, table string, task *Task) error {
+	skills, err := jsonb(task.RequiredSkills)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx, "INSERT INTO "+table+" ("+taskColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)",
+		task.TaskID, task.CustID, pq.Array(task.AgentIDs), skills, nullString(string(task.Status)),
+		task.AddedAt, nullTime(task.OfferedAt), task.AcceptedBy, nullTime(task.AcceptedAt), pq.Array(task.ReleasedAgentIDs),
+		nullTime(task.StartedAt), nullTime(task.CompletedAt), nullTime(task.AbandonedAt), nullTime(task.CancelledAt))
+	return err
+}
+
+func scanTask(row scanner) (Task, error) {
+	var task Task
+	var status sql.NullString
+	var skills []byte
+	var addedAt, offeredAt, acceptedAt, startedAt, completedAt, abandonedAt, cancelledAt pq.NullTime
+
+	err := row.Scan(&task.TaskID, &task.CustID, pq.Array(&task.AgentIDs), &skills, &status,
+		&addedAt, &offeredAt, &task.AcceptedBy, &acceptedAt, pq.Array(&task.ReleasedAgentIDs),
+		&startedAt, &completedAt, &abandonedAt, &cancelledAt)
+	if err != nil {
+		return Task{}, err
+	}
+	task.Status = TaskStatus(status.String)
+	task.AddedAt = localTime(addedAt)
+	task.OfferedAt = localTime(offeredAt)
+	task.AcceptedAt = localTime(acceptedAt)
+	task.StartedAt = localTime(startedAt)
+	task.CompletedAt = localTime(completedAt)
+	task.AbandonedAt = localTime(abandonedAt)
+	task.CancelledAt = localTime(cancelledAt)
+	if skills != nil {
+		if err = json.Unmarshal(skills, &task.RequiredSkills); err != nil {
+			return Task{}, err
+		}
+	}
+	return task, nil
+}
+
+// nextSequence returns the next value of the sequence 'name' (ErrCounterNotFound
+// if there is no such sequence)
+func (db *PostgresDatabase) nextSequence(ctx context.Context, q querier, name string) (int32, error) {
+	var seq int64
+	err := q.QueryRowContext(ctx, "SELECT nextval($1::regclass)", db.schema+"."+pq.QuoteIdentifier(name+"_seq")).Scan(&seq)
+
+	if pqErrorCode(err) == pqUndefinedTable {
+		return 0, amerrors.ErrCounterNotFoundError("failed to find an counter counters(_id=" + name + ")")
+	}
+
+	return int32(seq), err
+}
+
+// GetNextSequence returns the next value of the sequence for 'name'
+func (db *PostgresDatabase) GetNextSequence(ctx context.Context, name string) (int32, error) {
+	callCtx, cancel := db.context(ctx)
+	defer cancel()
+
+	seq, err := db.nextSequence(callCtx, db.db, name)
+
+	if err != nil {
+		logger.Log("level", "error", "msg", "Creation of next sequence failed for "+name, "err", err)
+		return 0, dbError(ctx, err)
+	}
+
+	return seq, nil
+}
+
+// AgentExists check whether an agent exist based of its agent ID
+func (db *PostgresDatabase) AgentExists(ctx context.Context, agentID int32) (bool, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	var exists bool
+	err := db.db.QueryRowContext(ctx, db.sql("SELECT EXISTS (SELECT 1 FROM {schema}.agents WHERE agentid = $1)"), agentID).Scan(&exists)
+
+	if err != nil {
+		return false, err
+	}
+
+	if !exists {
+		return false, amerrors.ErrAgentNotFoundError("failed to find an Agent(AgentID=" + strconv.Itoa(int(agentID)) + ")")
+	}
+
+	return true, nil
+}
+
+// GetAgent returns the agent with agent ID
+func (db *PostgresDatabase) GetAgent(ctx context.Context, agentID int32) (Agent, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	agent, err := scanAgent(db.db.QueryRowContext(ctx, db.sql("SELECT "+agentColumns+" FROM {schema}.agents WHERE agentid = $1"), agentID))
+
+	if err == sql.ErrNoRows {
+		return Agent{}, amerrors.ErrAgentNotFoundError("failed to find an Agent(AgentID=" + strconv.Itoa(int(agentID)) + ")")
+	}
+
+	return agent, err
+}
+
+// HeartBeat updates LastHeartBeat with current time now
+// An offline agent becomes available on its heartbeat
+func (db *PostgresDatabase) HeartBeat(ctx context.Context, agentID int32) error {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	result, err := db.db.ExecContext(ctx, db.sql(`UPDATE {schema}.agents SET
+		lastheartbeat = $2,
+		state = CASE WHEN state IS NULL OR state = $3 THEN $4 ELSE state END,
+		statechangedat = CASE WHEN state IS NULL OR state = $3 THEN $2 ELSE statechangedat END
+		WHERE agentid = $1`), agentID, NowFunc(), AgentOffline, AgentAvailable)
+
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = amerrors.ErrAgentNotFoundError("failed to find an Agent(AgentID=" + strconv.Itoa(int(agentID)) + ")")
+		}
+		logger.Log("level", "err", "err", err)
+		return err
+	}
+
+	return nil
+}
+
+// HeartBeats writes buffered heartbeats (agent id -> time) in a single update
+// and returns how many agents were found. A heartbeat never moves an agent's
+// last heartbeat backwards and offline agents become available.
+func (db *PostgresDatabase) HeartBeats(ctx context.Context, beats map[int32]time.Time) (int, error) {
+	if len(beats) == 0 {
+		return 0, nil
+	}
+
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	var ids []int32
+	var times []string
+	for agentID, at := range beats {
+		ids = append(ids, agentID)
+		times = append(times, at.Format(time.RFC3339Nano))
+	}
+
+	result, err := db.db.ExecContext(ctx, db.sql(`UPDATE {schema}.agents SET
+		lastheartbeat = GREATEST(agents.lastheartbeat, beats.at),
+		state = CASE WHEN agents.state IS NULL OR agents.state = $3 THEN $4 ELSE agents.state END,
+		statechangedat = CASE WHEN agents.state IS NULL OR agents.state = $3 THEN $5 ELSE agents.statechangedat END
+		FROM unnest($1::integer[], $2::timestamptz[]) AS beats(agentid, at)
+		WHERE agents.agentid = beats.agentid`), pq.Array(ids), pq.Array(times), AgentOffline, AgentAvailable, NowFunc())
+
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// TouchAgents sets the last heartbeat of the agents to now without checking
+// they exist (see HeartBeatStream) and returns how many were updated
+func (db *PostgresDatabase) TouchAgents(ctx context.Context, agentIDs []int32) (int, error) {
+	if len(agentIDs) == 0 {
+		return 0, nil
+	}
+
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	result, err := db.db.ExecContext(ctx, db.sql("UPDATE {schema}.agents SET lastheartbeat = $1 WHERE agentid = ANY($2)"), NowFunc(), pq.Array(agentIDs))
+
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// SetAgentState moves the agent from state from to state to. The update only
+// applies if the agent is still in state from so concurrent changes are safe.
+// It does not check the transition is allowed (see CanTransition)
+func (db *PostgresDatabase) SetAgentState(ctx context.Context, agentID int32, from AgentState, to AgentState) error {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	condition, state := "state = $4", from
+	if from == "" || from == AgentOffline {
+		condition, state = "(state IS NULL OR state = $4)", AgentOffline
+	}
+
+	result, err := db.db.ExecContext(ctx, db.sql("UPDATE {schema}.agents SET state = $1, statechangedat = $2 WHERE agentid = $3 AND "+condition),
+		to, NowFunc(), agentID, state)
+
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		if _, err = db.GetAgent(ctx, agentID); err != nil {
+			return err
+		}
+		return amerrors.ErrAgentStateTransitionError("Agent(AgentID=" + strconv.Itoa(int(agentID)) + ") is no longer " + string(from))
+	}
+
+	return nil
+}
+
+// SetAgentSkills replaces the agent's skill profile and returns the updated agent
+func (db *PostgresDatabase) SetAgentSkills(ctx context.Context, agentID int32, skills []Skill) (Agent, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	value, err := jsonb(skills)
+	if err != nil {
+		return Agent{}, err
+	}
+
+	agent, err := scanAgent(db.db.QueryRowContext(ctx, db.sql("UPDATE {schema}.agents SET skills = $1 WHERE agentid = $2 RETURNING "+agentColumns), value, agentID))
+
+	if err == sql.ErrNoRows {
+		return Agent{}, amerrors.ErrAgentNotFoundError("failed to find an Agent(AgentID=" + strconv.Itoa(int(agentID)) + ")")
+	}
+
+	return agent, err
+}
+
+// ExpireAgents marks agents offline whose last heartbeat is before before
+// (missed heartbeats) and returns their agent IDs. With dryRun nothing is changed.
+func (db *PostgresDatabase) ExpireAgents(ctx context.Context, before time.Time, dryRun bool) ([]int32, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	query := "UPDATE {schema}.agents SET state = $1, statechangedat = $3 WHERE (state IS NULL OR state <> $1) AND lastheartbeat < $2 RETURNING agentid"
+	args := []interface{}{AgentOffline, before, NowFunc()}
+	if dryRun {
+		query = "SELECT agentid FROM {schema}.agents WHERE (state IS NULL OR state <> $1) AND lastheartbeat < $2"
+		args = args[:2]
+	}
+
+	rows, err := db.db.QueryContext(ctx, db.sql(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int32
+	for rows.Next() {
+		var id int32
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, rows.Err()
+}
+
+// GetAgents returns all Agents in state within a certain heartbeat with every
+// required skill in order, by agent ID unless sorted otherwise (preferred
+// skills are ranked by RankBySkills)
+func (db *PostgresDatabase) GetAgents(ctx context.Context, state AgentState, timestamp time.Time, skills []SkillRequirement, order AgentOrder, limit int32) ([]Agent, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	query := "SELECT " + agentColumns + " FROM {schema}.agents WHERE state = $1 AND lastheartbeat > $2"
+	args := []interface{}{state, timestamp}
+	for _, req := range skills {
+		if !req.Required {
+			continue
+		}
+		// The containment can use the skills index, the level is checked on its matches
+		args = append(args, req.Name, req.MinLevel)
+		query += fmt.Sprintf(" AND skills @> jsonb_build_array(jsonb_build_object('name', $%[1]d::text))"+
+			" AND EXISTS (SELECT 1 FROM jsonb_array_elements(skills) skill WHERE skill->>'name' = $%[1]d AND (skill->>'level')::integer >= $%[2]d)",
+			len(args)-1, len(args))
+	}
+	if order.AfterAgentID != 0 {
+		args = append(args, order.AfterAgentID)
+		query += fmt.Sprintf(" AND agentid > $%d", len(args))
+	}
+	if order.By == AgentSortStateChangedAt {
+		query += " ORDER BY statechangedat NULLS FIRST, agentid"
+	} else {
+		query += " ORDER BY agentid"
+	}
+	if limit > 0 {
+		query += " LIMIT " + strconv.Itoa(int(limit))
+	}
+
+	rows, err := db.db.QueryContext(ctx, db.sql(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var agents []Agent
+	for rows.Next() {
+		agent, err := scanAgent(rows)
+		if err != nil {
+			return agents, err
+		}
+		agents = append(agents, agent)
+	}
+	return agents, rows.Err()
+}
+
+// AddAgent creates a new agent with an agent ID allocated from the agentid sequence
+// Agent IDs already taken are skipped.
+// The agent starts offline so is not available until its first HeartBeat()
+func (db *PostgresDatabase) AddAgent(ctx context.Context) (int32, error) {
+	for attempt := 0; attempt < maxAgentIDAttempts; attempt++ {
+		agentID, err := db.GetNextSequence(ctx, "agentid")
+
+		if err != nil {
+			return 0, err
+		}
+
+		insertCtx, cancel := db.context(ctx)
+		err = insertAgent(insertCtx, db.db, db.sql("{schema}.agents"), &Agent{AgentID: agentID, State: AgentOffline, StateChangedAt: NowFunc()})
+		cancel()
+
+		if err == nil {
+			return agentID, nil
+		}
+
+		if pqErrorCode(err) != pqUniqueViolation {
+			return 0, err
+		}
+
+		logger.Log("level", "warn", "msg", "Agent ID "+strconv.Itoa(int(agentID))+" already taken, trying next sequence")
+	}
+
+	return 0, amerrors.InternalServerError("failed to allocate a unique agent ID after %d attempts", maxAgentIDAttempts)
+}
+
+// RemoveAgent removes the agent with agent ID
+func (db *PostgresDatabase) RemoveAgent(ctx context.Context, agentID int32) error {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	result, err := db.db.ExecContext(ctx, db.sql("DELETE FROM {schema}.agents WHERE agentid = $1"), agentID)
+
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return amerrors.ErrAgentNotFoundError("failed to find an Agent(AgentID=" + strconv.Itoa(int(agentID)) + ")")
+	}
+
+	return nil
+}
+
+// AddTask adds a task and returns the newly created Task's id if successful.
+// The task ID is taken from the taskid sequence in the same transaction.
+func (db *PostgresDatabase) AddTask(ctx context.Context, custID int32, agentIDs []int32, skills []SkillRequirement) (int32, error) {
+	if custID <= 0 {
+		return 0, amerrors.ErrCustIDInvalidError("Invalid Cust ID: " + strconv.Itoa(int(custID)))
+	}
+
+	if err := ValidateSkillRequirements(skills); err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	taskID, err := db.nextSequence(ctx, tx, "taskid")
+	if err != nil {
+		return 0, err
+	}
+	logger.Log("level", "debug", "msg", "Created new sequence "+strconv.Itoa(int(taskID)))
+
+	if err = insertTask(ctx, tx, db.sql("{schema}.tasks"), newTask(taskID, custID, agentIDs, skills)); err != nil {
+		return 0, err
+	}
+
+	return taskID, tx.Commit()
+}
+
+// lockTask returns the task with task ID locked until tx ends
+func (db *PostgresDatabase) lockTask(ctx context.Context, tx *sql.Tx, taskID int32) (Task, error) {
+	task, err := scanTask(tx.QueryRowContext(ctx, db.sql("SELECT "+taskColumns+" FROM {schema}.tasks WHERE taskid = $1 FOR UPDATE"), taskID))
+
+	if err == sql.ErrNoRows {
+		return Task{}, amerrors.ErrTaskNotFoundError("failed to find a Task(TaskID=" + strconv.Itoa(int(taskID)) + ")")
+	}
+
+	return task, err
+}
+
+// hasAgent returns whether agentID is one of agentIDs
+func hasAgent(agentIDs []int32, agentID int32) bool {
+	for _, id := range agentIDs {
+		if id == agentID {
+			return true
+		}
+	}
+	return false
+}
+
+// AcceptTask marks the task as accepted by agentID (recording when) and releases
+// the other candidate agents. The task is locked while it is checked and
+// updated so concurrent accepts are safe: it must not already be accepted and
+// must have been offered to agentID. Cancelled and abandoned tasks cannot be
+// accepted.
+func (db *PostgresDatabase) AcceptTask(ctx context.Context, taskID int32, agentID int32) (Task, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Task{}, err
+	}
+	defer tx.Rollback()
+
+	task, err := db.lockTask(ctx, tx, taskID)
+	if err != nil {
+		return Task{}, err
+	}
+
+	if task.AcceptedBy != 0 || !hasAgent(task.AgentIDs, agentID) || (task.Status != "" && task.Status != TaskOffered) {
+		return Task{}, taskNotAcceptableError(task, agentID)
+	}
+
+	task.AcceptedBy = agentID
+	task.setStatus(TaskAccepted, NowFunc())
+	task.ReleasedAgentIDs = releasedAgentIDs(task.AgentIDs, agentID)
+	task.AgentIDs = []int32{agentID}
+
+	_, err = tx.ExecContext(ctx, db.sql("UPDATE {schema}.tasks SET status = $1, acceptedby = $2, acceptedat = $3, agentids = $4, releasedagentids = $5 WHERE taskid = $6"),
+		task.Status, task.AcceptedBy, task.AcceptedAt, pq.Array(task.AgentIDs), pq.Array(task.ReleasedAgentIDs), taskID)
+	if err != nil {
+		return Task{}, err
+	}
+
+	return task, tx.Commit()
+}
+
+// CompleteTask marks the task accepted by agentID as completed (recording when).
+// The task is locked while it is checked and updated: it must have been
+// accepted by agentID and not already be completed (or cancelled/abandoned).
+func (db *PostgresDatabase) CompleteTask(ctx context.Context, taskID int32, agentID int32) (Task, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Task{}, err
+	}
+	defer tx.Rollback()
+
+	task, err := db.lockTask(ctx, tx, taskID)
+	if err != nil {
+		return Task{}, err
+	}
+
+	if task.AcceptedBy != agentID || !task.CompletedAt.IsZero() || (task.Status != "" && task.Status != TaskAccepted && task.Status != TaskInProgress) {
+		return Task{}, taskNotCompletableError(task, agentID)
+	}
+
+	task.setStatus(TaskCompleted, NowFunc())
+
+	_, err = tx.ExecContext(ctx, db.sql("UPDATE {schema}.tasks SET status = $1, completedat = $2 WHERE taskid = $3"), task.Status, task.CompletedAt, taskID)
+	if err != nil {
+		return Task{}, err
+	}
+
+	return task, tx.Commit()
+}
+
+// CountAcceptedTasks returns how many tasks each of agentIDs accepted since since
+// (agents with no tasks are not in the map)
+func (db *PostgresDatabase) CountAcceptedTasks(ctx context.Context, agentIDs []int32, since time.Time) (map[int32]int, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	counts := make(map[int32]int)
+
+	rows, err := db.db.QueryContext(ctx, db.sql("SELECT acceptedby, count(*) FROM {schema}.tasks WHERE acceptedby = ANY($1) AND acceptedat >= $2 GROUP BY acceptedby"),
+		pq.Array(agentIDs), since)
+	if err != nil {
+		return counts, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var agentID int32
+		var n int
+		if err = rows.Scan(&agentID, &n); err != nil {
+			return counts, err
+		}
+		counts[agentID] = n
+	}
+
+	return counts, rows.Err()
+}
+
+// GetTask returns the task with task ID
+func (db *PostgresDatabase) GetTask(ctx context.Context, taskID int32) (Task, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	task, err := scanTask(db.db.QueryRowContext(ctx, db.sql("SELECT "+taskColumns+" FROM {schema}.tasks WHERE taskid = $1"), taskID))
+
+	if err == sql.ErrNoRows {
+		return Task{}, amerrors.ErrTaskNotFoundError("failed to find a Task(TaskID=" + strconv.Itoa(int(taskID)) + ")")
+	}
+
+	if err != nil {
+		return Task{}, err
+	}
+
+	task.Status = task.CurrentStatus()
+	return task, nil
+}
+
+// ListTasks returns the tasks matching filter (oldest first, limit 0 is no limit)
+func (db *PostgresDatabase) ListTasks(ctx context.Context, filter TaskFilter, limit int32) ([]Task, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	query := "SELECT " + taskColumns + " FROM {schema}.tasks WHERE true"
+	var args []interface{}
+	if filter.CustID != 0 {
+		args = append(args, filter.CustID)
+		query += " AND custid = $" + strconv.Itoa(len(args))
+	}
+	if filter.AgentID != 0 {
+		args = append(args, filter.AgentID)
+		query += " AND $" + strconv.Itoa(len(args)) + " = ANY(agentids)"
+	}
+	if filter.Status != "" {
+		args = append(args, filter.Status)
+		query += " AND status = $" + strconv.Itoa(len(args))
+	}
+	query += " ORDER BY taskid"
+	if limit > 0 {
+		query += " LIMIT " + strconv.Itoa(int(limit))
+	}
+
+	rows, err := db.db.QueryContext(ctx, db.sql(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tasks []Task
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			return tasks, err
+		}
+		task.Status = task.CurrentStatus()
+		tasks = append(tasks, task)
+	}
+
+	return tasks, rows.Err()
+}
+
+// SetTaskStatus moves the task from status from to status to (only if it is
+// still in status from) recording when. Returns the updated task.
+func (db *PostgresDatabase) SetTaskStatus(ctx context.Context, taskID int32, from TaskStatus, to TaskStatus) (Task, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Task{}, err
+	}
+	defer tx.Rollback()
+
+	task, err := db.lockTask(ctx, tx, taskID)
+	if err != nil {
+		return Task{}, err
+	}
+
+	if task.CurrentStatus() != from {
+		return Task{}, taskStatusTransitionError(taskID, from, to)
+	}
+
+	now := NowFunc()
+	task.setStatus(to, now)
+
+	set := "status = $1"
+	if field, ok := taskStatusTimestamps[to]; ok {
+		set += ", " + field + " = $3"
+	}
+	_, err = tx.ExecContext(ctx, db.sql("UPDATE {schema}.tasks SET "+set+" WHERE taskid = $2"), to, taskID, now)
+	if err != nil {
+		return Task{}, err
+	}
+
+	return task, tx.Commit()
+}
+
+// OfferTask offers the queued task to agentIDs (recording when). The task is
+// locked while it is checked and updated. Returns the updated task.
+func (db *PostgresDatabase) OfferTask(ctx context.Context, taskID int32, agentIDs []int32) (Task, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Task{}, err
+	}
+	defer tx.Rollback()
+
+	task, err := db.lockTask(ctx, tx, taskID)
+	if err != nil {
+		return Task{}, err
+	}
+
+	if status := task.CurrentStatus(); status != TaskQueued {
+		return Task{}, taskStatusTransitionError(taskID, status, TaskOffered)
+	}
+
+	task.AgentIDs = agentIDs
+	task.setStatus(TaskOffered, NowFunc())
+
+	_, err = tx.ExecContext(ctx, db.sql("UPDATE {schema}.tasks SET status = $1, offeredat = $2, agentids = $3 WHERE taskid = $4"),
+		task.Status, task.OfferedAt, pq.Array(task.AgentIDs), taskID)
+	if err != nil {
+		return Task{}, err
+	}
+
+	return task, tx.Commit()
+}
+
+// ArchiveTasks moves tasks completed, abandoned or cancelled before before into
+// the archived tasks table (in a transaction) and returns how many. With
+// dryRun nothing is moved.
+func (db *PostgresDatabase) ArchiveTasks(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	ended := make([]string, len(endedTaskFields))
+	for i, field := range endedTaskFields {
+		ended[i] = field + " < $1"
+	}
+	condition := strings.Join(ended, " OR ")
+
+	if dryRun {
+		var n int
+		err := db.db.QueryRowContext(ctx, db.sql("SELECT count(*) FROM {schema}.tasks WHERE "+condition), before).Scan(&n)
+		return n, err
+	}
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, db.sql("INSERT INTO {schema}.archived_tasks SELECT "+taskColumns+" FROM {schema}.tasks WHERE "+condition+" ON CONFLICT DO NOTHING"), before)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := tx.ExecContext(ctx, db.sql("DELETE FROM {schema}.tasks WHERE "+condition), before)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), tx.Commit()
+}
+
+// GetAgentIDFromRef returns the Agent ID from a Reference
+func (db *PostgresDatabase) GetAgentIDFromRef(ctx context.Context, refID string) (int32, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	var agentID int32
+	err := db.db.QueryRowContext(ctx, db.sql("SELECT agentid FROM {schema}.phone_sessions WHERE refid = $1 LIMIT 1"), refID).Scan(&agentID)
+
+	if err == sql.ErrNoRows {
+		return 0, amerrors.ErrAgentIDNotFoundError("failed to find an Agent from ref id " + refID)
+	}
+	if err != nil {
+		return 0, postgresError(err)
+	}
+
+	return agentID, nil
+}
+
+// ExpirePhoneSessions removes phone sessions created before before and returns
+// how many. With dryRun nothing is removed.
+func (db *PostgresDatabase) ExpirePhoneSessions(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	if dryRun {
+		var n int
+		err := db.db.QueryRowContext(ctx, db.sql("SELECT count(*) FROM {schema}.phone_sessions WHERE createdat < $1"), before).Scan(&n)
+		return n, err
+	}
+
+	result, err := db.db.ExecContext(ctx, db.sql("DELETE FROM {schema}.phone_sessions WHERE createdat < $1"), before)
+
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// createMigrationTables creates the schema and its migrations and migration
+// lock tables if they do not exist (they are needed before any migration)
+func (db *PostgresDatabase) createMigrationTables(ctx context.Context) error {
+	_, err := db.db.ExecContext(ctx, db.sql(`CREATE SCHEMA IF NOT EXISTS {schema};
+		CREATE TABLE IF NOT EXISTS {schema}.`+MigrationsCollection+` (
+			version integer PRIMARY KEY,
+			name text NOT NULL,
+			appliedat timestamptz NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS {schema}.`+MigrationLockCollection+` (
+			id text PRIMARY KEY,
+			owner text NOT NULL,
+			expires timestamptz NOT NULL
+		)`))
+	return err
+}
+
+// AppliedMigrations returns the migrations applied to the database by version
+func (db *PostgresDatabase) AppliedMigrations(ctx context.Context) ([]AppliedMigration, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	if err := db.createMigrationTables(ctx); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.db.QueryContext(ctx, db.sql("SELECT version, name, appliedat FROM {schema}."+MigrationsCollection+" ORDER BY version"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var applied []AppliedMigration
+	for rows.Next() {
+		var m AppliedMigration
+		if err = rows.Scan(&m.Version, &m.Name, &m.AppliedAt); err != nil {
+			return applied, err
+		}
+		m.AppliedAt = m.AppliedAt.Local()
+		applied = append(applied, m)
+	}
+	return applied, rows.Err()
+}
+
+// AddMigration records that migration m has been applied
+func (db *PostgresDatabase) AddMigration(ctx context.Context, m AppliedMigration) error {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	if err := db.createMigrationTables(ctx); err != nil {
+		return err
+	}
+
+	_, err := db.db.ExecContext(ctx, db.sql("INSERT INTO {schema}."+MigrationsCollection+" (version, name, appliedat) VALUES ($1, $2, $3)"+
+		" ON CONFLICT (version) DO UPDATE SET name = EXCLUDED.name, appliedat = EXCLUDED.appliedat"), m.Version, m.Name, m.AppliedAt)
+	return err
+}
+
+// RemoveMigration records that migration version has been reverted
+func (db *PostgresDatabase) RemoveMigration(ctx context.Context, version int) error {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	_, err := db.db.ExecContext(ctx, db.sql("DELETE FROM {schema}."+MigrationsCollection+" WHERE version = $1"), version)
+	return err
+}
+
+// LockMigrations takes the migration lock for owner until expires and returns
+// whether it did (false while another owner holds it, unless it expired
+// before now)
+func (db *PostgresDatabase) LockMigrations(ctx context.Context, owner string, expires time.Time, now time.Time) (bool, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	if err := db.createMigrationTables(ctx); err != nil {
+		return false, err
+	}
+
+	result, err := db.db.ExecContext(ctx, db.sql("INSERT INTO {schema}."+MigrationLockCollection+" AS held (id, owner, expires) VALUES ($1, $2, $3)"+
+		" ON CONFLICT (id) DO UPDATE SET owner = EXCLUDED.owner, expires = EXCLUDED.expires WHERE held.expires < $4"),
+		migrationLockID, owner, expires, now)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// RenewMigrationLock extends the migration lock held by owner until expires
+// and returns whether owner still held it
+func (db *PostgresDatabase) RenewMigrationLock(ctx context.Context, owner string, expires time.Time) (bool, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	result, err := db.db.ExecContext(ctx, db.sql("UPDATE {schema}."+MigrationLockCollection+" SET expires = $1 WHERE id = $2 AND owner = $3"), expires, migrationLockID, owner)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// UnlockMigrations releases the migration lock if owner holds it
+func (db *PostgresDatabase) UnlockMigrations(ctx context.Context, owner string) error {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+
+	_, err := db.db.ExecContext(ctx, db.sql("DELETE FROM {schema}."+MigrationLockCollection+" WHERE id = $1 AND owner = $2"), migrationLockID, owner)
+	return err
+}
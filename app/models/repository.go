@@ -0,0 +1,278 @@
+package models
+
+// repository.go
+// Repositories are the storage the service works with, in domain terms. The
+// session repositories (NewRepositories) keep the database session and name
+// out of the service; they work with any Session (Mongo or in memory).
+// Each tenant has its own repositories (see NewTenantRepositories).
+
+import (
+	"context"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+
+	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+	"github.com/newtonsystems/agent-mgmt/app/tenant"
+)
+
+// AgentRepository provides access to the agents
+type AgentRepository interface {
+	// Add registers a new agent and returns its agent ID
+	Add(ctx context.Context) (int32, error)
+	Remove(ctx context.Context, agentID int32) error
+	Find(ctx context.Context, agentID int32) (Agent, error)
+	// FindByState returns the agents in state with a heartbeat after since and
+	// the required skills in order (at most limit, 0 is no limit)
+	FindByState(ctx context.Context, state AgentState, since time.Time, skills []SkillRequirement, order AgentOrder, limit int32) ([]Agent, error)
+	SetState(ctx context.Context, agentID int32, from AgentState, to AgentState) error
+	SetSkills(ctx context.Context, agentID int32, skills []Skill) (Agent, error)
+	HeartBeat(ctx context.Context, agentID int32) error
+	// Touch sets the heartbeat of the agents to now and returns how many exist
+	Touch(ctx context.Context, agentIDs []int32) (int, error)
+}
+
+// TaskRepository provides access to the tasks
+type TaskRepository interface {
+	// Add creates a task for the customer offered to the agents and returns its task ID
+	Add(ctx context.Context, custID int32, agentIDs []int32, skills []SkillRequirement) (int32, error)
+	Accept(ctx context.Context, taskID int32, agentID int32) (Task, error)
+	Complete(ctx context.Context, taskID int32, agentID int32) (Task, error)
+	Find(ctx context.Context, taskID int32) (Task, error)
+	FindAll(ctx context.Context, filter TaskFilter, limit int32) ([]Task, error)
+	SetStatus(ctx context.Context, taskID int32, from TaskStatus, to TaskStatus) (Task, error)
+	// Offer offers the queued task to the agents
+	Offer(ctx context.Context, taskID int32, agentIDs []int32) (Task, error)
+	// CountAccepted returns how many tasks each agent accepted since then
+	CountAccepted(ctx context.Context, agentIDs []int32, since time.Time) (map[int32]int, error)
+}
+
+// PhoneSessionRepository provides access to the agents' phone sessions
+type PhoneSessionRepository interface {
+	// FindAgentID returns the agent ID of the phone session with reference refID
+	FindAgentID(ctx context.Context, refID string) (int32, error)
+}
+
+// CounterRepository provides the sequences agent and task IDs are taken from
+type CounterRepository interface {
+	// Next returns the next value of sequence name
+	Next(ctx context.Context, name string) (int32, error)
+}
+
+// Repositories are the repositories of a database
+type Repositories struct {
+	// Tenant whose database it is ("" if the service is not multi-tenant)
+	Tenant        string
+	Agents        AgentRepository
+	Tasks         TaskRepository
+	PhoneSessions PhoneSessionRepository
+	Counters      CounterRepository
+}
+
+// For returns r for a call for any tenant (Repositories are TenantRepositories
+// of a service that is not multi-tenant)
+func (r Repositories) For(ctx context.Context) (Repositories, error) {
+	return r, nil
+}
+
+// TenantRepositories provides the repositories of the tenant of a call
+type TenantRepositories interface {
+	// For returns the repositories of the tenant of ctx (see tenant.FromContext)
+	// or ErrTenantUnknown if the call is not for one of the tenants
+	For(ctx context.Context) (Repositories, error)
+}
+
+// NewTenantRepositories returns the repositories of every tenant, each of
+// the tenant's database (see tenant.Database). No tenants are the
+// repositories of db itself for every call (see NewRepositories).
+func NewTenantRepositories(session Session, db string, tenants []string) TenantRepositories {
+	if len(tenants) == 0 {
+		return NewRepositories(session, db)
+	}
+
+	byTenant := make(tenantRepositories)
+	for _, id := range tenants {
+		repos := NewRepositories(session, tenant.Database(db, id))
+		repos.Tenant = id
+		byTenant[id] = repos
+	}
+	return byTenant
+}
+
+type tenantRepositories map[string]Repositories
+
+func (t tenantRepositories) For(ctx context.Context) (Repositories, error) {
+	id := tenant.FromContext(ctx)
+	if id == "" {
+		return Repositories{}, amerrors.ErrTenantUnknownError("a tenant ID is required (%s metadata)", tenant.MetadataKey)
+	}
+
+	repos, ok := t[id]
+	if !ok {
+		return Repositories{}, amerrors.ErrTenantUnknownError("unknown tenant: %s", id)
+	}
+	return repos, nil
+}
+
+// NewRepositories returns the repositories of database db of session. Every
+// call is made on its own copy of session (see CopySession), in strong mode
+// unless it is a read where a slightly stale answer does (e.g. routing).
+func NewRepositories(session Session, db string) Repositories {
+	s := sessionStore{session: session, db: db}
+	return Repositories{
+		Agents:        agentRepository{s},
+		Tasks:         taskRepository{s},
+		PhoneSessions: phoneSessionRepository{s},
+		Counters:      counterRepository{s},
+	}
+}
+
+type sessionStore struct {
+	session Session
+	db      string
+}
+
+// database returns the database of a copy of the session for a call with ctx
+// and the func to call with the call's error once done with it. That closes
+// the copy, refreshes the session after a connection error and returns the
+// error to give the service (see dbError).
+func (s sessionStore) database(ctx context.Context, strong bool) (DataLayer, func(err error) error) {
+	// NOTE: Concurrent requests will not work otherwises
+	// Request a socket connection from the session to process our query.
+	// Close the session when the call is done and put the connection back
+	// into the pool.
+	sessionCopy := CopySession(ctx, s.session)
+
+	if strong {
+		sessionCopy.SetMode(mgo.Strong, false)
+	}
+
+	return sessionCopy.DB(s.db), func(err error) error {
+		sessionCopy.Close()
+		if RefreshOnError(s.session, err) {
+			logger.Log("level", "warn", "msg", "Refreshed the mongo session after a connection error", "db", s.db, "err", err)
+		}
+		return dbError(ctx, err)
+	}
+}
+
+type agentRepository struct {
+	sessionStore
+}
+
+func (r agentRepository) Add(ctx context.Context) (int32, error) {
+	dl, done := r.database(ctx, true)
+	id, err := dl.AddAgent(ctx)
+	return id, done(err)
+}
+
+func (r agentRepository) Remove(ctx context.Context, agentID int32) error {
+	dl, done := r.database(ctx, true)
+	return done(dl.RemoveAgent(ctx, agentID))
+}
+
+func (r agentRepository) Find(ctx context.Context, agentID int32) (Agent, error) {
+	dl, done := r.database(ctx, true)
+	agent, err := dl.GetAgent(ctx, agentID)
+	return agent, done(err)
+}
+
+func (r agentRepository) FindByState(ctx context.Context, state AgentState, since time.Time, skills []SkillRequirement, order AgentOrder, limit int32) ([]Agent, error) {
+	dl, done := r.database(ctx, false)
+	agents, err := dl.GetAgents(ctx, state, since, skills, order, limit)
+	return agents, done(err)
+}
+
+func (r agentRepository) SetState(ctx context.Context, agentID int32, from AgentState, to AgentState) error {
+	dl, done := r.database(ctx, true)
+	return done(dl.SetAgentState(ctx, agentID, from, to))
+}
+
+func (r agentRepository) SetSkills(ctx context.Context, agentID int32, skills []Skill) (Agent, error) {
+	dl, done := r.database(ctx, true)
+	agent, err := dl.SetAgentSkills(ctx, agentID, skills)
+	return agent, done(err)
+}
+
+func (r agentRepository) HeartBeat(ctx context.Context, agentID int32) error {
+	dl, done := r.database(ctx, true)
+	return done(dl.HeartBeat(ctx, agentID))
+}
+
+func (r agentRepository) Touch(ctx context.Context, agentIDs []int32) (int, error) {
+	dl, done := r.database(ctx, true)
+	n, err := dl.TouchAgents(ctx, agentIDs)
+	return n, done(err)
+}
+
+type taskRepository struct {
+	sessionStore
+}
+
+func (r taskRepository) Add(ctx context.Context, custID int32, agentIDs []int32, skills []SkillRequirement) (int32, error) {
+	dl, done := r.database(ctx, true)
+	id, err := dl.AddTask(ctx, custID, agentIDs, skills)
+	return id, done(err)
+}
+
+func (r taskRepository) Accept(ctx context.Context, taskID int32, agentID int32) (Task, error) {
+	dl, done := r.database(ctx, true)
+	task, err := dl.AcceptTask(ctx, taskID, agentID)
+	return task, done(err)
+}
+
+func (r taskRepository) Complete(ctx context.Context, taskID int32, agentID int32) (Task, error) {
+	dl, done := r.database(ctx, true)
+	task, err := dl.CompleteTask(ctx, taskID, agentID)
+	return task, done(err)
+}
+
+func (r taskRepository) Find(ctx context.Context, taskID int32) (Task, error) {
+	dl, done := r.database(ctx, true)
+	task, err := dl.GetTask(ctx, taskID)
+	return task, done(err)
+}
+
+func (r taskRepository) FindAll(ctx context.Context, filter TaskFilter, limit int32) ([]Task, error) {
+	dl, done := r.database(ctx, true)
+	tasks, err := dl.ListTasks(ctx, filter, limit)
+	return tasks, done(err)
+}
+
+func (r taskRepository) SetStatus(ctx context.Context, taskID int32, from TaskStatus, to TaskStatus) (Task, error) {
+	dl, done := r.database(ctx, true)
+	task, err := dl.SetTaskStatus(ctx, taskID, from, to)
+	return task, done(err)
+}
+
+func (r taskRepository) Offer(ctx context.Context, taskID int32, agentIDs []int32) (Task, error) {
+	dl, done := r.database(ctx, true)
+	task, err := dl.OfferTask(ctx, taskID, agentIDs)
+	return task, done(err)
+}
+
+func (r taskRepository) CountAccepted(ctx context.Context, agentIDs []int32, since time.Time) (map[int32]int, error) {
+	dl, done := r.database(ctx, false)
+	counts, err := dl.CountAcceptedTasks(ctx, agentIDs, since)
+	return counts, done(err)
+}
+
+type phoneSessionRepository struct {
+	sessionStore
+}
+
+func (r phoneSessionRepository) FindAgentID(ctx context.Context, refID string) (int32, error) {
+	dl, done := r.database(ctx, false)
+	agentID, err := dl.GetAgentIDFromRef(ctx, refID)
+	return agentID, done(err)
+}
+
+type counterRepository struct {
+	sessionStore
+}
+
+func (r counterRepository) Next(ctx context.Context, name string) (int32, error) {
+	dl, done := r.database(ctx, true)
+	seq, err := dl.GetNextSequence(ctx, name)
+	return seq, done(err)
+}
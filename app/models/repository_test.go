@@ -0,0 +1,159 @@
+package models_test
+
+// Tests for the session repositories (on the in-memory DataLayer)
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+	"github.com/newtonsystems/agent-mgmt/app/models"
+	"github.com/newtonsystems/agent-mgmt/app/tenant"
+	tu "github.com/newtonsystems/agent-mgmt/app/testutil"
+)
+
+func TestRepositories(t *testing.T) {
+	session, db := tu.NewTestMemoryConnection()
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	tu.InsertCollectionToDB(t, db, "phonesessions", []tu.TestModelInsert{
+		&models.PhoneSession{SessID: 1, AgentID: 7, RefID: "ref007a"},
+	})
+
+	ctx := context.Background()
+	repos := models.NewRepositories(session, tu.MongoDBName)
+
+	agentID, err := repos.Agents.Add(ctx)
+	tu.Ok(t, err)
+	tu.Ok(t, repos.Agents.HeartBeat(ctx, agentID))
+	agent, err := repos.Agents.Find(ctx, agentID)
+	tu.Ok(t, err)
+	tu.Ok(t, repos.Agents.SetState(ctx, agentID, agent.State, models.AgentAvailable))
+
+	agents, err := repos.Agents.FindByState(ctx, models.AgentAvailable, time.Now().Add(-time.Minute), nil, models.AgentOrder{}, 0)
+	tu.Ok(t, err)
+	tu.Equals(t, 1, len(agents))
+	tu.Equals(t, agentID, agents[0].AgentID)
+
+	taskID, err := repos.Tasks.Add(ctx, 5, []int32{agentID}, nil)
+	tu.Ok(t, err)
+	task, err := repos.Tasks.Accept(ctx, taskID, agentID)
+	tu.Ok(t, err)
+	tu.Equals(t, taskID, task.TaskID)
+
+	counts, err := repos.Tasks.CountAccepted(ctx, []int32{agentID}, time.Now().Add(-time.Minute))
+	tu.Ok(t, err)
+	tu.Equals(t, 1, counts[agentID])
+
+	refAgentID, err := repos.PhoneSessions.FindAgentID(ctx, "ref007a")
+	tu.Ok(t, err)
+	tu.Equals(t, int32(7), refAgentID)
+
+	// Agent and task IDs come from the counters
+	next, err := repos.Counters.Next(ctx, "taskid")
+	tu.Ok(t, err)
+	tu.Equals(t, taskID+1, next)
+
+	tu.Ok(t, repos.Agents.Remove(ctx, agentID))
+	_, err = repos.Agents.Find(ctx, agentID)
+	tu.IsAmError(t, amerrors.ErrAgentNotFound, err)
+}
+
+func TestTenantRepositories(t *testing.T) {
+	session, _ := tu.NewTestMemoryConnection()
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	tenants := []string{"acme", "globex"}
+	for _, id := range tenants {
+		tu.MigrateDB(session, tenant.Database(tu.MongoDBName, id))
+	}
+	repos := models.NewTenantRepositories(session, tu.MongoDBName, tenants)
+
+	acme, err := repos.For(tenant.NewContext(context.Background(), "acme"))
+	tu.Ok(t, err)
+	tu.Equals(t, "acme", acme.Tenant)
+	globex, err := repos.For(tenant.NewContext(context.Background(), "globex"))
+	tu.Ok(t, err)
+
+	// Each tenant has its own agents and counters
+	ctx := context.Background()
+	acmeID, err := acme.Agents.Add(ctx)
+	tu.Ok(t, err)
+	globexID, err := globex.Agents.Add(ctx)
+	tu.Ok(t, err)
+	tu.Equals(t, acmeID, globexID)
+
+	tu.Ok(t, acme.Agents.Remove(ctx, acmeID))
+	_, err = acme.Agents.Find(ctx, acmeID)
+	tu.IsAmError(t, amerrors.ErrAgentNotFound, err)
+	_, err = globex.Agents.Find(ctx, globexID)
+	tu.Ok(t, err)
+
+	// A call has to be for one of the tenants
+	_, err = repos.For(ctx)
+	tu.IsAmError(t, amerrors.ErrTenantUnknown, err)
+	_, err = repos.For(tenant.NewContext(ctx, "initech"))
+	tu.IsAmError(t, amerrors.ErrTenantUnknown, err)
+
+	// Without tenants every call is for the database itself
+	single, err := models.NewTenantRepositories(session, tu.MongoDBName, nil).For(tenant.NewContext(ctx, "initech"))
+	tu.Ok(t, err)
+	tu.Equals(t, "", single.Tenant)
+}
+
+// brokenSession is a session whose every call fails (see brokenDatabase)
+type brokenSession struct {
+	tu.MockSession
+	refreshed *int
+}
+
+func (s brokenSession) Copy() models.Session {
+	return s
+}
+
+func (s brokenSession) Refresh() {
+	*s.refreshed++
+}
+
+func (s brokenSession) DB(name string) models.DataLayer {
+	return brokenDatabase{}
+}
+
+type brokenDatabase struct {
+	tu.MockDatabase
+}
+
+// GetAgent fails as if the connection broke
+func (db brokenDatabase) GetAgent(ctx context.Context, agentID int32) (models.Agent, error) {
+	return models.Agent{}, io.EOF
+}
+
+// GetTask fails as if the primary stepped down
+func (db brokenDatabase) GetTask(ctx context.Context, taskID int32) (models.Task, error) {
+	return models.Task{}, errors.New("not master")
+}
+
+func TestRepositoriesErrors(t *testing.T) {
+	refreshed := 0
+	repos := models.NewRepositories(brokenSession{refreshed: &refreshed}, tu.MongoDBName)
+
+	// Database errors are internal errors, the session is refreshed after a
+	// connection error
+	_, err := repos.Agents.Find(context.Background(), 1)
+	tu.IsAmError(t, amerrors.InternalServer, err)
+	tu.Equals(t, 1, refreshed)
+
+	_, err = repos.Tasks.Find(context.Background(), 1)
+	tu.IsAmError(t, amerrors.InternalServer, err)
+	tu.Equals(t, 1, refreshed)
+
+	// The error of a call whose context is done is left for the service to
+	// report as cancelled / deadline exceeded
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = repos.Agents.Find(ctx, 1)
+	tu.Equals(t, io.EOF, err)
+}
@@ -4,32 +4,57 @@ package models
 // Session Model / Mongo Calls
 
 import (
+	"context"
 	"fmt"
+	"time"
 
+	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
+// PhoneSession - CreatedAt is used to expire old sessions (sessions without it are never expired)
 type PhoneSession struct {
-	SessID  int32  `bson:"sessid" json:"sessid"`
-	AgentID int32  `bson:"agentid" json:"agentid"`
-	RefID   string `bson:"refid" json:"refid"`
+	SessID    int32     `bson:"sessid" json:"sessid"`
+	AgentID   int32     `bson:"agentid" json:"agentid"`
+	RefID     string    `bson:"refid" json:"refid"`
+	CreatedAt time.Time `bson:"createdat,omitempty" json:"createdat"`
 }
 
 // Mongo Calls
 
 // GetAgentIDFromRef returns the Agent ID from a Reference
-func (db *MongoDatabase) GetAgentIDFromRef(refID string) (int32, error) {
+func (db *MongoDatabase) GetAgentIDFromRef(ctx context.Context, refID string) (int32, error) {
 	var pSess PhoneSession
 
-	err := db.C("phonesessions").Find(bson.M{"refid": refID}).Select(bson.M{"agentid": 1}).One(&pSess)
+	err := db.c(ctx, "phonesessions").Find(bson.M{"refid": refID}).Select(bson.M{"agentid": 1}).One(&pSess)
+
+	if err == mgo.ErrNotFound {
+		return 0, amerrors.ErrAgentIDNotFoundError("failed to find an Agent from ref id " + refID)
+	}
+	if err != nil {
+		return 0, err
+	}
 
 	logger.Log("level", "debug", "msg", "Found agent ID: "+fmt.Sprintf("%#v", pSess.AgentID))
 
+	return pSess.AgentID, nil
+}
+
+// ExpirePhoneSessions removes phone sessions created before before and returns
+// how many. With dryRun nothing is removed.
+func (db *MongoDatabase) ExpirePhoneSessions(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	selector := bson.M{"createdat": bson.M{"$lt": before}}
+
+	if dryRun {
+		return db.c(ctx, "phonesessions").Find(selector).Count()
+	}
+
+	info, err := db.c(ctx, "phonesessions").RemoveAll(selector)
+
 	if err != nil {
-		// Is returning 0 really the best way to handle this?
-		// What is the best way to handle error (raise something?)
 		return 0, err
 	}
 
-	return pSess.AgentID, nil
+	return info.Removed, nil
 }
@@ -3,6 +3,7 @@ package models_test
 // Basic property + table driven tests for agent.go
 
 import (
+	"context"
 	"fmt"
 	"testing"
 
@@ -71,7 +72,7 @@ func TestGetAgentIDFromRef(t *testing.T) {
 			defer tu.CleanAllCollectionsTestMongo(session)
 			tu.InsertCollectionToDB(t, db, "phonesessions", tc.inserts)
 
-			agentID, _ := db.GetAgentIDFromRef(tc.refID)
+			agentID, _ := db.GetAgentIDFromRef(context.Background(), tc.refID)
 			tu.Equals(t, tc.expectedAgentID, agentID)
 		})
 
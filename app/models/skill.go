@@ -0,0 +1,143 @@
+package models
+
+// skill.go
+// Agent skill profiles and task skill requirements (skills-based routing)
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// MinSkillLevel is the lowest proficiency level of a skill
+	MinSkillLevel int32 = 1
+	// MaxSkillLevel is the highest proficiency level of a skill
+	MaxSkillLevel int32 = 5
+)
+
+// Skill is something an agent can do and how well (Level MinSkillLevel-MaxSkillLevel)
+// Names are namespaced by kind e.g. "language:fr", "product:billing"
+type Skill struct {
+	Name  string `bson:"name" json:"name"`
+	Level int32  `bson:"level" json:"level"`
+}
+
+// SkillRequirement is a skill a task needs at MinLevel or above
+// Required skills are hard requirements (agents without them are never matched)
+// otherwise the skill is a preference and agents with it score Weight
+type SkillRequirement struct {
+	Name     string `bson:"name" json:"name"`
+	MinLevel int32  `bson:"minlevel,omitempty" json:"minlevel"`
+	Required bool   `bson:"required,omitempty" json:"required"`
+	Weight   int32  `bson:"weight,omitempty" json:"weight"`
+}
+
+// ValidateSkills returns ErrSkillInvalid if a skill has no name, an out of range
+// level or is listed twice
+func ValidateSkills(skills []Skill) error {
+	seen := make(map[string]bool)
+	for _, skill := range skills {
+		if skill.Name == "" {
+			return amerrors.ErrSkillInvalidError("skill name is empty")
+		}
+		if skill.Level < MinSkillLevel || skill.Level > MaxSkillLevel {
+			return amerrors.ErrSkillInvalidError("invalid level " + strconv.Itoa(int(skill.Level)) + " for skill " + skill.Name)
+		}
+		if seen[skill.Name] {
+			return amerrors.ErrSkillInvalidError("skill " + skill.Name + " is listed more than once")
+		}
+		seen[skill.Name] = true
+	}
+	return nil
+}
+
+// ValidateSkillRequirements returns ErrSkillInvalid if a requirement has no name,
+// an out of range minimum level or a negative weight
+func ValidateSkillRequirements(reqs []SkillRequirement) error {
+	for _, req := range reqs {
+		if req.Name == "" {
+			return amerrors.ErrSkillInvalidError("skill requirement name is empty")
+		}
+		if req.MinLevel < 0 || req.MinLevel > MaxSkillLevel {
+			return amerrors.ErrSkillInvalidError("invalid minimum level " + strconv.Itoa(int(req.MinLevel)) + " for skill " + req.Name)
+		}
+		if req.Weight < 0 {
+			return amerrors.ErrSkillInvalidError("invalid weight " + strconv.Itoa(int(req.Weight)) + " for skill " + req.Name)
+		}
+	}
+	return nil
+}
+
+// hasSkill returns whether the agent has the skill at the requirement's minimum level
+func (a Agent) hasSkill(req SkillRequirement) bool {
+	for _, skill := range a.Skills {
+		if skill.Name == req.Name && skill.Level >= req.MinLevel {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchSkills returns whether the agent meets every required skill and its score:
+// the total weight of the preferred skills it has
+func (a Agent) MatchSkills(reqs []SkillRequirement) (int32, bool) {
+	var score int32
+	for _, req := range reqs {
+		has := a.hasSkill(req)
+		if req.Required && !has {
+			return 0, false
+		}
+		if !req.Required && has {
+			score += req.Weight
+		}
+	}
+	return score, true
+}
+
+// RankBySkills returns the agents meeting every required skill, highest score
+// first. Agents with the same score keep their order (see service.Router)
+func RankBySkills(agents []Agent, reqs []SkillRequirement) []Agent {
+	if len(reqs) == 0 {
+		return agents
+	}
+
+	var ranked []Agent
+	scores := make(map[int32]int32)
+	for _, agent := range agents {
+		if score, ok := agent.MatchSkills(reqs); ok {
+			ranked = append(ranked, agent)
+			scores[agent.AgentID] = score
+		}
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool { return scores[ranked[i].AgentID] > scores[ranked[j].AgentID] })
+	return ranked
+}
+
+// requiredSkillsSelector matches agents with every required skill (nil if none are required)
+func requiredSkillsSelector(reqs []SkillRequirement) []interface{} {
+	var selectors []interface{}
+	for _, req := range reqs {
+		if !req.Required {
+			continue
+		}
+		selectors = append(selectors, bson.M{"skills": bson.M{"$elemMatch": bson.M{
+			"name":  req.Name,
+			"level": bson.M{"$gte": req.MinLevel},
+		}}})
+	}
+	return selectors
+}
+
+// agentsSelector matches agents in state with a heartbeat after timestamp and every required skill
+func agentsSelector(state AgentState, timestamp time.Time, reqs []SkillRequirement) bson.M {
+	selector := bson.M{"state": state, "lastheartbeat": bson.M{"$gt": timestamp}}
+	if required := requiredSkillsSelector(reqs); len(required) > 0 {
+		selector["$and"] = required
+	}
+	return selector
+}
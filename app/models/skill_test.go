@@ -0,0 +1,63 @@
+package models_test
+
+// Basic tests for skill.go
+
+import (
+	"testing"
+
+	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+	"github.com/newtonsystems/agent-mgmt/app/models"
+	tu "github.com/newtonsystems/agent-mgmt/app/testutil"
+)
+
+func TestValidateSkills(t *testing.T) {
+	var testCases = []struct {
+		description string
+		skills      []models.Skill
+		hasErr      bool
+	}{
+		{"no skills", nil, false},
+		{"valid skills", []models.Skill{{Name: "language:fr", Level: 1}, {Name: "product:billing", Level: 5}}, false},
+		{"empty name", []models.Skill{{Name: "", Level: 3}}, true},
+		{"level too low", []models.Skill{{Name: "language:fr", Level: 0}}, true},
+		{"level too high", []models.Skill{{Name: "language:fr", Level: 6}}, true},
+		{"duplicate skill", []models.Skill{{Name: "language:fr", Level: 1}, {Name: "language:fr", Level: 2}}, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			err := models.ValidateSkills(tc.skills)
+			if tc.hasErr {
+				tu.IsAmError(t, amerrors.ErrSkillInvalid, err)
+				return
+			}
+			tu.Ok(t, err)
+		})
+	}
+}
+
+func TestMatchSkills(t *testing.T) {
+	agent := models.Agent{AgentID: 1, Skills: []models.Skill{{Name: "language:fr", Level: 3}, {Name: "product:mobile", Level: 1}}}
+
+	var testCases = []struct {
+		description string
+		reqs        []models.SkillRequirement
+		score       int32
+		ok          bool
+	}{
+		{"no requirements", nil, 0, true},
+		{"required skill", []models.SkillRequirement{{Name: "language:fr", MinLevel: 3, Required: true}}, 0, true},
+		{"required skill below level", []models.SkillRequirement{{Name: "language:fr", MinLevel: 4, Required: true}}, 0, false},
+		{"missing required skill", []models.SkillRequirement{{Name: "language:de", Required: true}}, 0, false},
+		{"preferred skills", []models.SkillRequirement{{Name: "language:fr", Weight: 2}, {Name: "product:mobile", Weight: 5}, {Name: "language:de", Weight: 7}}, 7, true},
+		{"preferred skill below level", []models.SkillRequirement{{Name: "product:mobile", MinLevel: 2, Weight: 5}}, 0, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			score, ok := agent.MatchSkills(tc.reqs)
+			tu.Equals(t, tc.ok, ok)
+			tu.Equals(t, tc.score, score)
+		})
+	}
+}
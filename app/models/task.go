@@ -4,37 +4,259 @@ package models
 // Agent Model / Mongo Calls
 
 import (
+	"context"
 	"strconv"
 	"time"
 
 	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
+// archivedTasksCollection finished tasks are moved here by ArchiveTasks
+const archivedTasksCollection = "archivedtasks"
+
+// TaskStatus is where a task is in its lifecycle
+type TaskStatus string
+
+const (
+	// TaskQueued task is waiting for agents to be offered to
+	TaskQueued TaskStatus = "queued"
+	// TaskOffered task has been offered to candidate agents (see AddTask)
+	TaskOffered TaskStatus = "offered"
+	// TaskAccepted task has been accepted by an agent (see AcceptTask)
+	TaskAccepted TaskStatus = "accepted"
+	// TaskInProgress the accepting agent is connected to the customer
+	TaskInProgress TaskStatus = "in-progress"
+	// TaskCompleted task was completed by the accepting agent (see CompleteTask)
+	TaskCompleted TaskStatus = "completed"
+	// TaskAbandoned the customer gave up (e.g. hung up) before the task was completed
+	TaskAbandoned TaskStatus = "abandoned"
+	// TaskCancelled task was cancelled before it was completed
+	TaskCancelled TaskStatus = "cancelled"
+)
+
+// taskStatusTransitions are the statuses a task can move to from each status
+// completed, abandoned and cancelled are final
+var taskStatusTransitions = map[TaskStatus][]TaskStatus{
+	TaskQueued:     {TaskOffered, TaskAbandoned, TaskCancelled},
+	TaskOffered:    {TaskQueued, TaskAccepted, TaskAbandoned, TaskCancelled},
+	TaskAccepted:   {TaskInProgress, TaskCompleted, TaskAbandoned, TaskCancelled},
+	TaskInProgress: {TaskCompleted, TaskAbandoned, TaskCancelled},
+	TaskCompleted:  {},
+	TaskAbandoned:  {},
+	TaskCancelled:  {},
+}
+
+// taskStatusTimestamps is the field recording when a task moved to each status
+// (queued tasks use addedat)
+var taskStatusTimestamps = map[TaskStatus]string{
+	TaskOffered:    "offeredat",
+	TaskAccepted:   "acceptedat",
+	TaskInProgress: "startedat",
+	TaskCompleted:  "completedat",
+	TaskAbandoned:  "abandonedat",
+	TaskCancelled:  "cancelledat",
+}
+
+// ParseTaskStatus returns the TaskStatus for name or ErrTaskStatusInvalid if unknown
+func ParseTaskStatus(name string) (TaskStatus, error) {
+	status := TaskStatus(name)
+	if _, ok := taskStatusTransitions[status]; !ok {
+		return "", amerrors.ErrTaskStatusInvalidError("unknown task status: " + name)
+	}
+	return status, nil
+}
+
+// CanTransitionTask returns whether a task in status from can move to status to
+func CanTransitionTask(from TaskStatus, to TaskStatus) bool {
+	for _, status := range taskStatusTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
 // Task - models for phone task note bson uses int32 a lot
+// AgentIDs are the candidate agents the task is offered to. Once accepted
+// AgentIDs only contains the accepting agent and the others are moved to ReleasedAgentIDs
+// RequiredSkills are the skills an agent needs for the task (see SkillRequirement)
+// Each status change is timestamped (see taskStatusTimestamps)
 type Task struct {
-	TaskID   int32     `bson:"_id" json:"_id"`
-	CustID   int32     `bson:"custid" json:"custid"`
-	AgentIDs []int32   `bson:"agentids" json:"agentids"`
-	AddedAt  time.Time `bson:"addedat" json:"addedat"`
+	TaskID           int32              `bson:"_id" json:"_id"`
+	CustID           int32              `bson:"custid" json:"custid"`
+	AgentIDs         []int32            `bson:"agentids" json:"agentids"`
+	RequiredSkills   []SkillRequirement `bson:"requiredskills,omitempty" json:"requiredskills"`
+	Status           TaskStatus         `bson:"status,omitempty" json:"status"`
+	AddedAt          time.Time          `bson:"addedat" json:"addedat"`
+	OfferedAt        time.Time          `bson:"offeredat,omitempty" json:"offeredat"`
+	AcceptedBy       int32              `bson:"acceptedby" json:"acceptedby"`
+	AcceptedAt       time.Time          `bson:"acceptedat,omitempty" json:"acceptedat"`
+	ReleasedAgentIDs []int32            `bson:"releasedagentids,omitempty" json:"releasedagentids"`
+	StartedAt        time.Time          `bson:"startedat,omitempty" json:"startedat"`
+	CompletedAt      time.Time          `bson:"completedat,omitempty" json:"completedat"`
+	AbandonedAt      time.Time          `bson:"abandonedat,omitempty" json:"abandonedat"`
+	CancelledAt      time.Time          `bson:"cancelledat,omitempty" json:"cancelledat"`
+}
+
+// CurrentStatus returns the task status. Tasks created before task statuses
+// have no status so it is worked out from the timestamps
+func (t Task) CurrentStatus() TaskStatus {
+	switch {
+	case t.Status != "":
+		return t.Status
+	case !t.CompletedAt.IsZero():
+		return TaskCompleted
+	case t.AcceptedBy != 0:
+		return TaskAccepted
+	case len(t.AgentIDs) > 0:
+		return TaskOffered
+	}
+	return TaskQueued
+}
+
+// endedAt returns when the task was completed, abandoned or cancelled (zero if it has not ended)
+func (t Task) endedAt() time.Time {
+	switch {
+	case !t.CompletedAt.IsZero():
+		return t.CompletedAt
+	case !t.AbandonedAt.IsZero():
+		return t.AbandonedAt
+	}
+	return t.CancelledAt
+}
+
+// WaitTime is how long the customer waited for an agent to accept the task
+// (until it ended if it was never accepted, zero while still waiting)
+func (t Task) WaitTime() time.Duration {
+	if !t.AcceptedAt.IsZero() {
+		return t.AcceptedAt.Sub(t.AddedAt)
+	}
+	if ended := t.endedAt(); !ended.IsZero() {
+		return ended.Sub(t.AddedAt)
+	}
+	return 0
+}
+
+// HandleTime is how long the accepting agent spent on the task
+// (zero if it was never accepted or has not ended)
+func (t Task) HandleTime() time.Duration {
+	ended := t.endedAt()
+	if t.AcceptedAt.IsZero() || ended.IsZero() {
+		return 0
+	}
+	return ended.Sub(t.AcceptedAt)
+}
+
+// TaskFilter selects tasks for ListTasks (zero values match any task)
+// Tasks created before task statuses only match an empty Status
+type TaskFilter struct {
+	CustID  int32
+	AgentID int32
+	Status  TaskStatus
+}
+
+func (f TaskFilter) selector() bson.M {
+	selector := bson.M{}
+	if f.CustID != 0 {
+		selector["custid"] = f.CustID
+	}
+	if f.AgentID != 0 {
+		selector["agentids"] = f.AgentID
+	}
+	if f.Status != "" {
+		selector["status"] = f.Status
+	}
+	return selector
+}
+
+// statusSelector matches tasks in status from (or with no status, see CurrentStatus)
+func statusSelector(from ...TaskStatus) bson.M {
+	statuses := []interface{}{nil}
+	for _, status := range from {
+		statuses = append(statuses, status)
+	}
+	return bson.M{"$in": statuses}
+}
+
+// statusUpdate is the $set moving a task to status to at time now
+func statusUpdate(to TaskStatus, now time.Time) bson.M {
+	update := bson.M{"status": to}
+	if field, ok := taskStatusTimestamps[to]; ok {
+		update[field] = now
+	}
+	return update
+}
+
+// setStatus sets the status and its timestamp on t
+func (t *Task) setStatus(to TaskStatus, now time.Time) {
+	t.Status = to
+	switch to {
+	case TaskOffered:
+		t.OfferedAt = now
+	case TaskAccepted:
+		t.AcceptedAt = now
+	case TaskInProgress:
+		t.StartedAt = now
+	case TaskCompleted:
+		t.CompletedAt = now
+	case TaskAbandoned:
+		t.AbandonedAt = now
+	case TaskCancelled:
+		t.CancelledAt = now
+	}
+}
+
+// newTask returns a task for custID needing skills offered to agentIDs (queued if there are none)
+func newTask(taskID int32, custID int32, agentIDs []int32, skills []SkillRequirement) *Task {
+	now := NowFunc()
+	task := &Task{
+		TaskID:         taskID,
+		CustID:         custID,
+		AgentIDs:       agentIDs,
+		RequiredSkills: skills,
+		Status:         TaskQueued,
+		AddedAt:        now,
+	}
+	if len(agentIDs) > 0 {
+		task.setStatus(TaskOffered, now)
+	}
+	return task
+}
+
+// releasedAgentIDs returns the candidate agents other than agentID
+func releasedAgentIDs(agentIDs []int32, agentID int32) []int32 {
+	var released []int32
+	for _, id := range agentIDs {
+		if id != agentID {
+			released = append(released, id)
+		}
+	}
+	return released
 }
 
 // Mongo Calls
 
 // AddTask add a task to mongo and returns the newly created Task's id if successful
-func (db *MongoDatabase) AddTask(custID int32, agentIDs []int32) (int32, error) {
+func (db *MongoDatabase) AddTask(ctx context.Context, custID int32, agentIDs []int32, skills []SkillRequirement) (int32, error) {
 	if custID <= 0 {
 		return 0, amerrors.ErrCustIDInvalidError("Invalid Cust ID: " + strconv.Itoa(int(custID)))
 	}
 
-	taskID, err := db.GetNextSequence("taskid")
+	if err := ValidateSkillRequirements(skills); err != nil {
+		return 0, err
+	}
+
+	taskID, err := db.GetNextSequence(ctx, "taskid")
+
+	if err != nil {
+		return 0, dbError(ctx, err)
+	}
+
 	logger.Log("level", "debug", "msg", "Created new sequence "+strconv.Itoa(int(taskID)))
 
-	err = db.C("tasks").Insert(&Task{
-		TaskID:   taskID,
-		CustID:   custID,
-		AgentIDs: agentIDs,
-		AddedAt:  NowFunc(),
-	})
+	err = db.c(ctx, "tasks").Insert(newTask(taskID, custID, agentIDs, skills))
 
 	if err != nil {
 		return 0, err
@@ -42,3 +264,317 @@ func (db *MongoDatabase) AddTask(custID int32, agentIDs []int32) (int32, error)
 
 	return taskID, nil
 }
+
+// AcceptTask marks the task as accepted by agentID (recording when) and releases
+// the other candidate agents. The update only applies if the task has not
+// already been accepted and was offered to agentID so concurrent accepts are safe.
+// Cancelled and abandoned tasks cannot be accepted.
+func (db *MongoDatabase) AcceptTask(ctx context.Context, taskID int32, agentID int32) (Task, error) {
+	var task Task
+
+	selector := bson.M{
+		"_id":        taskID,
+		"agentids":   agentID,
+		"acceptedby": bson.M{"$in": []interface{}{0, nil}},
+		"status":     statusSelector(TaskOffered),
+	}
+
+	// Find the task first so we know which candidates to release
+	err := db.c(ctx, "tasks").Find(selector).One(&task)
+
+	if err == nil {
+		task.AcceptedBy = agentID
+		task.setStatus(TaskAccepted, NowFunc())
+		task.ReleasedAgentIDs = releasedAgentIDs(task.AgentIDs, agentID)
+		task.AgentIDs = []int32{agentID}
+
+		err = db.c(ctx, "tasks").Update(selector, bson.M{"$set": bson.M{
+			"status":           task.Status,
+			"acceptedby":       task.AcceptedBy,
+			"acceptedat":       task.AcceptedAt,
+			"agentids":         task.AgentIDs,
+			"releasedagentids": task.ReleasedAgentIDs,
+		}})
+	}
+
+	if err == mgo.ErrNotFound {
+		return Task{}, db.acceptTaskError(ctx, taskID, agentID)
+	}
+
+	if err != nil {
+		return Task{}, err
+	}
+
+	return task, nil
+}
+
+// acceptTaskError works out why a task could not be accepted
+func (db *MongoDatabase) acceptTaskError(ctx context.Context, taskID int32, agentID int32) error {
+	var task Task
+
+	err := db.c(ctx, "tasks").FindId(taskID).One(&task)
+
+	if err == mgo.ErrNotFound {
+		return amerrors.ErrTaskNotFoundError("failed to find a Task(TaskID=" + strconv.Itoa(int(taskID)) + ")")
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return taskNotAcceptableError(task, agentID)
+}
+
+// taskNotAcceptableError returns the error for a task that exists but cannot be accepted by agentID
+func taskNotAcceptableError(task Task, agentID int32) error {
+	if task.AcceptedBy != 0 {
+		return amerrors.ErrTaskAlreadyAcceptedError("Task(TaskID=" + strconv.Itoa(int(task.TaskID)) + ") already accepted by Agent(AgentID=" + strconv.Itoa(int(task.AcceptedBy)) + ")")
+	}
+
+	if status := task.CurrentStatus(); !CanTransitionTask(status, TaskAccepted) {
+		return taskStatusTransitionError(task.TaskID, status, TaskAccepted)
+	}
+
+	return amerrors.ErrTaskNotOfferedError("Task(TaskID=" + strconv.Itoa(int(task.TaskID)) + ") was not offered to Agent(AgentID=" + strconv.Itoa(int(agentID)) + ")")
+}
+
+// CompleteTask marks the task accepted by agentID as completed (recording when).
+// The update only applies if the task was accepted by agentID and has not
+// already been completed (or cancelled/abandoned).
+func (db *MongoDatabase) CompleteTask(ctx context.Context, taskID int32, agentID int32) (Task, error) {
+	var task Task
+
+	selector := bson.M{
+		"_id":         taskID,
+		"acceptedby":  agentID,
+		"completedat": nil,
+		"status":      statusSelector(TaskAccepted, TaskInProgress),
+	}
+
+	err := db.c(ctx, "tasks").Find(selector).One(&task)
+
+	if err == nil {
+		task.setStatus(TaskCompleted, NowFunc())
+		err = db.c(ctx, "tasks").Update(selector, bson.M{"$set": statusUpdate(task.Status, task.CompletedAt)})
+	}
+
+	if err == mgo.ErrNotFound {
+		return Task{}, db.completeTaskError(ctx, taskID, agentID)
+	}
+
+	if err != nil {
+		return Task{}, err
+	}
+
+	return task, nil
+}
+
+// completeTaskError works out why a task could not be completed
+func (db *MongoDatabase) completeTaskError(ctx context.Context, taskID int32, agentID int32) error {
+	var task Task
+
+	err := db.c(ctx, "tasks").FindId(taskID).One(&task)
+
+	if err == mgo.ErrNotFound {
+		return amerrors.ErrTaskNotFoundError("failed to find a Task(TaskID=" + strconv.Itoa(int(taskID)) + ")")
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return taskNotCompletableError(task, agentID)
+}
+
+// taskNotCompletableError returns the error for a task that exists but cannot be completed by agentID
+func taskNotCompletableError(task Task, agentID int32) error {
+	if task.AcceptedBy != agentID {
+		return amerrors.ErrTaskNotAcceptedError("Task(TaskID=" + strconv.Itoa(int(task.TaskID)) + ") was not accepted by Agent(AgentID=" + strconv.Itoa(int(agentID)) + ")")
+	}
+
+	if !task.CompletedAt.IsZero() {
+		return amerrors.ErrTaskAlreadyCompletedError("Task(TaskID=" + strconv.Itoa(int(task.TaskID)) + ") already completed")
+	}
+
+	return taskStatusTransitionError(task.TaskID, task.CurrentStatus(), TaskCompleted)
+}
+
+// taskStatusTransitionError returns the error for a task that cannot move from status from to status to
+func taskStatusTransitionError(taskID int32, from TaskStatus, to TaskStatus) error {
+	return amerrors.ErrTaskStatusTransitionError("Task(TaskID=" + strconv.Itoa(int(taskID)) + ") cannot go from " + string(from) + " to " + string(to))
+}
+
+// acceptedTasksSelector matches tasks accepted by any of agentIDs since since
+func acceptedTasksSelector(agentIDs []int32, since time.Time) bson.M {
+	ids := make([]interface{}, 0, len(agentIDs))
+	for _, id := range agentIDs {
+		ids = append(ids, id)
+	}
+	return bson.M{"acceptedby": bson.M{"$in": ids}, "acceptedat": bson.M{"$gte": since}}
+}
+
+// CountAcceptedTasks returns how many tasks each of agentIDs accepted since since
+// (agents with no tasks are not in the map)
+func (db *MongoDatabase) CountAcceptedTasks(ctx context.Context, agentIDs []int32, since time.Time) (map[int32]int, error) {
+	counts := make(map[int32]int)
+
+	var tasks []Task
+	err := db.c(ctx, "tasks").Find(acceptedTasksSelector(agentIDs, since)).Select(bson.M{"acceptedby": 1}).All(&tasks)
+
+	if err != nil {
+		return counts, err
+	}
+
+	for _, task := range tasks {
+		counts[task.AcceptedBy]++
+	}
+
+	return counts, nil
+}
+
+// GetTask returns the task with task ID
+func (db *MongoDatabase) GetTask(ctx context.Context, taskID int32) (Task, error) {
+	var task Task
+
+	err := db.c(ctx, "tasks").FindId(taskID).One(&task)
+
+	if err == mgo.ErrNotFound {
+		return Task{}, amerrors.ErrTaskNotFoundError("failed to find a Task(TaskID=" + strconv.Itoa(int(taskID)) + ")")
+	}
+
+	if err != nil {
+		return Task{}, err
+	}
+
+	task.Status = task.CurrentStatus()
+	return task, nil
+}
+
+// ListTasks returns the tasks matching filter (oldest first, limit 0 is no limit)
+func (db *MongoDatabase) ListTasks(ctx context.Context, filter TaskFilter, limit int32) ([]Task, error) {
+	var tasks []Task
+
+	err := db.c(ctx, "tasks").Find(filter.selector()).Sort("_id").Limit(int(limit)).All(&tasks)
+
+	if err != nil {
+		return tasks, err
+	}
+
+	for i := range tasks {
+		tasks[i].Status = tasks[i].CurrentStatus()
+	}
+
+	return tasks, nil
+}
+
+// SetTaskStatus moves the task from status from to status to (only if it is
+// still in status from) recording when. Returns the updated task.
+func (db *MongoDatabase) SetTaskStatus(ctx context.Context, taskID int32, from TaskStatus, to TaskStatus) (Task, error) {
+	task, err := db.GetTask(ctx, taskID)
+
+	if err != nil {
+		return Task{}, err
+	}
+
+	if task.Status != from {
+		return Task{}, taskStatusTransitionError(taskID, from, to)
+	}
+
+	now := NowFunc()
+	task.setStatus(to, now)
+
+	err = db.c(ctx, "tasks").Update(bson.M{"_id": taskID, "status": statusSelector(from)}, bson.M{"$set": statusUpdate(to, now)})
+
+	if err == mgo.ErrNotFound {
+		return Task{}, taskStatusTransitionError(taskID, from, to)
+	}
+
+	if err != nil {
+		return Task{}, err
+	}
+
+	return task, nil
+}
+
+// OfferTask offers the queued task to agentIDs (recording when). The update
+// only applies if the task is still queued. Returns the updated task.
+func (db *MongoDatabase) OfferTask(ctx context.Context, taskID int32, agentIDs []int32) (Task, error) {
+	task, err := db.GetTask(ctx, taskID)
+
+	if err != nil {
+		return Task{}, err
+	}
+
+	if task.Status != TaskQueued {
+		return Task{}, taskStatusTransitionError(taskID, task.Status, TaskOffered)
+	}
+
+	task.AgentIDs = agentIDs
+	task.setStatus(TaskOffered, NowFunc())
+
+	err = db.c(ctx, "tasks").Update(bson.M{"_id": taskID, "status": statusSelector(TaskQueued)}, bson.M{"$set": offerUpdate(task)})
+
+	if err == mgo.ErrNotFound {
+		return Task{}, taskStatusTransitionError(taskID, TaskQueued, TaskOffered)
+	}
+
+	if err != nil {
+		return Task{}, err
+	}
+
+	return task, nil
+}
+
+// offerUpdate is the $set offering task to its agents
+func offerUpdate(task Task) bson.M {
+	return bson.M{
+		"status":    task.Status,
+		"offeredat": task.OfferedAt,
+		"agentids":  task.AgentIDs,
+	}
+}
+
+// endedTaskFields are the timestamps of the final task statuses
+var endedTaskFields = []string{"completedat", "abandonedat", "cancelledat"}
+
+// ArchiveTasks moves tasks completed, abandoned or cancelled before before into
+// the archived tasks collection and returns how many. With dryRun nothing is moved.
+func (db *MongoDatabase) ArchiveTasks(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	archived := 0
+
+	for _, field := range endedTaskFields {
+		selector := bson.M{field: bson.M{"$lt": before}}
+
+		if dryRun {
+			n, err := db.c(ctx, "tasks").Find(selector).Count()
+			if err != nil {
+				return archived, err
+			}
+			archived += n
+			continue
+		}
+
+		var tasks []Task
+		err := db.c(ctx, "tasks").Find(selector).All(&tasks)
+
+		if err != nil {
+			return archived, err
+		}
+
+		for _, task := range tasks {
+			// A previous run may have archived the task but failed to remove it
+			err = db.c(ctx, archivedTasksCollection).Insert(&task)
+			if err != nil && !mgo.IsDup(err) {
+				return archived, err
+			}
+
+			err = db.c(ctx, "tasks").Remove(bson.M{"_id": task.TaskID})
+			if err != nil && err != mgo.ErrNotFound {
+				return archived, err
+			}
+			archived++
+		}
+	}
+
+	return archived, nil
+}
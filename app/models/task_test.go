@@ -3,15 +3,16 @@ package models_test
 // Basic property tests for task.go
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"testing"
 	"testing/quick"
+	"time"
 
 	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
 	"github.com/newtonsystems/agent-mgmt/app/models"
 	tu "github.com/newtonsystems/agent-mgmt/app/testutil"
-	"gopkg.in/mgo.v2/bson"
 )
 
 func TestAddTaskCustIDStaysSame(t *testing.T) {
@@ -29,11 +30,10 @@ func TestAddTaskCustIDStaysSame(t *testing.T) {
 			return true
 		}
 
-		_, err := db.AddTask(custID, agentIDs)
+		taskID, err := db.AddTask(context.Background(), custID, agentIDs, nil)
 		tu.Ok(t, err)
 
-		var task models.Task
-		err = db.C("tasks").Find(bson.M{"custid": custID}).Select(bson.M{"custid": 1}).One(&task)
+		task, err := db.GetTask(context.Background(), taskID)
 		tu.Ok(t, err)
 
 		return custID == task.CustID
@@ -59,13 +59,15 @@ func TestAddTaskAgentIDsStaysSame(t *testing.T) {
 			return true
 		}
 
-		_, err := db.AddTask(custID, agentIDs)
+		taskID, err := db.AddTask(context.Background(), custID, agentIDs, nil)
 		tu.Ok(t, err)
 
-		var task models.Task
-		err = db.C("tasks").Find(bson.M{"agentids": agentIDs}).Select(bson.M{"agentids": 1}).One(&task)
+		task, err := db.GetTask(context.Background(), taskID)
 		tu.Ok(t, err)
 
+		if len(agentIDs) == 0 {
+			return len(task.AgentIDs) == 0
+		}
 		return reflect.DeepEqual(agentIDs, task.AgentIDs)
 	}
 
@@ -91,7 +93,7 @@ func TestAddTaskCustIDInvalid(t *testing.T) {
 			return true
 		}
 
-		taskID, err := db.AddTask(custID, agentIDs)
+		taskID, err := db.AddTask(context.Background(), custID, agentIDs, nil)
 
 		return amerrors.Is(err, amerrors.ErrCustIDInvalid) && taskID == 0
 	}
@@ -114,20 +116,18 @@ func TestAddTaskTaskIDIncrements(t *testing.T) {
 		}
 
 		// What was the original taskid
-		var counter models.Count
-		errCount := db.C("counters").Find(bson.M{"_id": "taskid"}).Select(bson.M{"seq": 1}).One(&counter)
-		tu.Ok(t, errCount)
+		seq, err := db.GetNextSequence(context.Background(), "taskid")
+		tu.Ok(t, err)
 
 		// AddTask
-		taskID, err := db.AddTask(custID, agentIDs)
+		taskID, err := db.AddTask(context.Background(), custID, agentIDs, nil)
 		tu.Ok(t, err)
 
 		// Check DB
-		var task models.Task
-		err = db.C("tasks").Find(bson.M{"_id": taskID}).Select(bson.M{"_id": 1}).One(&task)
+		task, err := db.GetTask(context.Background(), taskID)
 		tu.Ok(t, err)
 
-		return counter.Seq+1 == taskID && taskID == taskID
+		return seq+1 == taskID && task.TaskID == taskID
 	}
 
 	err := quick.Check(assertion, nil)
@@ -135,6 +135,26 @@ func TestAddTaskTaskIDIncrements(t *testing.T) {
 
 }
 
+func TestAddTaskCounterNotFound(t *testing.T) {
+	if *tu.Postgres {
+		t.Skip("postgres has no counters collection")
+	}
+	session, _ := tu.NewTestMongoConnection(*tu.Debug, *tu.OutsideConn)
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	// A database that was never migrated has no counters
+	db := session.DB(tu.MongoDBName + "_unmigrated")
+	defer db.DropDatabase()
+
+	taskID, err := db.AddTask(context.Background(), 1, []int32{1}, nil)
+	tu.IsAmError(t, amerrors.ErrCounterNotFound, err)
+	tu.Equals(t, int32(0), taskID)
+
+	// No task was added without an ID
+	count, _ := db.C("tasks").Count()
+	tu.Equals(t, 0, count)
+}
+
 func TestAddTask(t *testing.T) {
 
 	testCases := []struct {
@@ -162,10 +182,109 @@ func TestAddTask(t *testing.T) {
 
 		t.Run(tc.description, func(t *testing.T) {
 			// NOTE: We dont clean up after every test (so seq increases)
-			taskID, err := db.AddTask(tc.custID, tc.agentIDs)
+			taskID, err := db.AddTask(context.Background(), tc.custID, tc.agentIDs, nil)
 			tu.Equals(t, tc.expectedTaskID, taskID)
 			tu.IsAmError(t, tc.expectedErr, err)
 		})
 	}
 
 }
+
+func TestOfferTask(t *testing.T) {
+	session, db := tu.NewTestMongoConnection(*tu.Debug, *tu.OutsideConn)
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	ctx := context.Background()
+
+	// A task added without agents is queued until it is offered
+	taskID, err := db.AddTask(ctx, 1, nil, nil)
+	tu.Ok(t, err)
+	task, err := db.GetTask(ctx, taskID)
+	tu.Ok(t, err)
+	tu.Equals(t, models.TaskQueued, task.Status)
+
+	task, err = db.OfferTask(ctx, taskID, []int32{1, 2})
+	tu.Ok(t, err)
+	tu.Equals(t, models.TaskOffered, task.Status)
+	tu.Equals(t, []int32{1, 2}, task.AgentIDs)
+	tu.Assert(t, !task.OfferedAt.IsZero(), "expected when the task was offered")
+
+	task, err = db.GetTask(ctx, taskID)
+	tu.Ok(t, err)
+	tu.Equals(t, models.TaskOffered, task.Status)
+	tu.Equals(t, []int32{1, 2}, task.AgentIDs)
+
+	// Only queued tasks are offered
+	_, err = db.OfferTask(ctx, taskID, []int32{3})
+	tu.IsAmError(t, amerrors.ErrTaskStatusTransition, err)
+
+	// The offered agents can accept it
+	task, err = db.AcceptTask(ctx, taskID, 2)
+	tu.Ok(t, err)
+	tu.Equals(t, models.TaskAccepted, task.Status)
+
+	_, err = db.OfferTask(ctx, 1000, []int32{1})
+	tu.IsAmError(t, amerrors.ErrTaskNotFound, err)
+}
+
+func TestCanTransitionTask(t *testing.T) {
+	testCases := []struct {
+		from     models.TaskStatus
+		to       models.TaskStatus
+		expected bool
+	}{
+		{models.TaskQueued, models.TaskOffered, true},
+		{models.TaskQueued, models.TaskAccepted, false},
+		{models.TaskOffered, models.TaskAccepted, true},
+		{models.TaskOffered, models.TaskQueued, true},
+		{models.TaskAccepted, models.TaskInProgress, true},
+		{models.TaskAccepted, models.TaskCompleted, true},
+		{models.TaskInProgress, models.TaskCompleted, true},
+		{models.TaskInProgress, models.TaskAccepted, false},
+		{models.TaskOffered, models.TaskAbandoned, true},
+		{models.TaskAccepted, models.TaskCancelled, true},
+		{models.TaskCompleted, models.TaskCancelled, false},
+		{models.TaskCancelled, models.TaskOffered, false},
+		{models.TaskAbandoned, models.TaskCancelled, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(string(tc.from)+"->"+string(tc.to), func(t *testing.T) {
+			tu.Equals(t, tc.expected, models.CanTransitionTask(tc.from, tc.to))
+		})
+	}
+
+	_, err := models.ParseTaskStatus("lost")
+	tu.IsAmError(t, amerrors.ErrTaskStatusInvalid, err)
+
+	status, err := models.ParseTaskStatus("in-progress")
+	tu.Ok(t, err)
+	tu.Equals(t, models.TaskInProgress, status)
+}
+
+func TestTaskTimes(t *testing.T) {
+	added := time.Date(2017, time.September, 21, 17, 50, 0, 0, time.UTC)
+
+	testCases := []struct {
+		description    string
+		task           models.Task
+		expectedStatus models.TaskStatus
+		expectedWait   time.Duration
+		expectedHandle time.Duration
+	}{
+		{"queued", models.Task{AddedAt: added}, models.TaskQueued, 0, 0},
+		{"offered", models.Task{AgentIDs: []int32{1}, AddedAt: added}, models.TaskOffered, 0, 0},
+		{"accepted", models.Task{AgentIDs: []int32{1}, AddedAt: added, AcceptedBy: 1, AcceptedAt: added.Add(20 * time.Second)}, models.TaskAccepted, 20 * time.Second, 0},
+		{"completed", models.Task{AgentIDs: []int32{1}, AddedAt: added, AcceptedBy: 1, AcceptedAt: added.Add(20 * time.Second), CompletedAt: added.Add(5 * time.Minute)}, models.TaskCompleted, 20 * time.Second, 4*time.Minute + 40*time.Second},
+		{"abandoned", models.Task{Status: models.TaskAbandoned, AddedAt: added, AbandonedAt: added.Add(time.Minute)}, models.TaskAbandoned, time.Minute, 0},
+		{"cancelled_on_call", models.Task{Status: models.TaskCancelled, AddedAt: added, AcceptedBy: 1, AcceptedAt: added.Add(10 * time.Second), CancelledAt: added.Add(time.Minute)}, models.TaskCancelled, 10 * time.Second, 50 * time.Second},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			tu.Equals(t, tc.expectedStatus, tc.task.CurrentStatus())
+			tu.Equals(t, tc.expectedWait, tc.task.WaitTime())
+			tu.Equals(t, tc.expectedHandle, tc.task.HandleTime())
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package reaper
+
+// reaper.go
+// Background cleanup of the database: agents that missed their heartbeats
+// are marked offline, old phone sessions are deleted and completed tasks
+// are archived. Every tenant's database is cleaned up.
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	mgo "gopkg.in/mgo.v2"
+
+	"github.com/newtonsystems/agent-mgmt/app/config"
+	"github.com/newtonsystems/agent-mgmt/app/heartbeat"
+	"github.com/newtonsystems/agent-mgmt/app/models"
+	"github.com/newtonsystems/agent-mgmt/app/tenant"
+	"github.com/newtonsystems/agent-mgmt/app/watch"
+)
+
+type nowFuncT func() time.Time
+
+var NowFunc nowFuncT
+
+func init() {
+	NowFunc = func() time.Time {
+		return time.Now()
+	}
+}
+
+// Metrics counts what the reaper changed (labelled with dry_run and tenant)
+type Metrics struct {
+	AgentsOfflined       metrics.Counter
+	PhoneSessionsDeleted metrics.Counter
+	TasksArchived        metrics.Counter
+}
+
+// NewMetrics returns the prometheus reaper counters
+func NewMetrics() Metrics {
+	return Metrics{
+		AgentsOfflined: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "example",
+			Subsystem: "agentmgmt",
+			Name:      "reaper_agents_offlined",
+			Help:      "Total count of agents marked offline by the reaper after missed heartbeats.",
+		}, []string{"dry_run", "tenant"}),
+		PhoneSessionsDeleted: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "example",
+			Subsystem: "agentmgmt",
+			Name:      "reaper_phonesessions_deleted",
+			Help:      "Total count of expired phone sessions deleted by the reaper.",
+		}, []string{"dry_run", "tenant"}),
+		TasksArchived: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "example",
+			Subsystem: "agentmgmt",
+			Name:      "reaper_tasks_archived",
+			Help:      "Total count of completed tasks archived by the reaper.",
+		}, []string{"dry_run", "tenant"}),
+	}
+}
+
+// Result is what a single reaper pass changed (or would change in dry run)
+type Result struct {
+	AgentsOfflined       int
+	PhoneSessionsDeleted int
+	TasksArchived        int
+}
+
+// Reaper periodically cleans up the database
+type Reaper struct {
+	cfg     config.Config
+	session models.Session
+	db      string
+	logger  log.Logger
+	metrics *Metrics
+	events  *watch.Hub
+	beats   *heartbeat.Buffer
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// New returns a Reaper for db, or each of cfg.Tenants' databases (see
+// tenant.Database) (metrics may be nil)
+// Agents marked offline are published to events as stale (events may be nil)
+// and forgotten by beats so their next heartbeat makes them available again
+// (beats may be nil)
+func New(cfg config.Config, session models.Session, db string, logger log.Logger, metrics *Metrics, events *watch.Hub, beats *heartbeat.Buffer) *Reaper {
+	return &Reaper{
+		cfg:     cfg,
+		session: session,
+		db:      db,
+		logger:  logger,
+		metrics: metrics,
+		events:  events,
+		beats:   beats,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Reap runs a single cleanup pass over every tenant. A tenant whose pass
+// fails does not stop the others (the first error is returned).
+func (r *Reaper) Reap(ctx context.Context) (Result, error) {
+	var (
+		result   Result
+		firstErr error
+	)
+
+	// NOTE: Concurrent requests will not work otherwises
+	// Request a socket connection from the session to process our query.
+	// Close the session when the goroutine exits and put the connection back
+	// into the pool.
+	sessionCopy := r.session.Copy()
+	sessionCopy.SetMode(mgo.Strong, false)
+	defer sessionCopy.Close()
+
+	for _, id := range tenant.All(r.cfg.Tenants) {
+		reaped, err := r.reap(ctx, sessionCopy.DB(tenant.Database(r.db, id)), id)
+		result.AgentsOfflined += reaped.AgentsOfflined
+		result.PhoneSessionsDeleted += reaped.PhoneSessionsDeleted
+		result.TasksArchived += reaped.TasksArchived
+
+		if err != nil {
+			r.logger.Log("level", "err", "msg", "Reaper pass failed", "tenant", id, "err", err)
+			// Otherwise every later pass would use the dead socket
+			if models.RefreshOnError(r.session, err) {
+				r.logger.Log("level", "warn", "msg", "Refreshed the mongo session after a connection error", "err", err)
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return result, firstErr
+}
+
+// reap runs a single cleanup pass over tenant id's database dl
+func (r *Reaper) reap(ctx context.Context, dl models.DataLayer, id string) (Result, error) {
+	var result Result
+
+	now := NowFunc()
+	dryRun := r.cfg.ReaperDryRun
+
+	// Agents that are no longer available have missed their heartbeats
+	agentIDs, err := dl.ExpireAgents(ctx, r.cfg.AvailableSince(now), dryRun)
+	if err != nil {
+		return result, err
+	}
+	result.AgentsOfflined = len(agentIDs)
+
+	if !dryRun {
+		var events []watch.Event
+		for _, agentID := range agentIDs {
+			events = append(events, watch.Event{Type: watch.EventStale, Tenant: id, AgentID: agentID, At: now})
+			r.beats.Forget(id, agentID)
+		}
+		r.events.Publish(events...)
+	}
+
+	if result.PhoneSessionsDeleted, err = dl.ExpirePhoneSessions(ctx, now.Add(-r.cfg.PhoneSessionTTL), dryRun); err != nil {
+		return result, err
+	}
+	if result.TasksArchived, err = dl.ArchiveTasks(ctx, now.Add(-r.cfg.TaskArchiveAfter), dryRun); err != nil {
+		return result, err
+	}
+
+	if r.metrics != nil {
+		label := strconv.FormatBool(dryRun)
+		r.metrics.AgentsOfflined.With("dry_run", label, "tenant", id).Add(float64(result.AgentsOfflined))
+		r.metrics.PhoneSessionsDeleted.With("dry_run", label, "tenant", id).Add(float64(result.PhoneSessionsDeleted))
+		r.metrics.TasksArchived.With("dry_run", label, "tenant", id).Add(float64(result.TasksArchived))
+	}
+
+	return result, nil
+}
+
+// Run reaps every cfg.ReaperInterval until Stop is called
+// (returns immediately if the reaper is disabled)
+func (r *Reaper) Run() {
+	defer close(r.done)
+
+	if r.cfg.ReaperInterval <= 0 {
+		r.logger.Log("level", "info", "msg", "Reaper disabled")
+		return
+	}
+
+	r.logger.Log("level", "info", "msg", "Reaper started", "interval", r.cfg.ReaperInterval, "dry_run", r.cfg.ReaperDryRun)
+
+	ticker := time.NewTicker(r.cfg.ReaperInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			result, err := r.Reap(context.Background())
+			if err != nil {
+				// Reap logged the tenants whose pass failed
+				continue
+			}
+			r.logger.Log("level", "debug", "msg", "Reaper pass finished", "dry_run", r.cfg.ReaperDryRun,
+				"agents_offlined", result.AgentsOfflined, "phonesessions_deleted", result.PhoneSessionsDeleted, "tasks_archived", result.TasksArchived)
+		case <-r.stop:
+			r.logger.Log("level", "info", "msg", "Reaper stopped")
+			return
+		}
+	}
+}
+
+// Stop stops Run and waits for the current pass to finish
+func (r *Reaper) Stop() {
+	r.stopOnce.Do(func() { close(r.stop) })
+	<-r.done
+}
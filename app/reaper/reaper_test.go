@@ -0,0 +1,140 @@
+package reaper_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+
+	"github.com/newtonsystems/agent-mgmt/app/config"
+	"github.com/newtonsystems/agent-mgmt/app/models"
+	"github.com/newtonsystems/agent-mgmt/app/reaper"
+	tu "github.com/newtonsystems/agent-mgmt/app/testutil"
+	"github.com/newtonsystems/agent-mgmt/app/watch"
+)
+
+// dryRunCounter records the total added per dry_run label value
+// (generic.Counter does not share its value with the counters from With)
+type dryRunCounter struct {
+	totals map[string]float64
+	label  string
+}
+
+func newDryRunCounter() *dryRunCounter {
+	return &dryRunCounter{totals: map[string]float64{}}
+}
+
+func (c *dryRunCounter) With(labelValues ...string) metrics.Counter {
+	return &dryRunCounter{totals: c.totals, label: labelValues[1]}
+}
+
+func (c *dryRunCounter) Add(delta float64) {
+	c.totals[c.label] += delta
+}
+
+func insertStale(t *testing.T, db models.DataLayer, now time.Time) {
+	tu.Ok(t, db.C("agents").Insert(
+		&models.Agent{AgentID: 1, State: models.AgentAvailable, LastHeartBeat: now},
+		&models.Agent{AgentID: 2, State: models.AgentAvailable, LastHeartBeat: now.Add(-2 * time.Minute)},
+	))
+	tu.Ok(t, db.C("phonesessions").Insert(
+		&models.PhoneSession{SessID: 1, AgentID: 1, RefID: "ref1", CreatedAt: now.Add(-48 * time.Hour)},
+	))
+	tu.Ok(t, db.C("tasks").Insert(
+		&models.Task{TaskID: 1, CustID: 1, AddedAt: now, AcceptedBy: 1, CompletedAt: now.Add(-48 * time.Hour)},
+	))
+}
+
+func TestReap(t *testing.T) {
+	now := time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)
+	reaper.NowFunc = func() time.Time { return now }
+	defer func() { reaper.NowFunc = time.Now }()
+
+	testCases := []struct {
+		description string
+		dryRun      bool
+	}{
+		{"dry_run", true},
+		{"reap", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			session, db := tu.NewTestMemoryConnection()
+			defer tu.CleanUpTestMongoConnection(t, session)
+			insertStale(t, db, now)
+
+			cfg := config.Default()
+			cfg.ReaperDryRun = tc.dryRun
+			agents, phoneSessions, tasks := newDryRunCounter(), newDryRunCounter(), newDryRunCounter()
+			metrics := reaper.Metrics{AgentsOfflined: agents, PhoneSessionsDeleted: phoneSessions, TasksArchived: tasks}
+
+			events := watch.NewHub(0)
+			watcher, err := events.Watch("")
+			tu.Ok(t, err)
+
+			result, err := reaper.New(cfg, session, tu.MongoDBName, log.NewNopLogger(), &metrics, events, nil).Reap(context.Background())
+			tu.Ok(t, err)
+			tu.Equals(t, reaper.Result{AgentsOfflined: 1, PhoneSessionsDeleted: 1, TasksArchived: 1}, result)
+
+			// Only agents actually marked offline are published as stale
+			watcher.Close()
+			var stale []int32
+			for event := range watcher.C {
+				tu.Equals(t, watch.EventStale, event.Type)
+				stale = append(stale, event.AgentID)
+			}
+			if tc.dryRun {
+				tu.Equals(t, 0, len(stale))
+			} else {
+				tu.Equals(t, []int32{2}, stale)
+			}
+
+			label := strconv.FormatBool(tc.dryRun)
+			tu.Equals(t, map[string]float64{label: 1}, agents.totals)
+			tu.Equals(t, map[string]float64{label: 1}, phoneSessions.totals)
+			tu.Equals(t, map[string]float64{label: 1}, tasks.totals)
+
+			expected := models.AgentOffline
+			if tc.dryRun {
+				expected = models.AgentAvailable
+			}
+			agent, err := db.GetAgent(context.Background(), 2)
+			tu.Ok(t, err)
+			tu.Equals(t, expected, agent.State)
+
+			agent, err = db.GetAgent(context.Background(), 1)
+			tu.Ok(t, err)
+			tu.Equals(t, models.AgentAvailable, agent.State)
+		})
+	}
+}
+
+func TestRunDisabled(t *testing.T) {
+	session, _ := tu.NewTestMemoryConnection()
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	cfg := config.Default()
+	cfg.ReaperInterval = 0
+	r := reaper.New(cfg, session, tu.MongoDBName, log.NewNopLogger(), nil, nil, nil)
+
+	// Run returns straight away and Stop must not block
+	r.Run()
+	r.Stop()
+}
+
+func TestRunStop(t *testing.T) {
+	session, _ := tu.NewTestMemoryConnection()
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	cfg := config.Default()
+	cfg.ReaperInterval = time.Millisecond
+	r := reaper.New(cfg, session, tu.MongoDBName, log.NewNopLogger(), nil, nil, nil)
+
+	go r.Run()
+	time.Sleep(5 * time.Millisecond)
+	r.Stop()
+}
@@ -0,0 +1,235 @@
+package service
+
+// auth.go
+// The auth middleware authenticates every call and only lets it through if
+// the caller may make it (see auth.Permissions). A call is always for the
+// caller's tenant (e.g. its token's tenant_id), never the one in the call's
+// metadata. Only admins may have no tenant when the service has tenants.
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/newtonsystems/agent-mgmt/app/auth"
+	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+	"github.com/newtonsystems/agent-mgmt/app/heartbeat"
+	"github.com/newtonsystems/agent-mgmt/app/models"
+	"github.com/newtonsystems/agent-mgmt/app/tenant"
+	"github.com/newtonsystems/agent-mgmt/app/watch"
+	"github.com/newtonsystems/grpc_types/go/grpc_types"
+)
+
+// AuthMiddleware returns a service middleware that authenticates every call
+// with authn and authorizes it (tenants are the service's, see
+// config.Config.Tenants). It should be the outermost middleware so the others
+// see the caller's tenant.
+func AuthMiddleware(authn auth.Authenticator, tenants []string, logger log.Logger) Middleware {
+	return func(next Service) Service {
+		return authMiddleware{authn, tenants, logger, next}
+	}
+}
+
+type authMiddleware struct {
+	authn   auth.Authenticator
+	tenants []string
+	logger  log.Logger
+	next    Service
+}
+
+// authorize returns the context of a call to method for agent id (0 if it is
+// not for an agent) by the authenticated caller or the reason it may not be made
+func (mw authMiddleware) authorize(ctx context.Context, method string, agentID int32) (context.Context, error) {
+	p, err := mw.authn.Authenticate(ctx)
+	if err == auth.ErrNoCredentials {
+		err = amerrors.ErrUnauthenticatedError("a bearer token or client certificate is required")
+	}
+	if err == nil {
+		err = auth.Authorize(p, method, agentID)
+	}
+	// e.g. a client certificate, whose agent IDs would be those of any tenant
+	if err == nil && p.Tenant == "" && len(mw.tenants) > 0 && !p.HasRole(auth.RoleAdmin) {
+		err = amerrors.ErrPermissionDeniedError("%s has no tenant", p.Subject)
+	}
+	if err != nil {
+		ContextLogger(ctx, mw.logger).Log("level", "warn", "msg", "Call refused", "method", method, "subject", p.Subject, "err", err)
+		return ctx, err
+	}
+
+	// The caller's tenant wins over the metadata even if it has none
+	ctx = tenant.NewContext(ctx, p.Tenant)
+	return auth.NewContext(ctx, p), nil
+}
+
+func (mw authMiddleware) Sum(ctx context.Context, a, b int) (int, error) {
+	ctx, err := mw.authorize(ctx, "Sum", 0)
+	if err != nil {
+		return 0, err
+	}
+	return mw.next.Sum(ctx, a, b)
+}
+
+func (mw authMiddleware) Concat(ctx context.Context, a, b string) (string, error) {
+	ctx, err := mw.authorize(ctx, "Concat", 0)
+	if err != nil {
+		return "", err
+	}
+	return mw.next.Concat(ctx, a, b)
+}
+
+func (mw authMiddleware) GetAvailableAgents(ctx context.Context, limit int32, strategy string, skills []models.SkillRequirement) ([]string, error) {
+	ctx, err := mw.authorize(ctx, "GetAvailableAgents", 0)
+	if err != nil {
+		return nil, err
+	}
+	return mw.next.GetAvailableAgents(ctx, limit, strategy, skills)
+}
+
+func (mw authMiddleware) GetAgentIDFromRef(ctx context.Context, refID string) (int32, error) {
+	ctx, err := mw.authorize(ctx, "GetAgentIDFromRef", 0)
+	if err != nil {
+		return 0, err
+	}
+	return mw.next.GetAgentIDFromRef(ctx, refID)
+}
+
+func (mw authMiddleware) HeartBeat(ctx context.Context, agentID int32) (grpc_types.HeartBeatResponse_HeartBeatStatus, time.Duration, error) {
+	ctx, err := mw.authorize(ctx, "HeartBeat", agentID)
+	if err != nil {
+		return grpc_types.HeartBeatResponse_HEARTBEAT_FAILED, 0, err
+	}
+	return mw.next.HeartBeat(ctx, agentID)
+}
+
+func (mw authMiddleware) AddTask(ctx context.Context, custID int32, agentIDs []int32, skills []models.SkillRequirement) (int32, error) {
+	ctx, err := mw.authorize(ctx, "AddTask", 0)
+	if err != nil {
+		return 0, err
+	}
+	return mw.next.AddTask(ctx, custID, agentIDs, skills)
+}
+
+func (mw authMiddleware) OfferTask(ctx context.Context, taskID int32, agentIDs []int32) (models.Task, error) {
+	ctx, err := mw.authorize(ctx, "OfferTask", 0)
+	if err != nil {
+		return models.Task{}, err
+	}
+	return mw.next.OfferTask(ctx, taskID, agentIDs)
+}
+
+func (mw authMiddleware) AcceptCall(ctx context.Context, agentID int32, taskID int32) (models.Task, error) {
+	ctx, err := mw.authorize(ctx, "AcceptCall", agentID)
+	if err != nil {
+		return models.Task{}, err
+	}
+	return mw.next.AcceptCall(ctx, agentID, taskID)
+}
+
+func (mw authMiddleware) StartTask(ctx context.Context, agentID int32, taskID int32) (models.Task, error) {
+	ctx, err := mw.authorize(ctx, "StartTask", agentID)
+	if err != nil {
+		return models.Task{}, err
+	}
+	return mw.next.StartTask(ctx, agentID, taskID)
+}
+
+func (mw authMiddleware) CompleteTask(ctx context.Context, agentID int32, taskID int32) (models.Task, error) {
+	ctx, err := mw.authorize(ctx, "CompleteTask", agentID)
+	if err != nil {
+		return models.Task{}, err
+	}
+	return mw.next.CompleteTask(ctx, agentID, taskID)
+}
+
+func (mw authMiddleware) GetTask(ctx context.Context, taskID int32) (models.Task, error) {
+	ctx, err := mw.authorize(ctx, "GetTask", 0)
+	if err != nil {
+		return models.Task{}, err
+	}
+	return mw.next.GetTask(ctx, taskID)
+}
+
+// ListTasks lets an agent list its own tasks only (agent id 0 lists everyone's)
+func (mw authMiddleware) ListTasks(ctx context.Context, custID int32, agentID int32, status string, limit int32) ([]models.Task, error) {
+	ctx, err := mw.authorize(ctx, "ListTasks", agentID)
+	if err != nil {
+		return nil, err
+	}
+	return mw.next.ListTasks(ctx, custID, agentID, status, limit)
+}
+
+func (mw authMiddleware) CancelTask(ctx context.Context, taskID int32, abandoned bool) (models.Task, error) {
+	ctx, err := mw.authorize(ctx, "CancelTask", 0)
+	if err != nil {
+		return models.Task{}, err
+	}
+	return mw.next.CancelTask(ctx, taskID, abandoned)
+}
+
+func (mw authMiddleware) SetAgentState(ctx context.Context, agentID int32, state string) error {
+	ctx, err := mw.authorize(ctx, "SetAgentState", agentID)
+	if err != nil {
+		return err
+	}
+	return mw.next.SetAgentState(ctx, agentID, state)
+}
+
+func (mw authMiddleware) SetAgentSkills(ctx context.Context, agentID int32, skills []models.Skill) (models.Agent, error) {
+	ctx, err := mw.authorize(ctx, "SetAgentSkills", agentID)
+	if err != nil {
+		return models.Agent{}, err
+	}
+	return mw.next.SetAgentSkills(ctx, agentID, skills)
+}
+
+func (mw authMiddleware) RegisterAgent(ctx context.Context) (int32, error) {
+	ctx, err := mw.authorize(ctx, "RegisterAgent", 0)
+	if err != nil {
+		return 0, err
+	}
+	return mw.next.RegisterAgent(ctx)
+}
+
+func (mw authMiddleware) DeregisterAgent(ctx context.Context, agentID int32) error {
+	ctx, err := mw.authorize(ctx, "DeregisterAgent", agentID)
+	if err != nil {
+		return err
+	}
+	return mw.next.DeregisterAgent(ctx, agentID)
+}
+
+func (mw authMiddleware) WatchAgents(ctx context.Context) ([]models.Agent, *watch.Watcher, error) {
+	ctx, err := mw.authorize(ctx, "WatchAgents", 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return mw.next.WatchAgents(ctx)
+}
+
+func (mw authMiddleware) ConnectAgent(ctx context.Context, agentID int32) (*heartbeat.Conn, time.Duration, error) {
+	ctx, err := mw.authorize(ctx, "ConnectAgent", agentID)
+	if err != nil {
+		return nil, 0, err
+	}
+	return mw.next.ConnectAgent(ctx, agentID)
+}
+
+// KeepAlive is authorized on every heartbeat so a stream ends once the
+// caller's token expires
+func (mw authMiddleware) KeepAlive(ctx context.Context, agentID int32, sinceLastBeat time.Duration) error {
+	ctx, err := mw.authorize(ctx, "KeepAlive", agentID)
+	if err != nil {
+		return err
+	}
+	return mw.next.KeepAlive(ctx, agentID, sinceLastBeat)
+}
+
+// DisconnectAgent is not authorized: the stream was when it connected and
+// has to be cleaned up either way
+func (mw authMiddleware) DisconnectAgent(ctx context.Context, conn *heartbeat.Conn) error {
+	if conn.Tenant != "" {
+		ctx = tenant.NewContext(ctx, conn.Tenant)
+	}
+	return mw.next.DisconnectAgent(ctx, conn)
+}
@@ -0,0 +1,100 @@
+package service_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/newtonsystems/agent-mgmt/app/auth"
+	"github.com/newtonsystems/agent-mgmt/app/config"
+	"github.com/newtonsystems/agent-mgmt/app/models"
+	"github.com/newtonsystems/agent-mgmt/app/service"
+	"github.com/newtonsystems/agent-mgmt/app/tenant"
+	tu "github.com/newtonsystems/agent-mgmt/app/testutil"
+	"github.com/newtonsystems/agent-mgmt/app/watch"
+)
+
+func TestAuthMiddleware(t *testing.T) {
+	session, _ := tu.NewTestMemoryConnection()
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	cfg := config.Default()
+	cfg.Tenants = []string{"acme", "globex"}
+
+	now := time.Now()
+	for _, id := range cfg.Tenants {
+		tu.Ok(t, session.DB(tenant.Database(tu.MongoDBName, id)).C("agents").Insert(
+			&models.Agent{AgentID: 1, State: models.AgentAvailable, LastHeartBeat: now},
+			&models.Agent{AgentID: 2, State: models.AgentAvailable, LastHeartBeat: now},
+		))
+	}
+
+	secret := []byte("s3cret")
+	s := service.AuthMiddleware(auth.NewJWT(secret, nil, "", ""), cfg.Tenants, logger)(
+		service.NewService(cfg, models.NewTenantRepositories(session, tu.MongoDBName, cfg.Tenants), logger, nil, watch.NewHub(watch.DefaultBuffer), nil, nil),
+	)
+
+	// withToken returns the context of a call for tenant (metadata) with a token
+	withToken := func(claims auth.Claims, tenantID string) context.Context {
+		claims.ExpiresAt = now.Add(time.Hour).Unix()
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secret)
+		tu.Ok(t, err)
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(auth.MetadataKey, "Bearer "+token, tenant.MetadataKey, tenantID))
+	}
+	// The agent's token is for acme whatever tenant its calls say they are for
+	agent := withToken(auth.Claims{StandardClaims: jwt.StandardClaims{Subject: "agent-1"}, Roles: []string{"agent"}, AgentID: 1, Tenant: "acme"}, "globex")
+	acme := withToken(auth.Claims{StandardClaims: jwt.StandardClaims{Subject: "telephony"}, Roles: []string{"dispatcher"}, Tenant: "acme"}, "acme")
+	globex := withToken(auth.Claims{StandardClaims: jwt.StandardClaims{Subject: "telephony"}, Roles: []string{"dispatcher"}, Tenant: "globex"}, "globex")
+	// Tokens without a tenant cannot pick one with the metadata
+	noTenant := withToken(auth.Claims{StandardClaims: jwt.StandardClaims{Subject: "telephony"}, Roles: []string{"dispatcher"}}, "globex")
+	noTenantAgent := withToken(auth.Claims{StandardClaims: jwt.StandardClaims{Subject: "agent-1"}, Roles: []string{"agent"}, AgentID: 1}, "globex")
+	admin := withToken(auth.Claims{StandardClaims: jwt.StandardClaims{Subject: "ops"}, Roles: []string{"admin"}}, "globex")
+
+	_, _, err := s.HeartBeat(agent, 1)
+	tu.Ok(t, err)
+	tu.Ok(t, s.SetAgentState(agent, 1, string(models.AgentOffline)))
+
+	agentIDs, err := s.GetAvailableAgents(acme, 0, "", nil)
+	tu.Ok(t, err)
+	tu.Equals(t, []string{"2"}, agentIDs)
+
+	agentIDs, err = s.GetAvailableAgents(globex, 0, "", nil)
+	tu.Ok(t, err)
+	tu.Equals(t, 2, len(agentIDs))
+
+	// An agent may only make calls for itself
+	testCases := []struct {
+		description string
+		ctx         context.Context
+		call        func(ctx context.Context) error
+		code        codes.Code
+	}{
+		{"heartbeat_other_agent", agent, func(ctx context.Context) error { _, _, err := s.HeartBeat(ctx, 2); return err }, codes.PermissionDenied},
+		{"accept_call_other_agent", agent, func(ctx context.Context) error { _, err := s.AcceptCall(ctx, 2, 1); return err }, codes.PermissionDenied},
+		{"agent_get_available_agents", agent, func(ctx context.Context) error { _, err := s.GetAvailableAgents(ctx, 0, "", nil); return err }, codes.PermissionDenied},
+		{"dispatcher_register_agent", acme, func(ctx context.Context) error { _, err := s.RegisterAgent(ctx); return err }, codes.PermissionDenied},
+		{"no_tenant_other_tenant", noTenant, func(ctx context.Context) error { _, err := s.GetAvailableAgents(ctx, 0, "", nil); return err }, codes.PermissionDenied},
+		{"no_tenant_agent_other_tenant", noTenantAgent, func(ctx context.Context) error { _, _, err := s.HeartBeat(ctx, 1); return err }, codes.PermissionDenied},
+		{"no_tenant_admin_other_tenant", admin, func(ctx context.Context) error { _, err := s.GetAvailableAgents(ctx, 0, "", nil); return err }, codes.PermissionDenied},
+		{"no_tenant_admin_sum", admin, func(ctx context.Context) error { _, err := s.Sum(ctx, 1, 2); return err }, codes.OK},
+		{"no_token", context.Background(), func(ctx context.Context) error { _, _, err := s.HeartBeat(ctx, 1); return err }, codes.Unauthenticated},
+		{"invalid_token", metadata.NewIncomingContext(context.Background(), metadata.Pairs(auth.MetadataKey, "Bearer garbage")), func(ctx context.Context) error { _, _, err := s.HeartBeat(ctx, 1); return err }, codes.Unauthenticated},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			err := tc.call(tc.ctx)
+			tu.Equals(t, tc.code, status.Code(service.WrapError(tc.ctx, err)))
+		})
+	}
+
+	// globex's agent 1 missed none of those heartbeats
+	globexAgent, err := models.NewRepositories(session, tenant.Database(tu.MongoDBName, "globex")).Agents.Find(context.Background(), 1)
+	tu.Ok(t, err)
+	tu.Equals(t, now.Unix(), globexAgent.LastHeartBeat.Unix())
+}
@@ -0,0 +1,106 @@
+package service
+
+// context.go
+// Request and trace IDs of a call so its log lines can be correlated (with
+// each other and with the caller's). They come from the incoming gRPC
+// metadata, a request without an ID is given one by the transport.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// RequestIDMetadataKey is the gRPC metadata key of the request ID
+	RequestIDMetadataKey = "x-request-id"
+	// TraceIDMetadataKey is the gRPC metadata key of the trace ID (B3 propagation)
+	TraceIDMetadataKey = "x-b3-traceid"
+	// TraceParentMetadataKey is the gRPC metadata key of the W3C trace context
+	// (version-traceid-parentid-flags)
+	TraceParentMetadataKey = "traceparent"
+)
+
+type contextKey string
+
+const requestIDKey contextKey = "request-id"
+
+// NewRequestID returns a random request ID
+func NewRequestID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
+// WithRequestID returns a copy of ctx with request ID id
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestIDFromContext returns the request ID set by WithRequestID or else
+// the one in the incoming gRPC metadata ("" if neither)
+func RequestIDFromContext(ctx context.Context) string {
+	if id, ok := ctx.Value(requestIDKey).(string); ok {
+		return id
+	}
+	return incomingMetadata(ctx, RequestIDMetadataKey)
+}
+
+// TraceIDFromContext returns the trace ID from the incoming gRPC metadata
+// (B3 or W3C trace context, "" if not set)
+func TraceIDFromContext(ctx context.Context) string {
+	if id := incomingMetadata(ctx, TraceIDMetadataKey); id != "" {
+		return id
+	}
+	if fields := strings.Split(incomingMetadata(ctx, TraceParentMetadataKey), "-"); len(fields) == 4 {
+		return fields[1]
+	}
+	return ""
+}
+
+// ContextLogger returns logger with the request and trace IDs of ctx (if any)
+func ContextLogger(ctx context.Context, logger log.Logger) log.Logger {
+	if id := RequestIDFromContext(ctx); id != "" {
+		logger = log.With(logger, "request_id", id)
+	}
+	if id := TraceIDFromContext(ctx); id != "" {
+		logger = log.With(logger, "trace_id", id)
+	}
+	return logger
+}
+
+// DetachContext returns a context with the values of ctx (request ID,
+// metadata etc.) that is never cancelled and has no deadline. It is for work
+// that has to finish after the call that started it, e.g. marking an agent
+// offline once its stream has gone.
+func DetachContext(ctx context.Context) context.Context {
+	return detachedContext{ctx}
+}
+
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+// incomingMetadata returns the first value of key in the incoming gRPC metadata
+func incomingMetadata(ctx context.Context, key string) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if values := md[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
@@ -0,0 +1,68 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/newtonsystems/agent-mgmt/app/service"
+	tu "github.com/newtonsystems/agent-mgmt/app/testutil"
+)
+
+func TestRequestIDFromContext(t *testing.T) {
+	tu.Equals(t, "", service.RequestIDFromContext(context.Background()))
+
+	// From the caller
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(service.RequestIDMetadataKey, "req-1"))
+	tu.Equals(t, "req-1", service.RequestIDFromContext(ctx))
+
+	// or given by the server
+	tu.Equals(t, "req-2", service.RequestIDFromContext(service.WithRequestID(context.Background(), "req-2")))
+
+	id := service.NewRequestID()
+	tu.Equals(t, 32, len(id))
+	tu.Assert(t, id != service.NewRequestID(), "expected request IDs to be unique")
+}
+
+func TestTraceIDFromContext(t *testing.T) {
+	tu.Equals(t, "", service.TraceIDFromContext(context.Background()))
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(service.TraceIDMetadataKey, "463ac35c9f6413ad"))
+	tu.Equals(t, "463ac35c9f6413ad", service.TraceIDFromContext(ctx))
+
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(service.TraceParentMetadataKey, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"))
+	tu.Equals(t, "0af7651916cd43dd8448eb211c80319c", service.TraceIDFromContext(ctx))
+
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(service.TraceParentMetadataKey, "garbage"))
+	tu.Equals(t, "", service.TraceIDFromContext(ctx))
+}
+
+func TestContextLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.NewLogfmtLogger(&buf)
+
+	service.ContextLogger(context.Background(), logger).Log("msg", "hello")
+	tu.Equals(t, "msg=hello\n", buf.String())
+
+	buf.Reset()
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(service.TraceIDMetadataKey, "463ac35c9f6413ad"))
+	service.ContextLogger(service.WithRequestID(ctx, "req-1"), logger).Log("msg", "hello")
+	tu.Equals(t, "request_id=req-1 trace_id=463ac35c9f6413ad msg=hello\n", buf.String())
+}
+
+func TestDetachContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(service.WithRequestID(context.Background(), "req-1"), time.Millisecond)
+	cancel()
+
+	detached := service.DetachContext(ctx)
+	tu.Ok(t, detached.Err())
+	_, ok := detached.Deadline()
+	tu.Assert(t, !ok, "expected no deadline")
+	tu.Assert(t, detached.Done() == nil, "expected the context to never be done")
+	tu.Equals(t, "req-1", service.RequestIDFromContext(detached))
+	tu.Equals(t, context.Canceled, ctx.Err())
+}
@@ -0,0 +1,200 @@
+package service
+
+// errors.go
+// Carrying AgentMgmtErrors across gRPC: each error type has a canonical status
+// code and the status carries google.rpc details (ErrorInfo, BadRequest) so
+// generic clients, proxies and dashboards can tell errors apart.
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+)
+
+// ErrorDomain is the google.rpc.ErrorInfo domain of the errors we return
+const ErrorDomain = "agent-mgmt.newtonsystems.com"
+
+// errorTypeKey is the trailer (and ErrorInfo metadata) key of the error type
+const errorTypeKey = "errortype"
+
+// errorCodes are the gRPC status codes of the error types, any other type is
+// codes.Internal
+var errorCodes = map[amerrors.ErrorType]codes.Code{
+	amerrors.ErrAgentIDNotFound:        codes.NotFound,
+	amerrors.ErrAgentNotFound:          codes.NotFound,
+	amerrors.ErrTaskNotFound:           codes.NotFound,
+	amerrors.ErrCustIDInvalid:          codes.InvalidArgument,
+	amerrors.ErrAgentStateInvalid:      codes.InvalidArgument,
+	amerrors.ErrTaskStatusInvalid:      codes.InvalidArgument,
+	amerrors.ErrRoutingStrategyInvalid: codes.InvalidArgument,
+	amerrors.ErrSkillInvalid:           codes.InvalidArgument,
+	amerrors.ErrInvalidArgument:        codes.InvalidArgument,
+	amerrors.ErrCounterNotFound:        codes.FailedPrecondition,
+	amerrors.ErrTaskAlreadyAccepted:    codes.FailedPrecondition,
+	amerrors.ErrTaskNotOffered:         codes.FailedPrecondition,
+	amerrors.ErrAgentStateTransition:   codes.FailedPrecondition,
+	amerrors.ErrTaskNotAccepted:        codes.FailedPrecondition,
+	amerrors.ErrTaskAlreadyCompleted:   codes.FailedPrecondition,
+	amerrors.ErrTaskStatusTransition:   codes.FailedPrecondition,
+	amerrors.ErrWatchSlowConsumer:      codes.ResourceExhausted,
+	amerrors.ErrWatchClosed:            codes.Unavailable,
+	amerrors.ErrStreamClosed:           codes.Unavailable,
+	amerrors.ErrStreamReplaced:         codes.Aborted,
+	amerrors.ErrHeartBeatMissed:        codes.DeadlineExceeded,
+	amerrors.ErrTenantUnknown:          codes.PermissionDenied,
+	amerrors.ErrUnauthenticated:        codes.Unauthenticated,
+	amerrors.ErrPermissionDenied:       codes.PermissionDenied,
+}
+
+// ErrorCode returns the gRPC status code of an error type
+func ErrorCode(errType amerrors.ErrorType) codes.Code {
+	if code, ok := errorCodes[errType]; ok {
+		return code
+	}
+	return codes.Internal
+}
+
+// Elegantly ripped from https://github.com/letsencrypt/boulder/blob/f193137405a22057fe46a1e0e27f9d1c9e07de8b/grpc/errors.go
+// WrapError wraps the internal error types we use for transport across the gRPC
+// layer. An AgentMgmtError becomes a status with the code of its type and an
+// ErrorInfo detail (plus a BadRequest detail if a request field is at fault).
+// The error type is also appended to the gRPC trailer via the provided context
+// for clients that still read it from there (grpc/grpc#4543 and grpc/grpc-go#478).
+func WrapError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	aerr, ok := err.(*amerrors.AgentMgmtError)
+	if !ok {
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return status.FromContextError(err).Err()
+		}
+		// e.g. a socket timeout because the caller's deadline passed (see models.CopySession)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return status.FromContextError(ctxErr).Err()
+		}
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	// Ignoring the error return here is safe because if setting the metadata
+	// fails the error type is still in the status details.
+	_ = grpc.SetTrailer(ctx, metadata.Pairs(errorTypeKey, strconv.Itoa(int(aerr.Type))))
+	return errorStatus(aerr).Err()
+}
+
+// errorStatus returns the status of an AgentMgmtError with its details
+func errorStatus(aerr *amerrors.AgentMgmtError) *status.Status {
+	st := status.New(ErrorCode(aerr.Type), aerr.Detail)
+
+	details := []proto.Message{
+		&errdetails.ErrorInfo{
+			Reason:   amerrors.StrName(aerr.Type),
+			Domain:   ErrorDomain,
+			Metadata: map[string]string{errorTypeKey: strconv.Itoa(int(aerr.Type))},
+		},
+	}
+	if aerr.Field != "" {
+		details = append(details, &errdetails.BadRequest{
+			FieldViolations: []*errdetails.BadRequest_FieldViolation{
+				{Field: aerr.Field, Description: aerr.Detail},
+			},
+		})
+	}
+
+	withDetails, err := st.WithDetails(details...)
+	if err != nil {
+		logger.Log("level", "err", "msg", "Failed to add error details", "err", err)
+		return st
+	}
+	return withDetails
+}
+
+// UnWrapError unwraps errors returned from gRPC client calls which were
+// wrapped with WrapError to their proper internal error type. The type is
+// taken from the status' ErrorInfo detail or, for servers that only set it
+// there, the "errortype" field of the provided trailer metadata.
+func UnWrapError(err error, md metadata.MD) error {
+	if err == nil {
+		return nil
+	}
+	logger.Log("level", "debug", "msg", "UnWrapError()")
+
+	if aerr, ok := unwrapStatus(err); ok {
+		return aerr
+	}
+
+	if errTypeStrs, ok := md[errorTypeKey]; ok {
+
+		unwrappedErr := grpc.ErrorDesc(err)
+		if len(errTypeStrs) != 1 {
+			return amerrors.InternalServerError(
+				"multiple errorType metadata, wrapped error %q",
+				unwrappedErr,
+			)
+		}
+
+		errType, decErr := strconv.Atoi(errTypeStrs[0])
+		if decErr != nil {
+			return amerrors.InternalServerError(
+				"failed to decode error type, decoding error %q, wrapped error %q",
+				decErr,
+				unwrappedErr,
+			)
+		}
+		return amerrors.New(amerrors.ErrorType(errType), unwrappedErr)
+	}
+	logger.Log("level", "debug", "msg", "Failed to find errortype")
+	return err
+}
+
+// unwrapStatus returns the AgentMgmtError in the details of err's status
+func unwrapStatus(err error) (error, bool) {
+	st, ok := status.FromError(err)
+	if !ok {
+		return nil, false
+	}
+
+	var (
+		aerr  *amerrors.AgentMgmtError
+		field string
+	)
+	for _, detail := range st.Details() {
+		switch d := detail.(type) {
+		case *errdetails.ErrorInfo:
+			if d.Domain != ErrorDomain {
+				continue
+			}
+			errType, decErr := strconv.Atoi(d.Metadata[errorTypeKey])
+			if decErr != nil {
+				return amerrors.InternalServerError(
+					"failed to decode error type, decoding error %q, wrapped error %q",
+					decErr,
+					st.Message(),
+				), true
+			}
+			aerr = &amerrors.AgentMgmtError{Type: amerrors.ErrorType(errType), Detail: st.Message()}
+		case *errdetails.BadRequest:
+			if len(d.FieldViolations) > 0 {
+				field = d.FieldViolations[0].Field
+			}
+		}
+	}
+
+	if aerr == nil {
+		return nil, false
+	}
+	aerr.Field = field
+	return aerr, true
+}
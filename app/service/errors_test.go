@@ -0,0 +1,113 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+	"github.com/newtonsystems/agent-mgmt/app/service"
+	tu "github.com/newtonsystems/agent-mgmt/app/testutil"
+)
+
+func TestErrorCode(t *testing.T) {
+	for _, tt := range []struct {
+		errType amerrors.ErrorType
+		code    codes.Code
+	}{
+		{amerrors.ErrAgentNotFound, codes.NotFound},
+		{amerrors.ErrAgentIDNotFound, codes.NotFound},
+		{amerrors.ErrTaskNotFound, codes.NotFound},
+		{amerrors.ErrCustIDInvalid, codes.InvalidArgument},
+		{amerrors.ErrInvalidArgument, codes.InvalidArgument},
+		{amerrors.ErrSkillInvalid, codes.InvalidArgument},
+		{amerrors.ErrCounterNotFound, codes.FailedPrecondition},
+		{amerrors.ErrTaskAlreadyAccepted, codes.FailedPrecondition},
+		{amerrors.ErrStreamClosed, codes.Unavailable},
+		{amerrors.ErrTenantUnknown, codes.PermissionDenied},
+		{amerrors.ErrUnauthenticated, codes.Unauthenticated},
+		{amerrors.ErrPermissionDenied, codes.PermissionDenied},
+		{amerrors.InternalServer, codes.Internal},
+		{amerrors.ErrorType(1000), codes.Internal},
+	} {
+		t.Run(amerrors.StrName(tt.errType), func(t *testing.T) {
+			tu.Equals(t, tt.code, service.ErrorCode(tt.errType))
+		})
+	}
+}
+
+func TestWrapError(t *testing.T) {
+	tu.Ok(t, service.WrapError(context.Background(), nil))
+
+	// An AgentMgmtError keeps its type, detail and field across the wire
+	for _, aerr := range []*amerrors.AgentMgmtError{
+		{Type: amerrors.ErrAgentNotFound, Detail: "Agent(AgentID=20) not found"},
+		{Type: amerrors.ErrCounterNotFound, Detail: "failed to find an counter counters(_id=taskid)"},
+		{Type: amerrors.ErrInvalidArgument, Detail: "agent_id must be positive (got 0)", Field: "agent_id"},
+	} {
+		t.Run(amerrors.StrName(aerr.Type), func(t *testing.T) {
+			err := service.WrapError(context.Background(), aerr)
+
+			st, ok := status.FromError(err)
+			tu.Assert(t, ok, "expected a status error, got %#v", err)
+			tu.Equals(t, service.ErrorCode(aerr.Type), st.Code())
+			tu.Equals(t, aerr.Detail, st.Message())
+
+			var info *errdetails.ErrorInfo
+			var badRequest *errdetails.BadRequest
+			for _, detail := range st.Details() {
+				switch d := detail.(type) {
+				case *errdetails.ErrorInfo:
+					info = d
+				case *errdetails.BadRequest:
+					badRequest = d
+				}
+			}
+			tu.Assert(t, info != nil, "expected an ErrorInfo detail")
+			tu.Equals(t, amerrors.StrName(aerr.Type), info.Reason)
+			tu.Equals(t, service.ErrorDomain, info.Domain)
+			if aerr.Field == "" {
+				tu.Assert(t, badRequest == nil, "expected no BadRequest detail, got %v", badRequest)
+			} else {
+				tu.Assert(t, badRequest != nil, "expected a BadRequest detail")
+				tu.Equals(t, aerr.Field, badRequest.FieldViolations[0].Field)
+			}
+
+			tu.Equals(t, aerr, service.UnWrapError(err, nil))
+		})
+	}
+
+	// Other errors
+	tu.Equals(t, codes.Internal, status.Code(service.WrapError(context.Background(), errors.New("no reachable servers"))))
+	tu.Equals(t, codes.Canceled, status.Code(service.WrapError(context.Background(), context.Canceled)))
+	tu.Equals(t, codes.DeadlineExceeded, status.Code(service.WrapError(context.Background(), context.DeadlineExceeded)))
+
+	// A database error once the caller has given up is the caller's
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	tu.Equals(t, codes.DeadlineExceeded, status.Code(service.WrapError(ctx, errors.New("read tcp 10.0.0.1:27017: i/o timeout"))))
+
+	st := status.New(codes.Unavailable, "transport is closing")
+	tu.Equals(t, st.Err(), service.WrapError(context.Background(), st.Err()))
+}
+
+func TestUnWrapErrorTrailer(t *testing.T) {
+	// Servers that only set the errortype trailer
+	err := status.Error(codes.Unknown, "Agent(AgentID=20) not found")
+
+	unwrapped := service.UnWrapError(err, metadata.Pairs("errortype", "3"))
+	tu.IsAmError(t, amerrors.ErrAgentNotFound, unwrapped)
+	tu.Equals(t, "Agent(AgentID=20) not found", unwrapped.Error())
+
+	tu.IsAmError(t, amerrors.InternalServer, service.UnWrapError(err, metadata.Pairs("errortype", "three")))
+	tu.IsAmError(t, amerrors.InternalServer, service.UnWrapError(err, metadata.Pairs("errortype", "3", "errortype", "4")))
+
+	// No error type at all
+	tu.Equals(t, err, service.UnWrapError(err, metadata.MD{}))
+}
@@ -3,6 +3,7 @@ package service
 import (
 	"context"
 	"strings"
+	"time"
 
 	stdprometheus "github.com/prometheus/client_golang/prometheus"
 
@@ -10,7 +11,11 @@ import (
 	"github.com/go-kit/kit/metrics"
 	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
 
+	"github.com/newtonsystems/agent-mgmt/app/config"
+	"github.com/newtonsystems/agent-mgmt/app/heartbeat"
 	"github.com/newtonsystems/agent-mgmt/app/models"
+	"github.com/newtonsystems/agent-mgmt/app/tenant"
+	"github.com/newtonsystems/agent-mgmt/app/watch"
 	"github.com/newtonsystems/grpc_types/go/grpc_types"
 )
 
@@ -32,44 +37,149 @@ type loggingMiddleware struct {
 
 func (mw loggingMiddleware) Sum(ctx context.Context, a, b int) (v int, err error) {
 	defer func() {
-		mw.logger.Log("method", "Sum", "a", a, "b", b, "v", v, "err", err)
+		ContextLogger(ctx, mw.logger).Log("method", "Sum", "a", a, "b", b, "v", v, "err", err)
 	}()
 	return mw.next.Sum(ctx, a, b)
 }
 
 func (mw loggingMiddleware) Concat(ctx context.Context, a, b string) (v string, err error) {
 	defer func() {
-		mw.logger.Log("method", "Concat", "a", a, "b", b, "v", v, "err", err)
+		ContextLogger(ctx, mw.logger).Log("method", "Concat", "a", a, "b", b, "v", v, "err", err)
 	}()
 	return mw.next.Concat(ctx, a, b)
 }
 
-func (mw loggingMiddleware) GetAvailableAgents(ctx context.Context, session models.Session, db string, limit int32) (v []string, err error) {
+func (mw loggingMiddleware) GetAvailableAgents(ctx context.Context, limit int32, strategy string, skills []models.SkillRequirement) (v []string, err error) {
 	defer func() {
-		mw.logger.Log("method", "GetAvailableAgents", "agent_ids", strings.Join(v, ", "), "err", err)
+		ContextLogger(ctx, mw.logger).Log("method", "GetAvailableAgents", "strategy", strategy, "skills", len(skills), "agent_ids", strings.Join(v, ", "), "err", err)
 	}()
-	return mw.next.GetAvailableAgents(ctx, session, db, limit)
+	return mw.next.GetAvailableAgents(ctx, limit, strategy, skills)
 }
 
-func (mw loggingMiddleware) GetAgentIDFromRef(session models.Session, db string, refID string) (v int32, err error) {
+func (mw loggingMiddleware) GetAgentIDFromRef(ctx context.Context, refID string) (v int32, err error) {
 	defer func() {
-		mw.logger.Log("method", "GetAgentIDFromRef", "agent_id", v, "err", err)
+		ContextLogger(ctx, mw.logger).Log("method", "GetAgentIDFromRef", "agent_id", v, "err", err)
 	}()
-	return mw.next.GetAgentIDFromRef(session, db, refID)
+	return mw.next.GetAgentIDFromRef(ctx, refID)
 }
 
-func (mw loggingMiddleware) HeartBeat(session models.Session, db string, agentID int32) (status grpc_types.HeartBeatResponse_HeartBeatStatus, err error) {
+func (mw loggingMiddleware) HeartBeat(ctx context.Context, agentID int32) (status grpc_types.HeartBeatResponse_HeartBeatStatus, next time.Duration, err error) {
 	defer func() {
-		mw.logger.Log("method", "HeartBeat", "agent_id", agentID, "status", status)
+		ContextLogger(ctx, mw.logger).Log("method", "HeartBeat", "agent_id", agentID, "status", status, "next", next)
 	}()
-	return mw.next.HeartBeat(session, db, agentID)
+	return mw.next.HeartBeat(ctx, agentID)
 }
 
-func (mw loggingMiddleware) AddTask(session models.Session, db string, custID int32, agentIDs []int32) (taskID int32, err error) {
+func (mw loggingMiddleware) AddTask(ctx context.Context, custID int32, agentIDs []int32, skills []models.SkillRequirement) (taskID int32, err error) {
 	defer func() {
-		mw.logger.Log("method", "AddTask", "cust_id", custID, "call_ids", agentIDs, "task_id", taskID, "err", err)
+		ContextLogger(ctx, mw.logger).Log("method", "AddTask", "cust_id", custID, "call_ids", agentIDs, "skills", len(skills), "task_id", taskID, "err", err)
 	}()
-	return mw.next.AddTask(session, db, custID, agentIDs)
+	return mw.next.AddTask(ctx, custID, agentIDs, skills)
+}
+
+func (mw loggingMiddleware) OfferTask(ctx context.Context, taskID int32, agentIDs []int32) (task models.Task, err error) {
+	defer func() {
+		ContextLogger(ctx, mw.logger).Log("method", "OfferTask", "task_id", taskID, "call_ids", agentIDs, "err", err)
+	}()
+	return mw.next.OfferTask(ctx, taskID, agentIDs)
+}
+
+func (mw loggingMiddleware) AcceptCall(ctx context.Context, agentID int32, taskID int32) (task models.Task, err error) {
+	defer func() {
+		ContextLogger(ctx, mw.logger).Log("method", "AcceptCall", "agent_id", agentID, "task_id", taskID, "released_ids", task.ReleasedAgentIDs, "err", err)
+	}()
+	return mw.next.AcceptCall(ctx, agentID, taskID)
+}
+
+func (mw loggingMiddleware) StartTask(ctx context.Context, agentID int32, taskID int32) (task models.Task, err error) {
+	defer func() {
+		ContextLogger(ctx, mw.logger).Log("method", "StartTask", "agent_id", agentID, "task_id", taskID, "err", err)
+	}()
+	return mw.next.StartTask(ctx, agentID, taskID)
+}
+
+func (mw loggingMiddleware) CompleteTask(ctx context.Context, agentID int32, taskID int32) (task models.Task, err error) {
+	defer func() {
+		ContextLogger(ctx, mw.logger).Log("method", "CompleteTask", "agent_id", agentID, "task_id", taskID, "err", err)
+	}()
+	return mw.next.CompleteTask(ctx, agentID, taskID)
+}
+
+func (mw loggingMiddleware) GetTask(ctx context.Context, taskID int32) (task models.Task, err error) {
+	defer func() {
+		ContextLogger(ctx, mw.logger).Log("method", "GetTask", "task_id", taskID, "status", task.Status, "err", err)
+	}()
+	return mw.next.GetTask(ctx, taskID)
+}
+
+func (mw loggingMiddleware) ListTasks(ctx context.Context, custID int32, agentID int32, status string, limit int32) (tasks []models.Task, err error) {
+	defer func() {
+		ContextLogger(ctx, mw.logger).Log("method", "ListTasks", "cust_id", custID, "agent_id", agentID, "status", status, "limit", limit, "tasks", len(tasks), "err", err)
+	}()
+	return mw.next.ListTasks(ctx, custID, agentID, status, limit)
+}
+
+func (mw loggingMiddleware) CancelTask(ctx context.Context, taskID int32, abandoned bool) (task models.Task, err error) {
+	defer func() {
+		ContextLogger(ctx, mw.logger).Log("method", "CancelTask", "task_id", taskID, "abandoned", abandoned, "err", err)
+	}()
+	return mw.next.CancelTask(ctx, taskID, abandoned)
+}
+
+func (mw loggingMiddleware) SetAgentState(ctx context.Context, agentID int32, state string) (err error) {
+	defer func() {
+		ContextLogger(ctx, mw.logger).Log("method", "SetAgentState", "agent_id", agentID, "state", state, "err", err)
+	}()
+	return mw.next.SetAgentState(ctx, agentID, state)
+}
+
+func (mw loggingMiddleware) SetAgentSkills(ctx context.Context, agentID int32, skills []models.Skill) (agent models.Agent, err error) {
+	defer func() {
+		ContextLogger(ctx, mw.logger).Log("method", "SetAgentSkills", "agent_id", agentID, "skills", len(agent.Skills), "err", err)
+	}()
+	return mw.next.SetAgentSkills(ctx, agentID, skills)
+}
+
+func (mw loggingMiddleware) RegisterAgent(ctx context.Context) (agentID int32, err error) {
+	defer func() {
+		ContextLogger(ctx, mw.logger).Log("method", "RegisterAgent", "agent_id", agentID, "err", err)
+	}()
+	return mw.next.RegisterAgent(ctx)
+}
+
+func (mw loggingMiddleware) DeregisterAgent(ctx context.Context, agentID int32) (err error) {
+	defer func() {
+		ContextLogger(ctx, mw.logger).Log("method", "DeregisterAgent", "agent_id", agentID, "err", err)
+	}()
+	return mw.next.DeregisterAgent(ctx, agentID)
+}
+
+func (mw loggingMiddleware) WatchAgents(ctx context.Context) (agents []models.Agent, watcher *watch.Watcher, err error) {
+	defer func() {
+		ContextLogger(ctx, mw.logger).Log("method", "WatchAgents", "agents", len(agents), "err", err)
+	}()
+	return mw.next.WatchAgents(ctx)
+}
+
+func (mw loggingMiddleware) ConnectAgent(ctx context.Context, agentID int32) (conn *heartbeat.Conn, next time.Duration, err error) {
+	defer func() {
+		ContextLogger(ctx, mw.logger).Log("method", "ConnectAgent", "agentID", agentID, "next", next, "err", err)
+	}()
+	return mw.next.ConnectAgent(ctx, agentID)
+}
+
+func (mw loggingMiddleware) KeepAlive(ctx context.Context, agentID int32, sinceLastBeat time.Duration) (err error) {
+	defer func() {
+		ContextLogger(ctx, mw.logger).Log("method", "KeepAlive", "agentID", agentID, "sinceLastBeat", sinceLastBeat, "err", err)
+	}()
+	return mw.next.KeepAlive(ctx, agentID, sinceLastBeat)
+}
+
+func (mw loggingMiddleware) DisconnectAgent(ctx context.Context, conn *heartbeat.Conn) (err error) {
+	defer func() {
+		ContextLogger(ctx, mw.logger).Log("method", "DisconnectAgent", "agentID", conn.AgentID, "err", err)
+	}()
+	return mw.next.DisconnectAgent(ctx, conn)
 }
 
 func NewMetrics() Metrics {
@@ -77,7 +187,7 @@ func NewMetrics() Metrics {
 	// dependencies that we pass to components that use them.
 
 	// TODO: change namespace
-	var ints, chars, refs, beats metrics.Counter
+	var ints, chars, refs, beats, addtasks, accepts, completes, cancels, states, skills, registers, deregisters, watches, streams metrics.Counter
 	{
 		// Business-level metrics.
 		ints = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
@@ -97,13 +207,73 @@ func NewMetrics() Metrics {
 			Subsystem: "agentmgmt",
 			Name:      "references_used",
 			Help:      "Total count of references used to get agent ID via the GetAgentIDFromRef method.",
-		}, []string{})
+		}, []string{"tenant"})
 		beats = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
 			Namespace: "example",
 			Subsystem: "agentmgmt",
 			Name:      "total_heartbeat_counts",
 			Help:      "Total count of heartbeats service call from the HeartBeat method.",
-		}, []string{})
+		}, []string{"tenant"})
+		addtasks = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "example",
+			Subsystem: "agentmgmt",
+			Name:      "tasks_added",
+			Help:      "Total count of tasks added via the AddTask method.",
+		}, []string{"tenant"})
+		accepts = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "example",
+			Subsystem: "agentmgmt",
+			Name:      "calls_accepted",
+			Help:      "Total count of tasks accepted via the AcceptCall method.",
+		}, []string{"tenant"})
+		completes = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "example",
+			Subsystem: "agentmgmt",
+			Name:      "tasks_completed",
+			Help:      "Total count of tasks completed via the CompleteTask method.",
+		}, []string{"tenant"})
+		cancels = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "example",
+			Subsystem: "agentmgmt",
+			Name:      "tasks_cancelled",
+			Help:      "Total count of tasks cancelled or abandoned via the CancelTask method.",
+		}, []string{"tenant", "status"})
+		states = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "example",
+			Subsystem: "agentmgmt",
+			Name:      "agent_state_changes",
+			Help:      "Total count of agent state changes via the SetAgentState method.",
+		}, []string{"tenant"})
+		skills = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "example",
+			Subsystem: "agentmgmt",
+			Name:      "agent_skill_updates",
+			Help:      "Total count of agent skill profile updates via the SetAgentSkills method.",
+		}, []string{"tenant"})
+		registers = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "example",
+			Subsystem: "agentmgmt",
+			Name:      "agents_registered",
+			Help:      "Total count of agents registered via the RegisterAgent method.",
+		}, []string{"tenant"})
+		deregisters = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "example",
+			Subsystem: "agentmgmt",
+			Name:      "agents_deregistered",
+			Help:      "Total count of agents deregistered via the DeregisterAgent method.",
+		}, []string{"tenant"})
+		watches = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "example",
+			Subsystem: "agentmgmt",
+			Name:      "agent_watches",
+			Help:      "Total count of agent availability watches started via the WatchAgents method.",
+		}, []string{"tenant"})
+		streams = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "example",
+			Subsystem: "agentmgmt",
+			Name:      "agent_heartbeat_streams",
+			Help:      "Total count of agent heartbeat streams connected via the ConnectAgent method.",
+		}, []string{"tenant"})
 	}
 
 	var duration metrics.Histogram
@@ -117,12 +287,22 @@ func NewMetrics() Metrics {
 	}
 
 	return Metrics{
-		Ints:     ints,
-		Chars:    chars,
-		Refs:     refs,
-		Beats:    beats,
-		Duration: duration,
-		next:     nil,
+		Ints:        ints,
+		Chars:       chars,
+		Refs:        refs,
+		Beats:       beats,
+		Addtasks:    addtasks,
+		Accepts:     accepts,
+		Completes:   completes,
+		Cancels:     cancels,
+		States:      states,
+		Skills:      skills,
+		Registers:   registers,
+		Deregisters: deregisters,
+		Watches:     watches,
+		Streams:     streams,
+		Duration:    duration,
+		next:        nil,
 	}
 
 }
@@ -132,27 +312,49 @@ func NewMetrics() Metrics {
 // the service.
 // references asked for
 // The number of heartbeats counted ()
-func InstrumentingMiddleware(metrics *Metrics) Middleware {
+// Calls are labelled with their tenant if it is one of cfg's tenants.
+func InstrumentingMiddleware(metrics *Metrics, cfg config.Config) Middleware {
 	return func(next Service) Service {
 		return Metrics{
-			Ints:     metrics.Ints,
-			Chars:    metrics.Chars,
-			Refs:     metrics.Refs,
-			Beats:    metrics.Beats,
-			Duration: metrics.Duration,
-			next:     next,
+			Ints:        metrics.Ints,
+			Chars:       metrics.Chars,
+			Refs:        metrics.Refs,
+			Beats:       metrics.Beats,
+			Addtasks:    metrics.Addtasks,
+			Accepts:     metrics.Accepts,
+			Completes:   metrics.Completes,
+			Cancels:     metrics.Cancels,
+			States:      metrics.States,
+			Skills:      metrics.Skills,
+			Registers:   metrics.Registers,
+			Deregisters: metrics.Deregisters,
+			Watches:     metrics.Watches,
+			Streams:     metrics.Streams,
+			Duration:    metrics.Duration,
+			cfg:         cfg,
+			next:        next,
 		}
 	}
 }
 
 type Metrics struct {
-	Ints     metrics.Counter
-	Chars    metrics.Counter
-	Refs     metrics.Counter
-	Beats    metrics.Counter
-	Addtasks metrics.Counter
-	Duration metrics.Histogram
-	next     Service
+	Ints        metrics.Counter
+	Chars       metrics.Counter
+	Refs        metrics.Counter
+	Beats       metrics.Counter
+	Addtasks    metrics.Counter
+	Accepts     metrics.Counter
+	Completes   metrics.Counter
+	Cancels     metrics.Counter
+	States      metrics.Counter
+	Skills      metrics.Counter
+	Registers   metrics.Counter
+	Deregisters metrics.Counter
+	Watches     metrics.Counter
+	Streams     metrics.Counter
+	Duration    metrics.Histogram
+	cfg         config.Config
+	next        Service
 }
 
 func (mw Metrics) Sum(ctx context.Context, a, b int) (int, error) {
@@ -167,26 +369,127 @@ func (mw Metrics) Concat(ctx context.Context, a, b string) (string, error) {
 	return v, err
 }
 
-func (mw Metrics) GetAvailableAgents(ctx context.Context, session models.Session, db string, limit int32) ([]string, error) {
-	v, err := mw.next.GetAvailableAgents(ctx, session, db, limit)
+func (mw Metrics) GetAvailableAgents(ctx context.Context, limit int32, strategy string, skills []models.SkillRequirement) ([]string, error) {
+	v, err := mw.next.GetAvailableAgents(ctx, limit, strategy, skills)
 	mw.Chars.Add(float64(len(v)))
 	return v, err
 }
 
-func (mw Metrics) GetAgentIDFromRef(session models.Session, db string, refID string) (int32, error) {
-	v, err := mw.next.GetAgentIDFromRef(session, db, refID)
-	mw.Refs.Add(1)
+func (mw Metrics) GetAgentIDFromRef(ctx context.Context, refID string) (int32, error) {
+	v, err := mw.next.GetAgentIDFromRef(ctx, refID)
+	mw.Refs.With("tenant", mw.tenantLabel(ctx)).Add(1)
 	return v, err
 }
 
-func (mw Metrics) HeartBeat(session models.Session, db string, agentID int32) (grpc_types.HeartBeatResponse_HeartBeatStatus, error) {
-	status, err := mw.next.HeartBeat(session, db, agentID)
-	mw.Beats.Add(1)
-	return status, err
+func (mw Metrics) HeartBeat(ctx context.Context, agentID int32) (grpc_types.HeartBeatResponse_HeartBeatStatus, time.Duration, error) {
+	status, next, err := mw.next.HeartBeat(ctx, agentID)
+	mw.Beats.With("tenant", mw.tenantLabel(ctx)).Add(1)
+	return status, next, err
 }
 
-func (mw Metrics) AddTask(session models.Session, db string, custID int32, agentIDs []int32) (int32, error) {
-	status, err := mw.next.AddTask(session, db, custID, agentIDs)
-	mw.Addtasks.Add(1)
+func (mw Metrics) AddTask(ctx context.Context, custID int32, agentIDs []int32, skills []models.SkillRequirement) (int32, error) {
+	status, err := mw.next.AddTask(ctx, custID, agentIDs, skills)
+	mw.Addtasks.With("tenant", mw.tenantLabel(ctx)).Add(1)
 	return status, err
 }
+
+func (mw Metrics) OfferTask(ctx context.Context, taskID int32, agentIDs []int32) (models.Task, error) {
+	return mw.next.OfferTask(ctx, taskID, agentIDs)
+}
+
+func (mw Metrics) AcceptCall(ctx context.Context, agentID int32, taskID int32) (models.Task, error) {
+	task, err := mw.next.AcceptCall(ctx, agentID, taskID)
+	if err == nil {
+		mw.Accepts.With("tenant", mw.tenantLabel(ctx)).Add(1)
+	}
+	return task, err
+}
+
+func (mw Metrics) StartTask(ctx context.Context, agentID int32, taskID int32) (models.Task, error) {
+	return mw.next.StartTask(ctx, agentID, taskID)
+}
+
+func (mw Metrics) CompleteTask(ctx context.Context, agentID int32, taskID int32) (models.Task, error) {
+	task, err := mw.next.CompleteTask(ctx, agentID, taskID)
+	if err == nil {
+		mw.Completes.With("tenant", mw.tenantLabel(ctx)).Add(1)
+	}
+	return task, err
+}
+
+func (mw Metrics) GetTask(ctx context.Context, taskID int32) (models.Task, error) {
+	return mw.next.GetTask(ctx, taskID)
+}
+
+func (mw Metrics) ListTasks(ctx context.Context, custID int32, agentID int32, status string, limit int32) ([]models.Task, error) {
+	return mw.next.ListTasks(ctx, custID, agentID, status, limit)
+}
+
+func (mw Metrics) CancelTask(ctx context.Context, taskID int32, abandoned bool) (models.Task, error) {
+	task, err := mw.next.CancelTask(ctx, taskID, abandoned)
+	if err == nil {
+		mw.Cancels.With("tenant", mw.tenantLabel(ctx), "status", string(task.Status)).Add(1)
+	}
+	return task, err
+}
+
+func (mw Metrics) SetAgentState(ctx context.Context, agentID int32, state string) error {
+	err := mw.next.SetAgentState(ctx, agentID, state)
+	if err == nil {
+		mw.States.With("tenant", mw.tenantLabel(ctx)).Add(1)
+	}
+	return err
+}
+
+func (mw Metrics) SetAgentSkills(ctx context.Context, agentID int32, skills []models.Skill) (models.Agent, error) {
+	agent, err := mw.next.SetAgentSkills(ctx, agentID, skills)
+	if err == nil {
+		mw.Skills.With("tenant", mw.tenantLabel(ctx)).Add(1)
+	}
+	return agent, err
+}
+
+func (mw Metrics) RegisterAgent(ctx context.Context) (int32, error) {
+	agentID, err := mw.next.RegisterAgent(ctx)
+	mw.Registers.With("tenant", mw.tenantLabel(ctx)).Add(1)
+	return agentID, err
+}
+
+func (mw Metrics) DeregisterAgent(ctx context.Context, agentID int32) error {
+	err := mw.next.DeregisterAgent(ctx, agentID)
+	mw.Deregisters.With("tenant", mw.tenantLabel(ctx)).Add(1)
+	return err
+}
+
+func (mw Metrics) WatchAgents(ctx context.Context) ([]models.Agent, *watch.Watcher, error) {
+	agents, watcher, err := mw.next.WatchAgents(ctx)
+	if err == nil {
+		mw.Watches.With("tenant", mw.tenantLabel(ctx)).Add(1)
+	}
+	return agents, watcher, err
+}
+
+func (mw Metrics) ConnectAgent(ctx context.Context, agentID int32) (*heartbeat.Conn, time.Duration, error) {
+	conn, next, err := mw.next.ConnectAgent(ctx, agentID)
+	if err == nil {
+		mw.Streams.With("tenant", mw.tenantLabel(ctx)).Add(1)
+	}
+	return conn, next, err
+}
+
+func (mw Metrics) KeepAlive(ctx context.Context, agentID int32, sinceLastBeat time.Duration) error {
+	return mw.next.KeepAlive(ctx, agentID, sinceLastBeat)
+}
+
+func (mw Metrics) DisconnectAgent(ctx context.Context, conn *heartbeat.Conn) error {
+	return mw.next.DisconnectAgent(ctx, conn)
+}
+
+// tenantLabel returns the tenant label of a call's metrics ("" unless the
+// call is for one of the service's tenants so callers cannot add labels)
+func (mw Metrics) tenantLabel(ctx context.Context) string {
+	if id := tenant.FromContext(ctx); mw.cfg.HasTenant(id) {
+		return id
+	}
+	return ""
+}
@@ -0,0 +1,230 @@
+package service
+
+// router.go
+// Routers order the available agents a task is offered to (see GetAvailableAgents)
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/newtonsystems/agent-mgmt/app/config"
+	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+	"github.com/newtonsystems/agent-mgmt/app/models"
+	"github.com/newtonsystems/agent-mgmt/app/tenant"
+)
+
+// TenantMetadataKey is the gRPC metadata key holding the caller's tenant ID
+// (used to pick the tenant's routing strategy)
+const TenantMetadataKey = tenant.MetadataKey
+
+// Router orders the available agents so the agents that should get the next
+// task come first. It returns at most limit agents (0 is no limit).
+type Router interface {
+	Route(ctx context.Context, tasks models.TaskRepository, agents []models.Agent, limit int32) ([]models.Agent, error)
+}
+
+// findAgents returns the available agents in order, at most limit (0 is no limit)
+type findAgents func(order models.AgentOrder, limit int32) ([]models.Agent, error)
+
+// orderedRouter is a Router whose order the database can sort agents in, so
+// it only needs the first limit agents rather than every available agent
+type orderedRouter interface {
+	Router
+	RouteOrdered(find findAgents, limit int32) ([]models.Agent, error)
+}
+
+// NewRouter returns the Router for strategy (see config.RoutingStrategies)
+// seed is only used by the random strategy (0 seeds from the clock)
+func NewRouter(strategy string, seed int64) (Router, error) {
+	switch strategy {
+	case config.RoutingLongestIdle:
+		return longestIdleRouter{}, nil
+	case config.RoutingRoundRobin:
+		return &roundRobinRouter{}, nil
+	case config.RoutingLeastTasksToday:
+		return leastTasksTodayRouter{}, nil
+	case config.RoutingRandom:
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		return &randomRouter{rand: rand.New(rand.NewSource(seed))}, nil
+	}
+	return nil, amerrors.ErrRoutingStrategyInvalidError("unknown routing strategy: " + strategy)
+}
+
+// firstAgents returns at most limit agents (0 is no limit)
+func firstAgents(agents []models.Agent, limit int32) []models.Agent {
+	if limit > 0 && len(agents) > int(limit) {
+		return agents[:limit]
+	}
+	return agents
+}
+
+// sortedByID returns a copy of agents in agent ID order
+func sortedByID(agents []models.Agent) []models.Agent {
+	sorted := append([]models.Agent{}, agents...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].AgentID < sorted[j].AgentID })
+	return sorted
+}
+
+// longestIdleRouter agents that have been available the longest come first
+type longestIdleRouter struct{}
+
+func (longestIdleRouter) Route(_ context.Context, _ models.TaskRepository, agents []models.Agent, limit int32) ([]models.Agent, error) {
+	sorted := sortedByID(agents)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].StateChangedAt.Before(sorted[j].StateChangedAt) })
+	return firstAgents(sorted, limit), nil
+}
+
+func (longestIdleRouter) RouteOrdered(find findAgents, limit int32) ([]models.Agent, error) {
+	return find(models.AgentOrder{By: models.AgentSortStateChangedAt}, limit)
+}
+
+// roundRobinRouter agents in agent ID order starting after the agent that came first last time
+type roundRobinRouter struct {
+	mu   sync.Mutex
+	last int32
+}
+
+func (r *roundRobinRouter) Route(_ context.Context, _ models.TaskRepository, agents []models.Agent, limit int32) ([]models.Agent, error) {
+	if len(agents) == 0 {
+		return agents, nil
+	}
+
+	sorted := sortedByID(agents)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	start := sort.Search(len(sorted), func(i int) bool { return sorted[i].AgentID > r.last })
+	if start == len(sorted) {
+		start = 0
+	}
+	routed := append(sorted[start:], sorted[:start]...)
+	r.last = routed[0].AgentID
+
+	return firstAgents(routed, limit), nil
+}
+
+func (r *roundRobinRouter) RouteOrdered(find findAgents, limit int32) ([]models.Agent, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	routed, err := find(models.AgentOrder{By: models.AgentSortID, AfterAgentID: r.last}, limit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Wrap around to the agents up to the last one
+	if r.last != 0 && len(routed) < int(limit) {
+		wrapped, err := find(models.AgentOrder{By: models.AgentSortID}, limit-int32(len(routed)))
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, agent := range wrapped {
+			if agent.AgentID > r.last {
+				break
+			}
+			routed = append(routed, agent)
+		}
+	}
+
+	if len(routed) > 0 {
+		r.last = routed[0].AgentID
+	}
+	return routed, nil
+}
+
+// leastTasksTodayRouter agents that accepted the fewest tasks today (UTC) come first
+type leastTasksTodayRouter struct{}
+
+func (leastTasksTodayRouter) Route(ctx context.Context, tasks models.TaskRepository, agents []models.Agent, limit int32) ([]models.Agent, error) {
+	agentIDs := make([]int32, 0, len(agents))
+	for _, agent := range agents {
+		agentIDs = append(agentIDs, agent.AgentID)
+	}
+
+	today := NowFunc().UTC().Truncate(24 * time.Hour)
+	counts, err := tasks.CountAccepted(ctx, agentIDs, today)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := sortedByID(agents)
+	sort.SliceStable(sorted, func(i, j int) bool { return counts[sorted[i].AgentID] < counts[sorted[j].AgentID] })
+	return firstAgents(sorted, limit), nil
+}
+
+// randomRouter agents in a random order (repeatable for a seed)
+type randomRouter struct {
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func (r *randomRouter) Route(_ context.Context, _ models.TaskRepository, agents []models.Agent, limit int32) ([]models.Agent, error) {
+	sorted := sortedByID(agents)
+
+	r.mu.Lock()
+	perm := r.rand.Perm(len(sorted))
+	r.mu.Unlock()
+
+	routed := make([]models.Agent, len(sorted))
+	for i, j := range perm {
+		routed[i] = sorted[j]
+	}
+	return firstAgents(routed, limit), nil
+}
+
+// routers holds a Router per strategy so stateful strategies (round-robin)
+// are shared between requests
+type routers struct {
+	byStrategy      map[string]Router
+	defaultStrategy string
+	tenants         map[string]string
+}
+
+func newRouters(cfg config.Config) *routers {
+	r := &routers{
+		byStrategy:      make(map[string]Router),
+		defaultStrategy: cfg.RoutingStrategy,
+		tenants:         cfg.TenantRoutingStrategies,
+	}
+	if r.defaultStrategy == "" {
+		r.defaultStrategy = config.DefaultRoutingStrategy
+	}
+
+	for _, strategy := range config.RoutingStrategies {
+		// Only unknown strategies fail
+		r.byStrategy[strategy], _ = NewRouter(strategy, cfg.RoutingSeed)
+	}
+	return r
+}
+
+// router returns the Router for strategy. If strategy is empty the tenant's
+// strategy is used (from the request metadata) and then the default strategy
+func (r *routers) router(ctx context.Context, strategy string) (Router, error) {
+	if strategy == "" {
+		strategy = r.tenants[TenantFromContext(ctx)]
+	}
+	if strategy == "" {
+		strategy = r.defaultStrategy
+	}
+
+	router, ok := r.byStrategy[strategy]
+	if !ok {
+		return nil, amerrors.ErrRoutingStrategyInvalidError("unknown routing strategy: " + strategy)
+	}
+	return router, nil
+}
+
+// TenantFromContext returns the tenant ID of the call ("" if not set, see tenant.FromContext)
+func TenantFromContext(ctx context.Context) string {
+	return tenant.FromContext(ctx)
+}
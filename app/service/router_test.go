@@ -0,0 +1,184 @@
+package service_test
+
+// Test routing strategies
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+
+	"github.com/newtonsystems/agent-mgmt/app/config"
+	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+	"github.com/newtonsystems/agent-mgmt/app/models"
+	"github.com/newtonsystems/agent-mgmt/app/service"
+	tu "github.com/newtonsystems/agent-mgmt/app/testutil"
+)
+
+var routerTime = time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)
+
+// routeIDs returns the agent IDs in the order the router returns them
+func routeIDs(t *testing.T, router service.Router, tasks models.TaskRepository, agents []models.Agent, limit int32) []int32 {
+	routed, err := router.Route(context.Background(), tasks, agents, limit)
+	tu.Ok(t, err)
+
+	var agentIDs []int32
+	for _, agent := range routed {
+		agentIDs = append(agentIDs, agent.AgentID)
+	}
+	return agentIDs
+}
+
+func routerAgents() []models.Agent {
+	return []models.Agent{
+		{AgentID: 3, StateChangedAt: routerTime.Add(-5 * time.Minute)},
+		{AgentID: 1, StateChangedAt: routerTime.Add(-10 * time.Minute)},
+		{AgentID: 4, StateChangedAt: routerTime.Add(-30 * time.Minute)},
+		{AgentID: 2, StateChangedAt: routerTime.Add(-10 * time.Minute)},
+	}
+}
+
+func TestRouterLongestIdle(t *testing.T) {
+	router, err := service.NewRouter(config.RoutingLongestIdle, 0)
+	tu.Ok(t, err)
+
+	tu.Equals(t, []int32{4, 1, 2, 3}, routeIDs(t, router, nil, routerAgents(), 0))
+	tu.Equals(t, []int32{4, 1}, routeIDs(t, router, nil, routerAgents(), 2))
+}
+
+func TestRouterRoundRobin(t *testing.T) {
+	router, err := service.NewRouter(config.RoutingRoundRobin, 0)
+	tu.Ok(t, err)
+
+	tu.Equals(t, []int32{1, 2, 3, 4}, routeIDs(t, router, nil, routerAgents(), 0))
+	tu.Equals(t, []int32{2, 3}, routeIDs(t, router, nil, routerAgents(), 2))
+	tu.Equals(t, []int32{3, 4, 1, 2}, routeIDs(t, router, nil, routerAgents(), 0))
+
+	// Agents 2 and 4 have gone so we wrap around to the first agent
+	tu.Equals(t, []int32{1, 3}, routeIDs(t, router, nil, routerAgents()[:2], 0))
+	tu.Equals(t, []int32{3, 1}, routeIDs(t, router, nil, routerAgents()[:2], 0))
+}
+
+func TestRouterLeastTasksToday(t *testing.T) {
+	session, db := tu.NewTestMemoryConnection()
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	service.NowFunc = func() time.Time { return routerTime }
+	defer func() { service.NowFunc = time.Now }()
+
+	inserts := []tu.TestModelInsert{
+		&models.Task{TaskID: 1, Status: models.TaskCompleted, AcceptedBy: 1, AcceptedAt: routerTime.Add(-2 * time.Hour)},
+		&models.Task{TaskID: 2, Status: models.TaskAccepted, AcceptedBy: 1, AcceptedAt: routerTime.Add(-time.Hour)},
+		&models.Task{TaskID: 3, Status: models.TaskCompleted, AcceptedBy: 3, AcceptedAt: routerTime.Add(-time.Hour)},
+		// Yesterday's tasks are not counted
+		&models.Task{TaskID: 4, Status: models.TaskCompleted, AcceptedBy: 2, AcceptedAt: routerTime.Add(-24 * time.Hour)},
+		&models.Task{TaskID: 5, Status: models.TaskCompleted, AcceptedBy: 2, AcceptedAt: routerTime.Add(-24 * time.Hour)},
+	}
+	tu.InsertCollectionToDB(t, db, "tasks", inserts)
+
+	router, err := service.NewRouter(config.RoutingLeastTasksToday, 0)
+	tu.Ok(t, err)
+
+	tasks := models.NewRepositories(session, tu.MongoDBName).Tasks
+
+	tu.Equals(t, []int32{2, 4, 3, 1}, routeIDs(t, router, tasks, routerAgents(), 0))
+	tu.Equals(t, []int32{2}, routeIDs(t, router, tasks, routerAgents(), 1))
+}
+
+func TestRouterRandom(t *testing.T) {
+	router, err := service.NewRouter(config.RoutingRandom, 42)
+	tu.Ok(t, err)
+	same, err := service.NewRouter(config.RoutingRandom, 42)
+	tu.Ok(t, err)
+
+	// The same seed gives the same order
+	for i := 0; i < 5; i++ {
+		agentIDs := routeIDs(t, router, nil, routerAgents(), 0)
+		tu.Equals(t, agentIDs, routeIDs(t, same, nil, routerAgents(), 0))
+		tu.Equals(t, 4, len(agentIDs))
+	}
+
+	tu.Equals(t, 2, len(routeIDs(t, router, nil, routerAgents(), 2)))
+}
+
+func TestRouterInvalid(t *testing.T) {
+	_, err := service.NewRouter("fastest-finger", 0)
+	tu.IsAmError(t, amerrors.ErrRoutingStrategyInvalid, err)
+}
+
+func TestRouterTenant(t *testing.T) {
+	session, db := tu.NewTestMemoryConnection()
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	service.NowFunc = func() time.Time { return routerTime }
+	defer func() { service.NowFunc = time.Now }()
+
+	inserts := []tu.TestModelInsert{
+		&models.Agent{AgentID: 1, State: models.AgentAvailable, LastHeartBeat: routerTime, StateChangedAt: routerTime.Add(-time.Minute)},
+		&models.Agent{AgentID: 2, State: models.AgentAvailable, LastHeartBeat: routerTime, StateChangedAt: routerTime.Add(-time.Hour)},
+	}
+	tu.InsertCollectionToDB(t, db, "agents", inserts)
+
+	cfg := config.Default()
+	cfg.TenantRoutingStrategies = map[string]string{"acme": config.RoutingRoundRobin}
+	s := service.NewBasicService(cfg, models.NewRepositories(session, tu.MongoDBName), nil, nil, nil)
+
+	// Default strategy (longest-idle)
+	agentIDs, err := s.GetAvailableAgents(context.Background(), 0, "", nil)
+	tu.Ok(t, err)
+	tu.Equals(t, []string{"2", "1"}, agentIDs)
+
+	// Tenant strategy (round-robin)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(service.TenantMetadataKey, "acme"))
+	tu.Equals(t, "acme", service.TenantFromContext(ctx))
+
+	agentIDs, err = s.GetAvailableAgents(ctx, 0, "", nil)
+	tu.Ok(t, err)
+	tu.Equals(t, []string{"1", "2"}, agentIDs)
+
+	agentIDs, err = s.GetAvailableAgents(ctx, 0, "", nil)
+	tu.Ok(t, err)
+	tu.Equals(t, []string{"2", "1"}, agentIDs)
+
+	// Request strategy beats the tenant strategy
+	agentIDs, err = s.GetAvailableAgents(ctx, 1, config.RoutingLongestIdle, nil)
+	tu.Ok(t, err)
+	tu.Equals(t, []string{"2"}, agentIDs)
+
+	_, err = s.GetAvailableAgents(ctx, 0, "fastest-finger", nil)
+	tu.IsAmError(t, amerrors.ErrRoutingStrategyInvalid, err)
+}
+
+func TestRouterLimit(t *testing.T) {
+	session, db := tu.NewTestMemoryConnection()
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	service.NowFunc = func() time.Time { return routerTime }
+	defer func() { service.NowFunc = time.Now }()
+
+	cfg := config.Default()
+	var inserts []tu.TestModelInsert
+	for _, agent := range routerAgents() {
+		agent := agent
+		agent.State = models.AgentAvailable
+		agent.LastHeartBeat = routerTime
+		inserts = append(inserts, &agent)
+	}
+	// Agent 5's heartbeat is only recent enough if one is buffered
+	inserts = append(inserts, &models.Agent{AgentID: 5, State: models.AgentAvailable, LastHeartBeat: cfg.AvailableSince(routerTime).Add(-time.Second), StateChangedAt: routerTime.Add(-time.Hour)})
+	tu.InsertCollectionToDB(t, db, "agents", inserts)
+
+	s := service.NewBasicService(cfg, models.NewRepositories(session, tu.MongoDBName), nil, nil, nil)
+
+	// The database orders and limits the agents the same as the routers
+	agentIDs, err := s.GetAvailableAgents(context.Background(), 2, config.RoutingLongestIdle, nil)
+	tu.Ok(t, err)
+	tu.Equals(t, []string{"4", "1"}, agentIDs)
+
+	for _, want := range [][]string{{"1", "2"}, {"2", "3"}, {"3", "4"}, {"4", "1"}, {"1", "2"}} {
+		agentIDs, err = s.GetAvailableAgents(context.Background(), 2, config.RoutingRoundRobin, nil)
+		tu.Ok(t, err)
+		tu.Equals(t, want, agentIDs)
+	}
+}
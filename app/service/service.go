@@ -4,18 +4,18 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
 	"strconv"
 	"time"
 
 	"github.com/go-kit/kit/log"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/metadata"
-	mgo "gopkg.in/mgo.v2"
 
+	"github.com/newtonsystems/agent-mgmt/app/config"
 	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+	"github.com/newtonsystems/agent-mgmt/app/heartbeat"
 	"github.com/newtonsystems/agent-mgmt/app/models"
 	"github.com/newtonsystems/agent-mgmt/app/utils"
+	"github.com/newtonsystems/agent-mgmt/app/watch"
 	"github.com/newtonsystems/grpc_types/go/grpc_types"
 	//"gopkg.in/mgo.v2/bson"
 )
@@ -36,79 +36,40 @@ func init() {
 type Service interface {
 	Sum(ctx context.Context, a, b int) (int, error)
 	Concat(ctx context.Context, a, b string) (string, error)
-	GetAvailableAgents(ctx context.Context, session models.Session, db string, limit int32) ([]string, error)
-	GetAgentIDFromRef(session models.Session, db string, refID string) (int32, error)
-	HeartBeat(session models.Session, db string, agentID int32) (grpc_types.HeartBeatResponse_HeartBeatStatus, error)
-	AddTask(session models.Session, db string, custID int32, agentIDs []int32) (int32, error)
-}
-
-// Elegantly ripped from https://github.com/letsencrypt/boulder/blob/f193137405a22057fe46a1e0e27f9d1c9e07de8b/grpc/errors.go
-// WrapError wraps the internal error types we use for transport across the gRPC
-// layer and appends an appropriate errortype to the gRPC trailer via the provided
-// context. errors.BoulderError error types are encoded using the grpc/metadata
-// in the context.Context for the RPC which is considered to be the 'proper'
-// method of encoding custom error types (grpc/grpc#4543 and grpc/grpc-go#478)
-func WrapError(ctx context.Context, err error) error {
-	if err == nil {
-		return nil
-	}
-	if aerr, ok := err.(*amerrors.AgentMgmtError); ok {
-		// Ignoring the error return here is safe because if setting the metadata
-		// fails, we'll still return an error, but it will be interpreted on the
-		// other side as an InternalServerError instead of a more specific one.
-		logger.Log("msg", "wrapping is current working I think ", "type", int(aerr.Type))
-		_ = grpc.SetTrailer(ctx, metadata.Pairs("errortype", strconv.Itoa(int(aerr.Type))))
-		return grpc.Errorf(codes.Unknown, err.Error())
-	}
-	return grpc.Errorf(codes.Unknown, err.Error())
-}
-
-// unwrapError unwraps errors returned from gRPC client calls which were wrapped
-// with wrapError to their proper internal error type. If the provided metadata
-// object has an "errortype" field, that will be used to set the type of the
-// error.
-func UnWrapError(err error, md metadata.MD) error {
-	if err == nil {
-		return nil
-	}
-	logger.Log("level", "debug", "msg", "UnWrapError()")
-	if errTypeStrs, ok := md["errortype"]; ok {
-
-		unwrappedErr := grpc.ErrorDesc(err)
-		if len(errTypeStrs) != 1 {
-			return amerrors.InternalServerError(
-				"multiple errorType metadata, wrapped error %q",
-				unwrappedErr,
-			)
-		}
-
-		errType, decErr := strconv.Atoi(errTypeStrs[0])
-		if decErr != nil {
-			return amerrors.InternalServerError(
-				"failed to decode error type, decoding error %q, wrapped error %q",
-				decErr,
-				unwrappedErr,
-			)
-		}
-		return amerrors.New(amerrors.ErrorType(errType), unwrappedErr)
-	}
-	logger.Log("level", "debug", "msg", "Failed to find errortype")
-	return err
+	GetAvailableAgents(ctx context.Context, limit int32, strategy string, skills []models.SkillRequirement) ([]string, error)
+	GetAgentIDFromRef(ctx context.Context, refID string) (int32, error)
+	HeartBeat(ctx context.Context, agentID int32) (grpc_types.HeartBeatResponse_HeartBeatStatus, time.Duration, error)
+	AddTask(ctx context.Context, custID int32, agentIDs []int32, skills []models.SkillRequirement) (int32, error)
+	OfferTask(ctx context.Context, taskID int32, agentIDs []int32) (models.Task, error)
+	AcceptCall(ctx context.Context, agentID int32, taskID int32) (models.Task, error)
+	StartTask(ctx context.Context, agentID int32, taskID int32) (models.Task, error)
+	CompleteTask(ctx context.Context, agentID int32, taskID int32) (models.Task, error)
+	GetTask(ctx context.Context, taskID int32) (models.Task, error)
+	ListTasks(ctx context.Context, custID int32, agentID int32, status string, limit int32) ([]models.Task, error)
+	CancelTask(ctx context.Context, taskID int32, abandoned bool) (models.Task, error)
+	SetAgentState(ctx context.Context, agentID int32, state string) error
+	SetAgentSkills(ctx context.Context, agentID int32, skills []models.Skill) (models.Agent, error)
+	RegisterAgent(ctx context.Context) (int32, error)
+	DeregisterAgent(ctx context.Context, agentID int32) error
+	WatchAgents(ctx context.Context) ([]models.Agent, *watch.Watcher, error)
+	ConnectAgent(ctx context.Context, agentID int32) (*heartbeat.Conn, time.Duration, error)
+	KeepAlive(ctx context.Context, agentID int32, sinceLastBeat time.Duration) error
+	DisconnectAgent(ctx context.Context, conn *heartbeat.Conn) error
 }
 
 // NewService returns a basic Service with all of the expected middlewares wired in.
-func NewService(logger log.Logger, metrics *Metrics) Service {
+func NewService(cfg config.Config, repos models.TenantRepositories, logger log.Logger, metrics *Metrics, events *watch.Hub, agents *heartbeat.Registry, beats *heartbeat.Buffer) Service {
 
 	var svc Service
 	{
-		svc = NewBasicService()
+		svc = NewBasicService(cfg, repos, events, agents, beats)
 
 		if logger != nil {
 			svc = LoggingMiddleware(logger)(svc)
 		}
 
 		if metrics != nil {
-			svc = InstrumentingMiddleware(metrics)(svc)
+			svc = InstrumentingMiddleware(metrics, cfg)(svc)
 		}
 	}
 
@@ -133,12 +94,26 @@ var (
 	//ErrAgentIDNotFound.metadata = metadata.
 )
 
-// NewBasicService returns a naïve, stateless implementation of Service.
-func NewBasicService() Service {
-	return basicService{}
+// NewBasicService returns a naïve, stateless implementation of Service
+// storing agents, tasks etc. in repos (each call in its tenant's repositories).
+// cfg sets how long agents stay available after a heartbeat and how often they should beat
+// and how available agents are routed. Agent availability changes are published to events
+// (see WatchAgents, events may be nil) and commands are pushed to the agents
+// connected to agents (see ConnectAgent, agents may be nil). Heartbeats are
+// buffered in beats and written by its flusher (beats may be nil to write them
+// straight away).
+func NewBasicService(cfg config.Config, repos models.TenantRepositories, events *watch.Hub, agents *heartbeat.Registry, beats *heartbeat.Buffer) Service {
+	return basicService{cfg: cfg, repos: repos, routers: newRouters(cfg), events: events, agents: agents, beats: beats}
 }
 
-type basicService struct{}
+type basicService struct {
+	cfg     config.Config
+	repos   models.TenantRepositories
+	routers *routers
+	events  *watch.Hub
+	agents  *heartbeat.Registry
+	beats   *heartbeat.Buffer
+}
 
 const (
 	intMax = 1<<31 - 1
@@ -179,51 +154,73 @@ func TBD() {
 }
 
 // HeartBeat() updates heartbeat for given agent id (LastHeartBeat)
-func (s basicService) HeartBeat(session models.Session, db string, agentID int32) (grpc_types.HeartBeatResponse_HeartBeatStatus, error) {
+// and returns how long the client should wait before its next heartbeat
+func (s basicService) HeartBeat(ctx context.Context, agentID int32) (grpc_types.HeartBeatResponse_HeartBeatStatus, time.Duration, error) {
+	logger := ContextLogger(ctx, logger)
 
 	logger.Log("level", "debug", "msg", "Updating heartbeat for agent ID: "+strconv.Itoa(int(agentID)))
 
-	// NOTE: Concurrent requests will not work otherwises
-	// Request a socket connection from the session to process our query.
-	// Close the session when the goroutine exits and put the connection back
-	// into the pool.
-	sessionCopy := session.Copy()
-	defer sessionCopy.Close()
+	next := s.cfg.HeartBeatInterval
 
-	exists, err := sessionCopy.DB(db).AgentExists(agentID)
+	repos, err := s.repos.For(ctx)
+
+	if err != nil {
+		return grpc_types.HeartBeatResponse_HEARTBEAT_FAILED, next, err
+	}
 
-	if !exists {
+	// An agent that beat within the window is known to exist and be online so
+	// its heartbeat is only buffered (and written by the flusher)
+	now := NowFunc()
+	if last, ok := s.beats.LastBeat(repos.Tenant, agentID); ok && last.After(s.cfg.AvailableSince(now)) {
+		s.beats.Beat(repos.Tenant, agentID, now)
+		return grpc_types.HeartBeatResponse_HEARTBEAT_SUCCESSFUL, next, nil
+	}
+
+	agent, err := repos.Agents.Find(ctx, agentID)
+
+	if err != nil {
 		logger.Log("level", "err", "err", err)
-		return grpc_types.HeartBeatResponse_HEARTBEAT_FAILED, err
+		return grpc_types.HeartBeatResponse_HEARTBEAT_FAILED, next, err
 	}
 
-	err = sessionCopy.DB(db).HeartBeat(agentID)
+	err = repos.Agents.HeartBeat(ctx, agentID)
 
 	if err != nil {
 		logger.Log("level", "err", "msg", "Failed to update heartbeat for agent id: "+strconv.Itoa(int(agentID)), "err", err)
-		return grpc_types.HeartBeatResponse_HEARTBEAT_FAILED, err
+		return grpc_types.HeartBeatResponse_HEARTBEAT_FAILED, next, err
 	}
 
-	return grpc_types.HeartBeatResponse_HEARTBEAT_SUCCESSFUL, err
+	s.beats.Record(repos.Tenant, agentID, now)
+
+	// Offline agents become available on their heartbeat and available agents
+	// whose heartbeat had gone stale are available again
+	wasAvailable := agent.State == models.AgentAvailable && agent.LastHeartBeat.After(s.cfg.AvailableSince(now))
+	if !wasAvailable && (agent.State == models.AgentAvailable || agent.State == models.AgentOffline || agent.State == "") {
+		s.events.Publish(watch.Event{Type: watch.EventAvailable, Tenant: repos.Tenant, AgentID: agentID, At: now})
+	}
+
+	return grpc_types.HeartBeatResponse_HEARTBEAT_SUCCESSFUL, next, err
 }
 
-// TODO: Will need to create some sort of cleanup for the database?
-func (s basicService) GetAgentIDFromRef(session models.Session, db string, refID string) (int32, error) {
+// GetAgentIDFromRef returns the agent ID for a phone session reference
+// (stale phone sessions are removed by the reaper)
+func (s basicService) GetAgentIDFromRef(ctx context.Context, refID string) (int32, error) {
+	logger := ContextLogger(ctx, logger)
+
 	// Get Agent ID from session data
 	logger.Log("level", "debug", "msg", "Getting available agent ID from ref ID: "+refID)
 
-	// NOTE: Concurrent requests will not work otherwises
-	// Request a socket connection from the session to process our query.
-	// Close the session when the goroutine exits and put the connection back
-	// into the pool.
-	sessionCopy := session.Copy()
-	defer sessionCopy.Close()
+	repos, err := s.repos.For(ctx)
 
-	agentID, err := sessionCopy.DB(db).GetAgentIDFromRef(refID)
+	if err != nil {
+		return 0, err
+	}
 
-	if agentID == 0 {
+	agentID, err := repos.PhoneSessions.FindAgentID(ctx, refID)
+
+	if amerrors.Is(err, amerrors.ErrAgentIDNotFound) {
 		logger.Log("level", "warn", "msg", "Failed to get agent ID from ref ID", "err", err)
-		return 0, amerrors.ErrAgentIDNotFoundError("failed to find an Agent from ref id")
+		return 0, err
 	}
 
 	if err != nil {
@@ -231,33 +228,83 @@ func (s basicService) GetAgentIDFromRef(session models.Session, db string, refID
 		return 0, err
 	}
 
-	return agentID, err
+	// A phone session without an agent
+	if agentID == 0 {
+		logger.Log("level", "warn", "msg", "Failed to get agent ID from ref ID", "ref_id", refID)
+		return 0, amerrors.ErrAgentIDNotFoundError("failed to find an Agent from ref id " + refID)
+	}
+
+	return agentID, nil
 }
 
-func (s basicService) GetAvailableAgents(_ context.Context, session models.Session, db string, limit int32) ([]string, error) {
+func (s basicService) GetAvailableAgents(ctx context.Context, limit int32, strategy string, skills []models.SkillRequirement) ([]string, error) {
+	logger := ContextLogger(ctx, logger)
+
 	// Find available agents from Mongo.
-	// models.Agents are considered available if the heartbeat has been received in
-	// the last minute (heartbeats should be every 30 secs)
+	// models.Agents are considered available if they are in the available state and
+	// the heartbeat has been received within the staleness window plus grace period
+	// (by default the last minute, heartbeats should be every 30 secs)
+	// Agents on a call (or busy, away etc.) are never offered another one
+	// The agents are then ordered by the routing strategy (request, tenant then default)
+	// With skills only agents with the required skills are returned, best match first
 	logger.Log("level", "debug", "msg", "Getting available agents from mongo with limit: "+strconv.Itoa(int(limit)))
 
-	minuteAgoDate := NowFunc().Add(-time.Minute)
-	logger.Log("level", "debug", "msg", "Getting available agents with heartbeats no older than "+minuteAgoDate.Format("01/02/2006 03:04:05"))
+	var agentIDs []string
+	repos, err := s.repos.For(ctx)
 
-	// NOTE: Concurrent requests will not work otherwises
-	// Request a socket connection from the session to process our query.
-	// Close the session when the goroutine exits and put the connection back
-	// into the pool.
-	sessionCopy := session.Copy()
-	defer sessionCopy.Close()
+	if err != nil {
+		return agentIDs, err
+	}
 
-	var agentIDs []string
-	agents, err := sessionCopy.DB(db).GetAgents(minuteAgoDate, limit)
+	router, err := s.routers.router(ctx, strategy)
 
 	if err != nil {
-		logger.Log("level", "err", "msg", "Failed to get agents", "err", err)
+		logger.Log("level", "warn", "msg", "Failed to get router", "err", err)
+		return agentIDs, err
+	}
+
+	if err = models.ValidateSkillRequirements(skills); err != nil {
+		logger.Log("level", "warn", "msg", "Invalid skill requirements", "err", err)
 		return agentIDs, err
 	}
 
+	sinceDate := s.cfg.AvailableSince(NowFunc())
+	logger.Log("level", "debug", "msg", "Getting available agents with heartbeats no older than "+sinceDate.Format("01/02/2006 03:04:05"))
+
+	var agents []models.Agent
+	if ordered, ok := router.(orderedRouter); ok && limit > 0 && len(skills) == 0 {
+		// The database orders the agents so only the first limit are read
+		agents, err = ordered.RouteOrdered(func(order models.AgentOrder, n int32) ([]models.Agent, error) {
+			return s.availableAgents(ctx, repos, sinceDate, nil, order, n)
+		}, limit)
+
+		if err != nil {
+			logger.Log("level", "err", "msg", "Failed to route agents", "err", err)
+			return agentIDs, err
+		}
+	} else {
+		// The router (or ranking by skills) needs every available agent to choose from
+		agents, err = s.availableAgents(ctx, repos, sinceDate, skills, models.AgentOrder{}, 0)
+
+		if err != nil {
+			logger.Log("level", "err", "msg", "Failed to get agents", "err", err)
+			return agentIDs, err
+		}
+
+		agents, err = router.Route(ctx, repos.Tasks, agents, 0)
+
+		if err != nil {
+			logger.Log("level", "err", "msg", "Failed to route agents", "err", err)
+			return agentIDs, err
+		}
+	}
+
+	// Routing order breaks ties between agents with the same skills score
+	agents = models.RankBySkills(agents, skills)
+	if limit > 0 && len(agents) > int(limit) {
+		agents = agents[:limit]
+	}
+
 	logger.Log("level", "info", "msg", "Found "+strconv.Itoa(len(agents))+" available agents")
 	logger.Log("level", "debug", "query", fmt.Sprintf("%#v", agents))
 
@@ -269,26 +316,613 @@ func (s basicService) GetAvailableAgents(_ context.Context, session models.Sessi
 	return agentIDs, nil
 }
 
-// AddTask adds a new task to the db and returns the new task's taskid
-func (s basicService) AddTask(session models.Session, db string, custID int32, agentIDs []int32) (int32, error) {
-	logger.Log("level", "debug", "msg", fmt.Sprintf("Adding task with custID: %d, agentIDs: %#v", custID, agentIDs))
+// AddTask adds a new task needing skills to the db and returns the new task's taskid
+func (s basicService) AddTask(ctx context.Context, custID int32, agentIDs []int32, skills []models.SkillRequirement) (int32, error) {
+	logger := ContextLogger(ctx, logger)
 
-	// NOTE: Concurrent requests will not work otherwises
-	// Request a socket connection from the session to process our query.
-	// Close the session when the goroutine exits and put the connection back
-	// into the pool.
-	sessionCopy := session.Copy()
+	logger.Log("level", "debug", "msg", fmt.Sprintf("Adding task with custID: %d, agentIDs: %#v", custID, agentIDs))
 
-	sessionCopy.SetMode(mgo.Strong, false)
+	repos, err := s.repos.For(ctx)
 
-	defer sessionCopy.Close()
+	if err != nil {
+		return 0, err
+	}
 
-	taskID, err := sessionCopy.DB(db).AddTask(custID, agentIDs)
+	taskID, err := repos.Tasks.Add(ctx, custID, agentIDs, skills)
 
 	if err != nil {
 		logger.Log("level", "err", "msg", "Failed to add task", "err", err)
 		return 0, err
 	}
 
+	s.publishAssigned(repos.Tenant, taskID, agentIDs...)
+
+	// Agents with a heartbeat stream are offered the task straight away
+	for _, agentID := range agentIDs {
+		s.agents.Send(repos.Tenant, agentID, heartbeat.Command{Type: heartbeat.CommandOfferTask, TaskID: taskID, CustID: custID})
+	}
+
 	return taskID, nil
 }
+
+// OfferTask offers a queued task (one added without agents) to agent ids.
+// The task goes from queued to offered.
+func (s basicService) OfferTask(ctx context.Context, taskID int32, agentIDs []int32) (models.Task, error) {
+	logger := ContextLogger(ctx, logger)
+
+	logger.Log("level", "debug", "msg", fmt.Sprintf("Offering task: %d to agent IDs: %v", taskID, agentIDs))
+
+	if len(agentIDs) == 0 {
+		return models.Task{}, amerrors.ErrInvalidArgumentError("Task(TaskID=%d) must be offered to at least one agent", taskID)
+	}
+
+	repos, err := s.repos.For(ctx)
+
+	if err != nil {
+		return models.Task{}, err
+	}
+
+	task, err := repos.Tasks.Offer(ctx, taskID, agentIDs)
+
+	if err != nil {
+		logger.Log("level", "err", "msg", fmt.Sprintf("Failed to offer task: %d", taskID), "err", err)
+		return models.Task{}, err
+	}
+
+	s.publishAssigned(repos.Tenant, taskID, agentIDs...)
+
+	for _, agentID := range agentIDs {
+		s.agents.Send(repos.Tenant, agentID, heartbeat.Command{Type: heartbeat.CommandOfferTask, TaskID: taskID, CustID: task.CustID})
+	}
+
+	return task, nil
+}
+
+// transitionAgent moves the agent to state to if allowed from its current state
+// and returns the state the agent was in
+func transitionAgent(ctx context.Context, agents models.AgentRepository, agentID int32, to models.AgentState) (models.AgentState, error) {
+	agent, err := agents.Find(ctx, agentID)
+
+	if err != nil {
+		return "", err
+	}
+
+	if !models.CanTransition(agent.State, to) {
+		return agent.State, amerrors.ErrAgentStateTransitionError(fmt.Sprintf("Agent(AgentID=%d) cannot go from %q to %q", agentID, agent.State, to))
+	}
+
+	return agent.State, agents.SetState(ctx, agentID, agent.State, to)
+}
+
+// AcceptCall accepts a task (created by AddTask) for agent id. The other
+// candidate agents for the task are released. A task can only be accepted once.
+// The agent must be available and goes on-call.
+func (s basicService) AcceptCall(ctx context.Context, agentID int32, taskID int32) (models.Task, error) {
+	logger := ContextLogger(ctx, logger)
+
+	logger.Log("level", "debug", "msg", fmt.Sprintf("Accepting task: %d for agent ID: %d", taskID, agentID))
+
+	repos, err := s.repos.For(ctx)
+
+	if err != nil {
+		return models.Task{}, err
+	}
+
+	from, err := transitionAgent(ctx, repos.Agents, agentID, models.AgentOnCall)
+
+	if err != nil {
+		logger.Log("level", "err", "err", err)
+		return models.Task{}, err
+	}
+
+	task, err := repos.Tasks.Accept(ctx, taskID, agentID)
+
+	if err != nil {
+		logger.Log("level", "err", "msg", fmt.Sprintf("Failed to accept task: %d for agent ID: %d", taskID, agentID), "err", err)
+
+		// The agent did not get the call so put them back
+		if errRestore := repos.Agents.SetState(ctx, agentID, models.AgentOnCall, from); errRestore != nil {
+			logger.Log("level", "err", "msg", fmt.Sprintf("Failed to restore agent ID: %d state to %q", agentID, from), "err", errRestore)
+		}
+		return models.Task{}, err
+	}
+
+	logger.Log("level", "debug", "msg", fmt.Sprintf("Task: %d accepted, released agent IDs: %v", taskID, task.ReleasedAgentIDs))
+
+	s.publishAssigned(repos.Tenant, taskID, agentID)
+
+	return task, nil
+}
+
+// StartTask records that agent id, who accepted the task, is connected to the
+// customer. The task goes from accepted to in-progress.
+func (s basicService) StartTask(ctx context.Context, agentID int32, taskID int32) (models.Task, error) {
+	logger := ContextLogger(ctx, logger)
+
+	logger.Log("level", "debug", "msg", fmt.Sprintf("Starting task: %d for agent ID: %d", taskID, agentID))
+
+	repos, err := s.repos.For(ctx)
+
+	if err != nil {
+		return models.Task{}, err
+	}
+
+	task, err := repos.Tasks.Find(ctx, taskID)
+
+	if err != nil {
+		logger.Log("level", "err", "err", err)
+		return models.Task{}, err
+	}
+
+	if task.AcceptedBy != agentID {
+		return models.Task{}, amerrors.ErrTaskNotAcceptedError(fmt.Sprintf("Task(TaskID=%d) was not accepted by Agent(AgentID=%d)", taskID, agentID))
+	}
+
+	if !models.CanTransitionTask(task.Status, models.TaskInProgress) {
+		return models.Task{}, amerrors.ErrTaskStatusTransitionError(fmt.Sprintf("Task(TaskID=%d) cannot go from %q to %q", taskID, task.Status, models.TaskInProgress))
+	}
+
+	task, err = repos.Tasks.SetStatus(ctx, taskID, task.Status, models.TaskInProgress)
+
+	if err != nil {
+		logger.Log("level", "err", "msg", fmt.Sprintf("Failed to start task: %d for agent ID: %d", taskID, agentID), "err", err)
+		return models.Task{}, err
+	}
+
+	return task, nil
+}
+
+// CompleteTask completes a task accepted by agent id. The agent goes from on-call to wrap-up.
+func (s basicService) CompleteTask(ctx context.Context, agentID int32, taskID int32) (models.Task, error) {
+	logger := ContextLogger(ctx, logger)
+
+	logger.Log("level", "debug", "msg", fmt.Sprintf("Completing task: %d for agent ID: %d", taskID, agentID))
+
+	repos, err := s.repos.For(ctx)
+
+	if err != nil {
+		return models.Task{}, err
+	}
+
+	task, err := repos.Tasks.Complete(ctx, taskID, agentID)
+
+	if err != nil {
+		logger.Log("level", "err", "msg", fmt.Sprintf("Failed to complete task: %d for agent ID: %d", taskID, agentID), "err", err)
+		return models.Task{}, err
+	}
+
+	// The task is complete either way. The agent may have already moved on (e.g. gone offline)
+	err = repos.Agents.SetState(ctx, agentID, models.AgentOnCall, models.AgentWrapUp)
+
+	if err != nil {
+		logger.Log("level", "warn", "msg", fmt.Sprintf("Agent ID: %d not moved to wrap-up", agentID), "err", err)
+	}
+
+	return task, nil
+}
+
+// GetTask returns the task with task id
+func (s basicService) GetTask(ctx context.Context, taskID int32) (models.Task, error) {
+	logger := ContextLogger(ctx, logger)
+
+	logger.Log("level", "debug", "msg", fmt.Sprintf("Getting task: %d", taskID))
+
+	repos, err := s.repos.For(ctx)
+
+	if err != nil {
+		return models.Task{}, err
+	}
+
+	task, err := repos.Tasks.Find(ctx, taskID)
+
+	if err != nil {
+		logger.Log("level", "err", "err", err)
+		return models.Task{}, err
+	}
+
+	return task, nil
+}
+
+// ListTasks returns the tasks for cust id, agent id and status (zero values
+// match any task). Oldest first, limit 0 returns all matching tasks.
+func (s basicService) ListTasks(ctx context.Context, custID int32, agentID int32, status string, limit int32) ([]models.Task, error) {
+	logger := ContextLogger(ctx, logger)
+
+	logger.Log("level", "debug", "msg", fmt.Sprintf("Listing tasks for cust ID: %d agent ID: %d status: %q", custID, agentID, status))
+
+	repos, err := s.repos.For(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	filter := models.TaskFilter{CustID: custID, AgentID: agentID}
+
+	if status != "" {
+		taskStatus, err := models.ParseTaskStatus(status)
+
+		if err != nil {
+			return nil, err
+		}
+		filter.Status = taskStatus
+	}
+
+	tasks, err := repos.Tasks.FindAll(ctx, filter, limit)
+
+	if err != nil {
+		logger.Log("level", "err", "msg", "Failed to list tasks", "err", err)
+		return nil, err
+	}
+
+	return tasks, nil
+}
+
+// CancelTask cancels a task that has not ended yet (abandoned if the customer
+// gave up). If the task was accepted the agent goes from on-call to wrap-up.
+func (s basicService) CancelTask(ctx context.Context, taskID int32, abandoned bool) (models.Task, error) {
+	logger := ContextLogger(ctx, logger)
+
+	to := models.TaskCancelled
+	if abandoned {
+		to = models.TaskAbandoned
+	}
+
+	logger.Log("level", "debug", "msg", fmt.Sprintf("Moving task: %d to %q", taskID, to))
+
+	repos, err := s.repos.For(ctx)
+
+	if err != nil {
+		return models.Task{}, err
+	}
+
+	task, err := repos.Tasks.Find(ctx, taskID)
+
+	if err != nil {
+		logger.Log("level", "err", "err", err)
+		return models.Task{}, err
+	}
+
+	if !models.CanTransitionTask(task.Status, to) {
+		return models.Task{}, amerrors.ErrTaskStatusTransitionError(fmt.Sprintf("Task(TaskID=%d) cannot go from %q to %q", taskID, task.Status, to))
+	}
+
+	task, err = repos.Tasks.SetStatus(ctx, taskID, task.Status, to)
+
+	if err != nil {
+		logger.Log("level", "err", "msg", fmt.Sprintf("Failed to move task: %d to %q", taskID, to), "err", err)
+		return models.Task{}, err
+	}
+
+	if task.AcceptedBy != 0 {
+		// The call is over either way. The agent may have already moved on (e.g. gone offline)
+		err = repos.Agents.SetState(ctx, task.AcceptedBy, models.AgentOnCall, models.AgentWrapUp)
+
+		if err != nil {
+			logger.Log("level", "warn", "msg", fmt.Sprintf("Agent ID: %d not moved to wrap-up", task.AcceptedBy), "err", err)
+		}
+	}
+
+	return task, nil
+}
+
+// SetAgentState changes the presence state of agent id (e.g. available, busy, away, offline)
+// on-call and wrap-up are only entered via AcceptCall and CompleteTask
+func (s basicService) SetAgentState(ctx context.Context, agentID int32, state string) error {
+	logger := ContextLogger(ctx, logger)
+
+	logger.Log("level", "debug", "msg", fmt.Sprintf("Setting agent ID: %d state to %q", agentID, state))
+
+	repos, err := s.repos.For(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	to, err := models.ParseAgentState(state)
+
+	if err != nil {
+		return err
+	}
+
+	if to == models.AgentOnCall || to == models.AgentWrapUp {
+		return amerrors.ErrAgentStateTransitionError(fmt.Sprintf("Agent(AgentID=%d) cannot be set to %q directly", agentID, to))
+	}
+
+	agent, err := repos.Agents.Find(ctx, agentID)
+
+	if err != nil {
+		logger.Log("level", "err", "err", err)
+		return err
+	}
+
+	if agent.State == to {
+		return nil
+	}
+
+	from, err := transitionAgent(ctx, repos.Agents, agentID, to)
+
+	if err != nil {
+		logger.Log("level", "err", "msg", fmt.Sprintf("Failed to set agent ID: %d state to %q", agentID, to), "err", err)
+		return err
+	}
+
+	// An offline agent's next heartbeat has to make it available again
+	if to == models.AgentOffline {
+		s.beats.Forget(repos.Tenant, agentID)
+	}
+
+	switch {
+	case to == models.AgentAvailable:
+		s.events.Publish(watch.Event{Type: watch.EventAvailable, Tenant: repos.Tenant, AgentID: agentID, At: NowFunc()})
+	case from == models.AgentAvailable:
+		s.events.Publish(watch.Event{Type: watch.EventUnavailable, Tenant: repos.Tenant, AgentID: agentID, At: NowFunc()})
+	}
+
+	return nil
+}
+
+// SetAgentSkills replaces the skill profile of agent id (admin) used for skills-based
+// routing by GetAvailableAgents
+func (s basicService) SetAgentSkills(ctx context.Context, agentID int32, skills []models.Skill) (models.Agent, error) {
+	logger := ContextLogger(ctx, logger)
+
+	logger.Log("level", "debug", "msg", fmt.Sprintf("Setting agent ID: %d skills to %#v", agentID, skills))
+
+	if err := models.ValidateSkills(skills); err != nil {
+		return models.Agent{}, err
+	}
+
+	repos, err := s.repos.For(ctx)
+
+	if err != nil {
+		return models.Agent{}, err
+	}
+
+	agent, err := repos.Agents.SetSkills(ctx, agentID, skills)
+
+	if err != nil {
+		logger.Log("level", "err", "msg", fmt.Sprintf("Failed to set agent ID: %d skills", agentID), "err", err)
+		return models.Agent{}, err
+	}
+
+	return agent, nil
+}
+
+// RegisterAgent creates a new agent and returns the new agent's agentid
+func (s basicService) RegisterAgent(ctx context.Context) (int32, error) {
+	logger := ContextLogger(ctx, logger)
+
+	logger.Log("level", "debug", "msg", "Registering new agent")
+
+	repos, err := s.repos.For(ctx)
+
+	if err != nil {
+		return 0, err
+	}
+
+	agentID, err := repos.Agents.Add(ctx)
+
+	if err != nil {
+		logger.Log("level", "err", "msg", "Failed to register agent", "err", err)
+		return 0, err
+	}
+
+	return agentID, nil
+}
+
+// DeregisterAgent removes the agent (it will no longer be returned by GetAvailableAgents)
+func (s basicService) DeregisterAgent(ctx context.Context, agentID int32) error {
+	logger := ContextLogger(ctx, logger)
+
+	logger.Log("level", "debug", "msg", "Deregistering agent ID: "+strconv.Itoa(int(agentID)))
+
+	repos, err := s.repos.For(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	err = repos.Agents.Remove(ctx, agentID)
+
+	if err != nil {
+		logger.Log("level", "err", "msg", "Failed to deregister agent id: "+strconv.Itoa(int(agentID)), "err", err)
+		return err
+	}
+
+	s.events.Publish(watch.Event{Type: watch.EventDeregistered, Tenant: repos.Tenant, AgentID: agentID, At: NowFunc()})
+	s.agents.Disconnect(repos.Tenant, agentID, amerrors.ErrStreamClosedError("Agent(AgentID=%d) was deregistered", agentID))
+	s.beats.Forget(repos.Tenant, agentID)
+
+	return nil
+}
+
+// WatchAgents returns the available agents and a watcher of their availability
+// changes from then on. The caller must Close the watcher.
+// The snapshot is read from the database but the changes are only those made
+// by this instance (see watch.Hub): changes made through other instances are
+// not seen until the caller watches again.
+func (s basicService) WatchAgents(ctx context.Context) ([]models.Agent, *watch.Watcher, error) {
+	logger := ContextLogger(ctx, logger)
+
+	logger.Log("level", "debug", "msg", "Watching agents")
+
+	repos, err := s.repos.For(ctx)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Watch before the snapshot so no change is missed (a change may be in both)
+	watcher, err := s.events.Watch(repos.Tenant)
+
+	if err != nil {
+		logger.Log("level", "warn", "msg", "Failed to watch agents", "err", err)
+		return nil, nil, err
+	}
+
+	agents, err := s.availableAgents(ctx, repos, s.cfg.AvailableSince(NowFunc()), nil, models.AgentOrder{}, 0)
+
+	if err != nil {
+		logger.Log("level", "err", "msg", "Failed to get agents", "err", err)
+		watcher.Close()
+		return nil, nil, err
+	}
+
+	return agents, watcher, nil
+}
+
+// ConnectAgent heartbeats agent id (see HeartBeat) and connects its heartbeat
+// stream. Commands for the agent are sent on the returned Conn until it is
+// given to DisconnectAgent. It returns how often the agent should send
+// heartbeats on the stream.
+func (s basicService) ConnectAgent(ctx context.Context, agentID int32) (*heartbeat.Conn, time.Duration, error) {
+	logger := ContextLogger(ctx, logger)
+
+	logger.Log("level", "debug", "msg", "Connecting heartbeat stream for agent ID: "+strconv.Itoa(int(agentID)))
+
+	repos, err := s.repos.For(ctx)
+
+	if err != nil {
+		return nil, s.cfg.HeartBeatInterval, err
+	}
+
+	_, next, err := s.HeartBeat(ctx, agentID)
+
+	if err != nil {
+		return nil, next, err
+	}
+
+	conn, err := s.agents.Connect(repos.Tenant, agentID)
+
+	if err != nil {
+		logger.Log("level", "warn", "msg", "Failed to connect heartbeat stream", "err", err)
+		return nil, next, err
+	}
+
+	return conn, next, nil
+}
+
+// KeepAlive keeps a streaming agent available. It costs a single write, or
+// none when heartbeats are buffered (the agent is known to exist since
+// ConnectAgent), and fails with
+// ErrHeartBeatMissed if the agent has not sent a heartbeat on its stream
+// within the staleness window.
+func (s basicService) KeepAlive(ctx context.Context, agentID int32, sinceLastBeat time.Duration) error {
+	logger := ContextLogger(ctx, logger)
+
+	now := NowFunc()
+	if window := now.Sub(s.cfg.AvailableSince(now)); sinceLastBeat > window {
+		return amerrors.ErrHeartBeatMissedError("Agent(AgentID=%d) has not sent a heartbeat for %s", agentID, sinceLastBeat)
+	}
+
+	repos, err := s.repos.For(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	if s.beats != nil {
+		s.beats.Beat(repos.Tenant, agentID, now)
+		return nil
+	}
+
+	n, err := repos.Agents.Touch(ctx, []int32{agentID})
+
+	if err != nil {
+		logger.Log("level", "err", "msg", "Failed to keep agent id: "+strconv.Itoa(int(agentID))+" alive", "err", err)
+		return err
+	}
+
+	if n == 0 {
+		return amerrors.ErrAgentNotFoundError("failed to find an Agent(AgentID=" + strconv.Itoa(int(agentID)) + ")")
+	}
+
+	return nil
+}
+
+// DisconnectAgent closes the agent's heartbeat stream. If the agent went away
+// (rather than opening a new stream or the server ending it) it is marked
+// offline straight away instead of after the staleness window.
+func (s basicService) DisconnectAgent(ctx context.Context, conn *heartbeat.Conn) error {
+	logger := ContextLogger(ctx, logger)
+
+	if !conn.Close() {
+		return nil
+	}
+	s.beats.Forget(conn.Tenant, conn.AgentID)
+
+	logger.Log("level", "debug", "msg", "Heartbeat stream closed for agent ID: "+strconv.Itoa(int(conn.AgentID)))
+
+	repos, err := s.repos.For(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	agent, err := repos.Agents.Find(ctx, conn.AgentID)
+
+	if err != nil {
+		logger.Log("level", "err", "msg", "Failed to get agent", "err", err)
+		return err
+	}
+
+	if agent.State == models.AgentOffline || agent.State == "" {
+		return nil
+	}
+
+	err = repos.Agents.SetState(ctx, conn.AgentID, agent.State, models.AgentOffline)
+
+	if err != nil {
+		logger.Log("level", "err", "msg", "Failed to mark agent id: "+strconv.Itoa(int(conn.AgentID))+" offline", "err", err)
+		return err
+	}
+
+	s.events.Publish(watch.Event{Type: watch.EventDisconnected, Tenant: conn.Tenant, AgentID: conn.AgentID, At: NowFunc()})
+
+	return nil
+}
+
+// availableAgents returns the available agents of repos with a heartbeat after since
+// and the required skills in order, at most limit (0 is no limit). Buffered
+// heartbeats are newer than the database's (by up to a flush interval) so they
+// are read first.
+func (s basicService) availableAgents(ctx context.Context, repos models.Repositories, since time.Time, skills []models.SkillRequirement, order models.AgentOrder, limit int32) ([]models.Agent, error) {
+	n := limit
+	for {
+		agents, err := repos.Agents.FindByState(ctx, models.AgentAvailable, since.Add(-s.cfg.HeartBeatFlushInterval), skills, order, n)
+
+		if err != nil {
+			return nil, err
+		}
+
+		s.beats.Overlay(repos.Tenant, agents)
+
+		available := agents[:0]
+		for _, agent := range agents {
+			if agent.LastHeartBeat.After(since) {
+				available = append(available, agent)
+			}
+		}
+
+		// Agents whose heartbeat is too old once the buffered heartbeats are
+		// read don't count towards the limit, so read more if there are more
+		if n == 0 || len(available) >= int(limit) || len(agents) < int(n) {
+			return firstAgents(available, limit), nil
+		}
+		if n > math.MaxInt32/2 {
+			n = 0
+		} else {
+			n *= 2
+		}
+	}
+}
+
+// publishAssigned publishes that tenant's agents were assigned task id
+func (s basicService) publishAssigned(tenant string, taskID int32, agentIDs ...int32) {
+	now := NowFunc()
+	var events []watch.Event
+	for _, agentID := range agentIDs {
+		events = append(events, watch.Event{Type: watch.EventAssigned, Tenant: tenant, AgentID: agentID, TaskID: taskID, At: now})
+	}
+	s.events.Publish(events...)
+}
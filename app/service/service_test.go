@@ -6,6 +6,7 @@ package service_test
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
@@ -14,11 +15,21 @@ import (
 	"testing"
 	"time"
 
+	"github.com/go-kit/kit/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/newtonsystems/agent-mgmt/app/config"
 	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+	"github.com/newtonsystems/agent-mgmt/app/heartbeat"
 	"github.com/newtonsystems/agent-mgmt/app/models"
+	"github.com/newtonsystems/agent-mgmt/app/reaper"
 	"github.com/newtonsystems/agent-mgmt/app/service"
+	"github.com/newtonsystems/agent-mgmt/app/tenant"
 	tu "github.com/newtonsystems/agent-mgmt/app/testutil"
 	"github.com/newtonsystems/agent-mgmt/app/utils"
+	"github.com/newtonsystems/agent-mgmt/app/watch"
 )
 
 var logger = utils.GetLogger()
@@ -75,6 +86,15 @@ var data = []entry{
 		"getavailableagents_minuteagoexactly.golden",
 		"A test to ensure a heartbeat exactly a minute ago is included as an available agent by service's GetAvailableAgents()",
 	},
+	{
+		"getavailableagents",
+		[]string{""},
+		0,
+		"getavailableagents_states.input",
+		"response agent IDs",
+		"getavailableagents_states.golden",
+		"A test to ensure only agents in the available state (not on-call, busy, away etc.) are returned by service's GetAvailableAgents()",
+	},
 	{
 		"getavailableagents",
 		[]string{"10"},
@@ -84,6 +104,60 @@ var data = []entry{
 		"getavailableagents_limit_results_10.golden",
 		"A test to check there is a limit to the available agent ids returned by service's GetAvailableAgents()",
 	},
+	{
+		"getavailableagents",
+		[]string{"", "longest-idle"},
+		0,
+		"getavailableagents_longestidle.input",
+		"response agent IDs",
+		"getavailableagents_longestidle.golden",
+		"A test to ensure agents available the longest are returned first by service's GetAvailableAgents() using the longest-idle strategy",
+	},
+	{
+		"getavailableagents",
+		[]string{"2", "longest-idle"},
+		0,
+		"getavailableagents_longestidle.input",
+		"response agent IDs",
+		"getavailableagents_longestidle_limit.golden",
+		"A test to ensure the limit is applied after routing by service's GetAvailableAgents()",
+	},
+	{
+		"getavailableagents",
+		[]string{"", "fastest-finger"},
+		amerrors.ErrRoutingStrategyInvalid,
+		"getavailableagents.input",
+		"response agent IDs",
+		"getavailableagents_invalidstrategy.golden",
+		"A test to check we get an ErrRoutingStrategyInvalid error for an unknown routing strategy for service's GetAvailableAgents()",
+	},
+	{
+		"getavailableagents",
+		[]string{"", "", `[{"name": "language:fr", "minlevel": 3, "required": true}]`},
+		0,
+		"getavailableagents_skills.input",
+		"response agent IDs",
+		"getavailableagents_skills_required.golden",
+		"A test to ensure only agents with the required skills (at the minimum level) are returned by service's GetAvailableAgents()",
+	},
+	{
+		"getavailableagents",
+		[]string{"", "", `[{"name": "language:fr", "required": true}, {"name": "product:billing", "minlevel": 2, "weight": 1}, {"name": "product:mobile", "weight": 3}]`},
+		0,
+		"getavailableagents_skills.input",
+		"response agent IDs",
+		"getavailableagents_skills_preferred.golden",
+		"A test to ensure agents are ranked by the weight of their preferred skills by service's GetAvailableAgents()",
+	},
+	{
+		"getavailableagents",
+		[]string{"", "", `[{"name": "language:fr", "minlevel": 9, "required": true}]`},
+		amerrors.ErrSkillInvalid,
+		"getavailableagents_skills.input",
+		"response agent IDs",
+		"getavailableagents_skills_invalid.golden",
+		"A test to check we get an ErrSkillInvalid error for an out of range skill level for service's GetAvailableAgents()",
+	},
 	{
 		"getagentidfromref",
 		[]string{"ref001a"},
@@ -147,6 +221,366 @@ var data = []entry{
 		"addtask_custid0.golden",
 		"A test to check invalid custid of 0 for service's AddTask()",
 	},
+	{
+		"acceptcall",
+		[]string{"2", "2"},
+		0,
+		"acceptcall.input",
+		"accepted task",
+		"acceptcall.golden",
+		"A basic test of service's AcceptCall() (the other candidate agents are released)",
+	},
+	{
+		"acceptcall",
+		[]string{"2", "2", "3", "2"},
+		amerrors.ErrTaskAlreadyAccepted,
+		"acceptcall.input",
+		"accepted task",
+		"acceptcall_twice.golden",
+		"A test to check a second accept of the same task returns ErrTaskAlreadyAccepted for service's AcceptCall()",
+	},
+	{
+		"acceptcall",
+		[]string{"5", "2"},
+		amerrors.ErrTaskNotOffered,
+		"acceptcall.input",
+		"accepted task",
+		"acceptcall_notoffered.golden",
+		"A test to check an agent can not accept a task not offered to them for service's AcceptCall()",
+	},
+	{
+		"acceptcall",
+		[]string{"4", "2"},
+		amerrors.ErrAgentStateTransition,
+		"acceptcall.input",
+		"accepted task",
+		"acceptcall_oncall.golden",
+		"A test to check an agent already on a call can not accept another for service's AcceptCall()",
+	},
+	{
+		"acceptcall",
+		[]string{"2", "20"},
+		amerrors.ErrTaskNotFound,
+		"acceptcall.input",
+		"accepted task",
+		"acceptcall_wrongtaskid.golden",
+		"A test to check we get an ErrTaskNotFound error when the task does not exist for service's AcceptCall()",
+	},
+	{
+		"acceptcall",
+		[]string{"20", "2"},
+		amerrors.ErrAgentNotFound,
+		"acceptcall.input",
+		"accepted task",
+		"acceptcall_wrongagentid.golden",
+		"A test to check we get an ErrAgentNotFound error when the agent does not exist for service's AcceptCall()",
+	},
+	{
+		"completetask",
+		[]string{"2", "2"},
+		0,
+		"agentstates.input",
+		"completed task and agent state",
+		"completetask.golden",
+		"A basic test of service's CompleteTask() (the agent goes from on-call to wrap-up)",
+	},
+	{
+		"completetask",
+		[]string{"1", "2"},
+		amerrors.ErrTaskNotAccepted,
+		"agentstates.input",
+		"completed task and agent state",
+		"completetask_notaccepted.golden",
+		"A test to check an agent can not complete a task they did not accept for service's CompleteTask()",
+	},
+	{
+		"completetask",
+		[]string{"3", "4"},
+		amerrors.ErrTaskAlreadyCompleted,
+		"agentstates.input",
+		"completed task and agent state",
+		"completetask_twice.golden",
+		"A test to check a task can only be completed once for service's CompleteTask()",
+	},
+	{
+		"completetask",
+		[]string{"2", "20"},
+		amerrors.ErrTaskNotFound,
+		"agentstates.input",
+		"completed task and agent state",
+		"completetask_wrongtaskid.golden",
+		"A test to check we get an ErrTaskNotFound error when the task does not exist for service's CompleteTask()",
+	},
+	{
+		"starttask",
+		[]string{"2", "2"},
+		0,
+		"tasks.input",
+		"started task",
+		"starttask.golden",
+		"A basic test of service's StartTask() (the accepted task goes in-progress)",
+	},
+	{
+		"starttask",
+		[]string{"1", "2"},
+		amerrors.ErrTaskNotAccepted,
+		"tasks.input",
+		"started task",
+		"starttask_notaccepted.golden",
+		"A test to check an agent can not start a task they did not accept for service's StartTask()",
+	},
+	{
+		"starttask",
+		[]string{"2", "3"},
+		amerrors.ErrTaskStatusTransition,
+		"tasks.input",
+		"started task",
+		"starttask_completed.golden",
+		"A test to check a completed task can not be started for service's StartTask()",
+	},
+	{
+		"starttask",
+		[]string{"2", "20"},
+		amerrors.ErrTaskNotFound,
+		"tasks.input",
+		"started task",
+		"starttask_wrongtaskid.golden",
+		"A test to check we get an ErrTaskNotFound error when the task does not exist for service's StartTask()",
+	},
+	{
+		"offertask",
+		[]string{"4", "1,3"},
+		0,
+		"tasks.input",
+		"offered task",
+		"offertask.golden",
+		"A basic test of service's OfferTask() (the queued task is offered to the agents)",
+	},
+	{
+		"offertask",
+		[]string{"1", "2"},
+		amerrors.ErrTaskStatusTransition,
+		"tasks.input",
+		"offered task",
+		"offertask_offered.golden",
+		"A test to check only queued tasks are offered for service's OfferTask()",
+	},
+	{
+		"offertask",
+		[]string{"4", ""},
+		amerrors.ErrInvalidArgument,
+		"tasks.input",
+		"offered task",
+		"offertask_noagents.golden",
+		"A test to check a task must be offered to agents for service's OfferTask()",
+	},
+	{
+		"gettask",
+		[]string{"3"},
+		0,
+		"tasks.input",
+		"task",
+		"gettask.golden",
+		"A basic test of service's GetTask() (wait and handle time of a completed task)",
+	},
+	{
+		"gettask",
+		[]string{"5"},
+		0,
+		"tasks.input",
+		"task",
+		"gettask_nostatus.golden",
+		"A test to check tasks created before task statuses get a status for service's GetTask()",
+	},
+	{
+		"gettask",
+		[]string{"20"},
+		amerrors.ErrTaskNotFound,
+		"tasks.input",
+		"task",
+		"gettask_wrongtaskid.golden",
+		"A test to check we get an ErrTaskNotFound error when the task does not exist for service's GetTask()",
+	},
+	{
+		"listtasks",
+		[]string{"1", "0", "", "0"},
+		0,
+		"tasks.input",
+		"tasks",
+		"listtasks_custid.golden",
+		"A test to list a customer's tasks for service's ListTasks()",
+	},
+	{
+		"listtasks",
+		[]string{"0", "2", "", "0"},
+		0,
+		"tasks.input",
+		"tasks",
+		"listtasks_agentid.golden",
+		"A test to list an agent's tasks for service's ListTasks()",
+	},
+	{
+		"listtasks",
+		[]string{"0", "0", "queued", "0"},
+		0,
+		"tasks.input",
+		"tasks",
+		"listtasks_status.golden",
+		"A test to list tasks in a status for service's ListTasks()",
+	},
+	{
+		"listtasks",
+		[]string{"0", "0", "", "2"},
+		0,
+		"tasks.input",
+		"tasks",
+		"listtasks_limit.golden",
+		"A test to check the limit (oldest first) for service's ListTasks()",
+	},
+	{
+		"listtasks",
+		[]string{"0", "0", "lost", "0"},
+		amerrors.ErrTaskStatusInvalid,
+		"tasks.input",
+		"tasks",
+		"listtasks_invalidstatus.golden",
+		"A test to check we get an ErrTaskStatusInvalid error for an unknown status for service's ListTasks()",
+	},
+	{
+		"canceltask",
+		[]string{"2", "false"},
+		0,
+		"tasks.input",
+		"cancelled task and agent state",
+		"canceltask.golden",
+		"A basic test of service's CancelTask() (the accepting agent goes from on-call to wrap-up)",
+	},
+	{
+		"canceltask",
+		[]string{"4", "true"},
+		0,
+		"tasks.input",
+		"cancelled task and agent state",
+		"canceltask_abandoned.golden",
+		"A test to abandon a queued task for service's CancelTask()",
+	},
+	{
+		"canceltask",
+		[]string{"3", "false"},
+		amerrors.ErrTaskStatusTransition,
+		"tasks.input",
+		"cancelled task and agent state",
+		"canceltask_completed.golden",
+		"A test to check a completed task can not be cancelled for service's CancelTask()",
+	},
+	{
+		"setagentskills",
+		[]string{"1", `[{"name": "language:fr", "level": 3}, {"name": "product:billing", "level": 2}]`},
+		0,
+		"agentstates.input",
+		"agent skills",
+		"setagentskills.golden",
+		"A basic test of service's SetAgentSkills()",
+	},
+	{
+		"setagentskills",
+		[]string{"1", `[{"name": "language:fr", "level": 0}]`},
+		amerrors.ErrSkillInvalid,
+		"agentstates.input",
+		"agent skills",
+		"setagentskills_invalidlevel.golden",
+		"A test to check we get an ErrSkillInvalid error for an out of range skill level for service's SetAgentSkills()",
+	},
+	{
+		"setagentskills",
+		[]string{"20", `[{"name": "language:fr", "level": 3}]`},
+		amerrors.ErrAgentNotFound,
+		"agentstates.input",
+		"agent skills",
+		"setagentskills_wrongagentid.golden",
+		"A test to check we get an ErrAgentNotFound error when the agent does not exist for service's SetAgentSkills()",
+	},
+	{
+		"setagentstate",
+		[]string{"1", "away", "1", "available", "4", "busy", "6", "offline"},
+		0,
+		"agentstates.input",
+		"agent states",
+		"setagentstate.golden",
+		"A basic test of service's SetAgentState()",
+	},
+	{
+		"setagentstate",
+		[]string{"1", "available"},
+		0,
+		"agentstates.input",
+		"agent states",
+		"setagentstate_unchanged.golden",
+		"A test to check setting the state an agent is already in is allowed for service's SetAgentState()",
+	},
+	{
+		"setagentstate",
+		[]string{"1", "on-call"},
+		amerrors.ErrAgentStateTransition,
+		"agentstates.input",
+		"agent states",
+		"setagentstate_oncall.golden",
+		"A test to check on-call can only be entered via AcceptCall() for service's SetAgentState()",
+	},
+	{
+		"setagentstate",
+		[]string{"5", "busy"},
+		amerrors.ErrAgentStateTransition,
+		"agentstates.input",
+		"agent states",
+		"setagentstate_offline.golden",
+		"A test to check an offline agent can only become available for service's SetAgentState()",
+	},
+	{
+		"setagentstate",
+		[]string{"1", "lunch"},
+		amerrors.ErrAgentStateInvalid,
+		"agentstates.input",
+		"agent states",
+		"setagentstate_invalid.golden",
+		"A test to check we get an ErrAgentStateInvalid error for an unknown state for service's SetAgentState()",
+	},
+	{
+		"setagentstate",
+		[]string{"20", "busy"},
+		amerrors.ErrAgentNotFound,
+		"agentstates.input",
+		"agent states",
+		"setagentstate_wrongagentid.golden",
+		"A test to check we get an ErrAgentNotFound error when the agent does not exist for service's SetAgentState()",
+	},
+	{
+		"registeragent",
+		[]string{},
+		0,
+		"registeragent.input",
+		"response agentID",
+		"registeragent.golden",
+		"A basic test of service's RegisterAgent() (skips agent IDs that are already taken)",
+	},
+	{
+		"deregisteragent",
+		[]string{"3"},
+		0,
+		"deregisteragent.input",
+		"available agent IDs after deregistering",
+		"deregisteragent.golden",
+		"A test to check a deregistered agent is no longer returned by service's GetAvailableAgents()",
+	},
+	{
+		"deregisteragent",
+		[]string{"20"},
+		amerrors.ErrAgentNotFound,
+		"deregisteragent.input",
+		"available agent IDs after deregistering",
+		"deregisteragent_wrongagentid.golden",
+		"A test to check we get an ErrAgentNotFound error when the agent does not exist for service's DeregisterAgent()",
+	},
 }
 
 // runSrvTest runs a specifc test based off testName we convert to bytes for possible writing
@@ -167,7 +601,21 @@ func runSrvTest(t *testing.T, session models.Session, s service.Service, testNam
 			limit = int32(limitInt)
 		}
 
-		agentIDs, err := s.GetAvailableAgents(ctx, session, tu.MongoDBName, limit)
+		// Optional routing strategy (default strategy if not given)
+		var strategy string
+		if len(testArgs) > 1 {
+			strategy = testArgs[1]
+		}
+
+		// Optional skill requirements as JSON
+		var skills []models.SkillRequirement
+		if len(testArgs) > 2 {
+			if errDecode := json.Unmarshal([]byte(testArgs[2]), &skills); errDecode != nil {
+				tu.FailNowAt(t, errDecode.Error())
+			}
+		}
+
+		agentIDs, err := s.GetAvailableAgents(ctx, limit, strategy, skills)
 
 		// Style: this doesnt feel go like
 		if err == nil {
@@ -176,7 +624,7 @@ func runSrvTest(t *testing.T, session models.Session, s service.Service, testNam
 		resErr = err
 
 	case "getagentidfromref":
-		agentID, err := s.GetAgentIDFromRef(session, tu.MongoDBName, testArgs[0])
+		agentID, err := s.GetAgentIDFromRef(context.Background(), testArgs[0])
 
 		if *tu.Verbose {
 			fmt.Printf("Response: " + fmt.Sprintf("%#v", agentID) + "\n")
@@ -192,7 +640,7 @@ func runSrvTest(t *testing.T, session models.Session, s service.Service, testNam
 			tu.FailNowAt(t, errConvert.Error())
 		}
 
-		status, err := s.HeartBeat(session, tu.MongoDBName, int32(agentID))
+		status, _, err := s.HeartBeat(context.Background(), int32(agentID))
 
 		res = []byte(strconv.Itoa(int(status)))
 		resErr = err
@@ -216,11 +664,216 @@ func runSrvTest(t *testing.T, session models.Session, s service.Service, testNam
 			agentIDs = append(agentIDs, int32(agentID))
 		}
 
-		taskID, err := s.AddTask(session, tu.MongoDBName, int32(custID), agentIDs)
+		taskID, err := s.AddTask(context.Background(), int32(custID), agentIDs, nil)
 
 		res = []byte(strconv.Itoa(int(taskID)))
 		resErr = err
 
+	case "acceptcall":
+		// testArgs are pairs of agentID, taskID accepted in order (stops at the first error)
+		var lines []string
+		for i := 0; i+1 < len(testArgs); i += 2 {
+			agentID, errConvert := strconv.Atoi(testArgs[i])
+			if errConvert != nil {
+				tu.FailNowAt(t, errConvert.Error())
+			}
+			taskID, errConvert := strconv.Atoi(testArgs[i+1])
+			if errConvert != nil {
+				tu.FailNowAt(t, errConvert.Error())
+			}
+
+			task, err := s.AcceptCall(context.Background(), int32(agentID), int32(taskID))
+			if err != nil {
+				resErr = err
+				break
+			}
+			lines = append(lines, fmt.Sprintf("taskid=%d custid=%d acceptedby=%d agentids=%v released=%v", task.TaskID, task.CustID, task.AcceptedBy, task.AgentIDs, task.ReleasedAgentIDs))
+		}
+		res = []byte(strings.Join(lines, "\n"))
+
+	case "completetask":
+		agentID, errConvert := strconv.Atoi(testArgs[0])
+		if errConvert != nil {
+			tu.FailNowAt(t, errConvert.Error())
+		}
+		taskID, errConvert := strconv.Atoi(testArgs[1])
+		if errConvert != nil {
+			tu.FailNowAt(t, errConvert.Error())
+		}
+
+		task, err := s.CompleteTask(context.Background(), int32(agentID), int32(taskID))
+
+		if err == nil {
+			agent, errAgent := session.DB(tu.MongoDBName).GetAgent(context.Background(), int32(agentID))
+			tu.Ok(t, errAgent)
+			res = []byte(fmt.Sprintf("taskid=%d completed=%t agentid=%d state=%s", task.TaskID, !task.CompletedAt.IsZero(), agent.AgentID, agent.State))
+		}
+		resErr = err
+
+	case "starttask":
+		agentID, errConvert := strconv.Atoi(testArgs[0])
+		if errConvert != nil {
+			tu.FailNowAt(t, errConvert.Error())
+		}
+		taskID, errConvert := strconv.Atoi(testArgs[1])
+		if errConvert != nil {
+			tu.FailNowAt(t, errConvert.Error())
+		}
+
+		task, err := s.StartTask(context.Background(), int32(agentID), int32(taskID))
+
+		if err == nil {
+			task, err = session.DB(tu.MongoDBName).GetTask(context.Background(), task.TaskID)
+			tu.Ok(t, err)
+			res = []byte(fmt.Sprintf("taskid=%d status=%s acceptedby=%d started=%t", task.TaskID, task.Status, task.AcceptedBy, !task.StartedAt.IsZero()))
+		}
+		resErr = err
+
+	case "offertask":
+		// testArgs are the task ID and comma separated agent IDs
+		taskID, errConvert := strconv.Atoi(testArgs[0])
+		if errConvert != nil {
+			tu.FailNowAt(t, errConvert.Error())
+		}
+		var agentIDs []int32
+		for _, arg := range strings.FieldsFunc(testArgs[1], func(r rune) bool { return r == ',' }) {
+			agentID, errConvert := strconv.Atoi(arg)
+			if errConvert != nil {
+				tu.FailNowAt(t, errConvert.Error())
+			}
+			agentIDs = append(agentIDs, int32(agentID))
+		}
+
+		task, err := s.OfferTask(context.Background(), int32(taskID), agentIDs)
+
+		if err == nil {
+			task, err = session.DB(tu.MongoDBName).GetTask(context.Background(), task.TaskID)
+			tu.Ok(t, err)
+			res = []byte(fmt.Sprintf("taskid=%d status=%s agentids=%v offered=%t", task.TaskID, task.Status, task.AgentIDs, !task.OfferedAt.IsZero()))
+		}
+		resErr = err
+
+	case "gettask":
+		taskID, errConvert := strconv.Atoi(testArgs[0])
+		if errConvert != nil {
+			tu.FailNowAt(t, errConvert.Error())
+		}
+
+		task, err := s.GetTask(context.Background(), int32(taskID))
+
+		if err == nil {
+			res = []byte(fmt.Sprintf("taskid=%d custid=%d status=%s acceptedby=%d wait=%v handle=%v", task.TaskID, task.CustID, task.Status, task.AcceptedBy, task.WaitTime(), task.HandleTime()))
+		}
+		resErr = err
+
+	case "listtasks":
+		// testArgs are custID, agentID, status, limit
+		var ids []int32
+		for _, arg := range []string{testArgs[0], testArgs[1], testArgs[3]} {
+			id, errConvert := strconv.Atoi(arg)
+			if errConvert != nil {
+				tu.FailNowAt(t, errConvert.Error())
+			}
+			ids = append(ids, int32(id))
+		}
+
+		tasks, err := s.ListTasks(context.Background(), ids[0], ids[1], testArgs[2], ids[2])
+
+		var lines []string
+		for _, task := range tasks {
+			lines = append(lines, fmt.Sprintf("taskid=%d custid=%d status=%s agentids=%v", task.TaskID, task.CustID, task.Status, task.AgentIDs))
+		}
+		res = []byte(strings.Join(lines, "\n"))
+		resErr = err
+
+	case "canceltask":
+		taskID, errConvert := strconv.Atoi(testArgs[0])
+		if errConvert != nil {
+			tu.FailNowAt(t, errConvert.Error())
+		}
+		abandoned, errConvert := strconv.ParseBool(testArgs[1])
+		if errConvert != nil {
+			tu.FailNowAt(t, errConvert.Error())
+		}
+
+		task, err := s.CancelTask(context.Background(), int32(taskID), abandoned)
+
+		if err == nil {
+			line := fmt.Sprintf("taskid=%d status=%s", task.TaskID, task.Status)
+			if task.AcceptedBy != 0 {
+				agent, errAgent := session.DB(tu.MongoDBName).GetAgent(context.Background(), task.AcceptedBy)
+				tu.Ok(t, errAgent)
+				line += fmt.Sprintf(" agentid=%d state=%s", agent.AgentID, agent.State)
+			}
+			res = []byte(line)
+		}
+		resErr = err
+
+	case "setagentskills":
+		agentID, errConvert := strconv.Atoi(testArgs[0])
+		if errConvert != nil {
+			tu.FailNowAt(t, errConvert.Error())
+		}
+		var skills []models.Skill
+		if errDecode := json.Unmarshal([]byte(testArgs[1]), &skills); errDecode != nil {
+			tu.FailNowAt(t, errDecode.Error())
+		}
+
+		agent, err := s.SetAgentSkills(context.Background(), int32(agentID), skills)
+
+		if err == nil {
+			var names []string
+			for _, skill := range agent.Skills {
+				names = append(names, fmt.Sprintf("%s/%d", skill.Name, skill.Level))
+			}
+			res = []byte(fmt.Sprintf("agentid=%d skills=%s", agent.AgentID, strings.Join(names, ", ")))
+		}
+		resErr = err
+
+	case "setagentstate":
+		// testArgs are pairs of agentID, state set in order (stops at the first error)
+		var lines []string
+		for i := 0; i+1 < len(testArgs); i += 2 {
+			agentID, errConvert := strconv.Atoi(testArgs[i])
+			if errConvert != nil {
+				tu.FailNowAt(t, errConvert.Error())
+			}
+
+			err := s.SetAgentState(context.Background(), int32(agentID), testArgs[i+1])
+			if err != nil {
+				resErr = err
+				break
+			}
+
+			agent, errAgent := session.DB(tu.MongoDBName).GetAgent(context.Background(), int32(agentID))
+			tu.Ok(t, errAgent)
+			lines = append(lines, fmt.Sprintf("agentid=%d state=%s", agent.AgentID, agent.State))
+		}
+		res = []byte(strings.Join(lines, "\n"))
+
+	case "registeragent":
+		agentID, err := s.RegisterAgent(context.Background())
+
+		res = []byte(strconv.Itoa(int(agentID)))
+		resErr = err
+
+	case "deregisteragent":
+		agentID, errConvert := strconv.Atoi(testArgs[0])
+
+		if errConvert != nil {
+			tu.FailNowAt(t, errConvert.Error())
+		}
+
+		err := s.DeregisterAgent(context.Background(), int32(agentID))
+
+		// Compare who is still available
+		if err == nil {
+			agentIDs, errAvailable := s.GetAvailableAgents(ctx, 0, "", nil)
+			tu.Ok(t, errAvailable)
+			res = []byte(strings.Join(agentIDs, ", "))
+		}
+		resErr = err
+
 	}
 
 	return res, resErr
@@ -239,7 +892,7 @@ func TestGoldenFiles(t *testing.T) {
 	}
 
 	// Create new service
-	s := service.NewService(logger, nil)
+	s := service.NewService(config.Default(), models.NewRepositories(session, tu.MongoDBName), logger, nil, nil, nil, nil)
 
 	for _, e := range data {
 		source := filepath.Join(dataDir, e.source)
@@ -305,3 +958,421 @@ func check(t *testing.T, session models.Session, srv service.Service, source, go
 	}
 
 }
+
+func TestServiceConfig(t *testing.T) {
+	session, _ := tu.NewTestMongoConnection(*tu.Debug, *tu.OutsideConn)
+	defer tu.CleanUpTestMongoConnection(t, session)
+	defer tu.CleanAllCollectionsTestMongo(session)
+
+	// Freeze time
+	service.NowFunc = func() time.Time {
+		return time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)
+	}
+
+	src, err := ioutil.ReadFile(filepath.Join(dataDir, "getavailableagents.input"))
+	tu.Ok(t, err)
+	tu.InsertFixturesToDB(t, session, "getavailableagents", src)
+
+	// Agent 1's heartbeat is 61 secs old so only available with a grace period
+	cfg := config.Default()
+	cfg.GracePeriod = 5 * time.Second
+	cfg.HeartBeatInterval = 10 * time.Second
+	s := service.NewService(cfg, models.NewRepositories(session, tu.MongoDBName), logger, nil, nil, nil, nil)
+
+	agentIDs, err := s.GetAvailableAgents(context.Background(), 0, "", nil)
+	tu.Ok(t, err)
+	tu.Equals(t, []string{"1", "2", "3", "4", "5"}, agentIDs)
+
+	// The client is told when to send its next heartbeat
+	_, next, err := s.HeartBeat(context.Background(), 2)
+	tu.Ok(t, err)
+	tu.Equals(t, 10*time.Second, next)
+}
+
+func TestWatchAgents(t *testing.T) {
+	session, _ := tu.NewTestMongoConnection(*tu.Debug, *tu.OutsideConn)
+	defer tu.CleanUpTestMongoConnection(t, session)
+	defer tu.CleanAllCollectionsTestMongo(session)
+
+	now := time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)
+	service.NowFunc = func() time.Time { return now }
+	defer func() { service.NowFunc = time.Now }()
+
+	tu.Ok(t, session.DB(tu.MongoDBName).C("agents").Insert(
+		&models.Agent{AgentID: 1, State: models.AgentAvailable, LastHeartBeat: now},
+		&models.Agent{AgentID: 2, State: models.AgentOffline, LastHeartBeat: now.Add(-time.Hour)},
+	))
+
+	events := watch.NewHub(watch.DefaultBuffer)
+	s := service.NewService(config.Default(), models.NewRepositories(session, tu.MongoDBName), logger, nil, events, nil, nil)
+
+	// The snapshot only has agent 1 (agent 2 is offline)
+	agents, watcher, err := s.WatchAgents(context.Background())
+	tu.Ok(t, err)
+	defer watcher.Close()
+	tu.Equals(t, 1, len(agents))
+	tu.Equals(t, int32(1), agents[0].AgentID)
+
+	_, _, err = s.HeartBeat(context.Background(), 2)
+	tu.Ok(t, err)
+	// Already available so nothing is published
+	_, _, err = s.HeartBeat(context.Background(), 2)
+	tu.Ok(t, err)
+	taskID, err := s.AddTask(context.Background(), 1, []int32{1}, nil)
+	tu.Ok(t, err)
+	tu.Ok(t, s.DeregisterAgent(context.Background(), 2))
+
+	events.Close()
+	var got []watch.Event
+	for event := range watcher.C {
+		got = append(got, event)
+	}
+	tu.Equals(t, []watch.Event{
+		{Type: watch.EventAvailable, AgentID: 2, At: now},
+		{Type: watch.EventAssigned, AgentID: 1, TaskID: taskID, At: now},
+		{Type: watch.EventDeregistered, AgentID: 2, At: now},
+	}, got)
+}
+
+// TestWatchAgentsOtherInstance documents that watchers only see the changes
+// made through their own instance
+func TestWatchAgentsOtherInstance(t *testing.T) {
+	session, _ := tu.NewTestMongoConnection(*tu.Debug, *tu.OutsideConn)
+	defer tu.CleanUpTestMongoConnection(t, session)
+	defer tu.CleanAllCollectionsTestMongo(session)
+
+	now := time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)
+	service.NowFunc = func() time.Time { return now }
+	defer func() { service.NowFunc = time.Now }()
+
+	tu.Ok(t, session.DB(tu.MongoDBName).C("agents").Insert(
+		&models.Agent{AgentID: 1, State: models.AgentOffline, LastHeartBeat: now.Add(-time.Hour)},
+	))
+
+	// Two instances sharing the database
+	events := watch.NewHub(watch.DefaultBuffer)
+	s := service.NewService(config.Default(), models.NewRepositories(session, tu.MongoDBName), logger, nil, events, nil, nil)
+	other := service.NewService(config.Default(), models.NewRepositories(session, tu.MongoDBName), logger, nil, watch.NewHub(watch.DefaultBuffer), nil, nil)
+
+	agents, watcher, err := s.WatchAgents(context.Background())
+	tu.Ok(t, err)
+	tu.Equals(t, 0, len(agents))
+
+	defer watcher.Close()
+
+	// (events are published before the call returns)
+	_, _, err = other.HeartBeat(context.Background(), 1)
+	tu.Ok(t, err)
+	tu.Equals(t, 0, len(watcher.C))
+
+	// A new snapshot has the agent
+	agents, again, err := s.WatchAgents(context.Background())
+	tu.Ok(t, err)
+	defer again.Close()
+	tu.Equals(t, 1, len(agents))
+}
+
+func TestHeartBeatStream(t *testing.T) {
+	session, _ := tu.NewTestMongoConnection(*tu.Debug, *tu.OutsideConn)
+	defer tu.CleanUpTestMongoConnection(t, session)
+	defer tu.CleanAllCollectionsTestMongo(session)
+
+	now := time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)
+	service.NowFunc = func() time.Time { return now }
+	defer func() { service.NowFunc = time.Now }()
+
+	tu.Ok(t, session.DB(tu.MongoDBName).C("agents").Insert(
+		&models.Agent{AgentID: 1, State: models.AgentOffline, LastHeartBeat: now.Add(-time.Hour)},
+	))
+
+	events := watch.NewHub(watch.DefaultBuffer)
+	agents := heartbeat.NewRegistry(heartbeat.DefaultBuffer)
+	s := service.NewService(config.Default(), models.NewRepositories(session, tu.MongoDBName), logger, nil, events, agents, nil)
+
+	watcher, err := events.Watch("")
+	tu.Ok(t, err)
+	defer watcher.Close()
+
+	// Connecting is a heartbeat
+	_, _, err = s.ConnectAgent(context.Background(), 2)
+	tu.IsAmError(t, amerrors.ErrAgentNotFound, err)
+	conn, next, err := s.ConnectAgent(context.Background(), 1)
+	tu.Ok(t, err)
+	tu.Equals(t, config.DefaultHeartBeatInterval, next)
+	tu.Equals(t, []int32{1}, agents.AgentIDs(""))
+
+	// The agent is offered new tasks on its stream
+	taskID, err := s.AddTask(context.Background(), 5, []int32{1}, nil)
+	tu.Ok(t, err)
+	tu.Equals(t, heartbeat.Command{Type: heartbeat.CommandOfferTask, TaskID: taskID, CustID: 5}, <-conn.C)
+
+	tu.Ok(t, s.KeepAlive(context.Background(), 1, 30*time.Second))
+	tu.IsAmError(t, amerrors.ErrHeartBeatMissed, s.KeepAlive(context.Background(), 1, 2*time.Minute))
+
+	// A replaced stream leaves the agent available
+	replaced := conn
+	conn, _, err = s.ConnectAgent(context.Background(), 1)
+	tu.Ok(t, err)
+	tu.Ok(t, s.DisconnectAgent(context.Background(), replaced))
+	agent, err := session.DB(tu.MongoDBName).GetAgent(context.Background(), 1)
+	tu.Ok(t, err)
+	tu.Equals(t, models.AgentAvailable, agent.State)
+
+	// The agent goes offline as soon as its stream ends
+	tu.Ok(t, s.DisconnectAgent(context.Background(), conn))
+	agent, err = session.DB(tu.MongoDBName).GetAgent(context.Background(), 1)
+	tu.Ok(t, err)
+	tu.Equals(t, models.AgentOffline, agent.State)
+	tu.Equals(t, 0, len(agents.AgentIDs("")))
+
+	events.Close()
+	var got []watch.EventType
+	for event := range watcher.C {
+		got = append(got, event.Type)
+	}
+	tu.Equals(t, []watch.EventType{watch.EventAvailable, watch.EventAssigned, watch.EventDisconnected}, got)
+}
+
+func TestBufferedHeartBeats(t *testing.T) {
+	session, _ := tu.NewTestMongoConnection(*tu.Debug, *tu.OutsideConn)
+	defer tu.CleanUpTestMongoConnection(t, session)
+	defer tu.CleanAllCollectionsTestMongo(session)
+
+	now := time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)
+	service.NowFunc = func() time.Time { return now }
+	models.NowFunc = func() time.Time { return now }
+	defer func() { service.NowFunc = time.Now; models.NowFunc = time.Now }()
+
+	tu.Ok(t, session.DB(tu.MongoDBName).C("agents").Insert(
+		&models.Agent{AgentID: 1, State: models.AgentOffline, LastHeartBeat: now.Add(-time.Hour)},
+	))
+
+	beats := heartbeat.NewBuffer()
+	s := service.NewService(config.Default(), models.NewRepositories(session, tu.MongoDBName), logger, nil, nil, nil, beats)
+
+	// The first heartbeat is written straight away (the agent comes online)
+	_, _, err := s.HeartBeat(context.Background(), 1)
+	tu.Ok(t, err)
+	tu.Equals(t, 0, beats.Pending())
+
+	// Later ones are only buffered
+	start := now
+	now = now.Add(50 * time.Second)
+	_, _, err = s.HeartBeat(context.Background(), 1)
+	tu.Ok(t, err)
+	tu.Equals(t, 1, beats.Pending())
+	agent, err := session.DB(tu.MongoDBName).GetAgent(context.Background(), 1)
+	tu.Ok(t, err)
+	tu.TimeEquals(t, start, agent.LastHeartBeat)
+
+	// The database heartbeat is stale by now (but within a flush interval) and
+	// the buffered one is not
+	now = now.Add(12 * time.Second)
+	agentIDs, err := s.GetAvailableAgents(context.Background(), 0, "", nil)
+	tu.Ok(t, err)
+	tu.Equals(t, []string{"1"}, agentIDs)
+
+	// Going offline means the next heartbeat is written straight away again
+	tu.Ok(t, s.SetAgentState(context.Background(), 1, string(models.AgentOffline)))
+	_, _, err = s.HeartBeat(context.Background(), 1)
+	tu.Ok(t, err)
+	agent, err = session.DB(tu.MongoDBName).GetAgent(context.Background(), 1)
+	tu.Ok(t, err)
+	tu.Equals(t, models.AgentAvailable, agent.State)
+}
+
+func TestReapedAgentHeartBeat(t *testing.T) {
+	session, _ := tu.NewTestMongoConnection(*tu.Debug, *tu.OutsideConn)
+	defer tu.CleanUpTestMongoConnection(t, session)
+	defer tu.CleanAllCollectionsTestMongo(session)
+
+	now := time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)
+	service.NowFunc = func() time.Time { return now }
+	models.NowFunc = func() time.Time { return now }
+	reaper.NowFunc = func() time.Time { return now }
+	defer func() { service.NowFunc = time.Now; models.NowFunc = time.Now; reaper.NowFunc = time.Now }()
+
+	tu.Ok(t, session.DB(tu.MongoDBName).C("agents").Insert(
+		&models.Agent{AgentID: 1, State: models.AgentOffline, LastHeartBeat: now.Add(-time.Hour)},
+	))
+
+	cfg := config.Default()
+	beats := heartbeat.NewBuffer()
+	events := watch.NewHub(watch.DefaultBuffer)
+	s := service.NewService(cfg, models.NewRepositories(session, tu.MongoDBName), logger, nil, events, nil, beats)
+
+	watcher, err := events.Watch("")
+	tu.Ok(t, err)
+	defer watcher.Close()
+
+	state := func() models.AgentState {
+		agent, err := session.DB(tu.MongoDBName).GetAgent(context.Background(), 1)
+		tu.Ok(t, err)
+		return agent.State
+	}
+
+	_, _, err = s.HeartBeat(context.Background(), 1)
+	tu.Ok(t, err)
+
+	// The buffered heartbeat is not flushed (e.g. the flush failed) so the
+	// reaper marks the agent offline
+	now = now.Add(50 * time.Second)
+	_, _, err = s.HeartBeat(context.Background(), 1)
+	tu.Ok(t, err)
+	now = now.Add(20 * time.Second)
+	result, err := reaper.New(cfg, session, tu.MongoDBName, log.NewNopLogger(), nil, events, beats).Reap(context.Background())
+	tu.Ok(t, err)
+	tu.Equals(t, 1, result.AgentsOfflined)
+	tu.Equals(t, models.AgentOffline, state())
+
+	// The reaper forgot the agent so its next heartbeat makes it available
+	_, _, err = s.HeartBeat(context.Background(), 1)
+	tu.Ok(t, err)
+	tu.Equals(t, models.AgentAvailable, state())
+
+	// Another pod's reaper (which cannot forget this pod's heartbeats) marks
+	// the agent offline, the flushed heartbeats make it available again
+	now = now.Add(50 * time.Second)
+	_, _, err = s.HeartBeat(context.Background(), 1)
+	tu.Ok(t, err)
+	now = now.Add(20 * time.Second)
+	result, err = reaper.New(cfg, session, tu.MongoDBName, log.NewNopLogger(), nil, nil, nil).Reap(context.Background())
+	tu.Ok(t, err)
+	tu.Equals(t, 1, result.AgentsOfflined)
+	_, _, err = s.HeartBeat(context.Background(), 1)
+	tu.Ok(t, err)
+	tu.Equals(t, 1, beats.Pending())
+	_, err = beats.Flush(context.Background(), func(string) models.DataLayer { return session.DB(tu.MongoDBName) }, cfg.AvailableSince(now))
+	tu.Ok(t, err)
+	tu.Equals(t, models.AgentAvailable, state())
+
+	events.Close()
+	var got []watch.EventType
+	for event := range watcher.C {
+		got = append(got, event.Type)
+	}
+	tu.Equals(t, []watch.EventType{watch.EventAvailable, watch.EventStale, watch.EventAvailable}, got)
+}
+
+func TestServiceContext(t *testing.T) {
+	session, _ := tu.NewTestMongoConnection(*tu.Debug, *tu.OutsideConn)
+	defer tu.CleanUpTestMongoConnection(t, session)
+	defer tu.CleanAllCollectionsTestMongo(session)
+
+	tu.Ok(t, session.DB(tu.MongoDBName).C("agents").Insert(
+		&models.Agent{AgentID: 1, State: models.AgentOffline, LastHeartBeat: time.Now().Add(-time.Hour)},
+	))
+
+	s := service.NewService(config.Default(), models.NewRepositories(session, tu.MongoDBName), logger, nil, nil, nil, nil)
+
+	// A cancelled call stops before writing
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := s.HeartBeat(ctx, 1)
+	tu.Equals(t, context.Canceled, err)
+	tu.Equals(t, codes.Canceled, status.Code(service.WrapError(ctx, err)))
+
+	// (and is not mistaken for a missing phone session)
+	_, err = s.GetAgentIDFromRef(ctx, "ref001a")
+	tu.Equals(t, context.Canceled, err)
+	tu.Equals(t, codes.Canceled, status.Code(service.WrapError(ctx, err)))
+
+	agent, err := session.DB(tu.MongoDBName).GetAgent(context.Background(), 1)
+	tu.Ok(t, err)
+	tu.Equals(t, models.AgentOffline, agent.State)
+
+	// and so does one past its deadline
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	_, err = s.AddTask(ctx, 1, []int32{1}, nil)
+	tu.Equals(t, context.DeadlineExceeded, err)
+	tu.Equals(t, codes.DeadlineExceeded, status.Code(service.WrapError(ctx, err)))
+
+	tasks, err := s.ListTasks(context.Background(), 1, 0, "", 0)
+	tu.Ok(t, err)
+	tu.Equals(t, 0, len(tasks))
+}
+
+// stateAgents is an AgentRepository of the agents' states
+type stateAgents struct {
+	models.AgentRepository
+	states map[int32]models.AgentState
+}
+
+func (a stateAgents) Find(_ context.Context, agentID int32) (models.Agent, error) {
+	return models.Agent{AgentID: agentID, State: a.states[agentID]}, nil
+}
+
+func (a stateAgents) SetState(_ context.Context, agentID int32, from models.AgentState, to models.AgentState) error {
+	a.states[agentID] = to
+	return nil
+}
+
+// takenTasks is a TaskRepository of tasks already accepted by another agent
+type takenTasks struct {
+	models.TaskRepository
+}
+
+func (takenTasks) Accept(_ context.Context, taskID int32, agentID int32) (models.Task, error) {
+	return models.Task{}, amerrors.ErrTaskAlreadyAcceptedError("task already accepted")
+}
+
+func TestAcceptCallTaken(t *testing.T) {
+	agents := stateAgents{states: map[int32]models.AgentState{1: models.AgentAvailable}}
+	s := service.NewBasicService(config.Default(), models.Repositories{Agents: agents, Tasks: takenTasks{}}, nil, nil, nil)
+
+	// The agent did not get the call so is available again
+	_, err := s.AcceptCall(context.Background(), 1, 10)
+	tu.IsAmError(t, amerrors.ErrTaskAlreadyAccepted, err)
+	tu.Equals(t, models.AgentAvailable, agents.states[1])
+}
+
+func TestTenants(t *testing.T) {
+	session, _ := tu.NewTestMemoryConnection()
+	defer tu.CleanUpTestMongoConnection(t, session)
+
+	cfg := config.Default()
+	cfg.Tenants = []string{"acme", "globex"}
+
+	// Both tenants have an agent 1
+	now := time.Now()
+	for _, id := range cfg.Tenants {
+		tu.Ok(t, session.DB(tenant.Database(tu.MongoDBName, id)).C("agents").Insert(
+			&models.Agent{AgentID: 1, State: models.AgentAvailable, LastHeartBeat: now},
+		))
+	}
+
+	events := watch.NewHub(watch.DefaultBuffer)
+	s := service.NewService(cfg, models.NewTenantRepositories(session, tu.MongoDBName, cfg.Tenants), logger, nil, events, nil, nil)
+	acme := metadata.NewIncomingContext(context.Background(), metadata.Pairs(tenant.MetadataKey, "acme"))
+	globex := metadata.NewIncomingContext(context.Background(), metadata.Pairs(tenant.MetadataKey, "globex"))
+
+	_, watcher, err := s.WatchAgents(acme)
+	tu.Ok(t, err)
+
+	// One tenant's agent going offline is not seen by the other
+	tu.Ok(t, s.SetAgentState(globex, 1, string(models.AgentOffline)))
+
+	agentIDs, err := s.GetAvailableAgents(acme, 0, "", nil)
+	tu.Ok(t, err)
+	tu.Equals(t, []string{"1"}, agentIDs)
+
+	agentIDs, err = s.GetAvailableAgents(globex, 0, "", nil)
+	tu.Ok(t, err)
+	tu.Equals(t, 0, len(agentIDs))
+
+	watcher.Close()
+	for event := range watcher.C {
+		t.Errorf("acme saw an event of globex: %#v", event)
+	}
+
+	// Calls must be for one of the tenants
+	for _, ctx := range []context.Context{
+		context.Background(),
+		metadata.NewIncomingContext(context.Background(), metadata.Pairs(tenant.MetadataKey, "initech")),
+	} {
+		_, err = s.GetAvailableAgents(ctx, 0, "", nil)
+		tu.IsAmError(t, amerrors.ErrTenantUnknown, err)
+		tu.Equals(t, codes.PermissionDenied, status.Code(service.WrapError(ctx, err)))
+	}
+}
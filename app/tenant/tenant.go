@@ -0,0 +1,67 @@
+package tenant
+
+// tenant.go
+// The tenant (customer organisation) a call is made for. Every tenant has its
+// own database (see Database) so one tenant's agents, tasks and counters are
+// never seen by another. The tenant comes from the caller's gRPC metadata or
+// is set on the context (e.g. from auth claims, which win over the metadata).
+
+import (
+	"context"
+	"regexp"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// MetadataKey is the gRPC metadata key holding the caller's tenant ID
+const MetadataKey = "tenant-id"
+
+type contextKey struct{}
+
+// validID tenant IDs are part of database names and metric labels
+var validID = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// Valid returns whether id can be a tenant ID (lower case letters, digits,
+// '-' and '_', at most 32 characters)
+func Valid(id string) bool {
+	return validID.MatchString(id)
+}
+
+// NewContext returns a copy of ctx for tenant id
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the tenant set by NewContext or else the one in the
+// incoming gRPC metadata ("" if neither)
+func FromContext(ctx context.Context) string {
+	if id, ok := ctx.Value(contextKey{}).(string); ok {
+		return id
+	}
+
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if values := md[MetadataKey]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Database returns the name of tenant id's database (db itself for no tenant)
+func Database(db string, id string) string {
+	if id == "" {
+		return db
+	}
+	return db + "_" + id
+}
+
+// All returns the tenants of a service configured with tenants: no tenant
+// ("") if there are none, i.e. the service is not multi-tenant
+func All(tenants []string) []string {
+	if len(tenants) == 0 {
+		return []string{""}
+	}
+	return tenants
+}
@@ -0,0 +1,51 @@
+package tenant_test
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+
+	"github.com/newtonsystems/agent-mgmt/app/tenant"
+	tu "github.com/newtonsystems/agent-mgmt/app/testutil"
+)
+
+func TestValid(t *testing.T) {
+	testCases := []struct {
+		id    string
+		valid bool
+	}{
+		{"acme", true},
+		{"acme-corp_2", true},
+		{"0", true},
+		{"", false},
+		{"Acme", false},
+		{"-acme", false},
+		{"acme corp", false},
+		{"acme.corp", false},
+		{"abcdefghijklmnopqrstuvwxyz0123456", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.id, func(t *testing.T) {
+			tu.Equals(t, tc.valid, tenant.Valid(tc.id))
+		})
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	tu.Equals(t, "", tenant.FromContext(context.Background()))
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(tenant.MetadataKey, "acme"))
+	tu.Equals(t, "acme", tenant.FromContext(ctx))
+
+	// The tenant set on the context (e.g. from auth claims) wins over the metadata
+	tu.Equals(t, "globex", tenant.FromContext(tenant.NewContext(ctx, "globex")))
+}
+
+func TestDatabase(t *testing.T) {
+	tu.Equals(t, "db1", tenant.Database("db1", ""))
+	tu.Equals(t, "db1_acme", tenant.Database("db1", "acme"))
+	tu.Equals(t, []string{""}, tenant.All(nil))
+	tu.Equals(t, []string{"acme"}, tenant.All([]string{"acme"}))
+}
@@ -14,8 +14,11 @@ import (
 	//"strconv"
 	"time"
 
+	"github.com/newtonsystems/agent-mgmt/app/config"
+	"github.com/newtonsystems/agent-mgmt/app/heartbeat"
 	"github.com/newtonsystems/agent-mgmt/app/models"
 	"github.com/newtonsystems/agent-mgmt/app/service"
+	"github.com/newtonsystems/agent-mgmt/app/watch"
 	"github.com/newtonsystems/grpc_types/go/grpc_types"
 	"gopkg.in/mgo.v2"
 )
@@ -26,8 +29,23 @@ import (
 type MockService struct {
 	MockGetAvailableAgents func() ([]string, error)
 	MockGetAgentIDFromRef  func() (int32, error)
-	MockHeartBeat          func() (grpc_types.HeartBeatResponse_HeartBeatStatus, error)
+	MockHeartBeat          func() (grpc_types.HeartBeatResponse_HeartBeatStatus, time.Duration, error)
 	MockAddTask            func() (int32, error)
+	MockOfferTask          func() (models.Task, error)
+	MockAcceptCall         func() (models.Task, error)
+	MockStartTask          func() (models.Task, error)
+	MockCompleteTask       func() (models.Task, error)
+	MockGetTask            func() (models.Task, error)
+	MockListTasks          func() ([]models.Task, error)
+	MockCancelTask         func() (models.Task, error)
+	MockSetAgentState      func() error
+	MockSetAgentSkills     func() (models.Agent, error)
+	MockRegisterAgent      func() (int32, error)
+	MockDeregisterAgent    func() error
+	MockWatchAgents        func() ([]models.Agent, *watch.Watcher, error)
+	MockConnectAgent       func() (*heartbeat.Conn, time.Duration, error)
+	MockKeepAlive          func() error
+	MockDisconnectAgent    func() error
 }
 
 func NewMockService() service.Service {
@@ -42,7 +60,7 @@ func (fs MockService) Concat(ctx context.Context, a, b string) (string, error) {
 	return "", nil
 }
 
-func (fs MockService) GetAvailableAgents(ctx context.Context, session models.Session, db string, limit int32) ([]string, error) {
+func (fs MockService) GetAvailableAgents(ctx context.Context, limit int32, strategy string, skills []models.SkillRequirement) ([]string, error) {
 	var strNil []string
 	if fs.MockGetAvailableAgents != nil {
 		return fs.MockGetAvailableAgents()
@@ -50,27 +68,132 @@ func (fs MockService) GetAvailableAgents(ctx context.Context, session models.Ses
 	return strNil, nil
 }
 
-func (fs MockService) GetAgentIDFromRef(session models.Session, db string, refID string) (int32, error) {
+func (fs MockService) GetAgentIDFromRef(ctx context.Context, refID string) (int32, error) {
 	if fs.MockGetAgentIDFromRef != nil {
 		return fs.MockGetAgentIDFromRef()
 	}
 	return 0, nil
 }
 
-func (fs MockService) HeartBeat(session models.Session, db string, agentID int32) (grpc_types.HeartBeatResponse_HeartBeatStatus, error) {
+func (fs MockService) HeartBeat(ctx context.Context, agentID int32) (grpc_types.HeartBeatResponse_HeartBeatStatus, time.Duration, error) {
 	if fs.MockHeartBeat != nil {
 		return fs.MockHeartBeat()
 	}
-	return grpc_types.HeartBeatResponse_HEARTBEAT_SUCCESSFUL, nil
+	return grpc_types.HeartBeatResponse_HEARTBEAT_SUCCESSFUL, config.DefaultHeartBeatInterval, nil
 }
 
-func (fs MockService) AddTask(session models.Session, db string, custID int32, agentIDs []int32) (int32, error) {
+func (fs MockService) AddTask(ctx context.Context, custID int32, agentIDs []int32, skills []models.SkillRequirement) (int32, error) {
 	if fs.MockAddTask != nil {
 		return fs.MockAddTask()
 	}
 	return 1, nil
 }
 
+func (fs MockService) OfferTask(ctx context.Context, taskID int32, agentIDs []int32) (models.Task, error) {
+	if fs.MockOfferTask != nil {
+		return fs.MockOfferTask()
+	}
+	return models.Task{TaskID: taskID, AgentIDs: agentIDs, Status: models.TaskOffered}, nil
+}
+
+func (fs MockService) AcceptCall(ctx context.Context, agentID int32, taskID int32) (models.Task, error) {
+	if fs.MockAcceptCall != nil {
+		return fs.MockAcceptCall()
+	}
+	return models.Task{TaskID: taskID, AgentIDs: []int32{agentID}, AcceptedBy: agentID}, nil
+}
+
+func (fs MockService) StartTask(ctx context.Context, agentID int32, taskID int32) (models.Task, error) {
+	if fs.MockStartTask != nil {
+		return fs.MockStartTask()
+	}
+	return models.Task{TaskID: taskID, AgentIDs: []int32{agentID}, AcceptedBy: agentID, Status: models.TaskInProgress}, nil
+}
+
+func (fs MockService) CompleteTask(ctx context.Context, agentID int32, taskID int32) (models.Task, error) {
+	if fs.MockCompleteTask != nil {
+		return fs.MockCompleteTask()
+	}
+	return models.Task{TaskID: taskID, AgentIDs: []int32{agentID}, AcceptedBy: agentID}, nil
+}
+
+func (fs MockService) GetTask(ctx context.Context, taskID int32) (models.Task, error) {
+	if fs.MockGetTask != nil {
+		return fs.MockGetTask()
+	}
+	return models.Task{TaskID: taskID, Status: models.TaskOffered}, nil
+}
+
+func (fs MockService) ListTasks(ctx context.Context, custID int32, agentID int32, status string, limit int32) ([]models.Task, error) {
+	if fs.MockListTasks != nil {
+		return fs.MockListTasks()
+	}
+	return []models.Task{}, nil
+}
+
+func (fs MockService) CancelTask(ctx context.Context, taskID int32, abandoned bool) (models.Task, error) {
+	if fs.MockCancelTask != nil {
+		return fs.MockCancelTask()
+	}
+	return models.Task{TaskID: taskID, Status: models.TaskCancelled}, nil
+}
+
+func (fs MockService) SetAgentState(ctx context.Context, agentID int32, state string) error {
+	if fs.MockSetAgentState != nil {
+		return fs.MockSetAgentState()
+	}
+	return nil
+}
+
+func (fs MockService) SetAgentSkills(ctx context.Context, agentID int32, skills []models.Skill) (models.Agent, error) {
+	if fs.MockSetAgentSkills != nil {
+		return fs.MockSetAgentSkills()
+	}
+	return models.Agent{}, nil
+}
+
+func (fs MockService) RegisterAgent(ctx context.Context) (int32, error) {
+	if fs.MockRegisterAgent != nil {
+		return fs.MockRegisterAgent()
+	}
+	return 1, nil
+}
+
+func (fs MockService) DeregisterAgent(ctx context.Context, agentID int32) error {
+	if fs.MockDeregisterAgent != nil {
+		return fs.MockDeregisterAgent()
+	}
+	return nil
+}
+
+func (fs MockService) WatchAgents(ctx context.Context) ([]models.Agent, *watch.Watcher, error) {
+	if fs.MockWatchAgents != nil {
+		return fs.MockWatchAgents()
+	}
+	return nil, nil, nil
+}
+
+func (fs MockService) ConnectAgent(ctx context.Context, agentID int32) (*heartbeat.Conn, time.Duration, error) {
+	if fs.MockConnectAgent != nil {
+		return fs.MockConnectAgent()
+	}
+	return nil, 0, nil
+}
+
+func (fs MockService) KeepAlive(ctx context.Context, agentID int32, sinceLastBeat time.Duration) error {
+	if fs.MockKeepAlive != nil {
+		return fs.MockKeepAlive()
+	}
+	return nil
+}
+
+func (fs MockService) DisconnectAgent(ctx context.Context, conn *heartbeat.Conn) error {
+	if fs.MockDisconnectAgent != nil {
+		return fs.MockDisconnectAgent()
+	}
+	return nil
+}
+
 // -----------------------------------------------------------------------------
 
 // MockSession satisfies Session and act as a mock of *mgo.session.
@@ -120,15 +243,6 @@ type MockDatabase struct{}
 // MockCollection satisfies Collection and act as a mock.
 type MockCollection struct{}
 
-// Find mock.
-func (fc MockCollection) Find(query interface{}) *mgo.Query {
-	return nil
-}
-
-func (fc MockCollection) FindId(query interface{}) *mgo.Query {
-	return nil
-}
-
 // Count mock.
 func (fc MockCollection) Count() (n int, err error) {
 	return 10, nil
@@ -159,6 +273,11 @@ func (fc MockCollection) EnsureIndex(index mgo.Index) error {
 	return nil
 }
 
+// DropIndex mock.
+func (fc MockCollection) DropIndex(key ...string) error {
+	return nil
+}
+
 // Upsert mock.
 func (fc MockCollection) Upsert(selector interface{}, update interface{}) (info *mgo.ChangeInfo, err error) {
 	return nil, nil
@@ -169,6 +288,11 @@ func (fc MockCollection) RemoveAll(selector interface{}) (info *mgo.ChangeInfo,
 	return nil, nil
 }
 
+// UpdateAll mock.
+func (fc MockCollection) UpdateAll(selector interface{}, update interface{}) (info *mgo.ChangeInfo, err error) {
+	return nil, nil
+}
+
 // C mocks mgo.Database(name).Collection(name).
 func (db MockDatabase) C(name string) models.Collection {
 	return MockCollection{}
@@ -177,12 +301,27 @@ func (db MockDatabase) C(name string) models.Collection {
 // Mock service calls
 
 //AgentExists mocks models.AgentExists().
-func (db MockDatabase) AgentExists(agentID int32) (bool, error) {
+func (db MockDatabase) AgentExists(ctx context.Context, agentID int32) (bool, error) {
 	return true, nil
 }
 
+// GetAgent mocks models.GetAgent().
+func (db MockDatabase) GetAgent(ctx context.Context, agentID int32) (models.Agent, error) {
+	return models.Agent{AgentID: agentID, State: models.AgentAvailable}, nil
+}
+
+// SetAgentState mocks models.SetAgentState().
+func (db MockDatabase) SetAgentState(ctx context.Context, agentID int32, from models.AgentState, to models.AgentState) error {
+	return nil
+}
+
+// SetAgentSkills mocks models.SetAgentSkills().
+func (db MockDatabase) SetAgentSkills(ctx context.Context, agentID int32, skills []models.Skill) (models.Agent, error) {
+	return models.Agent{AgentID: agentID, Skills: skills}, nil
+}
+
 //GetAgents mocks models.GetAgents().
-func (db MockDatabase) GetAgents(timestamp time.Time, limit int32) ([]models.Agent, error) {
+func (db MockDatabase) GetAgents(ctx context.Context, state models.AgentState, timestamp time.Time, skills []models.SkillRequirement, order models.AgentOrder, limit int32) ([]models.Agent, error) {
 	var agents []models.Agent
 	source := filepath.Join(dataDir, "get_agents.json")
 
@@ -193,28 +332,138 @@ func (db MockDatabase) GetAgents(timestamp time.Time, limit int32) ([]models.Age
 
 	json.Unmarshal(src, &agents)
 
-	return agents, nil
+	return order.Apply(agents, limit), nil
 }
 
 // AddTask mocks models.AddTask().
-func (db MockDatabase) AddTask(custID int32, agentIDs []int32) (int32, error) {
+func (db MockDatabase) AddTask(ctx context.Context, custID int32, agentIDs []int32, skills []models.SkillRequirement) (int32, error) {
 	return 0, nil
 }
 
-func (db MockDatabase) GetNextSequence(name string) (int32, error) {
+// AcceptTask mocks models.AcceptTask().
+func (db MockDatabase) AcceptTask(ctx context.Context, taskID int32, agentID int32) (models.Task, error) {
+	return models.Task{TaskID: taskID, AgentIDs: []int32{agentID}, AcceptedBy: agentID}, nil
+}
+
+// CompleteTask mocks models.CompleteTask().
+func (db MockDatabase) CompleteTask(ctx context.Context, taskID int32, agentID int32) (models.Task, error) {
+	return models.Task{TaskID: taskID, AgentIDs: []int32{agentID}, AcceptedBy: agentID}, nil
+}
+
+// GetTask mocks models.GetTask().
+func (db MockDatabase) GetTask(ctx context.Context, taskID int32) (models.Task, error) {
+	return models.Task{TaskID: taskID, Status: models.TaskOffered}, nil
+}
+
+// ListTasks mocks models.ListTasks().
+func (db MockDatabase) ListTasks(ctx context.Context, filter models.TaskFilter, limit int32) ([]models.Task, error) {
+	return []models.Task{}, nil
+}
+
+// SetTaskStatus mocks models.SetTaskStatus().
+func (db MockDatabase) SetTaskStatus(ctx context.Context, taskID int32, from models.TaskStatus, to models.TaskStatus) (models.Task, error) {
+	return models.Task{TaskID: taskID, Status: to}, nil
+}
+
+// OfferTask mocks models.OfferTask().
+func (db MockDatabase) OfferTask(ctx context.Context, taskID int32, agentIDs []int32) (models.Task, error) {
+	return models.Task{TaskID: taskID, AgentIDs: agentIDs, Status: models.TaskOffered}, nil
+}
+
+// CountAcceptedTasks mocks models.CountAcceptedTasks().
+func (db MockDatabase) CountAcceptedTasks(ctx context.Context, agentIDs []int32, since time.Time) (map[int32]int, error) {
+	return map[int32]int{}, nil
+}
+
+// AddAgent mocks models.AddAgent().
+func (db MockDatabase) AddAgent(ctx context.Context) (int32, error) {
+	return 1, nil
+}
+
+// RemoveAgent mocks models.RemoveAgent().
+func (db MockDatabase) RemoveAgent(ctx context.Context, agentID int32) error {
+	return nil
+}
+
+func (db MockDatabase) GetNextSequence(ctx context.Context, name string) (int32, error) {
 	return 1, nil
 }
 
 //GetAgentIDFromRef mocks models.GetAgents().
-func (db MockDatabase) GetAgentIDFromRef(refID string) (int32, error) {
+func (db MockDatabase) GetAgentIDFromRef(ctx context.Context, refID string) (int32, error) {
 	return 0, nil
 }
 
 //HeartBeat mocks models.GetAgents().
-func (db MockDatabase) HeartBeat(agentID int32) error {
+func (db MockDatabase) HeartBeat(ctx context.Context, agentID int32) error {
+	return nil
+}
+
+// HeartBeats mocks models.HeartBeats().
+func (db MockDatabase) HeartBeats(ctx context.Context, beats map[int32]time.Time) (int, error) {
+	return len(beats), nil
+}
+
+// TouchAgents mocks models.TouchAgents().
+func (db MockDatabase) TouchAgents(ctx context.Context, agentIDs []int32) (int, error) {
+	return len(agentIDs), nil
+}
+
+// ExpireAgents mocks models.ExpireAgents().
+func (db MockDatabase) ExpireAgents(ctx context.Context, before time.Time, dryRun bool) ([]int32, error) {
+	return nil, nil
+}
+
+// ExpirePhoneSessions mocks models.ExpirePhoneSessions().
+func (db MockDatabase) ExpirePhoneSessions(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	return 0, nil
+}
+
+// ArchiveTasks mocks models.ArchiveTasks().
+func (db MockDatabase) ArchiveTasks(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	return 0, nil
+}
+
+// AppliedMigrations mocks models.AppliedMigrations().
+func (db MockDatabase) AppliedMigrations(ctx context.Context) ([]models.AppliedMigration, error) {
+	return nil, nil
+}
+
+// AddMigration mocks models.AddMigration().
+func (db MockDatabase) AddMigration(ctx context.Context, m models.AppliedMigration) error {
 	return nil
 }
 
+// RemoveMigration mocks models.RemoveMigration().
+func (db MockDatabase) RemoveMigration(ctx context.Context, version int) error {
+	return nil
+}
+
+// LockMigrations mocks models.LockMigrations().
+func (db MockDatabase) LockMigrations(ctx context.Context, owner string, expires time.Time, now time.Time) (bool, error) {
+	return true, nil
+}
+
+// RenewMigrationLock mocks models.RenewMigrationLock().
+func (db MockDatabase) RenewMigrationLock(ctx context.Context, owner string, expires time.Time) (bool, error) {
+	return true, nil
+}
+
+// UnlockMigrations mocks models.UnlockMigrations().
+func (db MockDatabase) UnlockMigrations(ctx context.Context, owner string) error {
+	return nil
+}
+
+// WithTransaction mocks models.WithTransaction().
+func (db MockDatabase) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+// WatchCollection mocks models.WatchCollection().
+func (db MockDatabase) WatchCollection(ctx context.Context, collection string, pipeline interface{}) (models.ChangeStream, error) {
+	return nil, models.ErrNotSupported
+}
+
 //DropDatabase mocks db.DropDatabase().
 func (db MockDatabase) DropDatabase() error {
 	return nil
@@ -5,6 +5,7 @@ package testutil
 // mocks, test harnesses, helpers, etc.
 
 import (
+	"context"
 	"flag"
 	stdlog "log"
 	"os"
@@ -16,6 +17,7 @@ import (
 	//"strconv"
 	"time"
 
+	"github.com/newtonsystems/agent-mgmt/app/migrate"
 	tmodels "github.com/newtonsystems/agent-mgmt/app/models"
 	"github.com/newtonsystems/agent-mgmt/app/utils"
 	"gopkg.in/mgo.v2"
@@ -41,6 +43,15 @@ var Debug = flag.Bool("debug", false, "update golden files")
 // OutsideConn connect to a remote cluster from (outside of k8s cluster)
 var OutsideConn = flag.Bool("conn.local", true, "If connecting from outside of cluster")
 
+// Memory runs the tests against the in-memory database instead of mongo
+var Memory = flag.Bool("memory", false, "Use the in-memory database instead of mongo")
+
+// Driver runs the tests against mongo with the official mongo driver instead of mgo
+var Driver = flag.Bool("driver", false, "Use the official mongo driver instead of mgo")
+
+// Postgres runs the tests against postgres (POSTGRES_URI) instead of mongo
+var Postgres = flag.Bool("postgres", false, "Use postgres (POSTGRES_URI) instead of mongo")
+
 func envString(env, fallback string) string {
 	e := os.Getenv(env)
 	if e == "" {
@@ -108,8 +119,116 @@ func CleanAllCollectionsTestMongo(session tmodels.Session) {
 
 }
 
+// MigrateDB applies every migration to database db (panics if one fails)
+func MigrateDB(session tmodels.Session, db string) {
+	migrator, err := migrate.New(migrate.For(session), "test", logger)
+	if err != nil {
+		panic(err)
+	}
+
+	if _, err = migrator.Up(context.Background(), session.DB(db), 0); err != nil {
+		logger.Log("level", "error", "msg", "Failed to migrate test database "+db)
+		panic(err)
+	}
+}
+
+// NewTestMemoryConnection returns a prepared in-memory session set to "test" database
+func NewTestMemoryConnection() (tmodels.Session, tmodels.DataLayer) {
+	session, _ := tmodels.NewMemorySession(logger)
+
+	// Optional. Add stats
+	mgo.SetStats(true)
+
+	// Prepare database
+	MigrateDB(session, MongoDBName)
+
+	return session, session.DB(MongoDBName)
+}
+
+// NewTestDriverConnection returns a prepared session on the official mongo
+// driver set to "test" database (the servers of NewTestMongoConnection)
+func NewTestDriverConnection(debug bool, localConn bool) (tmodels.Session, tmodels.DataLayer) {
+	uri := "mongodb://mongo-0.mongo:27017,mongo-1.mongo:27017,mongo-2.mongo:27017/" + MongoDBName
+	if localConn {
+		// Only a single member can be reached from outside of the cluster
+		uri = "mongodb://" + envString("MONGO_0_SERVICE_HOST", "192.168.99.100") + ":" + envString("MONGO_0_SERVICE_PORT", "31070") + "/" + MongoDBName + "?connect=direct"
+	}
+
+	settings, err := tmodels.ParseMongoURI(uri)
+	if err != nil {
+		panic(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	session, _, err := tmodels.NewDriverSession(ctx, settings, logger, debug)
+
+	// Can't connect? - bail!
+	if err != nil {
+		panic(err)
+	}
+
+	session.SetSafe(&mgo.Safe{WMode: "majority", J: true})
+	session.SetSocketTimeout(10 * time.Second)
+
+	// Drop database - to have a clean start
+	if err = session.DB(MongoDBName).DropDatabase(); err != nil {
+		logger.Log("level", "error", "msg", "Failed to drop test database before trying to prepare")
+		panic(err)
+	}
+
+	// Prepare database
+	MigrateDB(session, MongoDBName)
+
+	return session, session.DB(MongoDBName)
+}
+
+// NewTestPostgresConnection returns a prepared postgres session set to "test"
+// database (the "test" schema of POSTGRES_URI, by default a locally started postgres)
+func NewTestPostgresConnection() (tmodels.Session, tmodels.DataLayer) {
+	settings, err := tmodels.ParsePostgresURI(envString("POSTGRES_URI", "postgres://postgres@localhost:5432/postgres?sslmode=disable"))
+	if err != nil {
+		panic(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	session, _, err := tmodels.NewPostgresSession(ctx, settings, logger)
+
+	// Can't connect? - bail!
+	if err != nil {
+		panic(err)
+	}
+
+	session.SetSocketTimeout(10 * time.Second)
+
+	// Drop database - to have a clean start
+	if err = session.DB(MongoDBName).DropDatabase(); err != nil {
+		logger.Log("level", "error", "msg", "Failed to drop test database before trying to prepare")
+		panic(err)
+	}
+
+	// Prepare database
+	MigrateDB(session, MongoDBName)
+
+	return session, session.DB(MongoDBName)
+}
+
 // NewTestMongoConnection set to "test" database
+// (returns an in-memory connection instead if the -memory flag is set, one
+// on the official mongo driver if the -driver flag is set or a postgres one
+// if the -postgres flag is set)
 func NewTestMongoConnection(debug bool, localConn bool) (tmodels.Session, tmodels.DataLayer) {
+	if *Memory {
+		return NewTestMemoryConnection()
+	}
+	if *Driver {
+		return NewTestDriverConnection(debug, localConn)
+	}
+	if *Postgres {
+		return NewTestPostgresConnection()
+	}
+
 	// Initialise mongodb connection and logger
 	// Create a session which maintains a pool of socket connections to our MongoDB.
 	if debug {
@@ -218,7 +337,7 @@ func NewTestMongoConnection(debug bool, localConn bool) (tmodels.Session, tmodel
 	}
 
 	// Prepare database
-	tmodels.PrepareDB(session, MongoDBName, logger)
+	MigrateDB(session, MongoDBName)
 
 	db := session.DB(MongoDBName)
 
@@ -24,6 +24,13 @@ const (
 	ColourReset = "\033[39m"
 )
 
+// Fixtures is the input file format for tests that need more than one collection
+type Fixtures struct {
+	Agents        []models.Agent        `json:"agents"`
+	PhoneSessions []models.PhoneSession `json:"phonesessions"`
+	Tasks         []models.Task         `json:"tasks"`
+}
+
 // InsertFixturesToDB Unmarshal JSON From File
 func InsertFixturesToDB(t *testing.T, session models.Session, testName string, src []byte) {
 	var errMessage = "No JSON data found when unmarshalled data from source file."
@@ -31,6 +38,10 @@ func InsertFixturesToDB(t *testing.T, session models.Session, testName string, s
 	switch testName {
 	case "getavailableagents":
 		fallthrough
+	case "registeragent":
+		fallthrough
+	case "deregisteragent":
+		fallthrough
 	case "heartbeat":
 		var agents []models.Agent
 		json.Unmarshal(src, &agents)
@@ -73,6 +84,26 @@ func InsertFixturesToDB(t *testing.T, session models.Session, testName string, s
 			}
 		}
 
+	case "acceptcall", "starttask", "completetask", "offertask", "setagentstate", "setagentskills", "gettask", "listtasks", "canceltask":
+		var fixtures Fixtures
+		json.Unmarshal(src, &fixtures)
+
+		// Check we have found some input
+		if len(fixtures.Agents) == 0 && len(fixtures.PhoneSessions) == 0 && len(fixtures.Tasks) == 0 {
+			FailNowAt(t, errMessage)
+		}
+
+		db := session.DB(MongoDBName)
+		for _, agent := range fixtures.Agents {
+			InsertCollectionToDB(t, db, "agents", []TestModelInsert{&agent})
+		}
+		for _, phoneSess := range fixtures.PhoneSessions {
+			InsertCollectionToDB(t, db, "phonesessions", []TestModelInsert{&phoneSess})
+		}
+		for _, task := range fixtures.Tasks {
+			InsertCollectionToDB(t, db, "tasks", []TestModelInsert{&task})
+		}
+
 	}
 }
 
@@ -115,6 +146,23 @@ func InsertCollectionToDB(t *testing.T, db models.DataLayer, collection string,
 			}
 
 		}
+
+	case "tasks":
+		for _, insert := range inserts {
+			task, ok := insert.(*models.Task)
+			if !ok {
+				FailNowAt(t, "Failed to convert/decode insert into Task. This shouldn't happen ...")
+			}
+			if *Verbose {
+				fmt.Printf("Inserting " + fmt.Sprintf("%#v", task) + " into collection '" + collection + "'\n")
+			}
+			err := db.C("tasks").Insert(task)
+			if err != nil {
+				t.Error(err)
+				FailNowAt(t, "Could not insert "+fmt.Sprintf("%#v", task)+" into mongo")
+			}
+
+		}
 	}
 }
 
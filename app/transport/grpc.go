@@ -6,15 +6,23 @@ package transport
 import (
 	"context"
 	"errors"
+	"io"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	//"github.com/go-kit/kit/tracing/opentracing"
 	grpctransport "github.com/go-kit/kit/transport/grpc"
 	stdopentracing "github.com/opentracing/opentracing-go"
 	oldcontext "golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
 
 	"github.com/newtonsystems/agent-mgmt/app/endpoint"
+	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+	"github.com/newtonsystems/agent-mgmt/app/heartbeat"
+	"github.com/newtonsystems/agent-mgmt/app/models"
+	"github.com/newtonsystems/agent-mgmt/app/service"
 	"github.com/newtonsystems/agent-mgmt/app/utils"
+	"github.com/newtonsystems/agent-mgmt/app/watch"
 	"github.com/newtonsystems/grpc_types/go/grpc_types"
 )
 
@@ -31,46 +39,141 @@ func GRPCServer(endpoints endpoint.Set, tracer stdopentracing.Tracer, logger log
 	//options := []grpctransport.ServerOption{
 	//	grpctransport.ServerErrorLogger(logger),
 	//}
+	options := []grpctransport.ServerOption{
+		grpctransport.ServerBefore(requestID),
+	}
 	return &grpcServer{
 		getavailableagents: grpctransport.NewServer(
 			endpoints.GetAvailableAgentsEndpoint,
 			DecodeGRPCGetAvailableAgentsRequest,
 			EncodeGRPCGetAvailableAgentsResponse,
 			//append(options, grpctransport.ServerBefore(opentracing.FromGRPCRequest(tracer, "GetAvailableAgents", logger)))...,
+			options...,
 		),
 		getagentidfromref: grpctransport.NewServer(
 			endpoints.GetAgentIDFromRefEndpoint,
 			DecodeGRPCGetAgentIDFromRefRequest,
 			EncodeGRPCGetAgentIDFromRefResponse,
 			//append(options, grpctransport.ServerBefore(opentracing.FromGRPCRequest(tracer, "Sum", logger)))...,
+			options...,
 		),
 		heartbeat: grpctransport.NewServer(
 			endpoints.HeartBeatEndpoint,
 			DecodeGRPCHeartBeatRequest,
 			EncodeGRPCHeartBeatResponse,
 			//append(options, grpctransport.ServerBefore(opentracing.FromGRPCRequest(tracer, "Sum", logger)))...,
+			options...,
 		),
 		addtask: grpctransport.NewServer(
 			endpoints.AddTaskEndpoint,
 			DecodeGRPCAddTaskRequest,
 			EncodeGRPCAddTaskResponse,
 			//append(options, grpctransport.ServerBefore(opentracing.FromGRPCRequest(tracer, "Sum", logger)))...,
+			options...,
+		),
+		registeragent: grpctransport.NewServer(
+			endpoints.RegisterAgentEndpoint,
+			DecodeGRPCRegisterAgentRequest,
+			EncodeGRPCRegisterAgentResponse,
+			options...,
+		),
+		deregisteragent: grpctransport.NewServer(
+			endpoints.DeregisterAgentEndpoint,
+			DecodeGRPCDeregisterAgentRequest,
+			EncodeGRPCDeregisterAgentResponse,
+			options...,
+		),
+		acceptcall: grpctransport.NewServer(
+			endpoints.AcceptCallEndpoint,
+			DecodeGRPCAcceptCallRequest,
+			EncodeGRPCAcceptCallResponse,
+			//append(options, grpctransport.ServerBefore(opentracing.FromGRPCRequest(tracer, "Sum", logger)))...,
+			options...,
+		),
+		offertask: grpctransport.NewServer(
+			endpoints.OfferTaskEndpoint,
+			DecodeGRPCOfferTaskRequest,
+			EncodeGRPCOfferTaskResponse,
+			options...,
+		),
+		starttask: grpctransport.NewServer(
+			endpoints.StartTaskEndpoint,
+			DecodeGRPCStartTaskRequest,
+			EncodeGRPCStartTaskResponse,
+			options...,
+		),
+		completetask: grpctransport.NewServer(
+			endpoints.CompleteTaskEndpoint,
+			DecodeGRPCCompleteTaskRequest,
+			EncodeGRPCCompleteTaskResponse,
+			options...,
 		),
-		//acceptcall: grpctransport.NewServer(
-		//	endpoints.GetAgentIDFromRefEndpoint,
-		//	DecodeGRPCGetAgentIDFromRefRequest,
-		//	EncodeGRPCGetAgentIDFromRefResponse,
-		//	//append(options, grpctransport.ServerBefore(opentracing.FromGRPCRequest(tracer, "Sum", logger)))...,
-		//),
+		setagentstate: grpctransport.NewServer(
+			endpoints.SetAgentStateEndpoint,
+			DecodeGRPCSetAgentStateRequest,
+			EncodeGRPCSetAgentStateResponse,
+			options...,
+		),
+		setagentskills: grpctransport.NewServer(
+			endpoints.SetAgentSkillsEndpoint,
+			DecodeGRPCSetAgentSkillsRequest,
+			EncodeGRPCSetAgentSkillsResponse,
+			options...,
+		),
+		gettask: grpctransport.NewServer(
+			endpoints.GetTaskEndpoint,
+			DecodeGRPCGetTaskRequest,
+			EncodeGRPCGetTaskResponse,
+			options...,
+		),
+		listtasks: grpctransport.NewServer(
+			endpoints.ListTasksEndpoint,
+			DecodeGRPCListTasksRequest,
+			EncodeGRPCListTasksResponse,
+			options...,
+		),
+		canceltask: grpctransport.NewServer(
+			endpoints.CancelTaskEndpoint,
+			DecodeGRPCCancelTaskRequest,
+			EncodeGRPCCancelTaskResponse,
+			options...,
+		),
+		watchagents:     endpoints.WatchAgents,
+		heartbeatstream: endpoints.HeartBeatStream,
+	}
+}
+
+// requestID is a grpctransport.ServerRequestFunc (see withRequestID)
+func requestID(ctx context.Context, _ metadata.MD) context.Context {
+	return withRequestID(ctx)
+}
+
+// withRequestID gives a call without a request ID a new one
+func withRequestID(ctx context.Context) context.Context {
+	if service.RequestIDFromContext(ctx) != "" {
+		return ctx
 	}
+	return service.WithRequestID(ctx, service.NewRequestID())
 }
 
 type grpcServer struct {
 	getavailableagents grpctransport.Handler
 	getagentidfromref  grpctransport.Handler
+	offertask          grpctransport.Handler
 	acceptcall         grpctransport.Handler
+	starttask          grpctransport.Handler
+	completetask       grpctransport.Handler
+	setagentstate      grpctransport.Handler
+	setagentskills     grpctransport.Handler
+	gettask            grpctransport.Handler
+	listtasks          grpctransport.Handler
+	canceltask         grpctransport.Handler
 	heartbeat          grpctransport.Handler
 	addtask            grpctransport.Handler
+	registeragent      grpctransport.Handler
+	deregisteragent    grpctransport.Handler
+	watchagents        endpoint.WatchAgentsFunc
+	heartbeatstream    endpoint.HeartBeatStreamFuncs
 }
 
 // API Server functions defined by proto file
@@ -100,6 +203,70 @@ func (s *grpcServer) AcceptCall(ctx oldcontext.Context, req *grpc_types.AcceptCa
 	return rep.(*grpc_types.AcceptCallResponse), nil
 }
 
+func (s *grpcServer) OfferTask(ctx oldcontext.Context, req *grpc_types.OfferTaskRequest) (*grpc_types.OfferTaskResponse, error) {
+	_, rep, err := s.offertask.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return rep.(*grpc_types.OfferTaskResponse), nil
+}
+
+func (s *grpcServer) StartTask(ctx oldcontext.Context, req *grpc_types.StartTaskRequest) (*grpc_types.StartTaskResponse, error) {
+	_, rep, err := s.starttask.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return rep.(*grpc_types.StartTaskResponse), nil
+}
+
+func (s *grpcServer) CompleteTask(ctx oldcontext.Context, req *grpc_types.CompleteTaskRequest) (*grpc_types.CompleteTaskResponse, error) {
+	_, rep, err := s.completetask.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return rep.(*grpc_types.CompleteTaskResponse), nil
+}
+
+func (s *grpcServer) SetAgentState(ctx oldcontext.Context, req *grpc_types.SetAgentStateRequest) (*grpc_types.SetAgentStateResponse, error) {
+	_, rep, err := s.setagentstate.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return rep.(*grpc_types.SetAgentStateResponse), nil
+}
+
+func (s *grpcServer) SetAgentSkills(ctx oldcontext.Context, req *grpc_types.SetAgentSkillsRequest) (*grpc_types.SetAgentSkillsResponse, error) {
+	_, rep, err := s.setagentskills.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return rep.(*grpc_types.SetAgentSkillsResponse), nil
+}
+
+func (s *grpcServer) GetTask(ctx oldcontext.Context, req *grpc_types.GetTaskRequest) (*grpc_types.GetTaskResponse, error) {
+	_, rep, err := s.gettask.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return rep.(*grpc_types.GetTaskResponse), nil
+}
+
+func (s *grpcServer) ListTasks(ctx oldcontext.Context, req *grpc_types.ListTasksRequest) (*grpc_types.ListTasksResponse, error) {
+	_, rep, err := s.listtasks.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return rep.(*grpc_types.ListTasksResponse), nil
+}
+
+func (s *grpcServer) CancelTask(ctx oldcontext.Context, req *grpc_types.CancelTaskRequest) (*grpc_types.CancelTaskResponse, error) {
+	_, rep, err := s.canceltask.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return rep.(*grpc_types.CancelTaskResponse), nil
+}
+
 func (s *grpcServer) HeartBeat(ctx oldcontext.Context, req *grpc_types.HeartBeatRequest) (*grpc_types.HeartBeatResponse, error) {
 	_, rep, err := s.heartbeat.ServeGRPC(ctx, req)
 	if err != nil {
@@ -116,13 +283,141 @@ func (s *grpcServer) AddTask(ctx oldcontext.Context, req *grpc_types.AddTaskRequ
 	return rep.(*grpc_types.AddTaskResponse), nil
 }
 
+func (s *grpcServer) RegisterAgent(ctx oldcontext.Context, req *grpc_types.RegisterAgentRequest) (*grpc_types.RegisterAgentResponse, error) {
+	_, rep, err := s.registeragent.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return rep.(*grpc_types.RegisterAgentResponse), nil
+}
+
+func (s *grpcServer) DeregisterAgent(ctx oldcontext.Context, req *grpc_types.DeregisterAgentRequest) (*grpc_types.DeregisterAgentResponse, error) {
+	_, rep, err := s.deregisteragent.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return rep.(*grpc_types.DeregisterAgentResponse), nil
+}
+
+// WatchAgents streams a snapshot of the available agents followed by every
+// agent event of this instance until the client goes away, the watcher falls
+// behind or the server shuts down
+func (s *grpcServer) WatchAgents(req *grpc_types.WatchAgentsRequest, stream grpc_types.AgentMgmt_WatchAgentsServer) error {
+	ctx := withRequestID(stream.Context())
+
+	agents, watcher, err := s.watchagents(ctx)
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	if err := stream.Send(EncodeGRPCAgentSnapshot(agents)); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event, ok := <-watcher.C:
+			if !ok {
+				// Shutting down is not an error for the client, it should just watch again
+				if err := watcher.Err(); err != nil && !amerrors.Is(err, amerrors.ErrWatchClosed) {
+					return service.WrapError(ctx, err)
+				}
+				return nil
+			}
+			if err := stream.Send(EncodeGRPCAgentEvent(event)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// HeartBeatStream keeps an agent available for as long as its stream is open.
+// The first message from the agent says who it is, the ones after are
+// heartbeats. The server pushes commands (change interval, offer task, go
+// away) back. The agent is marked offline as soon as the stream ends.
+func (s *grpcServer) HeartBeatStream(stream grpc_types.AgentMgmt_HeartBeatStreamServer) error {
+	ctx := withRequestID(stream.Context())
+
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if err := validate(ctx, validateID("agent_id", req.AgentId)); err != nil {
+		return err
+	}
+
+	conn, next, err := s.heartbeatstream.Connect(ctx, req.AgentId)
+	if err != nil {
+		return err
+	}
+	// The agent is marked offline after the stream (and its context) is done
+	defer s.heartbeatstream.Disconnect(service.DetachContext(ctx), conn)
+
+	if err := stream.Send(EncodeGRPCHeartBeatCommand(heartbeat.Command{Type: heartbeat.CommandChangeInterval, Interval: next})); err != nil {
+		return err
+	}
+
+	// Recv blocks so heartbeats are read in their own goroutine, it ends once
+	// this handler returns (the stream is then done and Recv fails)
+	beats := make(chan struct{}, 1)
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := stream.Recv(); err != nil {
+				recvErr <- err
+				return
+			}
+			select {
+			case beats <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(next)
+	defer ticker.Stop()
+	lastBeat := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-recvErr:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case <-beats:
+			lastBeat = time.Now()
+		case <-ticker.C:
+			if err := s.heartbeatstream.KeepAlive(ctx, conn.AgentID, time.Since(lastBeat)); err != nil {
+				return err
+			}
+		case cmd, ok := <-conn.C:
+			if !ok {
+				// Replaced by a new stream, deregistered or shutting down
+				return stream.Send(EncodeGRPCGoAway(conn.Err()))
+			}
+			if err := stream.Send(EncodeGRPCHeartBeatCommand(cmd)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
 // ------------------------------------------------------------------------ //
 
 // -- GetAvailableAgents()
 
-func DecodeGRPCGetAvailableAgentsRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+func DecodeGRPCGetAvailableAgentsRequest(ctx context.Context, grpcReq interface{}) (interface{}, error) {
 	req := grpcReq.(*grpc_types.GetAvailableAgentsRequest)
-	return endpoint.GetAvailableAgentsRequest{Limit: req.Limit}, nil
+	if err := validate(ctx, validateLimit(req.Limit)); err != nil {
+		return nil, err
+	}
+	return endpoint.GetAvailableAgentsRequest{Limit: req.Limit, Strategy: req.Strategy, Skills: decodeSkillRequirements(req.Skills)}, nil
 }
 
 func EncodeGRPCGetAvailableAgentsResponse(_ context.Context, response interface{}) (interface{}, error) {
@@ -135,8 +430,11 @@ func EncodeGRPCGetAvailableAgentsResponse(_ context.Context, response interface{
 // GetAgentIDFromRef()
 
 // agent mgmt service (grpc_types) -> go kit
-func DecodeGRPCGetAgentIDFromRefRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+func DecodeGRPCGetAgentIDFromRefRequest(ctx context.Context, grpcReq interface{}) (interface{}, error) {
 	req := grpcReq.(*grpc_types.GetAgentIDFromRefRequest)
+	if err := validate(ctx, validateRefID(req.RefId)); err != nil {
+		return nil, err
+	}
 	return endpoint.GetAgentIDFromRefRequest{RefId: req.RefId}, nil
 }
 
@@ -151,16 +449,21 @@ func EncodeGRPCGetAgentIDFromRefResponse(_ context.Context, response interface{}
 // HeartBeat()
 
 // agent mgmt service (grpc_types) -> go kit
-func DecodeGRPCHeartBeatRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
-	//logger.Log("level", "error", "msg", "DecodeGRPCHeartBeatRequest")
-	//req := grpcReq.(*grpc_types.HeartBeatRequest)
-	return endpoint.HeartBeatRequest{}, nil
+func DecodeGRPCHeartBeatRequest(ctx context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*grpc_types.HeartBeatRequest)
+	if err := validate(ctx, validateID("agent_id", req.AgentId)); err != nil {
+		return nil, err
+	}
+	return endpoint.HeartBeatRequest{AgentId: req.AgentId}, nil
 }
 
 // go-kit -> agent mgmt service (grpc_types)
 func EncodeGRPCHeartBeatResponse(_ context.Context, response interface{}) (interface{}, error) {
 	resp := response.(endpoint.HeartBeatResponse)
-	return &grpc_types.HeartBeatResponse{Status: resp.Status}, nil
+	return &grpc_types.HeartBeatResponse{
+		Status:          resp.Status,
+		NextHeartbeatMs: int64(resp.NextHeartBeat / time.Millisecond),
+	}, nil
 }
 
 // ------------------------------------------------------------------------ //
@@ -168,9 +471,12 @@ func EncodeGRPCHeartBeatResponse(_ context.Context, response interface{}) (inter
 // AddTask()
 
 // DecodeGRPCAddTaskRequest agent mgmt service (grpc_types) -> go kit
-func DecodeGRPCAddTaskRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+func DecodeGRPCAddTaskRequest(ctx context.Context, grpcReq interface{}) (interface{}, error) {
 	req := grpcReq.(*grpc_types.AddTaskRequest)
-	return endpoint.AddTaskRequest{CustId: req.CustId, AgentIds: req.CallIds}, nil
+	if err := validate(ctx, validateCustID(req.CustId), validateAgentIDs(req.CallIds)); err != nil {
+		return nil, err
+	}
+	return endpoint.AddTaskRequest{CustId: req.CustId, AgentIds: req.CallIds, RequiredSkills: decodeSkillRequirements(req.RequiredSkills)}, nil
 }
 
 // EncodeGRPCAddTaskResponse go-kit -> agent mgmt service (grpc_types)
@@ -178,3 +484,333 @@ func EncodeGRPCAddTaskResponse(_ context.Context, response interface{}) (interfa
 	resp := response.(endpoint.AddTaskResponse)
 	return &grpc_types.AddTaskResponse{TaskId: resp.TaskId}, nil
 }
+
+// ------------------------------------------------------------------------ //
+
+// OfferTask()
+
+// DecodeGRPCOfferTaskRequest agent mgmt service (grpc_types) -> go kit
+func DecodeGRPCOfferTaskRequest(ctx context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*grpc_types.OfferTaskRequest)
+	if err := validate(ctx, validateID("task_id", req.TaskId), validateAgentIDs(req.CallIds)); err != nil {
+		return nil, err
+	}
+	return endpoint.OfferTaskRequest{TaskId: req.TaskId, AgentIds: req.CallIds}, nil
+}
+
+// EncodeGRPCOfferTaskResponse go-kit -> agent mgmt service (grpc_types)
+func EncodeGRPCOfferTaskResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(endpoint.OfferTaskResponse)
+	return &grpc_types.OfferTaskResponse{TaskId: resp.TaskId, Status: resp.Status}, nil
+}
+
+// ------------------------------------------------------------------------ //
+
+// AcceptCall()
+
+// DecodeGRPCAcceptCallRequest agent mgmt service (grpc_types) -> go kit
+func DecodeGRPCAcceptCallRequest(ctx context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*grpc_types.AcceptCallRequest)
+	if err := validate(ctx, validateID("agent_id", req.AgentId), validateID("task_id", req.TaskId)); err != nil {
+		return nil, err
+	}
+	return endpoint.AcceptCallRequest{AgentId: req.AgentId, TaskId: req.TaskId}, nil
+}
+
+// EncodeGRPCAcceptCallResponse go-kit -> agent mgmt service (grpc_types)
+func EncodeGRPCAcceptCallResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(endpoint.AcceptCallResponse)
+	return &grpc_types.AcceptCallResponse{TaskId: resp.TaskId, CustId: resp.CustId}, nil
+}
+
+// ------------------------------------------------------------------------ //
+
+// StartTask()
+
+// DecodeGRPCStartTaskRequest agent mgmt service (grpc_types) -> go kit
+func DecodeGRPCStartTaskRequest(ctx context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*grpc_types.StartTaskRequest)
+	if err := validate(ctx, validateID("agent_id", req.AgentId), validateID("task_id", req.TaskId)); err != nil {
+		return nil, err
+	}
+	return endpoint.StartTaskRequest{AgentId: req.AgentId, TaskId: req.TaskId}, nil
+}
+
+// EncodeGRPCStartTaskResponse go-kit -> agent mgmt service (grpc_types)
+func EncodeGRPCStartTaskResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(endpoint.StartTaskResponse)
+	return &grpc_types.StartTaskResponse{TaskId: resp.TaskId, Status: resp.Status}, nil
+}
+
+// ------------------------------------------------------------------------ //
+
+// CompleteTask()
+
+// DecodeGRPCCompleteTaskRequest agent mgmt service (grpc_types) -> go kit
+func DecodeGRPCCompleteTaskRequest(ctx context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*grpc_types.CompleteTaskRequest)
+	if err := validate(ctx, validateID("agent_id", req.AgentId), validateID("task_id", req.TaskId)); err != nil {
+		return nil, err
+	}
+	return endpoint.CompleteTaskRequest{AgentId: req.AgentId, TaskId: req.TaskId}, nil
+}
+
+// EncodeGRPCCompleteTaskResponse go-kit -> agent mgmt service (grpc_types)
+func EncodeGRPCCompleteTaskResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(endpoint.CompleteTaskResponse)
+	return &grpc_types.CompleteTaskResponse{TaskId: resp.TaskId}, nil
+}
+
+// ------------------------------------------------------------------------ //
+
+// SetAgentState()
+
+// DecodeGRPCSetAgentStateRequest agent mgmt service (grpc_types) -> go kit
+func DecodeGRPCSetAgentStateRequest(ctx context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*grpc_types.SetAgentStateRequest)
+	if err := validate(ctx, validateID("agent_id", req.AgentId)); err != nil {
+		return nil, err
+	}
+	return endpoint.SetAgentStateRequest{AgentId: req.AgentId, State: req.State}, nil
+}
+
+// EncodeGRPCSetAgentStateResponse go-kit -> agent mgmt service (grpc_types)
+func EncodeGRPCSetAgentStateResponse(_ context.Context, response interface{}) (interface{}, error) {
+	_ = response.(endpoint.SetAgentStateResponse)
+	return &grpc_types.SetAgentStateResponse{}, nil
+}
+
+// ------------------------------------------------------------------------ //
+
+// SetAgentSkills()
+
+// DecodeGRPCSetAgentSkillsRequest agent mgmt service (grpc_types) -> go kit
+func DecodeGRPCSetAgentSkillsRequest(ctx context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*grpc_types.SetAgentSkillsRequest)
+	if err := validate(ctx, validateID("agent_id", req.AgentId)); err != nil {
+		return nil, err
+	}
+	skills := make([]models.Skill, 0, len(req.Skills))
+	for _, skill := range req.Skills {
+		skills = append(skills, models.Skill{Name: skill.Name, Level: skill.Level})
+	}
+	return endpoint.SetAgentSkillsRequest{AgentId: req.AgentId, Skills: skills}, nil
+}
+
+// EncodeGRPCSetAgentSkillsResponse go-kit -> agent mgmt service (grpc_types)
+func EncodeGRPCSetAgentSkillsResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(endpoint.SetAgentSkillsResponse)
+	skills := make([]*grpc_types.Skill, 0, len(resp.Skills))
+	for _, skill := range resp.Skills {
+		skills = append(skills, &grpc_types.Skill{Name: skill.Name, Level: skill.Level})
+	}
+	return &grpc_types.SetAgentSkillsResponse{AgentId: resp.AgentId, Skills: skills}, nil
+}
+
+// decodeSkillRequirements returns the skill requirements of a request (nil if none)
+func decodeSkillRequirements(reqs []*grpc_types.SkillRequirement) []models.SkillRequirement {
+	var skills []models.SkillRequirement
+	for _, req := range reqs {
+		skills = append(skills, models.SkillRequirement{Name: req.Name, MinLevel: req.MinLevel, Required: req.Required, Weight: req.Weight})
+	}
+	return skills
+}
+
+// encodeSkillRequirements returns the grpc_types skill requirements (nil if none)
+func encodeSkillRequirements(skills []models.SkillRequirement) []*grpc_types.SkillRequirement {
+	var reqs []*grpc_types.SkillRequirement
+	for _, skill := range skills {
+		reqs = append(reqs, &grpc_types.SkillRequirement{Name: skill.Name, MinLevel: skill.MinLevel, Required: skill.Required, Weight: skill.Weight})
+	}
+	return reqs
+}
+
+// ------------------------------------------------------------------------ //
+
+// GetTask()
+
+// DecodeGRPCGetTaskRequest agent mgmt service (grpc_types) -> go kit
+func DecodeGRPCGetTaskRequest(ctx context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*grpc_types.GetTaskRequest)
+	if err := validate(ctx, validateID("task_id", req.TaskId)); err != nil {
+		return nil, err
+	}
+	return endpoint.GetTaskRequest{TaskId: req.TaskId}, nil
+}
+
+// EncodeGRPCGetTaskResponse go-kit -> agent mgmt service (grpc_types)
+func EncodeGRPCGetTaskResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(endpoint.GetTaskResponse)
+	return &grpc_types.GetTaskResponse{Task: encodeTask(resp.Task)}, nil
+}
+
+// ------------------------------------------------------------------------ //
+
+// ListTasks()
+
+// DecodeGRPCListTasksRequest agent mgmt service (grpc_types) -> go kit
+func DecodeGRPCListTasksRequest(ctx context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*grpc_types.ListTasksRequest)
+	if err := validate(ctx, validateOptionalID("cust_id", req.CustId), validateOptionalID("agent_id", req.AgentId), validateLimit(req.Limit)); err != nil {
+		return nil, err
+	}
+	return endpoint.ListTasksRequest{CustId: req.CustId, AgentId: req.AgentId, Status: req.Status, Limit: req.Limit}, nil
+}
+
+// EncodeGRPCListTasksResponse go-kit -> agent mgmt service (grpc_types)
+func EncodeGRPCListTasksResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(endpoint.ListTasksResponse)
+	tasks := make([]*grpc_types.Task, 0, len(resp.Tasks))
+	for _, task := range resp.Tasks {
+		tasks = append(tasks, encodeTask(task))
+	}
+	return &grpc_types.ListTasksResponse{Tasks: tasks}, nil
+}
+
+// ------------------------------------------------------------------------ //
+
+// CancelTask()
+
+// DecodeGRPCCancelTaskRequest agent mgmt service (grpc_types) -> go kit
+func DecodeGRPCCancelTaskRequest(ctx context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*grpc_types.CancelTaskRequest)
+	if err := validate(ctx, validateID("task_id", req.TaskId)); err != nil {
+		return nil, err
+	}
+	return endpoint.CancelTaskRequest{TaskId: req.TaskId, Abandoned: req.Abandoned}, nil
+}
+
+// EncodeGRPCCancelTaskResponse go-kit -> agent mgmt service (grpc_types)
+func EncodeGRPCCancelTaskResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(endpoint.CancelTaskResponse)
+	return &grpc_types.CancelTaskResponse{TaskId: resp.TaskId, Status: resp.Status}, nil
+}
+
+// encodeTask models.Task -> grpc_types.Task (timestamps and durations in milliseconds, 0 if not set)
+func encodeTask(task models.Task) *grpc_types.Task {
+	return &grpc_types.Task{
+		TaskId:           task.TaskID,
+		CustId:           task.CustID,
+		AgentIds:         task.AgentIDs,
+		Status:           string(task.Status),
+		AcceptedBy:       task.AcceptedBy,
+		ReleasedAgentIds: task.ReleasedAgentIDs,
+		RequiredSkills:   encodeSkillRequirements(task.RequiredSkills),
+		AddedAtMs:        unixMs(task.AddedAt),
+		OfferedAtMs:      unixMs(task.OfferedAt),
+		AcceptedAtMs:     unixMs(task.AcceptedAt),
+		StartedAtMs:      unixMs(task.StartedAt),
+		CompletedAtMs:    unixMs(task.CompletedAt),
+		AbandonedAtMs:    unixMs(task.AbandonedAt),
+		CancelledAtMs:    unixMs(task.CancelledAt),
+		WaitTimeMs:       int64(task.WaitTime() / time.Millisecond),
+		HandleTimeMs:     int64(task.HandleTime() / time.Millisecond),
+	}
+}
+
+// unixMs returns t in milliseconds since the epoch (0 for the zero time)
+func unixMs(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// ------------------------------------------------------------------------ //
+
+// RegisterAgent()
+
+// DecodeGRPCRegisterAgentRequest agent mgmt service (grpc_types) -> go kit
+func DecodeGRPCRegisterAgentRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	_ = grpcReq.(*grpc_types.RegisterAgentRequest)
+	return endpoint.RegisterAgentRequest{}, nil
+}
+
+// EncodeGRPCRegisterAgentResponse go-kit -> agent mgmt service (grpc_types)
+func EncodeGRPCRegisterAgentResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(endpoint.RegisterAgentResponse)
+	return &grpc_types.RegisterAgentResponse{AgentId: resp.AgentId}, nil
+}
+
+// ------------------------------------------------------------------------ //
+
+// DeregisterAgent()
+
+// DecodeGRPCDeregisterAgentRequest agent mgmt service (grpc_types) -> go kit
+func DecodeGRPCDeregisterAgentRequest(ctx context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*grpc_types.DeregisterAgentRequest)
+	if err := validate(ctx, validateID("agent_id", req.AgentId)); err != nil {
+		return nil, err
+	}
+	return endpoint.DeregisterAgentRequest{AgentId: req.AgentId}, nil
+}
+
+// EncodeGRPCDeregisterAgentResponse go-kit -> agent mgmt service (grpc_types)
+func EncodeGRPCDeregisterAgentResponse(_ context.Context, response interface{}) (interface{}, error) {
+	_ = response.(endpoint.DeregisterAgentResponse)
+	return &grpc_types.DeregisterAgentResponse{}, nil
+}
+
+// ------------------------------------------------------------------------ //
+
+// WatchAgents()
+
+var agentEventTypes = map[watch.EventType]grpc_types.AgentEvent_EventType{
+	watch.EventAvailable:    grpc_types.AgentEvent_AVAILABLE,
+	watch.EventUnavailable:  grpc_types.AgentEvent_UNAVAILABLE,
+	watch.EventStale:        grpc_types.AgentEvent_STALE,
+	watch.EventAssigned:     grpc_types.AgentEvent_ASSIGNED,
+	watch.EventDeregistered: grpc_types.AgentEvent_DEREGISTERED,
+	watch.EventDisconnected: grpc_types.AgentEvent_DISCONNECTED,
+}
+
+// EncodeGRPCAgentSnapshot go-kit -> agent mgmt service (grpc_types)
+func EncodeGRPCAgentSnapshot(agents []models.Agent) *grpc_types.AgentEvent {
+	agentIDs := make([]int32, 0, len(agents))
+	for _, agent := range agents {
+		agentIDs = append(agentIDs, agent.AgentID)
+	}
+	return &grpc_types.AgentEvent{
+		Type:     grpc_types.AgentEvent_SNAPSHOT,
+		AgentIds: agentIDs,
+		AtMs:     unixMs(time.Now()),
+	}
+}
+
+// EncodeGRPCAgentEvent go-kit -> agent mgmt service (grpc_types)
+func EncodeGRPCAgentEvent(event watch.Event) *grpc_types.AgentEvent {
+	return &grpc_types.AgentEvent{
+		Type:    agentEventTypes[event.Type],
+		AgentId: event.AgentID,
+		TaskId:  event.TaskID,
+		AtMs:    unixMs(event.At),
+	}
+}
+
+// ------------------------------------------------------------------------ //
+
+// HeartBeatStream()
+
+var heartBeatCommandTypes = map[heartbeat.CommandType]grpc_types.HeartBeatCommand_CommandType{
+	heartbeat.CommandChangeInterval: grpc_types.HeartBeatCommand_CHANGE_INTERVAL,
+	heartbeat.CommandOfferTask:      grpc_types.HeartBeatCommand_OFFER_TASK,
+}
+
+// EncodeGRPCHeartBeatCommand go-kit -> agent mgmt service (grpc_types)
+func EncodeGRPCHeartBeatCommand(cmd heartbeat.Command) *grpc_types.HeartBeatCommand {
+	return &grpc_types.HeartBeatCommand{
+		Type:            heartBeatCommandTypes[cmd.Type],
+		TaskId:          cmd.TaskID,
+		CustId:          cmd.CustID,
+		NextHeartBeatMs: int64(cmd.Interval / time.Millisecond),
+	}
+}
+
+// EncodeGRPCGoAway go-kit -> agent mgmt service (grpc_types)
+func EncodeGRPCGoAway(reason error) *grpc_types.HeartBeatCommand {
+	cmd := &grpc_types.HeartBeatCommand{Type: grpc_types.HeartBeatCommand_GO_AWAY}
+	if reason != nil {
+		cmd.Reason = reason.Error()
+	}
+	return cmd
+}
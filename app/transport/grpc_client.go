@@ -0,0 +1,809 @@
+package transport
+
+// This file provides client-side bindings for the gRPC transport.
+// It utilizes the transport/grpc.Client.
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	kitendpoint "github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	grpctransport "github.com/go-kit/kit/transport/grpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/newtonsystems/agent-mgmt/app/endpoint"
+	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+	"github.com/newtonsystems/agent-mgmt/app/heartbeat"
+	"github.com/newtonsystems/agent-mgmt/app/models"
+	"github.com/newtonsystems/agent-mgmt/app/service"
+	"github.com/newtonsystems/agent-mgmt/app/tenant"
+	"github.com/newtonsystems/agent-mgmt/app/watch"
+	"github.com/newtonsystems/grpc_types/go/grpc_types"
+)
+
+// ServiceName is the gRPC service of the agent mgmt service
+const ServiceName = "grpc_types.AgentMgmt"
+
+// ClientErrorInterceptor turns the errors of unary calls back into
+// *amerrors.AgentMgmtError (see service.UnWrapError). Dial the connection
+// given to NewGRPCClient with grpc.WithUnaryInterceptor(ClientErrorInterceptor).
+func ClientErrorInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	var trailer metadata.MD
+	err := invoker(ctx, method, req, reply, cc, append(opts, grpc.Trailer(&trailer))...)
+	return service.UnWrapError(err, trailer)
+}
+
+// requestMetadata passes the tenant (see tenant.FromContext) and the request
+// and trace IDs of ctx (see service.ContextLogger) on to the service
+func requestMetadata(ctx context.Context, md *metadata.MD) context.Context {
+	if id := tenant.FromContext(ctx); id != "" {
+		(*md)[tenant.MetadataKey] = []string{id}
+	}
+	if id := service.RequestIDFromContext(ctx); id != "" {
+		(*md)[service.RequestIDMetadataKey] = []string{id}
+	}
+	if id := service.TraceIDFromContext(ctx); id != "" {
+		(*md)[service.TraceIDMetadataKey] = []string{id}
+	}
+	return ctx
+}
+
+// outgoingContext returns ctx with the metadata of requestMetadata (for the
+// streams, which are not go-kit clients)
+func outgoingContext(ctx context.Context) context.Context {
+	md := metadata.MD{}
+	requestMetadata(ctx, &md)
+	if len(md) == 0 {
+		return ctx
+	}
+	if out, ok := metadata.FromOutgoingContext(ctx); ok {
+		md = metadata.Join(out, md)
+	}
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// NewGRPCClient returns an endpoint.Set of the agent mgmt service at the other
+// end of conn. The commands pushed down the heartbeat streams are sent to the
+// agents' connections in agents (a new Registry if nil).
+func NewGRPCClient(conn *grpc.ClientConn, agents *heartbeat.Registry, logger log.Logger) endpoint.Set {
+	if agents == nil {
+		agents = heartbeat.NewRegistry(heartbeat.DefaultBuffer)
+	}
+
+	options := []grpctransport.ClientOption{
+		grpctransport.ClientBefore(requestMetadata),
+	}
+
+	var getAvailableAgentsEndpoint kitendpoint.Endpoint
+	{
+		getAvailableAgentsEndpoint = grpctransport.NewClient(
+			conn, ServiceName, "GetAvailableAgents",
+			EncodeGRPCGetAvailableAgentsRequest,
+			DecodeGRPCGetAvailableAgentsResponse,
+			grpc_types.GetAvailableAgentsResponse{},
+			options...,
+		).Endpoint()
+	}
+	var getAgentIDFromRefEndpoint kitendpoint.Endpoint
+	{
+		getAgentIDFromRefEndpoint = grpctransport.NewClient(
+			conn, ServiceName, "GetAgentIDFromRef",
+			EncodeGRPCGetAgentIDFromRefRequest,
+			DecodeGRPCGetAgentIDFromRefResponse,
+			grpc_types.GetAgentIDFromRefResponse{},
+			options...,
+		).Endpoint()
+	}
+	var heartBeatEndpoint kitendpoint.Endpoint
+	{
+		heartBeatEndpoint = grpctransport.NewClient(
+			conn, ServiceName, "HeartBeat",
+			EncodeGRPCHeartBeatRequest,
+			DecodeGRPCHeartBeatResponse,
+			grpc_types.HeartBeatResponse{},
+			options...,
+		).Endpoint()
+	}
+	var addTaskEndpoint kitendpoint.Endpoint
+	{
+		addTaskEndpoint = grpctransport.NewClient(
+			conn, ServiceName, "AddTask",
+			EncodeGRPCAddTaskRequest,
+			DecodeGRPCAddTaskResponse,
+			grpc_types.AddTaskResponse{},
+			options...,
+		).Endpoint()
+	}
+	var offerTaskEndpoint kitendpoint.Endpoint
+	{
+		offerTaskEndpoint = grpctransport.NewClient(
+			conn, ServiceName, "OfferTask",
+			EncodeGRPCOfferTaskRequest,
+			DecodeGRPCOfferTaskResponse,
+			grpc_types.OfferTaskResponse{},
+			options...,
+		).Endpoint()
+	}
+	var acceptCallEndpoint kitendpoint.Endpoint
+	{
+		acceptCallEndpoint = grpctransport.NewClient(
+			conn, ServiceName, "AcceptCall",
+			EncodeGRPCAcceptCallRequest,
+			DecodeGRPCAcceptCallResponse,
+			grpc_types.AcceptCallResponse{},
+			options...,
+		).Endpoint()
+	}
+	var startTaskEndpoint kitendpoint.Endpoint
+	{
+		startTaskEndpoint = grpctransport.NewClient(
+			conn, ServiceName, "StartTask",
+			EncodeGRPCStartTaskRequest,
+			DecodeGRPCStartTaskResponse,
+			grpc_types.StartTaskResponse{},
+			options...,
+		).Endpoint()
+	}
+	var completeTaskEndpoint kitendpoint.Endpoint
+	{
+		completeTaskEndpoint = grpctransport.NewClient(
+			conn, ServiceName, "CompleteTask",
+			EncodeGRPCCompleteTaskRequest,
+			DecodeGRPCCompleteTaskResponse,
+			grpc_types.CompleteTaskResponse{},
+			options...,
+		).Endpoint()
+	}
+	var setAgentStateEndpoint kitendpoint.Endpoint
+	{
+		setAgentStateEndpoint = grpctransport.NewClient(
+			conn, ServiceName, "SetAgentState",
+			EncodeGRPCSetAgentStateRequest,
+			DecodeGRPCSetAgentStateResponse,
+			grpc_types.SetAgentStateResponse{},
+			options...,
+		).Endpoint()
+	}
+	var setAgentSkillsEndpoint kitendpoint.Endpoint
+	{
+		setAgentSkillsEndpoint = grpctransport.NewClient(
+			conn, ServiceName, "SetAgentSkills",
+			EncodeGRPCSetAgentSkillsRequest,
+			DecodeGRPCSetAgentSkillsResponse,
+			grpc_types.SetAgentSkillsResponse{},
+			options...,
+		).Endpoint()
+	}
+	var getTaskEndpoint kitendpoint.Endpoint
+	{
+		getTaskEndpoint = grpctransport.NewClient(
+			conn, ServiceName, "GetTask",
+			EncodeGRPCGetTaskRequest,
+			DecodeGRPCGetTaskResponse,
+			grpc_types.GetTaskResponse{},
+			options...,
+		).Endpoint()
+	}
+	var listTasksEndpoint kitendpoint.Endpoint
+	{
+		listTasksEndpoint = grpctransport.NewClient(
+			conn, ServiceName, "ListTasks",
+			EncodeGRPCListTasksRequest,
+			DecodeGRPCListTasksResponse,
+			grpc_types.ListTasksResponse{},
+			options...,
+		).Endpoint()
+	}
+	var cancelTaskEndpoint kitendpoint.Endpoint
+	{
+		cancelTaskEndpoint = grpctransport.NewClient(
+			conn, ServiceName, "CancelTask",
+			EncodeGRPCCancelTaskRequest,
+			DecodeGRPCCancelTaskResponse,
+			grpc_types.CancelTaskResponse{},
+			options...,
+		).Endpoint()
+	}
+	var registerAgentEndpoint kitendpoint.Endpoint
+	{
+		registerAgentEndpoint = grpctransport.NewClient(
+			conn, ServiceName, "RegisterAgent",
+			EncodeGRPCRegisterAgentRequest,
+			DecodeGRPCRegisterAgentResponse,
+			grpc_types.RegisterAgentResponse{},
+			options...,
+		).Endpoint()
+	}
+	var deregisterAgentEndpoint kitendpoint.Endpoint
+	{
+		deregisterAgentEndpoint = grpctransport.NewClient(
+			conn, ServiceName, "DeregisterAgent",
+			EncodeGRPCDeregisterAgentRequest,
+			DecodeGRPCDeregisterAgentResponse,
+			grpc_types.DeregisterAgentResponse{},
+			options...,
+		).Endpoint()
+	}
+
+	streams := &clientStreams{
+		client:  grpc_types.NewAgentMgmtClient(conn),
+		agents:  agents,
+		streams: make(map[streamKey]*agentStream),
+		logger:  logger,
+	}
+
+	return endpoint.Set{
+		GetAvailableAgentsEndpoint: getAvailableAgentsEndpoint,
+		GetAgentIDFromRefEndpoint:  getAgentIDFromRefEndpoint,
+		HeartBeatEndpoint:          heartBeatEndpoint,
+		AddTaskEndpoint:            addTaskEndpoint,
+		OfferTaskEndpoint:          offerTaskEndpoint,
+		AcceptCallEndpoint:         acceptCallEndpoint,
+		StartTaskEndpoint:          startTaskEndpoint,
+		CompleteTaskEndpoint:       completeTaskEndpoint,
+		SetAgentStateEndpoint:      setAgentStateEndpoint,
+		SetAgentSkillsEndpoint:     setAgentSkillsEndpoint,
+		GetTaskEndpoint:            getTaskEndpoint,
+		ListTasksEndpoint:          listTasksEndpoint,
+		CancelTaskEndpoint:         cancelTaskEndpoint,
+		RegisterAgentEndpoint:      registerAgentEndpoint,
+		DeregisterAgentEndpoint:    deregisterAgentEndpoint,
+		WatchAgents:                streams.watchAgents,
+		HeartBeatStream: endpoint.HeartBeatStreamFuncs{
+			Connect:    streams.connect,
+			KeepAlive:  streams.keepAlive,
+			Disconnect: streams.disconnect,
+		},
+	}
+}
+
+// ------------------------------------------------------------------------ //
+
+// GetAvailableAgents()
+
+// EncodeGRPCGetAvailableAgentsRequest go-kit -> agent mgmt service (grpc_types)
+func EncodeGRPCGetAvailableAgentsRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(endpoint.GetAvailableAgentsRequest)
+	return &grpc_types.GetAvailableAgentsRequest{Limit: req.Limit, Strategy: req.Strategy, Skills: encodeSkillRequirements(req.Skills)}, nil
+}
+
+// DecodeGRPCGetAvailableAgentsResponse agent mgmt service (grpc_types) -> go kit
+func DecodeGRPCGetAvailableAgentsResponse(_ context.Context, grpcReply interface{}) (interface{}, error) {
+	reply := grpcReply.(*grpc_types.GetAvailableAgentsResponse)
+	return endpoint.GetAvailableAgentsResponse{AgentIds: reply.AgentIds}, nil
+}
+
+// ------------------------------------------------------------------------ //
+
+// GetAgentIDFromRef()
+
+// EncodeGRPCGetAgentIDFromRefRequest go-kit -> agent mgmt service (grpc_types)
+func EncodeGRPCGetAgentIDFromRefRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(endpoint.GetAgentIDFromRefRequest)
+	return &grpc_types.GetAgentIDFromRefRequest{RefId: req.RefId}, nil
+}
+
+// DecodeGRPCGetAgentIDFromRefResponse agent mgmt service (grpc_types) -> go kit
+func DecodeGRPCGetAgentIDFromRefResponse(_ context.Context, grpcReply interface{}) (interface{}, error) {
+	reply := grpcReply.(*grpc_types.GetAgentIDFromRefResponse)
+	return endpoint.GetAgentIDFromRefResponse{AgentId: reply.AgentId}, nil
+}
+
+// ------------------------------------------------------------------------ //
+
+// HeartBeat()
+
+// EncodeGRPCHeartBeatRequest go-kit -> agent mgmt service (grpc_types)
+func EncodeGRPCHeartBeatRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(endpoint.HeartBeatRequest)
+	return &grpc_types.HeartBeatRequest{AgentId: req.AgentId}, nil
+}
+
+// DecodeGRPCHeartBeatResponse agent mgmt service (grpc_types) -> go kit
+func DecodeGRPCHeartBeatResponse(_ context.Context, grpcReply interface{}) (interface{}, error) {
+	reply := grpcReply.(*grpc_types.HeartBeatResponse)
+	return endpoint.HeartBeatResponse{
+		Status:        reply.Status,
+		NextHeartBeat: time.Duration(reply.NextHeartbeatMs) * time.Millisecond,
+	}, nil
+}
+
+// ------------------------------------------------------------------------ //
+
+// AddTask()
+
+// EncodeGRPCAddTaskRequest go-kit -> agent mgmt service (grpc_types)
+func EncodeGRPCAddTaskRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(endpoint.AddTaskRequest)
+	return &grpc_types.AddTaskRequest{CustId: req.CustId, CallIds: req.AgentIds, RequiredSkills: encodeSkillRequirements(req.RequiredSkills)}, nil
+}
+
+// DecodeGRPCAddTaskResponse agent mgmt service (grpc_types) -> go kit
+func DecodeGRPCAddTaskResponse(_ context.Context, grpcReply interface{}) (interface{}, error) {
+	reply := grpcReply.(*grpc_types.AddTaskResponse)
+	return endpoint.AddTaskResponse{TaskId: reply.TaskId}, nil
+}
+
+// ------------------------------------------------------------------------ //
+
+// OfferTask()
+
+// EncodeGRPCOfferTaskRequest go-kit -> agent mgmt service (grpc_types)
+func EncodeGRPCOfferTaskRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(endpoint.OfferTaskRequest)
+	return &grpc_types.OfferTaskRequest{TaskId: req.TaskId, CallIds: req.AgentIds}, nil
+}
+
+// DecodeGRPCOfferTaskResponse agent mgmt service (grpc_types) -> go kit
+func DecodeGRPCOfferTaskResponse(_ context.Context, grpcReply interface{}) (interface{}, error) {
+	reply := grpcReply.(*grpc_types.OfferTaskResponse)
+	return endpoint.OfferTaskResponse{TaskId: reply.TaskId, Status: reply.Status}, nil
+}
+
+// ------------------------------------------------------------------------ //
+
+// AcceptCall()
+
+// EncodeGRPCAcceptCallRequest go-kit -> agent mgmt service (grpc_types)
+func EncodeGRPCAcceptCallRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(endpoint.AcceptCallRequest)
+	return &grpc_types.AcceptCallRequest{AgentId: req.AgentId, TaskId: req.TaskId}, nil
+}
+
+// DecodeGRPCAcceptCallResponse agent mgmt service (grpc_types) -> go kit
+func DecodeGRPCAcceptCallResponse(_ context.Context, grpcReply interface{}) (interface{}, error) {
+	reply := grpcReply.(*grpc_types.AcceptCallResponse)
+	return endpoint.AcceptCallResponse{TaskId: reply.TaskId, CustId: reply.CustId}, nil
+}
+
+// ------------------------------------------------------------------------ //
+
+// StartTask()
+
+// EncodeGRPCStartTaskRequest go-kit -> agent mgmt service (grpc_types)
+func EncodeGRPCStartTaskRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(endpoint.StartTaskRequest)
+	return &grpc_types.StartTaskRequest{AgentId: req.AgentId, TaskId: req.TaskId}, nil
+}
+
+// DecodeGRPCStartTaskResponse agent mgmt service (grpc_types) -> go kit
+func DecodeGRPCStartTaskResponse(_ context.Context, grpcReply interface{}) (interface{}, error) {
+	reply := grpcReply.(*grpc_types.StartTaskResponse)
+	return endpoint.StartTaskResponse{TaskId: reply.TaskId, Status: reply.Status}, nil
+}
+
+// ------------------------------------------------------------------------ //
+
+// CompleteTask()
+
+// EncodeGRPCCompleteTaskRequest go-kit -> agent mgmt service (grpc_types)
+func EncodeGRPCCompleteTaskRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(endpoint.CompleteTaskRequest)
+	return &grpc_types.CompleteTaskRequest{AgentId: req.AgentId, TaskId: req.TaskId}, nil
+}
+
+// DecodeGRPCCompleteTaskResponse agent mgmt service (grpc_types) -> go kit
+func DecodeGRPCCompleteTaskResponse(_ context.Context, grpcReply interface{}) (interface{}, error) {
+	reply := grpcReply.(*grpc_types.CompleteTaskResponse)
+	return endpoint.CompleteTaskResponse{TaskId: reply.TaskId}, nil
+}
+
+// ------------------------------------------------------------------------ //
+
+// SetAgentState()
+
+// EncodeGRPCSetAgentStateRequest go-kit -> agent mgmt service (grpc_types)
+func EncodeGRPCSetAgentStateRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(endpoint.SetAgentStateRequest)
+	return &grpc_types.SetAgentStateRequest{AgentId: req.AgentId, State: req.State}, nil
+}
+
+// DecodeGRPCSetAgentStateResponse agent mgmt service (grpc_types) -> go kit
+func DecodeGRPCSetAgentStateResponse(_ context.Context, grpcReply interface{}) (interface{}, error) {
+	_ = grpcReply.(*grpc_types.SetAgentStateResponse)
+	return endpoint.SetAgentStateResponse{}, nil
+}
+
+// ------------------------------------------------------------------------ //
+
+// SetAgentSkills()
+
+// EncodeGRPCSetAgentSkillsRequest go-kit -> agent mgmt service (grpc_types)
+func EncodeGRPCSetAgentSkillsRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(endpoint.SetAgentSkillsRequest)
+	skills := make([]*grpc_types.Skill, 0, len(req.Skills))
+	for _, skill := range req.Skills {
+		skills = append(skills, &grpc_types.Skill{Name: skill.Name, Level: skill.Level})
+	}
+	return &grpc_types.SetAgentSkillsRequest{AgentId: req.AgentId, Skills: skills}, nil
+}
+
+// DecodeGRPCSetAgentSkillsResponse agent mgmt service (grpc_types) -> go kit
+func DecodeGRPCSetAgentSkillsResponse(_ context.Context, grpcReply interface{}) (interface{}, error) {
+	reply := grpcReply.(*grpc_types.SetAgentSkillsResponse)
+	skills := make([]models.Skill, 0, len(reply.Skills))
+	for _, skill := range reply.Skills {
+		skills = append(skills, models.Skill{Name: skill.Name, Level: skill.Level})
+	}
+	return endpoint.SetAgentSkillsResponse{AgentId: reply.AgentId, Skills: skills}, nil
+}
+
+// ------------------------------------------------------------------------ //
+
+// GetTask()
+
+// EncodeGRPCGetTaskRequest go-kit -> agent mgmt service (grpc_types)
+func EncodeGRPCGetTaskRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(endpoint.GetTaskRequest)
+	return &grpc_types.GetTaskRequest{TaskId: req.TaskId}, nil
+}
+
+// DecodeGRPCGetTaskResponse agent mgmt service (grpc_types) -> go kit
+func DecodeGRPCGetTaskResponse(_ context.Context, grpcReply interface{}) (interface{}, error) {
+	reply := grpcReply.(*grpc_types.GetTaskResponse)
+	return endpoint.GetTaskResponse{Task: decodeTask(reply.Task)}, nil
+}
+
+// ------------------------------------------------------------------------ //
+
+// ListTasks()
+
+// EncodeGRPCListTasksRequest go-kit -> agent mgmt service (grpc_types)
+func EncodeGRPCListTasksRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(endpoint.ListTasksRequest)
+	return &grpc_types.ListTasksRequest{CustId: req.CustId, AgentId: req.AgentId, Status: req.Status, Limit: req.Limit}, nil
+}
+
+// DecodeGRPCListTasksResponse agent mgmt service (grpc_types) -> go kit
+func DecodeGRPCListTasksResponse(_ context.Context, grpcReply interface{}) (interface{}, error) {
+	reply := grpcReply.(*grpc_types.ListTasksResponse)
+	tasks := make([]models.Task, 0, len(reply.Tasks))
+	for _, task := range reply.Tasks {
+		tasks = append(tasks, decodeTask(task))
+	}
+	return endpoint.ListTasksResponse{Tasks: tasks}, nil
+}
+
+// ------------------------------------------------------------------------ //
+
+// CancelTask()
+
+// EncodeGRPCCancelTaskRequest go-kit -> agent mgmt service (grpc_types)
+func EncodeGRPCCancelTaskRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(endpoint.CancelTaskRequest)
+	return &grpc_types.CancelTaskRequest{TaskId: req.TaskId, Abandoned: req.Abandoned}, nil
+}
+
+// DecodeGRPCCancelTaskResponse agent mgmt service (grpc_types) -> go kit
+func DecodeGRPCCancelTaskResponse(_ context.Context, grpcReply interface{}) (interface{}, error) {
+	reply := grpcReply.(*grpc_types.CancelTaskResponse)
+	return endpoint.CancelTaskResponse{TaskId: reply.TaskId, Status: reply.Status}, nil
+}
+
+// decodeTask grpc_types.Task -> models.Task (the inverse of encodeTask)
+func decodeTask(task *grpc_types.Task) models.Task {
+	if task == nil {
+		return models.Task{}
+	}
+	return models.Task{
+		TaskID:           task.TaskId,
+		CustID:           task.CustId,
+		AgentIDs:         task.AgentIds,
+		Status:           models.TaskStatus(task.Status),
+		AcceptedBy:       task.AcceptedBy,
+		ReleasedAgentIDs: task.ReleasedAgentIds,
+		RequiredSkills:   decodeSkillRequirements(task.RequiredSkills),
+		AddedAt:          fromUnixMs(task.AddedAtMs),
+		OfferedAt:        fromUnixMs(task.OfferedAtMs),
+		AcceptedAt:       fromUnixMs(task.AcceptedAtMs),
+		StartedAt:        fromUnixMs(task.StartedAtMs),
+		CompletedAt:      fromUnixMs(task.CompletedAtMs),
+		AbandonedAt:      fromUnixMs(task.AbandonedAtMs),
+		CancelledAt:      fromUnixMs(task.CancelledAtMs),
+	}
+}
+
+// fromUnixMs returns the time ms milliseconds since the epoch (the zero time for 0)
+func fromUnixMs(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC()
+}
+
+// ------------------------------------------------------------------------ //
+
+// RegisterAgent()
+
+// EncodeGRPCRegisterAgentRequest go-kit -> agent mgmt service (grpc_types)
+func EncodeGRPCRegisterAgentRequest(_ context.Context, request interface{}) (interface{}, error) {
+	_ = request.(endpoint.RegisterAgentRequest)
+	return &grpc_types.RegisterAgentRequest{}, nil
+}
+
+// DecodeGRPCRegisterAgentResponse agent mgmt service (grpc_types) -> go kit
+func DecodeGRPCRegisterAgentResponse(_ context.Context, grpcReply interface{}) (interface{}, error) {
+	reply := grpcReply.(*grpc_types.RegisterAgentResponse)
+	return endpoint.RegisterAgentResponse{AgentId: reply.AgentId}, nil
+}
+
+// ------------------------------------------------------------------------ //
+
+// DeregisterAgent()
+
+// EncodeGRPCDeregisterAgentRequest go-kit -> agent mgmt service (grpc_types)
+func EncodeGRPCDeregisterAgentRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(endpoint.DeregisterAgentRequest)
+	return &grpc_types.DeregisterAgentRequest{AgentId: req.AgentId}, nil
+}
+
+// DecodeGRPCDeregisterAgentResponse agent mgmt service (grpc_types) -> go kit
+func DecodeGRPCDeregisterAgentResponse(_ context.Context, grpcReply interface{}) (interface{}, error) {
+	_ = grpcReply.(*grpc_types.DeregisterAgentResponse)
+	return endpoint.DeregisterAgentResponse{}, nil
+}
+
+// ------------------------------------------------------------------------ //
+
+// WatchAgents()
+
+// DecodeGRPCAgentEvent agent mgmt service (grpc_types) -> go kit
+func DecodeGRPCAgentEvent(event *grpc_types.AgentEvent) watch.Event {
+	var eventType watch.EventType
+	for t, grpcType := range agentEventTypes {
+		if grpcType == event.Type {
+			eventType = t
+		}
+	}
+	return watch.Event{
+		Type:    eventType,
+		AgentID: event.AgentId,
+		TaskID:  event.TaskId,
+		At:      fromUnixMs(event.AtMs),
+	}
+}
+
+// ------------------------------------------------------------------------ //
+
+// HeartBeatStream()
+
+// DecodeGRPCHeartBeatCommand agent mgmt service (grpc_types) -> go kit
+// (GO_AWAY is not a command, see DecodeGRPCGoAway)
+func DecodeGRPCHeartBeatCommand(cmd *grpc_types.HeartBeatCommand) heartbeat.Command {
+	var cmdType heartbeat.CommandType
+	for t, grpcType := range heartBeatCommandTypes {
+		if grpcType == cmd.Type {
+			cmdType = t
+		}
+	}
+	return heartbeat.Command{
+		Type:     cmdType,
+		TaskID:   cmd.TaskId,
+		CustID:   cmd.CustId,
+		Interval: time.Duration(cmd.NextHeartBeatMs) * time.Millisecond,
+	}
+}
+
+// DecodeGRPCGoAway agent mgmt service (grpc_types) -> go kit
+func DecodeGRPCGoAway(cmd *grpc_types.HeartBeatCommand) error {
+	return amerrors.ErrStreamClosedError("server ended the heartbeat stream: %s", cmd.Reason)
+}
+
+// clientStreams are the client side of the streaming RPCs
+type clientStreams struct {
+	client grpc_types.AgentMgmtClient
+	agents *heartbeat.Registry
+	logger log.Logger
+
+	mu      sync.Mutex
+	streams map[streamKey]*agentStream
+}
+
+// streamKey is a tenant's agent with a heartbeat stream
+type streamKey struct {
+	tenant  string
+	agentID int32
+}
+
+// agentStream is the open heartbeat stream of a connected agent
+type agentStream struct {
+	conn   *heartbeat.Conn
+	cancel context.CancelFunc
+
+	mu     sync.Mutex // Send is not safe to call concurrently
+	stream grpc_types.AgentMgmt_HeartBeatStreamClient
+}
+
+func (s *agentStream) key() streamKey {
+	return streamKey{s.conn.Tenant, s.conn.AgentID}
+}
+
+// watchAgents opens a WatchAgents stream. The events are published to a
+// watcher of its own that is closed (ErrWatchClosed) when the stream ends.
+// The stream ends with ctx or once the watcher is closed.
+func (c *clientStreams) watchAgents(ctx context.Context) ([]models.Agent, *watch.Watcher, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	stream, err := c.client.WatchAgents(outgoingContext(ctx), &grpc_types.WatchAgentsRequest{})
+	if err != nil {
+		cancel()
+		return nil, nil, service.UnWrapError(err, nil)
+	}
+
+	snapshot, err := stream.Recv()
+	if err != nil {
+		cancel()
+		return nil, nil, service.UnWrapError(err, stream.Trailer())
+	}
+
+	hub := watch.NewHub(watch.DefaultBuffer)
+	watcher, err := hub.Watch("")
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	go func() {
+		defer cancel()
+		defer hub.Close()
+
+		for {
+			event, err := stream.Recv()
+			if err != nil {
+				if err != io.EOF && ctx.Err() == nil {
+					c.logger.Log("level", "warn", "msg", "WatchAgents stream ended", "err", service.UnWrapError(err, stream.Trailer()))
+				}
+				return
+			}
+			hub.Publish(DecodeGRPCAgentEvent(event))
+			if hub.Watchers() == 0 {
+				return
+			}
+		}
+	}()
+
+	agents := make([]models.Agent, 0, len(snapshot.AgentIds))
+	for _, agentID := range snapshot.AgentIds {
+		agents = append(agents, models.Agent{AgentID: agentID})
+	}
+	return agents, watcher, nil
+}
+
+// connect opens a heartbeat stream for agent id and returns the agent's
+// connection and heartbeat interval. The stream stays open until disconnect
+// (ctx only bounds opening it, the stream keeps its values). An open stream
+// of the agent is closed.
+func (c *clientStreams) connect(ctx context.Context, agentID int32) (*heartbeat.Conn, time.Duration, error) {
+	streamCtx, cancel := context.WithCancel(service.DetachContext(ctx))
+
+	// Give up opening the stream with ctx
+	opened := make(chan struct{})
+	defer close(opened)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-opened:
+		}
+	}()
+
+	stream, err := c.client.HeartBeatStream(outgoingContext(streamCtx))
+	if err != nil {
+		cancel()
+		return nil, 0, service.UnWrapError(err, nil)
+	}
+
+	if err := stream.Send(&grpc_types.HeartBeatStreamRequest{AgentId: agentID}); err != nil {
+		cancel()
+		return nil, 0, service.UnWrapError(err, stream.Trailer())
+	}
+
+	cmd, err := stream.Recv()
+	if err != nil {
+		cancel()
+		return nil, 0, service.UnWrapError(err, stream.Trailer())
+	}
+	if cmd.Type == grpc_types.HeartBeatCommand_GO_AWAY {
+		cancel()
+		return nil, 0, DecodeGRPCGoAway(cmd)
+	}
+	next := DecodeGRPCHeartBeatCommand(cmd).Interval
+
+	conn, err := c.agents.Connect(tenant.FromContext(ctx), agentID)
+	if err != nil {
+		cancel()
+		return nil, 0, err
+	}
+	s := &agentStream{conn: conn, cancel: cancel, stream: stream}
+
+	c.mu.Lock()
+	if old, ok := c.streams[s.key()]; ok {
+		old.cancel()
+	}
+	c.streams[s.key()] = s
+	c.mu.Unlock()
+
+	go c.recv(s)
+
+	return conn, next, nil
+}
+
+// recv pushes the commands of s to its connection until the stream ends
+func (c *clientStreams) recv(s *agentStream) {
+	defer s.cancel()
+
+	for {
+		cmd, err := s.stream.Recv()
+		if err != nil {
+			if err == io.EOF {
+				c.end(s, amerrors.ErrStreamClosedError("server closed the heartbeat stream"))
+				return
+			}
+			c.end(s, service.UnWrapError(err, s.stream.Trailer()))
+			return
+		}
+
+		if cmd.Type == grpc_types.HeartBeatCommand_GO_AWAY {
+			c.end(s, DecodeGRPCGoAway(cmd))
+			return
+		}
+		c.agents.Send(s.conn.Tenant, s.conn.AgentID, DecodeGRPCHeartBeatCommand(cmd))
+	}
+}
+
+// end forgets s and ends its connection with err
+func (c *clientStreams) end(s *agentStream, err error) {
+	c.mu.Lock()
+	if c.streams[s.key()] == s {
+		delete(c.streams, s.key())
+	}
+	c.mu.Unlock()
+
+	c.agents.End(s.conn, err)
+}
+
+// keepAlive sends a heartbeat down agent id's stream (the server measures the
+// time since the last one itself)
+func (c *clientStreams) keepAlive(ctx context.Context, agentID int32, sinceLastBeat time.Duration) error {
+	c.mu.Lock()
+	s, ok := c.streams[streamKey{tenant.FromContext(ctx), agentID}]
+	c.mu.Unlock()
+
+	if !ok {
+		return amerrors.ErrStreamClosedError("Agent(AgentID=%d) has no heartbeat stream", agentID)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.stream.Send(&grpc_types.HeartBeatStreamRequest{AgentId: agentID}); err != nil {
+		return service.UnWrapError(err, nil)
+	}
+	return nil
+}
+
+// disconnect closes conn and its stream
+func (c *clientStreams) disconnect(ctx context.Context, conn *heartbeat.Conn) error {
+	conn.Close()
+
+	c.mu.Lock()
+	s, ok := c.streams[streamKey{conn.Tenant, conn.AgentID}]
+	if ok && s.conn == conn {
+		delete(c.streams, s.key())
+	}
+	c.mu.Unlock()
+
+	if !ok || s.conn != conn {
+		return nil
+	}
+
+	s.mu.Lock()
+	s.stream.CloseSend()
+	s.mu.Unlock()
+	s.cancel()
+	return nil
+}
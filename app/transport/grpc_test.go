@@ -0,0 +1,145 @@
+package transport_test
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/newtonsystems/agent-mgmt/app/endpoint"
+	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+	"github.com/newtonsystems/agent-mgmt/app/models"
+	"github.com/newtonsystems/agent-mgmt/app/service"
+	tu "github.com/newtonsystems/agent-mgmt/app/testutil"
+	"github.com/newtonsystems/agent-mgmt/app/transport"
+	"github.com/newtonsystems/grpc_types/go/grpc_types"
+)
+
+// trailerStream keeps the trailer set by a decoder so the error type can be
+// unwrapped as it would be by a client
+type trailerStream struct {
+	trailer metadata.MD
+}
+
+func (s *trailerStream) Method() string                  { return "/grpc_types.AgentMgmt/Test" }
+func (s *trailerStream) SetHeader(md metadata.MD) error  { return nil }
+func (s *trailerStream) SendHeader(md metadata.MD) error { return nil }
+func (s *trailerStream) SetTrailer(md metadata.MD) error {
+	s.trailer = metadata.Join(s.trailer, md)
+	return nil
+}
+
+type decoder func(context.Context, interface{}) (interface{}, error)
+
+func agentIDs(n int) []int32 {
+	ids := make([]int32, n)
+	for i := range ids {
+		ids[i] = int32(i + 1)
+	}
+	return ids
+}
+
+var decoderTests = []struct {
+	name    string
+	decode  decoder
+	req     interface{}
+	want    interface{}
+	wantErr amerrors.ErrorType // 0 if the request is valid
+}{
+	// GetAvailableAgents()
+	{"getavailableagents", transport.DecodeGRPCGetAvailableAgentsRequest, &grpc_types.GetAvailableAgentsRequest{Limit: 3, Strategy: "round_robin"}, endpoint.GetAvailableAgentsRequest{Limit: 3, Strategy: "round_robin"}, 0},
+	{"getavailableagents_skills", transport.DecodeGRPCGetAvailableAgentsRequest, &grpc_types.GetAvailableAgentsRequest{Skills: []*grpc_types.SkillRequirement{{Name: "language:fr", MinLevel: 2, Required: true}}}, endpoint.GetAvailableAgentsRequest{Skills: []models.SkillRequirement{{Name: "language:fr", MinLevel: 2, Required: true}}}, 0},
+	{"getavailableagents_nolimit", transport.DecodeGRPCGetAvailableAgentsRequest, &grpc_types.GetAvailableAgentsRequest{}, endpoint.GetAvailableAgentsRequest{}, 0},
+	{"getavailableagents_negativelimit", transport.DecodeGRPCGetAvailableAgentsRequest, &grpc_types.GetAvailableAgentsRequest{Limit: -1}, nil, amerrors.ErrInvalidArgument},
+
+	// GetAgentIDFromRef()
+	{"getagentidfromref", transport.DecodeGRPCGetAgentIDFromRefRequest, &grpc_types.GetAgentIDFromRefRequest{RefId: "ref001a"}, endpoint.GetAgentIDFromRefRequest{RefId: "ref001a"}, 0},
+	{"getagentidfromref_empty", transport.DecodeGRPCGetAgentIDFromRefRequest, &grpc_types.GetAgentIDFromRefRequest{}, nil, amerrors.ErrInvalidArgument},
+	{"getagentidfromref_blank", transport.DecodeGRPCGetAgentIDFromRefRequest, &grpc_types.GetAgentIDFromRefRequest{RefId: "  "}, nil, amerrors.ErrInvalidArgument},
+
+	// HeartBeat()
+	{"heartbeat", transport.DecodeGRPCHeartBeatRequest, &grpc_types.HeartBeatRequest{AgentId: 3}, endpoint.HeartBeatRequest{AgentId: 3}, 0},
+	{"heartbeat_noagentid", transport.DecodeGRPCHeartBeatRequest, &grpc_types.HeartBeatRequest{}, nil, amerrors.ErrInvalidArgument},
+	{"heartbeat_negativeagentid", transport.DecodeGRPCHeartBeatRequest, &grpc_types.HeartBeatRequest{AgentId: -3}, nil, amerrors.ErrInvalidArgument},
+
+	// AddTask()
+	{"addtask", transport.DecodeGRPCAddTaskRequest, &grpc_types.AddTaskRequest{CustId: 1, CallIds: []int32{1, 2}}, endpoint.AddTaskRequest{CustId: 1, AgentIds: []int32{1, 2}}, 0},
+	{"addtask_maxagents", transport.DecodeGRPCAddTaskRequest, &grpc_types.AddTaskRequest{CustId: 1, CallIds: agentIDs(transport.MaxAgentIDs)}, endpoint.AddTaskRequest{CustId: 1, AgentIds: agentIDs(transport.MaxAgentIDs)}, 0},
+	{"addtask_custid0", transport.DecodeGRPCAddTaskRequest, &grpc_types.AddTaskRequest{CallIds: []int32{1}}, nil, amerrors.ErrCustIDInvalid},
+	{"addtask_negativecustid", transport.DecodeGRPCAddTaskRequest, &grpc_types.AddTaskRequest{CustId: -1}, nil, amerrors.ErrCustIDInvalid},
+	{"addtask_agentid0", transport.DecodeGRPCAddTaskRequest, &grpc_types.AddTaskRequest{CustId: 1, CallIds: []int32{1, 0}}, nil, amerrors.ErrInvalidArgument},
+	{"addtask_toomanyagents", transport.DecodeGRPCAddTaskRequest, &grpc_types.AddTaskRequest{CustId: 1, CallIds: agentIDs(transport.MaxAgentIDs + 1)}, nil, amerrors.ErrInvalidArgument},
+
+	// AcceptCall()
+	{"acceptcall", transport.DecodeGRPCAcceptCallRequest, &grpc_types.AcceptCallRequest{AgentId: 2, TaskId: 4}, endpoint.AcceptCallRequest{AgentId: 2, TaskId: 4}, 0},
+	{"acceptcall_noagentid", transport.DecodeGRPCAcceptCallRequest, &grpc_types.AcceptCallRequest{TaskId: 4}, nil, amerrors.ErrInvalidArgument},
+	{"acceptcall_notaskid", transport.DecodeGRPCAcceptCallRequest, &grpc_types.AcceptCallRequest{AgentId: 2}, nil, amerrors.ErrInvalidArgument},
+
+	// OfferTask()
+	{"offertask", transport.DecodeGRPCOfferTaskRequest, &grpc_types.OfferTaskRequest{TaskId: 4, CallIds: []int32{1, 3}}, endpoint.OfferTaskRequest{TaskId: 4, AgentIds: []int32{1, 3}}, 0},
+	{"offertask_notaskid", transport.DecodeGRPCOfferTaskRequest, &grpc_types.OfferTaskRequest{CallIds: []int32{1}}, nil, amerrors.ErrInvalidArgument},
+	{"offertask_agentid0", transport.DecodeGRPCOfferTaskRequest, &grpc_types.OfferTaskRequest{TaskId: 4, CallIds: []int32{1, 0}}, nil, amerrors.ErrInvalidArgument},
+
+	// StartTask()
+	{"starttask", transport.DecodeGRPCStartTaskRequest, &grpc_types.StartTaskRequest{AgentId: 2, TaskId: 4}, endpoint.StartTaskRequest{AgentId: 2, TaskId: 4}, 0},
+	{"starttask_noagentid", transport.DecodeGRPCStartTaskRequest, &grpc_types.StartTaskRequest{TaskId: 4}, nil, amerrors.ErrInvalidArgument},
+	{"starttask_notaskid", transport.DecodeGRPCStartTaskRequest, &grpc_types.StartTaskRequest{AgentId: 2}, nil, amerrors.ErrInvalidArgument},
+
+	// CompleteTask()
+	{"completetask", transport.DecodeGRPCCompleteTaskRequest, &grpc_types.CompleteTaskRequest{AgentId: 2, TaskId: 4}, endpoint.CompleteTaskRequest{AgentId: 2, TaskId: 4}, 0},
+	{"completetask_noagentid", transport.DecodeGRPCCompleteTaskRequest, &grpc_types.CompleteTaskRequest{TaskId: 4}, nil, amerrors.ErrInvalidArgument},
+	{"completetask_negativetaskid", transport.DecodeGRPCCompleteTaskRequest, &grpc_types.CompleteTaskRequest{AgentId: 2, TaskId: -4}, nil, amerrors.ErrInvalidArgument},
+
+	// SetAgentState()
+	{"setagentstate", transport.DecodeGRPCSetAgentStateRequest, &grpc_types.SetAgentStateRequest{AgentId: 1, State: "away"}, endpoint.SetAgentStateRequest{AgentId: 1, State: "away"}, 0},
+	{"setagentstate_noagentid", transport.DecodeGRPCSetAgentStateRequest, &grpc_types.SetAgentStateRequest{State: "away"}, nil, amerrors.ErrInvalidArgument},
+
+	// SetAgentSkills()
+	{"setagentskills", transport.DecodeGRPCSetAgentSkillsRequest, &grpc_types.SetAgentSkillsRequest{AgentId: 1, Skills: []*grpc_types.Skill{{Name: "language:fr", Level: 3}}}, endpoint.SetAgentSkillsRequest{AgentId: 1, Skills: []models.Skill{{Name: "language:fr", Level: 3}}}, 0},
+	{"setagentskills_noagentid", transport.DecodeGRPCSetAgentSkillsRequest, &grpc_types.SetAgentSkillsRequest{}, nil, amerrors.ErrInvalidArgument},
+
+	// GetTask()
+	{"gettask", transport.DecodeGRPCGetTaskRequest, &grpc_types.GetTaskRequest{TaskId: 3}, endpoint.GetTaskRequest{TaskId: 3}, 0},
+	{"gettask_notaskid", transport.DecodeGRPCGetTaskRequest, &grpc_types.GetTaskRequest{}, nil, amerrors.ErrInvalidArgument},
+
+	// ListTasks()
+	{"listtasks", transport.DecodeGRPCListTasksRequest, &grpc_types.ListTasksRequest{CustId: 2, AgentId: 1, Status: "offered", Limit: 5}, endpoint.ListTasksRequest{CustId: 2, AgentId: 1, Status: "offered", Limit: 5}, 0},
+	{"listtasks_nofilter", transport.DecodeGRPCListTasksRequest, &grpc_types.ListTasksRequest{}, endpoint.ListTasksRequest{}, 0},
+	{"listtasks_negativecustid", transport.DecodeGRPCListTasksRequest, &grpc_types.ListTasksRequest{CustId: -2}, nil, amerrors.ErrInvalidArgument},
+	{"listtasks_negativeagentid", transport.DecodeGRPCListTasksRequest, &grpc_types.ListTasksRequest{AgentId: -1}, nil, amerrors.ErrInvalidArgument},
+	{"listtasks_negativelimit", transport.DecodeGRPCListTasksRequest, &grpc_types.ListTasksRequest{Limit: -5}, nil, amerrors.ErrInvalidArgument},
+
+	// CancelTask()
+	{"canceltask", transport.DecodeGRPCCancelTaskRequest, &grpc_types.CancelTaskRequest{TaskId: 3, Abandoned: true}, endpoint.CancelTaskRequest{TaskId: 3, Abandoned: true}, 0},
+	{"canceltask_notaskid", transport.DecodeGRPCCancelTaskRequest, &grpc_types.CancelTaskRequest{Abandoned: true}, nil, amerrors.ErrInvalidArgument},
+
+	// RegisterAgent()
+	{"registeragent", transport.DecodeGRPCRegisterAgentRequest, &grpc_types.RegisterAgentRequest{}, endpoint.RegisterAgentRequest{}, 0},
+
+	// DeregisterAgent()
+	{"deregisteragent", transport.DecodeGRPCDeregisterAgentRequest, &grpc_types.DeregisterAgentRequest{AgentId: 3}, endpoint.DeregisterAgentRequest{AgentId: 3}, 0},
+	{"deregisteragent_noagentid", transport.DecodeGRPCDeregisterAgentRequest, &grpc_types.DeregisterAgentRequest{}, nil, amerrors.ErrInvalidArgument},
+}
+
+func TestDecoders(t *testing.T) {
+	for _, tt := range decoderTests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := &trailerStream{}
+			ctx := grpc.NewContextWithServerTransportStream(context.Background(), stream)
+
+			got, err := tt.decode(ctx, tt.req)
+
+			if tt.wantErr == 0 {
+				tu.Ok(t, err)
+				tu.Equals(t, tt.want, got)
+				return
+			}
+
+			tu.Assert(t, got == nil, "expected no request, got %#v", got)
+			tu.Equals(t, codes.InvalidArgument, grpc.Code(err))
+			tu.IsAmError(t, tt.wantErr, service.UnWrapError(err, stream.trailer))
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package transport
+
+// validate.go
+// Checks on the grpc_types requests made by the decoders so a malformed
+// request is rejected (codes.InvalidArgument) before it reaches the service
+// or the database.
+
+import (
+	"context"
+	"strings"
+
+	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+	"github.com/newtonsystems/agent-mgmt/app/service"
+)
+
+// MaxAgentIDs is the most agents a task can be offered to in one AddTask() request
+const MaxAgentIDs = 100
+
+// validate returns the first failed check wrapped for gRPC (nil if all passed)
+func validate(ctx context.Context, checks ...error) error {
+	for _, err := range checks {
+		if err != nil {
+			logger.Log("level", "debug", "msg", "Rejected request", "err", err)
+			return service.WrapError(ctx, err)
+		}
+	}
+	return nil
+}
+
+// validateID checks a required ID (agent, task, ...) is positive
+func validateID(name string, id int32) error {
+	if id <= 0 {
+		return amerrors.NewFieldError(amerrors.ErrInvalidArgument, name, "%s must be positive (got %d)", name, id)
+	}
+	return nil
+}
+
+// validateOptionalID checks an ID that may be left out (0) is not negative
+func validateOptionalID(name string, id int32) error {
+	if id < 0 {
+		return amerrors.NewFieldError(amerrors.ErrInvalidArgument, name, "%s must not be negative (got %d)", name, id)
+	}
+	return nil
+}
+
+// validateCustID checks the customer ID is positive
+func validateCustID(custID int32) error {
+	if custID <= 0 {
+		return amerrors.NewFieldError(amerrors.ErrCustIDInvalid, "cust_id", "cust_id must be positive (got %d)", custID)
+	}
+	return nil
+}
+
+// validateLimit checks a result limit is not negative (0 is no limit)
+func validateLimit(limit int32) error {
+	if limit < 0 {
+		return amerrors.NewFieldError(amerrors.ErrInvalidArgument, "limit", "limit must not be negative (got %d)", limit)
+	}
+	return nil
+}
+
+// validateRefID checks a phone session reference is not empty
+func validateRefID(refID string) error {
+	if strings.TrimSpace(refID) == "" {
+		return amerrors.NewFieldError(amerrors.ErrInvalidArgument, "ref_id", "ref_id must not be empty")
+	}
+	return nil
+}
+
+// validateAgentIDs checks there are at most MaxAgentIDs agent IDs and that
+// each is positive
+func validateAgentIDs(agentIDs []int32) error {
+	if len(agentIDs) > MaxAgentIDs {
+		return amerrors.NewFieldError(amerrors.ErrInvalidArgument, "call_ids", "at most %d call_ids are allowed (got %d)", MaxAgentIDs, len(agentIDs))
+	}
+	for _, agentID := range agentIDs {
+		if err := validateID("call_ids", agentID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
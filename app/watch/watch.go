@@ -0,0 +1,172 @@
+package watch
+
+// watch.go
+// Fan out of agent availability events to watchers (see the WatchAgents RPC)
+// Publishing never blocks: a watcher that falls behind is dropped and has to
+// watch again (and so take a new snapshot)
+// A Hub is local to its process: it only has the events of the calls this
+// instance served (and its reaper), not those served by other instances.
+
+import (
+	"sync"
+	"time"
+
+	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+)
+
+// DefaultBuffer is how many events a watcher can fall behind before it is dropped
+const DefaultBuffer = 64
+
+// EventType is what happened to the agent
+type EventType string
+
+const (
+	// EventAvailable agent can be offered tasks (heartbeat or state change)
+	EventAvailable EventType = "available"
+	// EventUnavailable agent is connected but no longer available (busy, away etc.)
+	EventUnavailable EventType = "unavailable"
+	// EventStale agent missed its heartbeats and was marked offline (see reaper)
+	EventStale EventType = "stale"
+	// EventAssigned agent was offered or accepted a task
+	EventAssigned EventType = "assigned"
+	// EventDeregistered agent was removed
+	EventDeregistered EventType = "deregistered"
+	// EventDisconnected agent closed its heartbeat stream and was marked offline
+	EventDisconnected EventType = "disconnected"
+)
+
+// Event is a change to an agent's availability (TaskID is only set for EventAssigned)
+// Tenant is the tenant of the agent ("" if the service is not multi-tenant)
+type Event struct {
+	Type    EventType
+	Tenant  string
+	AgentID int32
+	TaskID  int32
+	At      time.Time
+}
+
+// Hub sends published events to every watcher
+// A nil *Hub is valid and drops everything published to it
+type Hub struct {
+	mu       sync.Mutex
+	buffer   int
+	watchers map[*Watcher]struct{}
+	closed   bool
+}
+
+// NewHub returns a Hub whose watchers are dropped when buffer events behind
+func NewHub(buffer int) *Hub {
+	if buffer <= 0 {
+		buffer = DefaultBuffer
+	}
+	return &Hub{buffer: buffer, watchers: make(map[*Watcher]struct{})}
+}
+
+// Watch returns a new watcher of every event of tenant published from now on
+// (a tenant never sees another's events)
+func (h *Hub) Watch(tenant string) (*Watcher, error) {
+	if h == nil {
+		return nil, amerrors.ErrWatchClosedError("agent events are not enabled")
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil, amerrors.ErrWatchClosedError("server is shutting down")
+	}
+
+	c := make(chan Event, h.buffer)
+	w := &Watcher{C: c, c: c, hub: h, tenant: tenant}
+	h.watchers[w] = struct{}{}
+	return w, nil
+}
+
+// Publish sends events to every watcher without blocking. Watchers with a
+// full buffer are dropped (ErrWatchSlowConsumer)
+func (h *Hub) Publish(events ...Event) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for w := range h.watchers {
+		for _, event := range events {
+			if event.Tenant != w.tenant {
+				continue
+			}
+			select {
+			case w.c <- event:
+			default:
+				h.drop(w, amerrors.ErrWatchSlowConsumerError("watcher fell more than %d events behind", h.buffer))
+			}
+			if w.err != nil {
+				break
+			}
+		}
+	}
+}
+
+// Watchers returns how many watchers there are
+func (h *Hub) Watchers() int {
+	if h == nil {
+		return 0
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.watchers)
+}
+
+// Close drops every watcher (ErrWatchClosed) and refuses new ones
+func (h *Hub) Close() {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for w := range h.watchers {
+		h.drop(w, amerrors.ErrWatchClosedError("server is shutting down"))
+	}
+}
+
+// drop removes the watcher and closes its channel (caller must hold h.mu)
+func (h *Hub) drop(w *Watcher, err error) {
+	if _, ok := h.watchers[w]; !ok {
+		return
+	}
+	delete(h.watchers, w)
+	w.err = err
+	close(w.c)
+}
+
+// Watcher receives events on C until it is closed or dropped by the hub
+// (C is then closed, see Err)
+type Watcher struct {
+	C <-chan Event
+
+	c      chan Event
+	hub    *Hub
+	tenant string
+	err    error
+}
+
+// Close stops the watcher (safe to call more than once and after being dropped)
+func (w *Watcher) Close() {
+	w.hub.mu.Lock()
+	defer w.hub.mu.Unlock()
+	w.hub.drop(w, nil)
+}
+
+// Err returns why C was closed: ErrWatchSlowConsumer, ErrWatchClosed or nil
+// if the watcher was closed by Close. Only valid once C is closed.
+func (w *Watcher) Err() error {
+	w.hub.mu.Lock()
+	defer w.hub.mu.Unlock()
+	return w.err
+}
@@ -0,0 +1,118 @@
+package watch_test
+
+import (
+	"testing"
+	"time"
+
+	amerrors "github.com/newtonsystems/agent-mgmt/app/errors"
+	tu "github.com/newtonsystems/agent-mgmt/app/testutil"
+	"github.com/newtonsystems/agent-mgmt/app/watch"
+)
+
+// drain returns the events on the watcher until its channel is closed
+func drain(w *watch.Watcher) []watch.Event {
+	var events []watch.Event
+	for event := range w.C {
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestPublish(t *testing.T) {
+	hub := watch.NewHub(4)
+	w1, err := hub.Watch("")
+	tu.Ok(t, err)
+	w2, err := hub.Watch("")
+	tu.Ok(t, err)
+	tu.Equals(t, 2, hub.Watchers())
+
+	at := time.Date(2017, time.September, 21, 17, 50, 31, 0, time.UTC)
+	hub.Publish(
+		watch.Event{Type: watch.EventAvailable, AgentID: 1, At: at},
+		watch.Event{Type: watch.EventAssigned, AgentID: 1, TaskID: 7, At: at},
+	)
+
+	// Every watcher gets every event
+	w1.Close()
+	w2.Close()
+	want := []watch.Event{
+		{Type: watch.EventAvailable, AgentID: 1, At: at},
+		{Type: watch.EventAssigned, AgentID: 1, TaskID: 7, At: at},
+	}
+	tu.Equals(t, want, drain(w1))
+	tu.Equals(t, want, drain(w2))
+	tu.Ok(t, w1.Err())
+	tu.Equals(t, 0, hub.Watchers())
+
+	// Closing twice is fine
+	w1.Close()
+}
+
+func TestPublishTenants(t *testing.T) {
+	hub := watch.NewHub(4)
+	acme, err := hub.Watch("acme")
+	tu.Ok(t, err)
+	globex, err := hub.Watch("globex")
+	tu.Ok(t, err)
+
+	hub.Publish(
+		watch.Event{Type: watch.EventAvailable, Tenant: "acme", AgentID: 1},
+		watch.Event{Type: watch.EventAvailable, Tenant: "globex", AgentID: 1},
+		watch.Event{Type: watch.EventStale, Tenant: "acme", AgentID: 2},
+	)
+
+	// A watcher only gets its tenant's events
+	acme.Close()
+	globex.Close()
+	tu.Equals(t, []watch.Event{
+		{Type: watch.EventAvailable, Tenant: "acme", AgentID: 1},
+		{Type: watch.EventStale, Tenant: "acme", AgentID: 2},
+	}, drain(acme))
+	tu.Equals(t, []watch.Event{{Type: watch.EventAvailable, Tenant: "globex", AgentID: 1}}, drain(globex))
+}
+
+func TestSlowConsumer(t *testing.T) {
+	hub := watch.NewHub(2)
+	slow, err := hub.Watch("")
+	tu.Ok(t, err)
+	fast, err := hub.Watch("")
+	tu.Ok(t, err)
+	defer fast.Close()
+
+	for i := int32(1); i <= 3; i++ {
+		hub.Publish(watch.Event{Type: watch.EventStale, AgentID: i})
+		<-fast.C
+	}
+
+	// The slow watcher is dropped without holding up the publisher or the others
+	tu.Equals(t, 2, len(drain(slow)))
+	tu.Assert(t, amerrors.Is(slow.Err(), amerrors.ErrWatchSlowConsumer), "expected ErrWatchSlowConsumer got %v", slow.Err())
+	tu.Equals(t, 1, hub.Watchers())
+}
+
+func TestClose(t *testing.T) {
+	hub := watch.NewHub(0)
+	w, err := hub.Watch("")
+	tu.Ok(t, err)
+
+	hub.Close()
+	tu.Equals(t, 0, len(drain(w)))
+	tu.Assert(t, amerrors.Is(w.Err(), amerrors.ErrWatchClosed), "expected ErrWatchClosed got %v", w.Err())
+
+	// No new watchers once closed
+	_, err = hub.Watch("")
+	tu.Assert(t, amerrors.Is(err, amerrors.ErrWatchClosed), "expected ErrWatchClosed got %v", err)
+
+	// Publishing after close is a no-op
+	hub.Publish(watch.Event{Type: watch.EventAvailable, AgentID: 1})
+}
+
+func TestNilHub(t *testing.T) {
+	var hub *watch.Hub
+	hub.Publish(watch.Event{Type: watch.EventAvailable, AgentID: 1})
+	hub.Close()
+	tu.Equals(t, 0, hub.Watchers())
+
+	_, err := hub.Watch("")
+	tu.Assert(t, amerrors.Is(err, amerrors.ErrWatchClosed), "expected ErrWatchClosed got %v", err)
+}